@@ -83,6 +83,12 @@ func middlewareRecovery(logger *zap.Logger, stack bool) gin.HandlerFunc {
 }
 
 func InitApis() {
+	r := newRouter()
+	r.Run(fmt.Sprintf(":%d", Conf.App.Port))
+}
+
+// all routes, tests serve it by httptest
+func newRouter() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode) // set to release mode
 
 	r := gin.New()
@@ -104,10 +110,64 @@ func InitApis() {
 	r.POST("/key", ApiSetKeyPub)
 	r.GET("/key", ApiGetKeyPub)
 	r.DELETE("/key", ApiDeleteKey)
+	r.POST("/key/rotate", ApiRotateKey)
+	r.GET("/key/meta", ApiGetKeyMeta)
+	r.POST("/key/meta", ApiSetKeyMeta)
+	r.GET("/keys/meta", ApiListKeyMeta)
 	r.POST("/sign", ApiSign)
 	r.POST("/verify", ApiVerify)
 	r.POST("/encrypt", ApiEncrypt)
 	r.POST("/decrypt", ApiDecrypt)
+	r.POST("/batch", ApiBatch)
+	r.GET("/capabilities", ApiGetCapabilities)
 
-	r.Run(fmt.Sprintf(":%d", Conf.App.Port))
+	// key attestation, simulated only
+	r.POST("/key/attest/prepare", ApiPrepareKeyAttestation)
+	r.POST("/key/attest", ApiAttestKey)
+	r.POST("/key/attest/verify", ApiVerifyKeyAttestation)
+
+	// key usage of tenants
+	r.GET("/tenants", ApiTenantUsage)
+
+	// key lifecycle events by SSE or websocket
+	r.GET("/events", ApiEvents)
+
+	// key generation run with ?async=1
+	r.GET("/jobs/:id", ApiGetJob)
+
+	// compact JWS and JWT
+	r.POST("/jws/sign", ApiJwsSign)
+	r.POST("/jws/verify", ApiJwsVerify)
+	r.GET("/.well-known/jwks.json", ApiJwks)
+
+	// COSE_Sign1 for cbor devices
+	r.POST("/cose/sign", ApiCoseSign)
+	r.POST("/cose/verify", ApiCoseVerify)
+
+	// detached CMS signature of files
+	r.POST("/file/sign", ApiFileSign)
+	r.POST("/file/verify", ApiFileVerify)
+	r.GET("/file/cert", ApiGetFileCert)
+	r.POST("/file/cert", ApiSetFileCert)
+
+	// RFC 3161 time stamping
+	r.POST("/tsa", ApiTsa)
+	r.GET("/tsa/cert", ApiTsaCert)
+
+	// parsec daemon connectivity
+	r.GET("/health", ApiHealth)
+
+	// selftest of parsec daemons by temporary keys
+	r.POST("/diagnostics", ApiRunDiagnostics)
+	r.GET("/diagnostics", ApiDiagnostics)
+
+	// prometheus metrics
+	r.GET("/metrics", ApiMetrics)
+
+	// vault transit compatible facade
+	if Conf.Vault.Enabled {
+		registerVaultApis(r)
+	}
+
+	return r
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+)
+
+// api tests call the handlers by httptest, the crypto ops go through the real
+// parsec-client-go and the wire protocol to the mock daemon of mockdaemon_test.go
+
+var testMock *MockDaemon
+var testRouter *gin.Engine
+var testConfig string // config file of runTests
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "parsecclient")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	testMock, err = StartMockDaemon(filepath.Join(dir, "parsec.sock"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer testMock.Close()
+	os.Setenv("PARSEC_SERVICE_ENDPOINT", "unix:"+testMock.path)
+
+	testConfig = fmt.Sprintf(`
+[log]
+level = "debug"
+fileName = %q
+audit = %q
+
+[meta]
+path = ""
+
+[cms]
+certDir = %q
+
+[reconnect]
+initialBackoff = "10ms"
+checkInterval = "1h"
+
+[vault]
+enabled = true
+[[vault.tokens]]
+token = "s.test"
+name = "VaultClient"
+`, filepath.Join(dir, "ParsecClient.log"), filepath.Join(dir, "ParsecClient.audit.log"), filepath.Join(dir, "cms"))
+	*flagConfig = filepath.Join(dir, "ParsecClient.toml")
+	if err := os.WriteFile(*flagConfig, []byte(testConfig), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := InitConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	InitLog()
+	InitBackend()
+	InitReconnect()
+	InitPubKeyCache()
+	InitRateLimit()
+	testRouter = newRouter()
+
+	return m.Run()
+}
+
+// change the config for one test, the old one was back by cleanup
+func testSetConf(t *testing.T, fn func(conf *AppConfig)) {
+	t.Helper()
+	confLock.Lock()
+	old := Conf
+	fn(&Conf)
+	confLock.Unlock()
+	t.Cleanup(func() {
+		confLock.Lock()
+		Conf = old
+		confLock.Unlock()
+	})
+}
+
+func testApi(t *testing.T, method string, path string, param interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	return w
+}
+
+// Code of the error response, CODE_SUCCESS for 200
+func testCode(t *testing.T, w *httptest.ResponseRecorder) int32 {
+	t.Helper()
+	if w.Code == http.StatusOK {
+		return CODE_SUCCESS
+	}
+	var rtn rtnCode
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil {
+		t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+	}
+	return rtn.Code
+}
+
+func testExpect(t *testing.T, w *httptest.ResponseRecorder, code int32) {
+	t.Helper()
+	if got := testCode(t, w); got != code {
+		t.Fatalf("got code %d, want %d, body %q", got, code, w.Body.String())
+	}
+}
+
+func testNewClient(t *testing.T, name string) {
+	t.Helper()
+	testExpect(t, testApi(t, "POST", "/client", &paramAll{Name: name}), CODE_SUCCESS)
+	t.Cleanup(func() {
+		testMock.ClearFailures()
+		testApi(t, "DELETE", "/client", &paramAll{Name: name})
+	})
+}
+
+func TestApiNewClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   *paramAll
+		op      requests.OpCode
+		status  requests.StatusCode
+		drop    bool
+		code    int32
+		created bool
+	}{
+		{name: "Ok", param: &paramAll{Name: "ClientOk"}, code: CODE_SUCCESS, created: true},
+		{name: "NoName", param: &paramAll{}, code: CODE_INVALID_PARAM},
+		{name: "PingFail", param: &paramAll{Name: "ClientPingFail"}, op: requests.OpPing, status: requests.StatusPsaErrorCommunicationFailure, code: CODE_PARSEC_ERROR},
+		{name: "PingDropOnce", param: &paramAll{Name: "ClientPingDrop"}, op: requests.OpPing, drop: true, code: CODE_SUCCESS, created: true},
+		{name: "ListOpcodesFail", param: &paramAll{Name: "ClientOpcodesFail"}, op: requests.OpListOpcodes, status: requests.StatusPsaErrorGenericError, code: CODE_PARSEC_ERROR},
+		{name: "NoBackend", param: &paramAll{Name: "ClientNoBackend", Backend: "se0"}, code: CODE_INVALID_PARAM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer testMock.ClearFailures()
+			if tt.op != 0 {
+				testMock.InjectFailure(tt.op, tt.status, 1, tt.drop)
+			}
+			testExpect(t, testApi(t, "POST", "/client", tt.param), tt.code)
+			if _, ok := getClient(tt.param.Name); ok != tt.created {
+				t.Fatalf("client cached %v, want %v", ok, tt.created)
+			}
+			if tt.created {
+				testExpect(t, testApi(t, "DELETE", "/client", tt.param), CODE_SUCCESS)
+			}
+		})
+	}
+}
+
+func TestApiSignVerify(t *testing.T) {
+	const name = "SignClient"
+	testNewClient(t, name)
+
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "MyKey"}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "MyKey"}), CODE_INVALID_KEY)
+
+	w := testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World"})
+	testExpect(t, w, CODE_SUCCESS)
+	signature := w.Body.String()
+	if _, err := base64.StdEncoding.DecodeString(signature); err != nil {
+		t.Fatalf("signature %q is not base64: %v", signature, err)
+	}
+
+	tampered, _ := base64.StdEncoding.DecodeString(signature)
+	tampered[0] ^= 1
+	tests := []struct {
+		name  string
+		param *paramAll
+		code  int32
+	}{
+		{"Ok", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World", Sign: signature}, CODE_SUCCESS},
+		{"OtherMessage", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World!", Sign: signature}, CODE_VERIFY_FAIL},
+		{"Tampered", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World", Sign: base64.StdEncoding.EncodeToString(tampered)}, CODE_VERIFY_FAIL},
+		{"NotBase64", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World", Sign: "%%%"}, CODE_INVALID_PARAM},
+		{"NoSign", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World"}, CODE_INVALID_PARAM},
+		{"NoClient", &paramAll{Name: "NoClient", KeyName: "MyKey", Message: "Hello World", Sign: signature}, CODE_INVALID_CLIENT},
+	}
+	for _, tt := range tests {
+		t.Run("Verify"+tt.name, func(t *testing.T) {
+			testExpect(t, testApi(t, "POST", "/verify", tt.param), tt.code)
+		})
+	}
+
+	t.Run("SignMissingKey", func(t *testing.T) {
+		w := testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: "NoKey", Message: "Hello World"})
+		if testCode(t, w) == CODE_SUCCESS {
+			t.Fatalf("signed by missing key")
+		}
+	})
+	t.Run("SignFail", func(t *testing.T) {
+		defer testMock.ClearFailures()
+		testMock.InjectFailure(requests.OpPsaSignHash, requests.StatusPsaErrorHardwareFailure, 1, false)
+		testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World"}), CODE_PARSEC_ERROR)
+	})
+	t.Run("SignDropRetried", func(t *testing.T) {
+		defer testMock.ClearFailures()
+		testMock.InjectFailure(requests.OpPsaSignHash, 0, 1, true)
+		testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World"}), CODE_SUCCESS)
+	})
+	t.Run("KeysignFail", func(t *testing.T) {
+		defer testMock.ClearFailures()
+		testMock.InjectFailure(requests.OpPsaGenerateKey, requests.StatusPsaErrorInsufficientStorage, 1, false)
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "FailKey"}), CODE_PARSEC_ERROR)
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "FailKey"}), CODE_SUCCESS)
+	})
+}
+
+// every alg of /keysign, sign and verify must use the alg of the key policy
+func TestApiSignVerifyAlgs(t *testing.T) {
+	const name = "AlgClient"
+	testMetaDB(t)
+	testNewClient(t, name)
+
+	prefixes := map[string]string{JWS_RS256: "ssh-rsa ", JWS_PS256: "ssh-rsa ", JWS_ES256: "ecdsa-sha2-nistp256 ", JWS_ES384: "ecdsa-sha2-nistp384 "}
+	for _, alg := range jwsAlgOrder {
+		t.Run(alg, func(t *testing.T) {
+			keyName := "Key" + alg
+			testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: keyName, Alg: alg}), CODE_SUCCESS)
+
+			sign := func() string {
+				t.Helper()
+				w := testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: keyName, Message: "Hello World"})
+				testExpect(t, w, CODE_SUCCESS)
+				return w.Body.String()
+			}
+			signature := sign()
+			testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: name, KeyName: keyName, Message: "Hello World", Sign: signature}), CODE_SUCCESS)
+			testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: name, KeyName: keyName, Message: "Hello World!", Sign: signature}), CODE_VERIFY_FAIL)
+
+			w := testApi(t, "GET", "/key", &paramAll{Name: name, KeyName: keyName})
+			testExpect(t, w, CODE_SUCCESS)
+			if !strings.HasPrefix(w.Body.String(), prefixes[alg]) {
+				t.Fatalf("public key %q, want prefix %q", w.Body.String(), prefixes[alg])
+			}
+
+			// attributes forgotten like after restart, the alg was kept in meta store
+			resetKeyRings(name)
+			signature = sign()
+			testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: name, KeyName: keyName, Message: "Hello World", Sign: signature}), CODE_SUCCESS)
+			defer testMock.ClearFailures()
+			testMock.InjectFailure(requests.OpPsaSignHash, requests.StatusPsaErrorNotPermitted, 1, false)
+			testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: keyName, Message: "Hello World"}), CODE_PARSEC_ERROR)
+		})
+	}
+
+	t.Run("SignByEncKey", func(t *testing.T) {
+		testExpect(t, testApi(t, "POST", "/keyenc", &paramAll{Name: name, KeyName: "EncKey"}), CODE_SUCCESS)
+		testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: "EncKey", Message: "Hello World"}), CODE_INVALID_KEY)
+	})
+
+	// made before restart without meta store, the alg was never guessed by signing
+	t.Run("UnknownAlg", func(t *testing.T) {
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "UnknownKey", Alg: JWS_PS256}), CODE_SUCCESS)
+		db := metaDB
+		metaDB = nil
+		defer func() { metaDB = db }()
+		resetKeyRings(name)
+		count := testCountOps(t)
+		testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: "UnknownKey", Message: "Hello World"}), CODE_INVALID_KEY)
+		testExpect(t, testApi(t, "POST", "/jws/sign", &paramJwsSign{Name: name, KeyName: "UnknownKey"}), CODE_INVALID_KEY)
+		if n := count(requests.OpPsaSignHash); n != 0 {
+			t.Fatalf("signed %d times to guess the alg", n)
+		}
+	})
+}
+
+func TestApiEncryptDecrypt(t *testing.T) {
+	const name = "EncClient"
+	testNewClient(t, name)
+
+	testExpect(t, testApi(t, "POST", "/keyenc", &paramAll{Name: name, KeyName: "MyEncKey"}), CODE_SUCCESS)
+
+	w := testApi(t, "POST", "/encrypt", &paramAll{Name: name, KeyName: "MyEncKey", Message: "Hello World"})
+	testExpect(t, w, CODE_SUCCESS)
+	ciphertext := w.Body.String()
+
+	w = testApi(t, "POST", "/decrypt", &paramAll{Name: name, KeyName: "MyEncKey", Message: ciphertext})
+	testExpect(t, w, CODE_SUCCESS)
+	if w.Body.String() != "Hello World" {
+		t.Fatalf("decrypt got %q", w.Body.String())
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(ciphertext)
+	data[len(data)/2] ^= 1
+	tests := []struct {
+		name  string
+		param *paramAll
+		op    requests.OpCode
+		code  int32
+	}{
+		{"Tampered", &paramAll{Name: name, KeyName: "MyEncKey", Message: base64.StdEncoding.EncodeToString(data)}, 0, CODE_PARSEC_ERROR},
+		{"NotBase64", &paramAll{Name: name, KeyName: "MyEncKey", Message: "%%%"}, 0, CODE_INVALID_PARAM},
+		{"DecryptFail", &paramAll{Name: name, KeyName: "MyEncKey", Message: ciphertext}, requests.OpPsaAsymmetricDecrypt, CODE_PARSEC_ERROR},
+		{"NoClient", &paramAll{Name: "NoClient", KeyName: "MyEncKey", Message: ciphertext}, 0, CODE_INVALID_CLIENT},
+	}
+	for _, tt := range tests {
+		t.Run("Decrypt"+tt.name, func(t *testing.T) {
+			defer testMock.ClearFailures()
+			if tt.op != 0 {
+				testMock.InjectFailure(tt.op, requests.StatusPsaErrorHardwareFailure, 1, false)
+			}
+			testExpect(t, testApi(t, "POST", "/decrypt", tt.param), tt.code)
+		})
+	}
+
+	t.Run("EncryptFail", func(t *testing.T) {
+		defer testMock.ClearFailures()
+		testMock.InjectFailure(requests.OpPsaAsymmetricEncrypt, requests.StatusPsaErrorHardwareFailure, 1, false)
+		testExpect(t, testApi(t, "POST", "/encrypt", &paramAll{Name: name, KeyName: "MyEncKey", Message: "Hello World"}), CODE_PARSEC_ERROR)
+	})
+	t.Run("EncryptBySignKey", func(t *testing.T) {
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "MyKey"}), CODE_SUCCESS)
+		testExpect(t, testApi(t, "POST", "/encrypt", &paramAll{Name: name, KeyName: "MyKey", Message: "Hello World"}), CODE_PARSEC_ERROR)
+	})
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"go.uber.org/zap"
+)
+
+// key attestation in two steps like parsec PrepareKeyAttestation and AttestKey:
+// prepare return a nonce, attest return certify data of the key signed by the
+// attesting key. parsec-client-go has no attestation ops, so the daemon flow
+// (TPM ActivateCredential) can not be used yet. only the simulated mechanism
+// was supported, the attesting key is a software key in attest.keyFile and it
+// prove nothing about hardware, it is for test and develop of verifiers.
+
+const ATTEST_SIMULATED = "simulated-certify"
+
+// provider of simulated statements, a real provider name like Tpm would claim
+// hardware evidence that the software attesting key can not give
+const ATTEST_PROVIDER_SIMULATED = "simulated"
+
+var errAttestFormat = errors.New("invalid attestation")
+
+// simulated attesting key, nil if attest.keyFile empty
+var attestKey *ecdsa.PrivateKey
+
+// nonce -> pending attestation
+var attestNonces = make(map[string]*attestNonce)
+var attestNoncesLock sync.Mutex
+
+type attestNonce struct {
+	appName   string
+	keyName   string
+	expiresAt time.Time
+}
+
+type paramAttest struct {
+	Name    string
+	KeyName string
+	Nonce   string // base64 returned by prepare
+}
+
+type rtnAttestPrepare struct {
+	Mechanism    string
+	Nonce        string // base64, used once
+	ExpiresAt    time.Time
+	AttestingKey string // PEM public key
+}
+
+// signed by the attesting key
+type attestStatement struct {
+	Mechanism   string
+	Provider    string // simulated
+	KeyProvider string // provider of the key as reported, not attested
+	Name        string // application name
+	KeyName     string // with version
+	PublicKey   string // base64 of parsec export format
+	Nonce       string
+	Time        time.Time
+}
+
+type rtnAttestation struct {
+	Mechanism      string
+	Provider       string
+	KeyName        string
+	CertifyData    string // base64 of json attestStatement
+	Signature      string // base64 asn.1 ecdsa over sha256 of certify data
+	AttestingKeyId string // hex sha256 of attesting public key DER
+}
+
+type paramAttestVerify struct {
+	Attestation rtnAttestation
+	Nonce       string // nonce given to attest, empty skip check
+}
+
+func InitAttest() {
+	conf := Conf.Attest
+	if len(conf.KeyFile) == 0 {
+		return
+	}
+	key, err := loadAttestKey(conf.KeyFile)
+	if err != nil {
+		zap.L().Fatal("Load attesting key fail", zap.String("path", conf.KeyFile), zap.Error(err))
+	}
+	attestKey = key
+	zap.L().Warn("Key attestation is simulated by a software key, it is NOT hardware evidence", zap.String("path", conf.KeyFile))
+}
+
+// PEM EC private key, made if not exist
+func loadAttestKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		return key, ioutil.WriteFile(path, data, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errAttestFormat
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func loadAttestPub(path string) (*ecdsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errAttestFormat
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errAttestFormat
+	}
+	return ecPub, nil
+}
+
+func attestKeyId(pub *ecdsa.PublicKey) (string, []byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), der, nil
+}
+
+// provider name of the key, same as /capabilities
+func attestKeyProvider(appName string) string {
+	if GetConf().Backend.Type == BACKEND_SOFTWARE {
+		return "Software"
+	}
+	return backendProvider(appName).String()
+}
+
+// trusted attesting key of verifier, attest.trustKey or the simulated key
+func attestTrustKey() (*ecdsa.PublicKey, error) {
+	path := GetConf().Attest.TrustKey
+	if len(path) != 0 {
+		return loadAttestPub(path)
+	}
+	if attestKey == nil {
+		return nil, errAttestFormat
+	}
+	return &attestKey.PublicKey, nil
+}
+
+// check signature, mechanism, provider and nonce of the attestation
+func verifyAttestation(att *rtnAttestation, trustKey *ecdsa.PublicKey, provider string, nonce string) (*attestStatement, error) {
+	if att.Mechanism != ATTEST_SIMULATED {
+		return nil, errAttestFormat
+	}
+	data, err := base64.StdEncoding.DecodeString(att.CertifyData)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(att.Signature)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(trustKey, digest[:], signature) {
+		return nil, errors.New("attestation signature mismatch")
+	}
+
+	var statement attestStatement
+	if err := json.Unmarshal(data, &statement); err != nil {
+		return nil, err
+	}
+	if statement.Mechanism != att.Mechanism || statement.Provider != att.Provider || statement.KeyName != att.KeyName {
+		return nil, errors.New("attestation fields differ from certify data")
+	}
+	if statement.Provider != ATTEST_PROVIDER_SIMULATED {
+		return nil, errors.New("simulated attestation claim provider " + statement.Provider)
+	}
+	if len(provider) != 0 && statement.Provider != provider {
+		return nil, errors.New("attestation provider " + statement.Provider + " not trusted")
+	}
+	if len(nonce) != 0 && statement.Nonce != nonce {
+		return nil, errors.New("attestation nonce mismatch")
+	}
+	return &statement, nil
+}
+
+// sign the statement by the attesting key
+func signAttestation(key *ecdsa.PrivateKey, statement *attestStatement) (*rtnAttestation, error) {
+	data, err := json.Marshal(statement)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	id, _, err := attestKeyId(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &rtnAttestation{
+		Mechanism:      statement.Mechanism,
+		Provider:       statement.Provider,
+		KeyName:        statement.KeyName,
+		CertifyData:    base64.StdEncoding.EncodeToString(data),
+		Signature:      base64.StdEncoding.EncodeToString(signature),
+		AttestingKeyId: id,
+	}, nil
+}
+
+func checkAttestParam(c *gin.Context) (*paramAttest, CryptoClient, bool) {
+	var data, _ = c.GetRawData()
+	var param paramAttest
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Name) == 0 || len(param.KeyName) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return nil, nil, false
+	}
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return nil, nil, false
+	}
+	if attestKey == nil {
+		zap.L().Warn("Key attestation of parsec daemon was not supported by parsec-client-go, only attest.keyFile simulated")
+		responseError(c, CODE_NOT_SUPPORTED)
+		return nil, nil, false
+	}
+	return &param, client, true
+}
+
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyKey"}' 127.0.0.1:8300/key/attest/prepare
+func ApiPrepareKeyAttestation(c *gin.Context) {
+	param, client, ok := checkAttestParam(c)
+	if !ok {
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_EXPORT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	keyName, err := currentKeyName(param.Name, client, param.KeyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, keyErrorCode(err, CODE_INVALID_KEY))
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	_, der, err := attestKeyId(&attestKey.PublicKey)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	rtn := rtnAttestPrepare{
+		Mechanism:    ATTEST_SIMULATED,
+		Nonce:        base64.StdEncoding.EncodeToString(b),
+		ExpiresAt:    time.Now().Add(GetConf().Attest.NonceTtl),
+		AttestingKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+
+	attestNoncesLock.Lock()
+	now := time.Now()
+	for nonce, pending := range attestNonces {
+		if now.After(pending.expiresAt) {
+			delete(attestNonces, nonce)
+		}
+	}
+	attestNonces[rtn.Nonce] = &attestNonce{appName: param.Name, keyName: keyName, expiresAt: rtn.ExpiresAt}
+	attestNoncesLock.Unlock()
+
+	c.JSON(http.StatusOK, &rtn)
+}
+
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Nonce": "nonce from prepare"}' 127.0.0.1:8300/key/attest
+func ApiAttestKey(c *gin.Context) {
+	param, client, ok := checkAttestParam(c)
+	if !ok {
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_EXPORT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaExportPublicKey) {
+		return
+	}
+
+	// nonce was used once, for the key version prepared
+	attestNoncesLock.Lock()
+	pending, ok := attestNonces[param.Nonce]
+	delete(attestNonces, param.Nonce)
+	attestNoncesLock.Unlock()
+	if !ok || pending.appName != param.Name {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	if base, _ := splitKeyName(pending.keyName); base != param.KeyName && pending.keyName != param.KeyName {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	if time.Now().After(pending.expiresAt) {
+		responseError(c, CODE_TOKEN_EXPIRED)
+		return
+	}
+
+	pub, err := client.PsaExportPublicKey(pending.keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	att, err := signAttestation(attestKey, &attestStatement{
+		Mechanism:   ATTEST_SIMULATED,
+		Provider:    ATTEST_PROVIDER_SIMULATED,
+		KeyProvider: attestKeyProvider(param.Name),
+		Name:        param.Name,
+		KeyName:     pending.keyName,
+		PublicKey:   base64.StdEncoding.EncodeToString(pub),
+		Nonce:       param.Nonce,
+		Time:        time.Now().UTC(),
+	})
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	c.JSON(http.StatusOK, att)
+}
+
+// check by attest.trustKey and attest.provider, return the certify data
+// curl -v -d '{"Attestation": {...}, "Nonce": "nonce from prepare"}' 127.0.0.1:8300/key/attest/verify
+func ApiVerifyKeyAttestation(c *gin.Context) {
+	var data, _ = c.GetRawData()
+	var param paramAttestVerify
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Attestation.CertifyData) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	trustKey, err := attestTrustKey()
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+	statement, err := verifyAttestation(&param.Attestation, trustKey, GetConf().Attest.Provider, param.Nonce)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_VERIFY_FAIL)
+		return
+	}
+	c.JSON(http.StatusOK, statement)
+}
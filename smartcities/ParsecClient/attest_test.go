@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testAttestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testStatement() *attestStatement {
+	return &attestStatement{
+		Mechanism:   ATTEST_SIMULATED,
+		Provider:    ATTEST_PROVIDER_SIMULATED,
+		KeyProvider: "Tpm",
+		Name:        "AttestClient",
+		KeyName:     "AttestKey",
+		PublicKey:   base64.StdEncoding.EncodeToString([]byte("public key")),
+		Nonce:       "nonce",
+		Time:        time.Now().UTC(),
+	}
+}
+
+func TestVerifyAttestation(t *testing.T) {
+	key := testAttestKey(t)
+	otherKey := testAttestKey(t)
+
+	tests := []struct {
+		name      string
+		sign      *ecdsa.PrivateKey
+		statement func(s *attestStatement)  // changed before signing
+		att       func(att *rtnAttestation) // changed after signing
+		provider  string
+		nonce     string
+		ok        bool
+	}{
+		{"Valid", key, nil, nil, "", "nonce", true},
+		{"NonceSkipped", key, nil, nil, "", "", true},
+		{"TrustedProvider", key, nil, nil, ATTEST_PROVIDER_SIMULATED, "nonce", true},
+		{"WrongNonce", key, nil, nil, "", "other nonce", false},
+		{"WrongKey", otherKey, nil, nil, "", "nonce", false},
+		{"UntrustedProvider", key, nil, nil, "Tpm", "nonce", false},
+		{"RealProvider", key, func(s *attestStatement) { s.Provider = "Tpm" }, nil, "", "nonce", false},
+		{"TamperedData", key, nil, func(att *rtnAttestation) {
+			data, _ := base64.StdEncoding.DecodeString(att.CertifyData)
+			data[len(data)-2] ^= 1
+			att.CertifyData = base64.StdEncoding.EncodeToString(data)
+		}, "", "nonce", false},
+		{"TamperedKeyName", key, nil, func(att *rtnAttestation) { att.KeyName = "OtherKey" }, "", "nonce", false},
+		{"TamperedSignature", key, nil, func(att *rtnAttestation) {
+			signature, _ := base64.StdEncoding.DecodeString(att.Signature)
+			signature[len(signature)-1] ^= 1
+			att.Signature = base64.StdEncoding.EncodeToString(signature)
+		}, "", "nonce", false},
+		{"Mechanism", key, nil, func(att *rtnAttestation) { att.Mechanism = "tpm-certify" }, "", "nonce", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement := testStatement()
+			if tt.statement != nil {
+				tt.statement(statement)
+			}
+			att, err := signAttestation(tt.sign, statement)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.att != nil {
+				tt.att(att)
+			}
+			got, err := verifyAttestation(att, &key.PublicKey, tt.provider, tt.nonce)
+			if tt.ok != (err == nil) {
+				t.Fatalf("verify error %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (got.KeyName != "AttestKey" || got.KeyProvider != "Tpm" || got.Provider != ATTEST_PROVIDER_SIMULATED) {
+				t.Fatalf("statement %+v", got)
+			}
+		})
+	}
+}
+
+// prepare, attest and verify by apis, the statement never claim a real provider
+func TestApiAttestKey(t *testing.T) {
+	key, err := loadAttestKey(filepath.Join(t.TempDir(), "attest.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := attestKey
+	attestKey = key
+	t.Cleanup(func() { attestKey = oldKey })
+
+	testNewClient(t, "AttestClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "AttestClient", KeyName: "AttestKey"}), CODE_SUCCESS)
+
+	w := testApi(t, "POST", "/key/attest/prepare", &paramAttest{Name: "AttestClient", KeyName: "AttestKey"})
+	var prepared rtnAttestPrepare
+	if err := json.Unmarshal(w.Body.Bytes(), &prepared); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("prepare: status %d, %v", w.Code, err)
+	}
+	w = testApi(t, "POST", "/key/attest", &paramAttest{Name: "AttestClient", KeyName: "AttestKey", Nonce: prepared.Nonce})
+	var att rtnAttestation
+	if err := json.Unmarshal(w.Body.Bytes(), &att); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("attest: status %d, %v", w.Code, err)
+	}
+	if att.Provider != ATTEST_PROVIDER_SIMULATED {
+		t.Fatalf("attestation provider %q", att.Provider)
+	}
+
+	w = testApi(t, "POST", "/key/attest/verify", &paramAttestVerify{Attestation: att, Nonce: prepared.Nonce})
+	var statement attestStatement
+	if err := json.Unmarshal(w.Body.Bytes(), &statement); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d, %v", w.Code, err)
+	}
+	if statement.Provider != ATTEST_PROVIDER_SIMULATED || statement.KeyProvider == ATTEST_PROVIDER_SIMULATED || statement.KeyName != "AttestKey" {
+		t.Fatalf("statement %+v", statement)
+	}
+	testExpect(t, testApi(t, "POST", "/key/attest/verify", &paramAttestVerify{Attestation: att, Nonce: "other nonce"}), CODE_VERIFY_FAIL)
+
+	// nonce was used once
+	testExpect(t, testApi(t, "POST", "/key/attest", &paramAttest{Name: "AttestClient", KeyName: "AttestKey", Nonce: prepared.Nonce}), CODE_INVALID_PARAM)
+
+	conf := GetConf()
+	conf.Attest.Provider = "Tpm"
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("attest.provider Tpm: no error")
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	BACKEND_PARSEC   = "parsec"   // keys in parsec daemon
+	BACKEND_SOFTWARE = "software" // keys in memory, NOT secure, for test and develop only
+)
+
+// name of the daemon used when backend.daemons was empty
+const DEFAULT_DAEMON = "default"
+
+// provider names of backend.daemons
+var daemonProviders = map[string]parsec.ProviderID{
+	"mbed":            parsec.ProviderMBed,
+	"pkcs11":          parsec.ProviderPKCS11,
+	"tpm":             parsec.ProviderTPM,
+	"trusted-service": parsec.ProviderTrustedService,
+}
+
+// application name -> daemon name chosen by /client, kept in meta store if enabled
+var appDaemons = make(map[string]string)
+var appDaemonsLock sync.RWMutex
+
+var daemonBucket = []byte("daemons")
+
+// CryptoClient has the crypto operations used by apis.
+// *parsec.BasicClient implement it by calling the parsec daemon.
+type CryptoClient interface {
+	Ping() (uint8, uint8, error)
+	ListOpcodes(providerID parsec.ProviderID) ([]uint32, error)
+	ListAuthenticators() ([]*parsec.AuthenticatorInfo, error)
+	ListKeys() ([]*parsec.KeyInfo, error)
+	PsaGenerateKey(name string, attributes *parsec.KeyAttributes) error
+	PsaImportKey(name string, attributes *parsec.KeyAttributes, data []byte) error
+	PsaExportPublicKey(name string) ([]byte, error)
+	PsaDestroyKey(name string) error
+	PsaHashCompute(message []byte, alg algorithm.HashAlgorithmType) ([]byte, error)
+	PsaSignHash(name string, hash []byte, alg *algorithm.AsymmetricSignatureAlgorithm) ([]byte, error)
+	PsaVerifyHash(name string, hash, signature []byte, alg *algorithm.AsymmetricSignatureAlgorithm) error
+	PsaAsymmetricEncrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, plaintext []byte) ([]byte, error)
+	PsaAsymmetricDecrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, ciphertext []byte) ([]byte, error)
+	PsaAeadEncrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, plaintext []byte) ([]byte, error)
+	PsaAeadDecrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, ciphertext []byte) ([]byte, error)
+	Close() error
+}
+
+var _ CryptoClient = (*parsec.BasicClient)(nil)
+
+func InitBackend() {
+	if GetConf().Backend.Type == BACKEND_SOFTWARE {
+		zap.L().Warn("Crypto backend is software, keys are kept in memory and NOT secure, never use it in production")
+	}
+}
+
+// parsec daemons of config, or one default daemon with PARSEC_SERVICE_ENDPOINT
+func backendDaemons() []CfgDaemon {
+	conf := GetConf().Backend
+	if len(conf.Daemons) == 0 {
+		return []CfgDaemon{{Name: DEFAULT_DAEMON}}
+	}
+	return conf.Daemons
+}
+
+func findDaemon(name string) (CfgDaemon, bool) {
+	for _, d := range backendDaemons() {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return CfgDaemon{}, false
+}
+
+// daemon bound by config
+func configDaemon(appName string) (CfgDaemon, bool) {
+	for _, d := range backendDaemons() {
+		for _, app := range d.Apps {
+			if app == appName {
+				return d, true
+			}
+		}
+	}
+	return CfgDaemon{}, false
+}
+
+// daemon of the application: bound by config, chosen by /client, or backend.default
+func appDaemon(appName string) CfgDaemon {
+	if d, ok := configDaemon(appName); ok {
+		return d
+	}
+	appDaemonsLock.RLock()
+	name, ok := appDaemons[appName]
+	appDaemonsLock.RUnlock()
+	if ok {
+		if d, ok := findDaemon(name); ok {
+			return d
+		}
+	}
+	if d, ok := findDaemon(GetConf().Backend.Default); ok {
+		return d
+	}
+	return backendDaemons()[0]
+}
+
+// bind the application to a daemon for /client, it can not be changed while its client was cached
+func selectDaemon(appName string, daemonName string) int32 {
+	d, ok := findDaemon(daemonName)
+	if !ok {
+		return CODE_INVALID_PARAM
+	}
+	if bound, ok := configDaemon(appName); ok {
+		if bound.Name != d.Name {
+			return CODE_NOT_ALLOWED
+		}
+		return CODE_SUCCESS
+	}
+	if _, ok := getClient(appName); ok && appDaemon(appName).Name != d.Name {
+		return CODE_NOT_ALLOWED
+	}
+	bindDaemon(appName, d.Name)
+	return CODE_SUCCESS
+}
+
+// keep the daemon of a new client, so it was found again after restart
+// even if backend.default was changed
+func keepAppDaemon(appName string) {
+	if GetConf().Backend.Type == BACKEND_SOFTWARE {
+		return
+	}
+	if _, ok := configDaemon(appName); ok {
+		return
+	}
+	appDaemonsLock.RLock()
+	_, ok := appDaemons[appName]
+	appDaemonsLock.RUnlock()
+	if !ok {
+		bindDaemon(appName, appDaemon(appName).Name)
+	}
+}
+
+func bindDaemon(appName string, daemonName string) {
+	appDaemonsLock.Lock()
+	appDaemons[appName] = daemonName
+	appDaemonsLock.Unlock()
+	if metaDB == nil {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(daemonBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(appName), []byte(daemonName))
+	})
+	if err != nil {
+		zap.L().Error("Store client backend fail", zap.String("client", appName), zap.String("backend", daemonName), zap.Error(err))
+	}
+}
+
+// daemons chosen by /client before restart, called after the meta store was opened
+func loadAppDaemons() error {
+	return metaDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(daemonBucket)
+		if err != nil {
+			return err
+		}
+		appDaemonsLock.Lock()
+		defer appDaemonsLock.Unlock()
+		return bucket.ForEach(func(k, v []byte) error {
+			appDaemons[string(k)] = string(v)
+			return nil
+		})
+	})
+}
+
+// daemon of the application was bound by config or /client, or there is only one.
+// keys of others may be in any daemon, they must not be listed by backend.default
+func appDaemonKnown(appName string) bool {
+	if GetConf().Backend.Type == BACKEND_SOFTWARE || len(backendDaemons()) == 1 {
+		return true
+	}
+	if _, ok := configDaemon(appName); ok {
+		return true
+	}
+	appDaemonsLock.RLock()
+	name, ok := appDaemons[appName]
+	appDaemonsLock.RUnlock()
+	if !ok {
+		return false
+	}
+	_, ok = findDaemon(name)
+	return ok
+}
+
+func (d *CfgDaemon) providerID() parsec.ProviderID {
+	if provider, ok := daemonProviders[d.Provider]; ok {
+		return provider
+	}
+	return parsecProvider
+}
+
+// provider of crypto ops for the application
+func backendProvider(appName string) parsec.ProviderID {
+	if GetConf().Backend.Type == BACKEND_SOFTWARE {
+		return softProviderID
+	}
+	d := appDaemon(appName)
+	return d.providerID()
+}
+
+// unix socket of one daemon, the connection of parsec-client-go only use PARSEC_SERVICE_ENDPOINT
+type socketConnection struct {
+	path string
+	conn net.Conn
+}
+
+func (sc *socketConnection) Open() error {
+	conn, err := net.Dial("unix", sc.path)
+	if err != nil {
+		return err
+	}
+	sc.conn = conn
+	return nil
+}
+
+func (sc *socketConnection) Read(p []byte) (int, error) {
+	if sc.conn == nil {
+		return 0, fmt.Errorf("reading closed connection")
+	}
+	return sc.conn.Read(p)
+}
+
+func (sc *socketConnection) Write(p []byte) (int, error) {
+	if sc.conn == nil {
+		return 0, fmt.Errorf("writing closed connection")
+	}
+	return sc.conn.Write(p)
+}
+
+func (sc *socketConnection) Close() error {
+	if sc.conn == nil {
+		return nil
+	}
+	err := sc.conn.Close()
+	sc.conn = nil
+	return err
+}
+
+// new client of the configured backend for the application
+func newCryptoClient(name string) (CryptoClient, error) {
+	var client CryptoClient
+	if GetConf().Backend.Type == BACKEND_SOFTWARE {
+		zap.L().Warn("New software crypto client, it is NOT secure: " + name)
+		client = newSoftClient(name)
+	} else {
+		rc, err := newReconnectClient(name, appDaemon(name))
+		if err != nil {
+			return nil, err
+		}
+		client = rc
+	}
+	if metaDB != nil {
+		client = &metaClient{CryptoClient: client, name: name}
+	}
+	return client, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+)
+
+// second mock daemon se1 next to testMock as se0, apps bound to se1 by config
+func testTwoDaemons(t *testing.T, apps ...string) *MockDaemon {
+	t.Helper()
+	mock, err := StartMockDaemon(filepath.Join(t.TempDir(), "parsec1.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mock.Close() })
+	testSetConf(t, func(conf *AppConfig) {
+		conf.Backend.Default = "se0"
+		conf.Backend.Daemons = []CfgDaemon{
+			{Name: "se0", Socket: testMock.path},
+			{Name: "se1", Socket: mock.path, Apps: apps},
+		}
+	})
+
+	// bindings of /client were forgotten like after restart
+	appDaemonsLock.Lock()
+	old := appDaemons
+	appDaemons = make(map[string]string)
+	appDaemonsLock.Unlock()
+	t.Cleanup(func() {
+		appDaemonsLock.Lock()
+		appDaemons = old
+		appDaemonsLock.Unlock()
+	})
+	return mock
+}
+
+// requests of op got by the mock daemon
+func testMockOps(t *testing.T, mock *MockDaemon, op requests.OpCode) func() int {
+	t.Helper()
+	var lock sync.Mutex
+	count := 0
+	mock.OnRequest(func(got requests.OpCode) {
+		if got == op {
+			lock.Lock()
+			count++
+			lock.Unlock()
+		}
+	})
+	t.Cleanup(func() { mock.OnRequest(nil) })
+	return func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return count
+	}
+}
+
+func testBackendClient(t *testing.T, name string, backend string) int32 {
+	t.Helper()
+	t.Cleanup(func() { testApi(t, "DELETE", "/client", &paramAll{Name: name}) })
+	return testCode(t, testApi(t, "POST", "/client", &paramAll{Name: name, Backend: backend}))
+}
+
+func testHealth(t *testing.T) (int, *rtnHealth) {
+	t.Helper()
+	w := testApi(t, "GET", "/health", nil)
+	var rtn rtnHealth
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, &rtn
+}
+
+func TestBackendRouting(t *testing.T) {
+	mock := testTwoDaemons(t, "BoundApp")
+	se0 := testMockOps(t, testMock, requests.OpPsaGenerateKey)
+	se1 := testMockOps(t, mock, requests.OpPsaGenerateKey)
+
+	tests := []struct {
+		name    string
+		backend string
+		se1     bool
+	}{
+		{"DefaultApp", "", false},
+		{"Se0App", "se0", false},
+		{"Se1App", "se1", true},
+		{"BoundApp", "", true},
+		{"BoundApp", "se1", true},
+	}
+	for _, tt := range tests {
+		if code := testBackendClient(t, tt.name, tt.backend); code != CODE_SUCCESS {
+			t.Fatalf("client %s backend %q: code %d", tt.name, tt.backend, code)
+		}
+		n0, n1 := se0(), se1()
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: tt.name, KeyName: "RouteKey" + tt.backend, Alg: JWS_ES256}), CODE_SUCCESS)
+		if got := se1() > n1; got != tt.se1 || se0() > n0 == tt.se1 {
+			t.Fatalf("client %s backend %q: key made by se0 %d se1 %d", tt.name, tt.backend, se0()-n0, se1()-n1)
+		}
+	}
+
+	// refused bindings
+	testExpect(t, testApi(t, "POST", "/client", &paramAll{Name: "BoundApp", Backend: "se0"}), CODE_NOT_ALLOWED)
+	testExpect(t, testApi(t, "POST", "/client", &paramAll{Name: "Se1App", Backend: "se0"}), CODE_NOT_ALLOWED)
+	testExpect(t, testApi(t, "POST", "/client", &paramAll{Name: "OtherApp", Backend: "se9"}), CODE_INVALID_PARAM)
+}
+
+func TestBackendBindingRestart(t *testing.T) {
+	testMetaDB(t)
+	mock := testTwoDaemons(t)
+	if code := testBackendClient(t, "KeptApp", "se1"); code != CODE_SUCCESS {
+		t.Fatalf("client code %d", code)
+	}
+	if code := testBackendClient(t, "KeptDefaultApp", ""); code != CODE_SUCCESS {
+		t.Fatalf("client code %d", code)
+	}
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "KeptApp", KeyName: "KeptKey", Alg: JWS_ES256}), CODE_SUCCESS)
+	testPutMeta(t, &keyMeta{Name: "LostApp", KeyName: "LostKey"})
+
+	// restart, clients and bindings in memory were gone
+	testApi(t, "DELETE", "/client", &paramAll{Name: "KeptApp"})
+	testApi(t, "DELETE", "/client", &paramAll{Name: "KeptDefaultApp"})
+	appDaemonsLock.Lock()
+	appDaemons = make(map[string]string)
+	appDaemonsLock.Unlock()
+	if err := loadAppDaemons(); err != nil {
+		t.Fatal(err)
+	}
+	testSetConf(t, func(conf *AppConfig) { conf.Backend.Default = "se1" })
+	if d := appDaemon("KeptApp"); d.Name != "se1" {
+		t.Fatalf("KeptApp daemon %s after restart, want se1", d.Name)
+	}
+	if d := appDaemon("KeptDefaultApp"); d.Name != "se0" {
+		t.Fatalf("KeptDefaultApp daemon %s after default changed, want se0", d.Name)
+	}
+
+	// application of unknown daemon was not listed, its records were kept
+	se0 := testMockOps(t, testMock, requests.OpListKeys)
+	se1 := testMockOps(t, mock, requests.OpListKeys)
+	reconcileAllMeta()
+	if se0() != 0 || se1() == 0 {
+		t.Fatalf("reconcile listed se0 %d se1 %d", se0(), se1())
+	}
+	for _, id := range [][2]string{{"KeptApp", "KeptKey"}, {"LostApp", "LostKey"}} {
+		if meta, err := loadMeta(id[0], id[1]); err != nil || meta == nil {
+			t.Fatalf("record of %s %s removed, %v", id[0], id[1], err)
+		}
+	}
+
+	// and its expired keys were not destroyed by the reaper
+	destroyOps := testMockOps(t, testMock, requests.OpPsaDestroyKey)
+	at := time.Now().Add(-time.Minute)
+	setKeyExpiry("LostApp", "LostKey", &at)
+	t.Cleanup(func() { setKeyExpiry("LostApp", "LostKey", nil) })
+	destroyExpiredKey("LostApp", "LostKey", at)
+	if destroyOps() != 0 {
+		t.Fatalf("reaper destroyed %d keys of unknown daemon", destroyOps())
+	}
+	if meta, _ := loadMeta("LostApp", "LostKey"); meta == nil {
+		t.Fatal("record of expired key of unknown daemon removed")
+	}
+}
+
+func TestBackendHealth(t *testing.T) {
+	mock := testTwoDaemons(t)
+	if code := testBackendClient(t, "HealthApp", "se1"); code != CODE_SUCCESS {
+		t.Fatalf("client code %d", code)
+	}
+	status, rtn := testHealth(t)
+	if status != http.StatusOK || rtn.Status != "ok" || len(rtn.Daemons) != 2 {
+		t.Fatalf("health %d %+v", status, rtn)
+	}
+
+	// se1 down, found by the op of its application
+	path := mock.path
+	mock.Close()
+	testExpect(t, testApi(t, "GET", "/keys", &paramAll{Name: "HealthApp"}), CODE_PARSEC_ERROR)
+	status, rtn = testHealth(t)
+	if status != http.StatusOK || rtn.Status != "degraded" || rtn.Daemon != "up" {
+		t.Fatalf("health %d %+v", status, rtn)
+	}
+	for _, d := range rtn.Daemons {
+		want := map[string]string{"se0": "up", "se1": "down"}[d.Name]
+		if d.Daemon != want || (d.Name == "se1") != (d.TransportErrors > 0) {
+			t.Fatalf("daemon %+v, want %s", d, want)
+		}
+	}
+	// se0 still served its applications
+	testNewClient(t, "HealthSe0App")
+	testExpect(t, testApi(t, "GET", "/keys", &paramAll{Name: "HealthSe0App"}), CODE_SUCCESS)
+
+	// se1 back
+	mock, err := StartMockDaemon(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mock.Close() })
+	testExpect(t, testApi(t, "GET", "/keys", &paramAll{Name: "HealthApp"}), CODE_SUCCESS)
+	if status, rtn := testHealth(t); status != http.StatusOK || rtn.Status != "ok" {
+		t.Fatalf("health %d %+v", status, rtn)
+	}
+}
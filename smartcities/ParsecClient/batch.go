@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	BATCH_OP_SIGN    = "sign"
+	BATCH_OP_VERIFY  = "verify"
+	BATCH_OP_ENCRYPT = "encrypt"
+	BATCH_OP_DECRYPT = "decrypt"
+)
+
+// same fields meaning as the single op apis
+type batchOp struct {
+	Op      string
+	KeyName string
+	Message string
+	Sign    string
+	Version string
+}
+
+type paramBatch struct {
+	Name string
+	Ops  []batchOp
+}
+
+type rtnBatchItem struct {
+	Code    int32
+	Result  string `json:",omitempty"`
+	Version string `json:",omitempty"`
+}
+
+func checkBatchParam(c *gin.Context) (*paramBatch, bool) {
+	// get request param
+	var data, _ = c.GetRawData()
+	var param paramBatch
+	var err = json.Unmarshal(data, &param)
+	if err != nil {
+		return nil, false
+	}
+
+	// check param is valid
+	if len(param.Name) == 0 || len(param.Ops) == 0 {
+		return nil, false
+	}
+	if maxOps := GetConf().Batch.MaxOps; maxOps > 0 && len(param.Ops) > maxOps {
+		return nil, false
+	}
+
+	return &param, true
+}
+
+// run one op, result was base64 for sign and encrypt, plain text for decrypt
+func runBatchOp(appName string, client CryptoClient, op *batchOp) rtnBatchItem {
+	if len(op.KeyName) == 0 {
+		return rtnBatchItem{Code: CODE_INVALID_PARAM}
+	}
+
+	release, _, ok := acquireLimit(appName, op.Op)
+	if !ok {
+		return rtnBatchItem{Code: CODE_RATE_LIMITED}
+	}
+	defer release()
+
+	var keyName string
+	var result string
+	var code int32
+	switch op.Op {
+	case BATCH_OP_SIGN:
+		var signature []byte
+		keyName, signature, code = signMessage(appName, client, op.KeyName, []byte(op.Message))
+		result = base64.StdEncoding.EncodeToString(signature)
+	case BATCH_OP_VERIFY:
+		signature, err := base64.StdEncoding.DecodeString(op.Sign)
+		if err != nil || len(signature) == 0 {
+			return rtnBatchItem{Code: CODE_INVALID_PARAM}
+		}
+		keyName, code = verifyMessage(appName, client, op.KeyName, []byte(op.Message), signature, op.Version)
+	case BATCH_OP_ENCRYPT:
+		var ciphertext []byte
+		keyName, ciphertext, code = encryptMessage(appName, client, op.KeyName, []byte(op.Message))
+		result = base64.StdEncoding.EncodeToString(ciphertext)
+	case BATCH_OP_DECRYPT:
+		ciphertext, err := base64.StdEncoding.DecodeString(op.Message)
+		if err != nil || len(ciphertext) == 0 {
+			return rtnBatchItem{Code: CODE_INVALID_PARAM}
+		}
+		var plaintext []byte
+		keyName, plaintext, code = decryptMessage(appName, client, op.KeyName, ciphertext, op.Version)
+		result = string(plaintext)
+	default:
+		return rtnBatchItem{Code: CODE_INVALID_PARAM}
+	}
+
+	if code != CODE_SUCCESS {
+		return rtnBatchItem{Code: code}
+	}
+	return rtnBatchItem{
+		Code:    CODE_SUCCESS,
+		Result:  result,
+		Version: keyVersionLabel(keyName),
+	}
+}
+
+// curl -v -d '{"Name": "GoClient", "Ops": [{"Op": "sign", "KeyName": "MyKey", "Message": "Hello World"}, {"Op": "encrypt", "KeyName": "MyEncKey", "Message": "Hello World"}]}' 127.0.0.1:8300/batch
+func ApiBatch(c *gin.Context) {
+	param, ok := checkBatchParam(c)
+	if !ok {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	parallel := GetConf().Batch.Parallel
+	if parallel > len(param.Ops) {
+		parallel = len(param.Ops)
+	}
+
+	// workers share the cached client, every op take its own parsec connection
+	results := make([]rtnBatchItem, len(param.Ops))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = runBatchOp(param.Name, client, &param.Ops[i])
+			}
+		}()
+	}
+	for i := range param.Ops {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	c.JSON(http.StatusOK, results)
+}
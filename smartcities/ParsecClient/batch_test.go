@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+)
+
+func testBatch(t *testing.T, param *paramBatch) []rtnBatchItem {
+	t.Helper()
+	w := testApi(t, "POST", "/batch", param)
+	var results []rtnBatchItem
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("batch: status %d, body %q", w.Code, w.Body.String())
+	}
+	if len(results) != len(param.Ops) {
+		t.Fatalf("%d results of %d ops", len(results), len(param.Ops))
+	}
+	return results
+}
+
+// results are in the order of ops, a failed op does not fail the others
+func TestApiBatch(t *testing.T) {
+	testNewClient(t, "BatchClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "BatchClient", KeyName: "BatchSignKey"}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/keyenc", &paramAll{Name: "BatchClient", KeyName: "BatchEncKey"}), CODE_SUCCESS)
+
+	results := testBatch(t, &paramBatch{Name: "BatchClient", Ops: []batchOp{
+		{Op: BATCH_OP_SIGN, KeyName: "BatchSignKey", Message: "first"},
+		{Op: BATCH_OP_ENCRYPT, KeyName: "BatchEncKey", Message: "second"},
+		{Op: BATCH_OP_SIGN, KeyName: "MissingKey", Message: "third"},
+		{Op: "hash", KeyName: "BatchSignKey", Message: "fourth"},
+		{Op: BATCH_OP_SIGN, Message: "fifth"},
+		{Op: BATCH_OP_DECRYPT, KeyName: "BatchEncKey", Message: "not base64"},
+	}})
+	for i, code := range []int32{CODE_SUCCESS, CODE_SUCCESS, CODE_INVALID_KEY, CODE_INVALID_PARAM, CODE_INVALID_PARAM, CODE_INVALID_PARAM} {
+		if results[i].Code != code {
+			t.Fatalf("result %d: %+v, want code %d", i, results[i], code)
+		}
+	}
+	if results[0].Version != "v0" || len(results[0].Result) == 0 {
+		t.Fatalf("sign result %+v", results[0])
+	}
+
+	// results of the first batch are used by the second one
+	results = testBatch(t, &paramBatch{Name: "BatchClient", Ops: []batchOp{
+		{Op: BATCH_OP_DECRYPT, KeyName: "BatchEncKey", Message: results[1].Result},
+		{Op: BATCH_OP_VERIFY, KeyName: "BatchSignKey", Message: "first", Sign: results[0].Result},
+		{Op: BATCH_OP_VERIFY, KeyName: "BatchSignKey", Message: "changed", Sign: results[0].Result},
+		{Op: BATCH_OP_VERIFY, KeyName: "BatchSignKey", Message: "first", Sign: results[0].Result, Version: "v0"},
+	}})
+	if results[0].Code != CODE_SUCCESS || results[0].Result != "second" {
+		t.Fatalf("decrypt result %+v", results[0])
+	}
+	for i, code := range []int32{CODE_SUCCESS, CODE_VERIFY_FAIL, CODE_SUCCESS} {
+		if results[i+1].Code != code {
+			t.Fatalf("verify result %d: %+v, want code %d", i+1, results[i+1], code)
+		}
+	}
+}
+
+func TestApiBatchMaxOps(t *testing.T) {
+	testNewClient(t, "BatchMaxClient")
+	testSetConf(t, func(conf *AppConfig) { conf.Batch.MaxOps = 2 })
+
+	ops := []batchOp{{Op: BATCH_OP_SIGN, KeyName: "BatchKey", Message: "a"}, {Op: BATCH_OP_SIGN, KeyName: "BatchKey", Message: "b"}}
+	testBatch(t, &paramBatch{Name: "BatchMaxClient", Ops: ops})
+	ops = append(ops, batchOp{Op: BATCH_OP_SIGN, KeyName: "BatchKey", Message: "c"})
+	testExpect(t, testApi(t, "POST", "/batch", &paramBatch{Name: "BatchMaxClient", Ops: ops}), CODE_INVALID_PARAM)
+	testExpect(t, testApi(t, "POST", "/batch", &paramBatch{Name: "BatchMaxClient"}), CODE_INVALID_PARAM)
+	testExpect(t, testApi(t, "POST", "/batch", &paramBatch{Name: "BatchMissingClient", Ops: ops[:1]}), CODE_INVALID_CLIENT)
+}
+
+// no more ops run at the same time than batch.parallel
+func TestApiBatchParallel(t *testing.T) {
+	testNewClient(t, "BatchParallelClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "BatchParallelClient", KeyName: "BatchParallelKey"}), CODE_SUCCESS)
+
+	var lock sync.Mutex
+	running, most := 0, 0
+	testMock.OnRequest(func(op requests.OpCode) {
+		if op != requests.OpPsaSignHash {
+			return
+		}
+		lock.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	})
+	t.Cleanup(func() { testMock.OnRequest(nil) })
+
+	ops := make([]batchOp, 8)
+	for i := range ops {
+		ops[i] = batchOp{Op: BATCH_OP_SIGN, KeyName: "BatchParallelKey", Message: "hello"}
+	}
+	for _, parallel := range []int{1, 3} {
+		testSetConf(t, func(conf *AppConfig) { conf.Batch.Parallel = parallel })
+		most = 0
+		for i, rtn := range testBatch(t, &paramBatch{Name: "BatchParallelClient", Ops: ops}) {
+			if rtn.Code != CODE_SUCCESS {
+				t.Fatalf("result %d: %+v", i, rtn)
+			}
+		}
+		lock.Lock()
+		if most != parallel {
+			t.Fatalf("batch.parallel %d, %d ops ran at the same time", parallel, most)
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"go.uber.org/zap"
+)
+
+// opcodes supported by the provider and authenticators of the daemon,
+// queried when client was created
+type clientCaps struct {
+	provider       parsec.ProviderID
+	opcodes        map[requests.OpCode]bool
+	authenticators []*parsec.AuthenticatorInfo
+}
+
+type rtnCapabilities struct {
+	Provider       string
+	ProviderID     uint32
+	Opcodes        []string
+	Authenticators []string
+}
+
+var opcodeNames = map[requests.OpCode]string{
+	requests.OpPing:                 "Ping",
+	requests.OpPsaGenerateKey:       "PsaGenerateKey",
+	requests.OpPsaDestroyKey:        "PsaDestroyKey",
+	requests.OpPsaSignHash:          "PsaSignHash",
+	requests.OpPsaVerifyHash:        "PsaVerifyHash",
+	requests.OpPsaImportKey:         "PsaImportKey",
+	requests.OpPsaExportPublicKey:   "PsaExportPublicKey",
+	requests.OpListProviders:        "ListProviders",
+	requests.OpListOpcodes:          "ListOpcodes",
+	requests.OpPsaAsymmetricEncrypt: "PsaAsymmetricEncrypt",
+	requests.OpPsaAsymmetricDecrypt: "PsaAsymmetricDecrypt",
+	requests.OpPsaExportKey:         "PsaExportKey",
+	requests.OpPsaGenerateRandom:    "PsaGenerateRandom",
+	requests.OpListAuthenticators:   "ListAuthenticators",
+	requests.OpPsaHashCompute:       "PsaHashCompute",
+	requests.OpPsaHashCompare:       "PsaHashCompare",
+	requests.OpPsaAeadEncrypt:       "PsaAeadEncrypt",
+	requests.OpPsaAeadDecrypt:       "PsaAeadDecrypt",
+	requests.OpPsaRawKeyAgreement:   "PsaRawKeyAgreement",
+	requests.OpPsaCipherEncrypt:     "PsaCipherEncrypt",
+	requests.OpPsaCipherDecrypt:     "PsaCipherDecrypt",
+	requests.OpPsaMacCompute:        "PsaMacCompute",
+	requests.OpPsaMacVerify:         "PsaMacVerify",
+	requests.OpPsaSignMessage:       "PsaSignMessage",
+	requests.OpPsaVerifyMessage:     "PsaVerifyMessage",
+	requests.OpListKeys:             "ListKeys",
+}
+
+// application name -> capabilities
+var capsCache = make(map[string]*clientCaps)
+var capsLock sync.RWMutex
+
+func opcodeName(op requests.OpCode) string {
+	if name, ok := opcodeNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", uint32(op))
+}
+
+func discoverCaps(appName string, client CryptoClient) (*clientCaps, error) {
+	provider := backendProvider(appName)
+	opcodes, err := client.ListOpcodes(provider)
+	if err != nil {
+		return nil, err
+	}
+	authenticators, err := client.ListAuthenticators()
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &clientCaps{
+		provider:       provider,
+		opcodes:        make(map[requests.OpCode]bool),
+		authenticators: authenticators,
+	}
+	for _, op := range opcodes {
+		caps.opcodes[requests.OpCode(op)] = true
+	}
+	return caps, nil
+}
+
+// clients use direct authenticator, daemon must have it
+func (caps *clientCaps) hasDirectAuth() bool {
+	for _, auth := range caps.authenticators {
+		if auth.ID == parsec.AuthDirect {
+			return true
+		}
+	}
+	return false
+}
+
+func setCaps(appName string, caps *clientCaps) {
+	capsLock.Lock()
+	defer capsLock.Unlock()
+	capsCache[appName] = caps
+}
+
+func forgetCaps(appName string) {
+	capsLock.Lock()
+	defer capsLock.Unlock()
+	delete(capsCache, appName)
+}
+
+func getCaps(appName string) (*clientCaps, bool) {
+	capsLock.RLock()
+	defer capsLock.RUnlock()
+	caps, ok := capsCache[appName]
+	return caps, ok
+}
+
+// supportOp return false only if the provider was known to lack op
+func supportOp(appName string, op requests.OpCode) bool {
+	caps, ok := getCaps(appName)
+	if !ok {
+		return true
+	}
+	return caps.opcodes[op]
+}
+
+// requireOp response CODE_NOT_SUPPORTED if the provider lack op
+func requireOp(c *gin.Context, appName string, op requests.OpCode) bool {
+	if supportOp(appName, op) {
+		return true
+	}
+	zap.L().Warn("Op not supported by provider", zap.String("client", appName), zap.String("op", opcodeName(op)))
+	responseError(c, CODE_NOT_SUPPORTED)
+	return false
+}
+
+// curl -v -X GET -d '{"Name": "GoClient"}' 127.0.0.1:8300/capabilities
+func ApiGetCapabilities(c *gin.Context) {
+	param, ok := checkParam(c, 0)
+	if !ok {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	if _, ok := getClient(param.Name); !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+	caps, ok := getCaps(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	rtn := rtnCapabilities{
+		Provider:       caps.provider.String(),
+		ProviderID:     uint32(caps.provider),
+		Opcodes:        make([]string, 0, len(caps.opcodes)),
+		Authenticators: make([]string, 0, len(caps.authenticators)),
+	}
+	ops := make([]requests.OpCode, 0, len(caps.opcodes))
+	for op := range caps.opcodes {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+	for _, op := range ops {
+		rtn.Opcodes = append(rtn.Opcodes, opcodeName(op))
+	}
+	if GetConf().Backend.Type == BACKEND_SOFTWARE {
+		rtn.Provider = "Software"
+	}
+	for _, auth := range caps.authenticators {
+		rtn.Authenticators = append(rtn.Authenticators, auth.Description)
+	}
+
+	c.JSON(http.StatusOK, &rtn)
+}
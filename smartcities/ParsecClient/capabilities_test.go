@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+)
+
+// a provider without asymmetric encrypt, the ops it lack are refused before parsec
+func TestApiCapabilities(t *testing.T) {
+	testMock.HideOpcodes(requests.OpPsaAsymmetricEncrypt)
+	t.Cleanup(func() { testMock.HideOpcodes() })
+	testNewClient(t, "CapsClient")
+
+	w := testApi(t, "GET", "/capabilities", &paramAll{Name: "CapsClient"})
+	var rtn rtnCapabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("capabilities: status %d, body %q", w.Code, w.Body.String())
+	}
+	if rtn.ProviderID != uint32(parsec.ProviderMBed) || rtn.Provider != parsec.ProviderMBed.String() {
+		t.Fatalf("provider %s %d", rtn.Provider, rtn.ProviderID)
+	}
+	ops := strings.Join(rtn.Opcodes, " ")
+	if strings.Contains(ops, "PsaAsymmetricEncrypt") || !strings.Contains(ops, "PsaAsymmetricDecrypt") || !strings.Contains(ops, "PsaSignHash") {
+		t.Fatalf("opcodes %v", rtn.Opcodes)
+	}
+	if len(rtn.Authenticators) != 1 || rtn.Authenticators[0] != "Direct authenticator" {
+		t.Fatalf("authenticators %v", rtn.Authenticators)
+	}
+
+	testExpect(t, testApi(t, "POST", "/keyenc", &paramAll{Name: "CapsClient", KeyName: "CapsKey"}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/encrypt", &paramAll{Name: "CapsClient", KeyName: "CapsKey", Message: "hello"}), CODE_NOT_SUPPORTED)
+	results := testBatch(t, &paramBatch{Name: "CapsClient", Ops: []batchOp{{Op: BATCH_OP_ENCRYPT, KeyName: "CapsKey", Message: "hello"}}})
+	if results[0].Code != CODE_NOT_SUPPORTED {
+		t.Fatalf("batch encrypt %+v", results[0])
+	}
+
+	testExpect(t, testApi(t, "GET", "/capabilities", &paramAll{Name: "MissingCapsClient"}), CODE_INVALID_CLIENT)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// body of all ParsecClient apis, same fields as paramAll of the server
+type param struct {
+	Name        string
+	KeyName     string            `json:",omitempty"`
+	Message     string            `json:",omitempty"`
+	Sign        string            `json:",omitempty"`
+	Version     string            `json:",omitempty"`
+	Alg         string            `json:",omitempty"`
+	Labels      map[string]string `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	Ttl         string            `json:",omitempty"`
+	ExpiresAt   string            `json:",omitempty"`
+	Protected   bool              `json:",omitempty"`
+	Callback    string            `json:",omitempty"`
+	Backend     string            `json:",omitempty"`
+}
+
+type apiClient struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// error returned by ParsecClient as {"Code": n}
+type apiError struct {
+	Status int
+	Code   int32
+	Body   string
+}
+
+func (e *apiError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("server returned %d, code %d (%s)", e.Status, e.Code, codeName(e.Code))
+	}
+	return fmt.Sprintf("server returned %d: %s", e.Status, strings.TrimSpace(e.Body))
+}
+
+// names of Code in ParsecClient code.go
+var codeNames = []string{
+	"CODE_SUCCESS",
+	"CODE_PARSEC_ERROR",
+	"CODE_INVALID_PARAM",
+	"CODE_INVALID_CLIENT",
+	"CODE_INVALID_KEY",
+	"CODE_VERIFY_FAIL",
+	"CODE_NOT_ALLOWED",
+	"CODE_LIMIT_EXCEEDED",
+	"CODE_RATE_LIMITED",
+	"CODE_NOT_SUPPORTED",
+	"CODE_TOKEN_EXPIRED",
+	"CODE_TOKEN_NOT_ACTIVE",
+	"CODE_KEY_EXPIRED",
+	"CODE_KEY_PROTECTED",
+	"CODE_QUOTA_EXCEEDED",
+}
+
+const CODE_VERIFY_FAIL = 5
+
+func codeName(code int32) string {
+	if code >= 0 && int(code) < len(codeNames) {
+		return codeNames[code]
+	}
+	return "unknown"
+}
+
+func newApiClient(server string, token string, timeout time.Duration) *apiClient {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	return &apiClient{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: timeout},
+	}
+}
+
+// send body as json, the response body and headers were returned for 2xx
+func (a *apiClient) do(method string, path string, body interface{}) ([]byte, http.Header, int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, a.server+path, reader)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(a.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, resp.StatusCode, err
+	}
+	if resp.StatusCode/100 != 2 {
+		apiErr := &apiError{Status: resp.StatusCode, Body: string(data)}
+		var rtn struct{ Code int32 }
+		if json.Unmarshal(data, &rtn) == nil {
+			apiErr.Code = rtn.Code
+		}
+		return data, resp.Header, resp.StatusCode, apiErr
+	}
+	return data, resp.Header, resp.StatusCode, nil
+}
+
+func (a *apiClient) call(method string, path string, body interface{}, out interface{}) (http.Header, error) {
+	data, header, _, err := a.do(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil && len(data) != 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// apis returning text like base64 signature or ssh public key
+func (a *apiClient) text(method string, path string, body interface{}) (string, http.Header, error) {
+	data, header, _, err := a.do(method, path, body)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(data), header, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiRequest(t *testing.T) {
+	server := testNewServer(t, map[string]testResponse{
+		"GET /keys":    {http.StatusOK, nil, `[{"Name":"KeyA"}]`},
+		"POST /sign":   {http.StatusOK, map[string]string{"X-Key-Version": "v3"}, "c2ln"},
+		"POST /verify": {http.StatusBadRequest, nil, `{"Code":5}`},
+		"GET /key":     {http.StatusBadGateway, nil, "bad gateway\n"},
+	})
+	api := newApiClient(strings.TrimPrefix(server.URL, "http://")+"/", "secret", time.Second)
+	if api.server != server.URL {
+		t.Fatalf("server %q, want %q", api.server, server.URL)
+	}
+
+	// json body with only the fields set
+	var keys []rtnKey
+	if _, err := api.call(http.MethodGet, "/keys", &param{Name: "App"}, &keys); err != nil || len(keys) != 1 || keys[0].Name != "KeyA" {
+		t.Fatalf("keys %+v, %v", keys, err)
+	}
+	req := server.last(t)
+	if req.Method != "GET" || req.ContentType != "application/json" || req.Authorization != "Bearer secret" || string(req.Body) != `{"Name":"App"}` {
+		t.Fatalf("request %+v, body %s", req, req.Body)
+	}
+
+	p := &param{Name: "App", KeyName: "MyKey", Labels: map[string]string{"site": "gate"}, Protected: true, Backend: "se0"}
+	if _, err := api.call(http.MethodPost, "/keysign?async=1", p, nil); err != nil {
+		t.Fatal(err)
+	}
+	req = server.last(t)
+	want := `{"Name":"App","KeyName":"MyKey","Labels":{"site":"gate"},"Protected":true,"Backend":"se0"}`
+	if req.Path != "/keysign" || req.Query != "async=1" || string(req.Body) != want {
+		t.Fatalf("request %+v, body %s, want %s", req, req.Body, want)
+	}
+
+	// text apis return the headers
+	sig, header, err := api.text(http.MethodPost, "/sign", &param{Name: "App", KeyName: "MyKey", Message: "hello"})
+	if err != nil || sig != "c2ln" || header.Get("X-Key-Version") != "v3" {
+		t.Fatalf("sign %q, header %v, %v", sig, header, err)
+	}
+
+	// no body, no content type
+	if _, _, _, err := api.do(http.MethodGet, "/health", nil); err != nil {
+		t.Fatal(err)
+	}
+	if req := server.last(t); len(req.Body) != 0 || req.ContentType != "" {
+		t.Fatalf("request %+v", req)
+	}
+
+	// errors by Code or by the body
+	_, err = api.call(http.MethodPost, "/verify", &param{Name: "App"}, nil)
+	if apiErr, ok := err.(*apiError); !ok || apiErr.Status != http.StatusBadRequest || apiErr.Code != CODE_VERIFY_FAIL ||
+		!strings.Contains(err.Error(), "CODE_VERIFY_FAIL") {
+		t.Fatalf("verify error %v", err)
+	}
+	_, _, err = api.text(http.MethodGet, "/key", &param{Name: "App"})
+	if apiErr, ok := err.(*apiError); !ok || apiErr.Code != 0 || err.Error() != "server returned 502: bad gateway" {
+		t.Fatalf("export error %v", err)
+	}
+
+	// no token, no header
+	api = newApiClient(server.URL, "", time.Second)
+	api.call(http.MethodGet, "/keys", &param{Name: "App"}, nil)
+	if req := server.last(t); req.Authorization != "" {
+		t.Fatalf("authorization %q without token", req.Authorization)
+	}
+}
+
+func TestApiHealth(t *testing.T) {
+	testHome(t)
+	body := `{"Status":"degraded","Backend":"parsec","Reconnects":2,"Daemons":[{"Name":"se0","Provider":"MBed","Daemon":"down","Since":"x","Reconnects":2,"TransportErrors":5}]}`
+	server := testNewServer(t, map[string]testResponse{
+		"GET /health": {http.StatusServiceUnavailable, nil, body},
+	})
+
+	// 503 still print the health
+	code, out := testRun(t, "", "-s", server.URL, "health")
+	if code != 1 || !strings.Contains(out, "degraded") || !strings.Contains(out, "se0") {
+		t.Fatalf("exit %d, output %q", code, out)
+	}
+	if req := server.last(t); req.Method != "GET" || req.Path != "/health" || len(req.Body) != 0 {
+		t.Fatalf("request %+v", req)
+	}
+}
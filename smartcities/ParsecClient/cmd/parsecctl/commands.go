@@ -0,0 +1,666 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ssh"
+)
+
+// public key formats of export and import.
+// ParsecClient use "ssh-rsa <base64 of PKCS#1 DER> <comment>", it is not an
+// openssh key even it looks like one. ecc keys were exported as
+// "ecdsa-sha2-nistp256 <base64 of uncompressed point> <comment>", der and pem of them are PKIX.
+const (
+	FORMAT_SSH     = "ssh"
+	FORMAT_OPENSSH = "openssh"
+	FORMAT_PEM     = "pem"
+	FORMAT_DER     = "der"
+)
+
+var keyFormats = []string{FORMAT_SSH, FORMAT_OPENSSH, FORMAT_PEM, FORMAT_DER}
+
+type rtnKey struct {
+	Name       string
+	ProviderID uint32
+	Meta       *struct {
+		Labels      map[string]string
+		Description string
+		ExpiresAt   *time.Time
+		Protected   bool
+	} `json:",omitempty"`
+}
+
+type rtnHealth struct {
+	Status     string
+	Backend    string
+	Daemon     string `json:",omitempty"`
+	Since      string `json:",omitempty"`
+	Reconnects uint64
+	Daemons    []struct {
+		Name            string
+		Socket          string `json:",omitempty"`
+		Provider        string
+		Daemon          string
+		Since           string
+		Reconnects      uint64
+		TransportErrors uint64
+	} `json:",omitempty"`
+}
+
+// result of sign encrypt decrypt in json output
+type rtnData struct {
+	KeyName    string
+	KeyVersion string `json:",omitempty"`
+	Data       string
+}
+
+func init() {
+	register(&command{
+		name: "client create",
+		help: "create the parsec client of the application",
+		flags: func(fs *pflag.FlagSet) {
+			fs.String("backend", "", "named parsec daemon, default backend.default of server")
+		},
+		run: runClientCreate,
+	})
+	register(&command{
+		name: "client delete",
+		help: "close the parsec client of the application",
+		run:  runClientDelete,
+	})
+	register(&command{
+		name: "keys list",
+		help: "list keys of the application",
+		run:  runKeysList,
+	})
+	register(&command{
+		name:  "key gen",
+		usage: "<key>",
+		help:  "generate a sign or encrypt key",
+		flags: func(fs *pflag.FlagSet) {
+			fs.String("type", "sign", "key type, sign or enc")
+			fs.String("alg", "", "sign algorithm, RS256 PS256 ES256 ES384")
+			fs.String("ttl", "", "key expire after it, like 30m")
+			fs.String("expires-at", "", "key expire at RFC 3339 time")
+			fs.StringToString("label", nil, "label of the key, k=v, repeatable")
+			fs.String("description", "", "description of the key")
+			fs.Bool("protected", false, "key can not be destroyed")
+			fs.Bool("async", false, "generate in background and print the job")
+			fs.String("callback", "", "url posted with the job when finished, implies --async, must match jobs.callbacks of the server")
+		},
+		run: runKeyGen,
+	})
+	register(&command{
+		name:  "key export",
+		usage: "<key>",
+		help:  "export the public key",
+		flags: func(fs *pflag.FlagSet) {
+			fs.String("format", FORMAT_SSH, "public key format, "+strings.Join(keyFormats, " "))
+			fs.String("out", "", "output file, default stdout")
+		},
+		run: runKeyExport,
+	})
+	register(&command{
+		name:  "key import",
+		usage: "<key>",
+		help:  "import a rsa public key for encrypt",
+		flags: func(fs *pflag.FlagSet) {
+			fs.String("format", FORMAT_PEM, "public key format, "+strings.Join(keyFormats, " "))
+			fs.StringP("file", "f", "-", "public key file, - is stdin")
+			fs.StringToString("label", nil, "label of the key, k=v, repeatable")
+			fs.String("description", "", "description of the key")
+			fs.Bool("protected", false, "key can not be destroyed")
+		},
+		run: runKeyImport,
+	})
+	register(&command{
+		name:  "sign",
+		usage: "<key>",
+		help:  "sign the message, print base64 signature",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringP("file", "f", "-", "message file, - is stdin")
+			fs.String("out", "", "signature file, default stdout")
+		},
+		run: runSign,
+	})
+	register(&command{
+		name:  "verify",
+		usage: "<key>",
+		help:  "verify the signature of message, exit 1 if invalid",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringP("file", "f", "-", "message file, - is stdin")
+			fs.String("sig", "", "base64 signature")
+			fs.String("sig-file", "", "file of base64 signature")
+			fs.String("version", "", "key version hint like v2")
+		},
+		run: runVerify,
+	})
+	register(&command{
+		name:  "encrypt",
+		usage: "<key>",
+		help:  "encrypt the message, print base64 ciphertext",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringP("file", "f", "-", "plaintext file, - is stdin")
+			fs.String("out", "", "ciphertext file, default stdout")
+		},
+		run: runEncrypt,
+	})
+	register(&command{
+		name:  "decrypt",
+		usage: "<key>",
+		help:  "decrypt base64 ciphertext",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringP("file", "f", "-", "ciphertext file, - is stdin")
+			fs.String("out", "", "plaintext file, default stdout")
+			fs.String("version", "", "key version hint like v1")
+		},
+		run: runDecrypt,
+	})
+	register(&command{
+		name: "health",
+		help: "show health of the server and parsec daemons, exit 1 if not ok",
+		run:  runHealth,
+	})
+}
+
+func runClientCreate(ctx *context, args []string) error {
+	if err := needArgs(args, 0); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	backend, _ := ctx.fs.GetString("backend")
+	if _, err := ctx.api.call(http.MethodPost, "/client", &param{Name: ctx.name, Backend: backend}, nil); err != nil {
+		return err
+	}
+	return ctx.print(map[string]string{"Name": ctx.name}, func(w io.Writer) {
+		row(w, "created", ctx.name)
+	})
+}
+
+func runClientDelete(ctx *context, args []string) error {
+	if err := needArgs(args, 0); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	if _, err := ctx.api.call(http.MethodDelete, "/client", &param{Name: ctx.name}, nil); err != nil {
+		return err
+	}
+	return ctx.print(map[string]string{"Name": ctx.name}, func(w io.Writer) {
+		row(w, "deleted", ctx.name)
+	})
+}
+
+func runKeysList(ctx *context, args []string) error {
+	if err := needArgs(args, 0); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	data, _, _, err := ctx.api.do(http.MethodGet, "/keys", &param{Name: ctx.name})
+	if err != nil {
+		return err
+	}
+	var keys []rtnKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	// json output as server returned, with all meta fields
+	return ctx.print(json.RawMessage(data), func(w io.Writer) {
+		row(w, "NAME", "PROVIDER", "PROTECTED", "EXPIRES", "LABELS")
+		for _, key := range keys {
+			protected, expires, labels := "-", "-", "-"
+			if key.Meta != nil {
+				protected = fmt.Sprint(key.Meta.Protected)
+				if key.Meta.ExpiresAt != nil {
+					expires = key.Meta.ExpiresAt.Format(time.RFC3339)
+				}
+				if len(key.Meta.Labels) != 0 {
+					pairs := make([]string, 0, len(key.Meta.Labels))
+					for k, v := range key.Meta.Labels {
+						pairs = append(pairs, k+"="+v)
+					}
+					labels = strings.Join(pairs, ",")
+				}
+			}
+			row(w, key.Name, key.ProviderID, protected, expires, labels)
+		}
+	})
+}
+
+func runKeyGen(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	fs := ctx.fs
+	keyType, _ := fs.GetString("type")
+	p := &param{Name: ctx.name, KeyName: args[0]}
+	p.Alg, _ = fs.GetString("alg")
+	p.Ttl, _ = fs.GetString("ttl")
+	p.ExpiresAt, _ = fs.GetString("expires-at")
+	p.Labels, _ = fs.GetStringToString("label")
+	p.Description, _ = fs.GetString("description")
+	p.Protected, _ = fs.GetBool("protected")
+	p.Callback, _ = fs.GetString("callback")
+	async, _ := fs.GetBool("async")
+
+	var path string
+	switch keyType {
+	case "sign":
+		path = "/keysign"
+	case "enc":
+		if len(p.Alg) != 0 {
+			return &usageError{msg: "--alg is only for sign keys"}
+		}
+		path = "/keyenc"
+	default:
+		return &usageError{msg: "unknown key type " + keyType}
+	}
+	if async || len(p.Callback) != 0 {
+		path += "?async=1"
+	}
+
+	data, _, status, err := ctx.api.do(http.MethodPost, path, p)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusAccepted {
+		var j struct {
+			ID     string
+			Status string
+		}
+		if err := json.Unmarshal(data, &j); err != nil {
+			return err
+		}
+		return ctx.print(json.RawMessage(data), func(w io.Writer) {
+			row(w, "job", j.ID, j.Status)
+		})
+	}
+	return ctx.print(map[string]string{"Name": ctx.name, "KeyName": p.KeyName}, func(w io.Writer) {
+		row(w, "generated", p.KeyName)
+	})
+}
+
+func checkFormat(format string) error {
+	for _, f := range keyFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return &usageError{msg: "unknown key format " + format}
+}
+
+func runKeyExport(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	format, _ := ctx.fs.GetString("format")
+	out, _ := ctx.fs.GetString("out")
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+
+	str, header, err := ctx.api.text(http.MethodGet, "/key", &param{Name: ctx.name, KeyName: args[0]})
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(str)
+	if len(fields) < 2 {
+		return fmt.Errorf("unexpected public key from server: %s", str)
+	}
+	raw, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return err
+	}
+	pub, err := exportedPublicKey(fields[0], raw)
+	if err != nil {
+		return err
+	}
+	// rsa keep PKCS#1 like before
+	der, pemType := raw, "RSA PUBLIC KEY"
+	if _, ok := pub.(*ecdsa.PublicKey); ok {
+		if der, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+			return err
+		}
+		pemType = "PUBLIC KEY"
+	}
+
+	var data []byte
+	switch format {
+	case FORMAT_SSH:
+		data = []byte(str + "\n")
+	case FORMAT_DER:
+		data = der
+	case FORMAT_PEM:
+		data = pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+	case FORMAT_OPENSSH:
+		sshPub, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			return err
+		}
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+		data = []byte(line + " " + ctx.name + "_" + args[0] + "\n")
+	}
+
+	if ctx.output == OUTPUT_JSON && (len(out) == 0 || out == "-") {
+		rtn := map[string]string{"KeyName": args[0], "KeyVersion": header.Get("X-Key-Version"), "Format": format}
+		if format == FORMAT_DER {
+			rtn["PublicKey"] = base64.StdEncoding.EncodeToString(data)
+		} else {
+			rtn["PublicKey"] = string(data)
+		}
+		return ctx.print(rtn, nil)
+	}
+	return writeOutput(out, data)
+}
+
+// public key of "/key" output, by its type field
+func exportedPublicKey(keyType string, raw []byte) (crypto.PublicKey, error) {
+	var curve elliptic.Curve
+	switch keyType {
+	case "ssh-rsa":
+		return x509.ParsePKCS1PublicKey(raw)
+	case "ecdsa-sha2-nistp256":
+		curve = elliptic.P256()
+	case "ecdsa-sha2-nistp384":
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("unsupported public key type %s", keyType)
+	}
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, fmt.Errorf("invalid %s public key", keyType)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// PKCS#1 DER of the rsa public key in any of keyFormats
+func parsePublicKey(format string, data []byte) ([]byte, error) {
+	switch format {
+	case FORMAT_DER:
+		if _, err := x509.ParsePKCS1PublicKey(data); err == nil {
+			return data, nil
+		}
+		return pkixToPkcs1(data)
+	case FORMAT_PEM:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no pem block found")
+		}
+		switch block.Type {
+		case "RSA PUBLIC KEY":
+			if _, err := x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+				return nil, err
+			}
+			return block.Bytes, nil
+		case "PUBLIC KEY":
+			return pkixToPkcs1(block.Bytes)
+		}
+		return nil, fmt.Errorf("unsupported pem block %s", block.Type)
+	case FORMAT_SSH:
+		fields := strings.Fields(string(data))
+		if len(fields) < 2 || fields[0] != "ssh-rsa" {
+			return nil, fmt.Errorf("not a ssh-rsa public key")
+		}
+		der, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := x509.ParsePKCS1PublicKey(der); err != nil {
+			return nil, err
+		}
+		return der, nil
+	case FORMAT_OPENSSH:
+		sshPub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		cpk, ok := sshPub.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported ssh key %s", sshPub.Type())
+		}
+		pub, ok := cpk.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not a rsa key: %s", sshPub.Type())
+		}
+		return x509.MarshalPKCS1PublicKey(pub), nil
+	}
+	return nil, checkFormat(format)
+}
+
+func pkixToPkcs1(der []byte) ([]byte, error) {
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not a rsa public key")
+	}
+	return x509.MarshalPKCS1PublicKey(rsaPub), nil
+}
+
+func runKeyImport(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	fs := ctx.fs
+	format, _ := fs.GetString("format")
+	file, _ := fs.GetString("file")
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+	data, err := readInput(file)
+	if err != nil {
+		return err
+	}
+	der, err := parsePublicKey(format, data)
+	if err != nil {
+		return fmt.Errorf("parse public key fail: %v", err)
+	}
+
+	p := &param{Name: ctx.name, KeyName: args[0]}
+	p.Message = "ssh-rsa " + base64.StdEncoding.EncodeToString(der) + " " + ctx.name + "_" + args[0]
+	p.Labels, _ = fs.GetStringToString("label")
+	p.Description, _ = fs.GetString("description")
+	p.Protected, _ = fs.GetBool("protected")
+	if _, err := ctx.api.call(http.MethodPost, "/key", p, nil); err != nil {
+		return err
+	}
+	return ctx.print(map[string]string{"Name": ctx.name, "KeyName": args[0]}, func(w io.Writer) {
+		row(w, "imported", args[0])
+	})
+}
+
+// sign encrypt and decrypt print the text result, or rtnData in json
+func printData(ctx *context, keyName string, header http.Header, out string, data string) error {
+	if ctx.output == OUTPUT_JSON && (len(out) == 0 || out == "-") {
+		return ctx.print(&rtnData{KeyName: keyName, KeyVersion: header.Get("X-Key-Version"), Data: data}, nil)
+	}
+	if len(out) == 0 || out == "-" {
+		data += "\n"
+	}
+	return writeOutput(out, []byte(data))
+}
+
+func runSign(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	file, _ := ctx.fs.GetString("file")
+	out, _ := ctx.fs.GetString("out")
+	msg, err := readMessage(file)
+	if err != nil {
+		return err
+	}
+	sig, header, err := ctx.api.text(http.MethodPost, "/sign", &param{Name: ctx.name, KeyName: args[0], Message: msg})
+	if err != nil {
+		return err
+	}
+	return printData(ctx, args[0], header, out, sig)
+}
+
+func runVerify(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	fs := ctx.fs
+	file, _ := fs.GetString("file")
+	sig, _ := fs.GetString("sig")
+	sigFile, _ := fs.GetString("sig-file")
+	version, _ := fs.GetString("version")
+	if (len(sig) == 0) == (len(sigFile) == 0) {
+		return &usageError{msg: "need one of --sig and --sig-file"}
+	}
+	if len(sigFile) != 0 {
+		if sigFile == file {
+			return &usageError{msg: "message and signature can not both be read from stdin"}
+		}
+		data, err := readInput(sigFile)
+		if err != nil {
+			return err
+		}
+		sig = strings.TrimSpace(string(data))
+	}
+	msg, err := readMessage(file)
+	if err != nil {
+		return err
+	}
+
+	header, err := ctx.api.call(http.MethodPost, "/verify", &param{Name: ctx.name, KeyName: args[0], Message: msg, Sign: sig, Version: version}, nil)
+	valid := err == nil
+	if apiErr, ok := err.(*apiError); ok && apiErr.Code == CODE_VERIFY_FAIL {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	rtn := map[string]interface{}{"KeyName": args[0], "Valid": valid}
+	if valid {
+		rtn["KeyVersion"] = header.Get("X-Key-Version")
+	}
+	if err := ctx.print(rtn, func(w io.Writer) {
+		if valid {
+			row(w, "valid", header.Get("X-Key-Version"))
+		} else {
+			row(w, "invalid")
+		}
+	}); err != nil {
+		return err
+	}
+	if !valid {
+		return fmt.Errorf("signature invalid")
+	}
+	return nil
+}
+
+func runEncrypt(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	file, _ := ctx.fs.GetString("file")
+	out, _ := ctx.fs.GetString("out")
+	msg, err := readMessage(file)
+	if err != nil {
+		return err
+	}
+	ciphertext, header, err := ctx.api.text(http.MethodPost, "/encrypt", &param{Name: ctx.name, KeyName: args[0], Message: msg})
+	if err != nil {
+		return err
+	}
+	return printData(ctx, args[0], header, out, ciphertext)
+}
+
+func runDecrypt(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	if err := ctx.needName(); err != nil {
+		return err
+	}
+	file, _ := ctx.fs.GetString("file")
+	out, _ := ctx.fs.GetString("out")
+	version, _ := ctx.fs.GetString("version")
+	data, err := readInput(file)
+	if err != nil {
+		return err
+	}
+	ciphertext := strings.TrimSpace(string(data))
+	plaintext, header, err := ctx.api.text(http.MethodPost, "/decrypt", &param{Name: ctx.name, KeyName: args[0], Message: ciphertext, Version: version})
+	if err != nil {
+		return err
+	}
+	if ctx.output == OUTPUT_JSON && (len(out) == 0 || out == "-") {
+		return ctx.print(&rtnData{KeyName: args[0], KeyVersion: header.Get("X-Key-Version"), Data: plaintext}, nil)
+	}
+	// plaintext as it was, no newline added
+	return writeOutput(out, []byte(plaintext))
+}
+
+func runHealth(ctx *context, args []string) error {
+	if err := needArgs(args, 0); err != nil {
+		return err
+	}
+	// 503 still has the health body
+	data, _, status, err := ctx.api.do(http.MethodGet, "/health", nil)
+	if err != nil && status != http.StatusServiceUnavailable {
+		return err
+	}
+	var rtn rtnHealth
+	if err := json.Unmarshal(data, &rtn); err != nil {
+		return err
+	}
+	if err := ctx.print(json.RawMessage(data), func(w io.Writer) {
+		row(w, "STATUS", rtn.Status)
+		row(w, "BACKEND", rtn.Backend)
+		row(w, "RECONNECTS", rtn.Reconnects)
+		if len(rtn.Daemons) != 0 {
+			fmt.Fprintln(w)
+			row(w, "DAEMON", "SOCKET", "PROVIDER", "STATE", "SINCE", "RECONNECTS", "ERRORS")
+			for _, d := range rtn.Daemons {
+				row(w, d.Name, d.Socket, d.Provider, d.Daemon, d.Since, d.Reconnects, d.TransportErrors)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	if rtn.Status != "ok" {
+		return fmt.Errorf("server is %s", rtn.Status)
+	}
+	return nil
+}
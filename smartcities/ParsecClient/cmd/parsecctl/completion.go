@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// source <(parsecctl completion bash)
+// parsecctl completion zsh > "${fpath[1]}/_parsecctl"
+
+func init() {
+	register(&command{
+		name:  "completion",
+		usage: "<bash|zsh>",
+		help:  "print shell completion script",
+		run:   runCompletion,
+	})
+}
+
+// words of the command line after "parsecctl" -> next words,
+// "<command> -" -> its flags, " -" -> global flags
+func completionWords() map[string][]string {
+	words := make(map[string][]string)
+	add := func(prefix string, word string) {
+		for _, w := range words[prefix] {
+			if w == word {
+				return
+			}
+		}
+		words[prefix] = append(words[prefix], word)
+	}
+	flagNames := func(fs *pflag.FlagSet) []string {
+		var flags []string
+		fs.VisitAll(func(f *pflag.Flag) {
+			flags = append(flags, "--"+f.Name)
+		})
+		return flags
+	}
+	for _, cmd := range commands {
+		parts := strings.Fields(cmd.name)
+		add("", parts[0])
+		if len(parts) == 2 {
+			add(parts[0], parts[1])
+		}
+		fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+		globalFlags(fs)
+		if cmd.flags != nil {
+			cmd.flags(fs)
+		}
+		words[cmd.name+" -"] = flagNames(fs)
+	}
+	fs := pflag.NewFlagSet("global", pflag.ContinueOnError)
+	globalFlags(fs)
+	words[" -"] = flagNames(fs)
+	words["completion"] = []string{"bash", "zsh"}
+	for _, list := range words {
+		sort.Strings(list)
+	}
+	return words
+}
+
+// global flags followed by a value, like "-n|--name"
+func valueFlags() string {
+	fs := pflag.NewFlagSet("global", pflag.ContinueOnError)
+	globalFlags(fs)
+	var names []string
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Value.Type() == "bool" {
+			return
+		}
+		names = append(names, "--"+f.Name)
+		if len(f.Shorthand) != 0 {
+			names = append(names, "-"+f.Shorthand)
+		}
+	})
+	return strings.Join(names, "|")
+}
+
+// commands having sub commands, like client and key
+func commandGroups() string {
+	var groups []string
+	for _, cmd := range commands {
+		parts := strings.Fields(cmd.name)
+		if len(parts) == 2 && !strings.Contains(" "+strings.Join(groups, " ")+" ", " "+parts[0]+" ") {
+			groups = append(groups, parts[0])
+		}
+	}
+	sort.Strings(groups)
+	return strings.Join(groups, " ")
+}
+
+func runCompletion(ctx *context, args []string) error {
+	if err := needArgs(args, 1); err != nil {
+		return err
+	}
+	words := completionWords()
+	keys := make([]string, 0, len(words))
+	for k := range words {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	switch args[0] {
+	case "bash":
+		fmt.Fprintln(stdout, "# bash completion for parsecctl")
+		fmt.Fprintln(stdout, "_parsecctl() {")
+		fmt.Fprintln(stdout, `    local cur="${COMP_WORDS[COMP_CWORD]}" prev="" path="" w i`)
+		fmt.Fprintln(stdout, `    for ((i = 1; i < COMP_CWORD; i++)); do`)
+		fmt.Fprintln(stdout, `        w="${COMP_WORDS[i]}"`)
+		fmt.Fprintln(stdout, `        if [[ "$w" == -* ]]; then prev="$w"; continue; fi`)
+		fmt.Fprintf(stdout, "        case \"$prev\" in %s) prev=\"\"; continue ;; esac\n", valueFlags())
+		fmt.Fprintln(stdout, `        prev=""`)
+		fmt.Fprintln(stdout, `        if [[ -z "$path" ]]; then path="$w"`)
+		fmt.Fprintf(stdout, "        elif [[ \"$path\" != *\" \"* && \" %s \" == *\" $path \"* ]]; then path=\"$path $w\"\n", commandGroups())
+		fmt.Fprintln(stdout, `        else break; fi`)
+		fmt.Fprintln(stdout, `    done`)
+		fmt.Fprintln(stdout, `    [[ "$cur" == -* ]] && path="$path -"`)
+		fmt.Fprintln(stdout, `    local words=""`)
+		fmt.Fprintln(stdout, `    case "$path" in`)
+		for _, k := range keys {
+			fmt.Fprintf(stdout, "        %q) words=%q ;;\n", k, strings.Join(words[k], " "))
+		}
+		fmt.Fprintln(stdout, `        *) COMPREPLY=($(compgen -f -- "$cur")); return ;;`)
+		fmt.Fprintln(stdout, `    esac`)
+		fmt.Fprintln(stdout, `    COMPREPLY=($(compgen -W "$words" -- "$cur"))`)
+		fmt.Fprintln(stdout, "}")
+		fmt.Fprintln(stdout, "complete -o default -F _parsecctl parsecctl")
+	case "zsh":
+		// zsh run the bash script by bashcompinit
+		fmt.Fprintln(stdout, "#compdef parsecctl")
+		fmt.Fprintln(stdout, "autoload -U +X bashcompinit && bashcompinit")
+		ctx.output = OUTPUT_TABLE
+		return runCompletion(ctx, []string{"bash"})
+	default:
+		return &usageError{msg: "unknown shell " + args[0]}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+// parsecctl drive ParsecClient from shell instead of curl with hand escaped json.
+//
+//	parsecctl -n GoClient client create
+//	parsecctl -n GoClient key gen MyKey
+//	echo -n "Hello World" | parsecctl -n GoClient sign MyKey > hello.sig
+//	parsecctl -n GoClient verify MyKey --sig-file hello.sig < hello.txt
+//
+// server, token and application name were read from ~/.parsecctl.toml,
+// PARSECCTL_* environment or flags, flags win. the config file is like
+//
+//	server = "http://127.0.0.1:8300"
+//	token = "xxx"
+//	name = "GoClient"
+//	output = "table"
+//	timeout = "30s"
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+type command struct {
+	name  string // "key gen"
+	usage string // args after the name
+	help  string
+	flags func(fs *pflag.FlagSet)
+	run   func(ctx *context, args []string) error
+}
+
+// global settings of one run
+type context struct {
+	api    *apiClient
+	name   string // application name
+	output string // json or table
+	fs     *pflag.FlagSet
+}
+
+var commands []*command
+
+func register(cmd *command) {
+	commands = append(commands, cmd)
+}
+
+func findCommand(args []string) (*command, []string) {
+	// longest name first, "key gen" before "key"
+	for n := 2; n >= 1; n-- {
+		if len(args) < n {
+			continue
+		}
+		name := strings.Join(args[:n], " ")
+		for _, cmd := range commands {
+			if cmd.name == name {
+				return cmd, args[n:]
+			}
+		}
+	}
+	return nil, args
+}
+
+func globalFlags(fs *pflag.FlagSet) {
+	fs.StringP("config", "c", "", "config file, default ~/.parsecctl.toml")
+	fs.StringP("server", "s", "", "ParsecClient address, default http://127.0.0.1:8300")
+	fs.String("token", "", "sent as Authorization: Bearer")
+	fs.StringP("name", "n", "", "application name of the parsec client")
+	fs.StringP("output", "o", "", "output format, table or json")
+	fs.Duration("timeout", 0, "request timeout, default 30s")
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: parsecctl [global flags] <command> [args]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	sorted := append([]*command(nil), commands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	for _, cmd := range sorted {
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", strings.TrimSpace(cmd.name+" "+cmd.usage), cmd.help)
+	}
+	fs := pflag.NewFlagSet("global", pflag.ContinueOnError)
+	globalFlags(fs)
+	fmt.Fprintln(os.Stderr, "\nGlobal flags:")
+	fmt.Fprint(os.Stderr, fs.FlagUsages())
+}
+
+func loadConfig(fs *pflag.FlagSet) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetDefault("server", "http://127.0.0.1:8300")
+	v.SetDefault("output", "table")
+	v.SetDefault("timeout", 30*time.Second)
+	v.SetEnvPrefix("parsecctl")
+	v.AutomaticEnv()
+
+	file, _ := fs.GetString("config")
+	if len(file) == 0 {
+		file = os.Getenv("PARSECCTL_CONFIG")
+	}
+	if len(file) != 0 {
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, err
+		}
+	} else {
+		v.SetConfigName(".parsecctl")
+		v.SetConfigType("toml")
+		if home, err := os.UserHomeDir(); err == nil {
+			v.AddConfigPath(home)
+		}
+		if err := v.ReadInConfig(); err != nil {
+			if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+				return nil, err
+			}
+		}
+	}
+
+	for _, key := range []string{"server", "token", "name", "output", "timeout"} {
+		if err := v.BindPFlag(key, fs.Lookup(key)); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run the command line without program name, return the exit code
+func run(argv []string) int {
+	fs := pflag.NewFlagSet("parsecctl", pflag.ContinueOnError)
+	fs.SortFlags = false
+	fs.Usage = usage
+	globalFlags(fs)
+
+	// flags of the command were added after it was found
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+	if err := fs.Parse(argv); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, "Error,", err)
+		return 2
+	}
+	cmd, _ := findCommand(fs.Args())
+	if cmd == nil {
+		usage()
+		return 2
+	}
+
+	fs = pflag.NewFlagSet("parsecctl "+cmd.name, pflag.ContinueOnError)
+	fs.SortFlags = false
+	globalFlags(fs)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: parsecctl %s [flags] %s\n\n%s\n\nFlags:\n", cmd.name, cmd.usage, cmd.help)
+		fmt.Fprint(os.Stderr, fs.FlagUsages())
+	}
+	if err := fs.Parse(argv); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, "Error,", err)
+		return 2
+	}
+	_, args := findCommand(fs.Args())
+
+	v, err := loadConfig(fs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error, load config fail:", err)
+		return 2
+	}
+	ctx := &context{
+		api:    newApiClient(v.GetString("server"), v.GetString("token"), v.GetDuration("timeout")),
+		name:   v.GetString("name"),
+		output: v.GetString("output"),
+		fs:     fs,
+	}
+	if ctx.output != OUTPUT_TABLE && ctx.output != OUTPUT_JSON {
+		fmt.Fprintln(os.Stderr, "Error, unknown output format:", ctx.output)
+		return 2
+	}
+
+	if err := cmd.run(ctx, args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error,", err)
+		if _, ok := err.(*usageError); ok {
+			fs.Usage()
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func needArgs(args []string, n int) error {
+	if len(args) != n {
+		return &usageError{msg: fmt.Sprintf("need %d argument(s), got %d", n, len(args))}
+	}
+	return nil
+}
+
+func (ctx *context) needName() error {
+	if len(ctx.name) == 0 {
+		return &usageError{msg: "application name was not set by --name, PARSECCTL_NAME or config"}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// request got by the fake server
+type testRequest struct {
+	Method        string
+	Path          string
+	Query         string
+	Authorization string
+	ContentType   string
+	Body          []byte
+	Param         param
+}
+
+type testResponse struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+// fake ParsecClient answering by "METHOD /path", 200 with empty body if not set
+type testServer struct {
+	*httptest.Server
+	lock      sync.Mutex
+	requests  []testRequest
+	responses map[string]testResponse
+}
+
+func testNewServer(t *testing.T, responses map[string]testResponse) *testServer {
+	t.Helper()
+	s := &testServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := testRequest{
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Query:         r.URL.RawQuery,
+			Authorization: r.Header.Get("Authorization"),
+			ContentType:   r.Header.Get("Content-Type"),
+			Body:          body,
+		}
+		json.Unmarshal(body, &req.Param)
+		s.lock.Lock()
+		s.requests = append(s.requests, req)
+		s.lock.Unlock()
+
+		resp, ok := s.responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			resp.status = http.StatusOK
+		}
+		for k, v := range resp.header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.status)
+		io.WriteString(w, resp.body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) last(t *testing.T) testRequest {
+	t.Helper()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.requests) == 0 {
+		t.Fatal("no request sent")
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+// home without config file and no PARSECCTL_ environment
+func testHome(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, key := range []string{"CONFIG", "SERVER", "TOKEN", "NAME", "OUTPUT", "TIMEOUT"} {
+		t.Setenv("PARSECCTL_"+key, "")
+		os.Unsetenv("PARSECCTL_" + key)
+	}
+	return home
+}
+
+// run the command line with input as stdin, return exit code and stdout
+func testRun(t *testing.T, input string, argv ...string) (int, string) {
+	t.Helper()
+	var out bytes.Buffer
+	oldIn, oldOut := stdin, stdout
+	stdin, stdout = strings.NewReader(input), &out
+	defer func() { stdin, stdout = oldIn, oldOut }()
+	code := run(argv)
+	return code, out.String()
+}
+
+func testWriteFile(t *testing.T, path string, data string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigResolution(t *testing.T) {
+	home := testHome(t)
+	home1 := testNewServer(t, nil)
+	other := testNewServer(t, nil)
+	testWriteFile(t, filepath.Join(home, ".parsecctl.toml"), `
+server = "`+home1.URL+`"
+token = "home-token"
+name = "HomeApp"
+`)
+	otherFile := testWriteFile(t, filepath.Join(t.TempDir(), "other.toml"), `
+server = "`+other.URL+`"
+name = "OtherApp"
+`)
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		argv   []string
+		server *testServer
+		app    string
+		token  string
+	}{
+		{"HomeFile", nil, nil, home1, "HomeApp", "Bearer home-token"},
+		{"EnvName", map[string]string{"PARSECCTL_NAME": "EnvApp"}, nil, home1, "EnvApp", "Bearer home-token"},
+		{"FlagName", map[string]string{"PARSECCTL_NAME": "EnvApp"}, []string{"-n", "FlagApp"}, home1, "FlagApp", "Bearer home-token"},
+		{"FlagToken", nil, []string{"--token", "flag-token"}, home1, "HomeApp", "Bearer flag-token"},
+		{"ConfigFlag", nil, []string{"--config", otherFile}, other, "OtherApp", ""},
+		{"ConfigEnv", map[string]string{"PARSECCTL_CONFIG": otherFile}, nil, other, "OtherApp", ""},
+		{"EnvServer", map[string]string{"PARSECCTL_SERVER": strings.TrimPrefix(other.URL, "http://")}, nil, other, "HomeApp", "Bearer home-token"},
+		{"FlagServer", map[string]string{"PARSECCTL_SERVER": home1.URL}, []string{"-s", other.URL + "/"}, other, "HomeApp", "Bearer home-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			// global flags before or after the command
+			argv := append(append([]string{"client"}, tt.argv...), "create")
+			if code, out := testRun(t, "", argv...); code != 0 {
+				t.Fatalf("exit %d, output %q", code, out)
+			}
+			req := tt.server.last(t)
+			if req.Method != "POST" || req.Path != "/client" || req.Param.Name != tt.app || req.Authorization != tt.token {
+				t.Fatalf("request %+v, want name %s token %q", req, tt.app, tt.token)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	home := testHome(t)
+	server := testNewServer(t, nil)
+
+	tests := []struct {
+		name string
+		argv []string
+		code int
+	}{
+		{"MissingConfig", []string{"--config", filepath.Join(home, "missing.toml"), "-n", "App", "client", "create"}, 2},
+		{"NoName", []string{"-s", server.URL, "client", "create"}, 2},
+		{"Output", []string{"-s", server.URL, "-n", "App", "-o", "yaml", "keys", "list"}, 2},
+		{"UnknownCommand", []string{"-s", server.URL, "key", "burn"}, 2},
+		{"Args", []string{"-s", server.URL, "-n", "App", "sign"}, 2},
+		{"UnknownFlag", []string{"-s", server.URL, "-n", "App", "keys", "list", "--nope"}, 2},
+		{"Help", []string{"sign", "--help"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, out := testRun(t, "", tt.argv...); code != tt.code {
+				t.Fatalf("exit %d, want %d, output %q", code, tt.code, out)
+			}
+		})
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.requests) != 0 {
+		t.Fatalf("requests sent by wrong command lines: %+v", server.requests)
+	}
+
+	// bad toml
+	bad := testWriteFile(t, filepath.Join(home, "bad.toml"), "server = ")
+	if code, _ := testRun(t, "", "--config", bad, "-n", "App", "client", "create"); code != 2 {
+		t.Fatalf("bad config: exit %d", code)
+	}
+}
+
+func TestInput(t *testing.T) {
+	testHome(t)
+	server := testNewServer(t, map[string]testResponse{
+		"POST /sign":   {http.StatusOK, map[string]string{"X-Key-Version": "v1"}, "c2lnbmF0dXJl"},
+		"POST /verify": {http.StatusOK, map[string]string{"X-Key-Version": "v1"}, ""},
+	})
+	dir := t.TempDir()
+	msgFile := testWriteFile(t, filepath.Join(dir, "hello.txt"), "Hello File")
+	sigFile := testWriteFile(t, filepath.Join(dir, "hello.sig"), "c2lnbmF0dXJl\n")
+	global := []string{"-s", server.URL, "-n", "App"}
+
+	// stdin
+	code, out := testRun(t, "Hello Stdin", append(global, "sign", "MyKey")...)
+	if code != 0 || out != "c2lnbmF0dXJl\n" || server.last(t).Param.Message != "Hello Stdin" {
+		t.Fatalf("sign stdin: exit %d, output %q, request %+v", code, out, server.last(t).Param)
+	}
+	// file, and signature written to file
+	outFile := filepath.Join(dir, "out.sig")
+	code, out = testRun(t, "ignored", append(global, "sign", "MyKey", "-f", msgFile, "--out", outFile)...)
+	if data, _ := os.ReadFile(outFile); code != 0 || len(out) != 0 || string(data) != "c2lnbmF0dXJl" || server.last(t).Param.Message != "Hello File" {
+		t.Fatalf("sign file: exit %d, output %q, file %q", code, out, data)
+	}
+	// binary can not be a json string
+	if code, _ := testRun(t, "\xff\xfe", append(global, "sign", "MyKey")...); code != 1 {
+		t.Fatalf("sign binary: exit %d", code)
+	}
+	if code, _ := testRun(t, "", append(global, "sign", "MyKey")...); code != 1 {
+		t.Fatalf("sign empty: exit %d", code)
+	}
+
+	// message from stdin, signature from file
+	code, out = testRun(t, "Hello Stdin", append(global, "verify", "MyKey", "--sig-file", sigFile, "--version", "v1")...)
+	req := server.last(t)
+	if code != 0 || out != "valid  v1\n" || req.Param.Sign != "c2lnbmF0dXJl" || req.Param.Message != "Hello Stdin" || req.Param.Version != "v1" {
+		t.Fatalf("verify: exit %d, output %q, request %+v", code, out, req.Param)
+	}
+	// both from stdin, or none of signature
+	if code, _ := testRun(t, "x", append(global, "verify", "MyKey", "--sig-file", "-")...); code != 2 {
+		t.Fatalf("verify both stdin: exit %d", code)
+	}
+	if code, _ := testRun(t, "x", append(global, "verify", "MyKey")...); code != 2 {
+		t.Fatalf("verify no signature: exit %d", code)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	testHome(t)
+	keys := `[{"Name":"KeyA","ProviderID":1,"Meta":{"Labels":{"site":"gate"},"Protected":true}},{"Name":"KeyB","ProviderID":1}]`
+	server := testNewServer(t, map[string]testResponse{
+		"GET /keys":    {http.StatusOK, nil, keys},
+		"POST /sign":   {http.StatusOK, map[string]string{"X-Key-Version": "v2"}, "c2ln"},
+		"POST /verify": {http.StatusBadRequest, nil, `{"Code":5}`},
+	})
+	global := []string{"-s", server.URL, "-n", "App"}
+
+	code, out := testRun(t, "", append(global, "keys", "list")...)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if code != 0 || len(lines) != 3 || strings.Fields(lines[0])[0] != "NAME" ||
+		strings.Join(strings.Fields(lines[1]), " ") != "KeyA 1 true - site=gate" ||
+		strings.Join(strings.Fields(lines[2]), " ") != "KeyB 1 - - -" {
+		t.Fatalf("table: exit %d, output %q", code, out)
+	}
+
+	// json as the server returned
+	code, out = testRun(t, "", append(global, "-o", "json", "keys", "list")...)
+	var list []map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &list); code != 0 || err != nil || len(list) != 2 || list[0]["Meta"] == nil {
+		t.Fatalf("json: exit %d, output %q, %v", code, out, err)
+	}
+
+	t.Setenv("PARSECCTL_OUTPUT", "json")
+	code, out = testRun(t, "hello", append(global, "sign", "MyKey")...)
+	var data rtnData
+	if err := json.Unmarshal([]byte(out), &data); code != 0 || err != nil || data != (rtnData{KeyName: "MyKey", KeyVersion: "v2", Data: "c2ln"}) {
+		t.Fatalf("sign json: exit %d, output %q, %v", code, out, err)
+	}
+
+	// invalid signature exit 1 with a result
+	code, out = testRun(t, "hello", append(global, "verify", "MyKey", "--sig", "c2ln")...)
+	var valid map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &valid); code != 1 || err != nil || valid["Valid"] != false {
+		t.Fatalf("verify json: exit %d, output %q, %v", code, out, err)
+	}
+	code, out = testRun(t, "hello", append(global, "-o", "table", "verify", "MyKey", "--sig", "c2ln")...)
+	if code != 1 || out != "invalid\n" {
+		t.Fatalf("verify table: exit %d, output %q", code, out)
+	}
+}
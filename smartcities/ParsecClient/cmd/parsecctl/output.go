@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+)
+
+// standard streams, tests replace them
+var stdin io.Reader = os.Stdin
+var stdout io.Writer = os.Stdout
+
+// json output print v, table output call table with a tab aligned writer
+func (ctx *context) print(v interface{}, table func(w io.Writer)) error {
+	if ctx.output == OUTPUT_JSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func row(w io.Writer, cols ...interface{}) {
+	strs := make([]string, len(cols))
+	for i, col := range cols {
+		strs[i] = fmt.Sprint(col)
+	}
+	fmt.Fprintln(w, strings.Join(strs, "\t"))
+}
+
+// "-" or empty is stdin
+func readInput(file string) ([]byte, error) {
+	if len(file) == 0 || file == "-" {
+		return io.ReadAll(stdin)
+	}
+	return os.ReadFile(file)
+}
+
+// "-" or empty is stdout
+func writeOutput(file string, data []byte) error {
+	if len(file) == 0 || file == "-" {
+		_, err := stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(file, data, 0600)
+}
+
+// Message of the api is a json string, binary data can not pass it
+func readMessage(file string) (string, error) {
+	data, err := readInput(file)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("empty input")
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("input is not utf-8 text, encode binary data like base64 first")
+	}
+	return string(data), nil
+}
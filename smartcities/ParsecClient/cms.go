@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// CMS SignedData of RFC 5652, signed by parsec keys through a crypto.Signer.
+// only issuerAndSerialNumber signer and signed attributes were made.
+
+var (
+	oidData              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidRSA               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidRSAPSS            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidECDSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidExtKeyUsage       = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidTimeStamping      = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+)
+
+var errCmsFormat = errors.New("invalid cms signed data")
+var errCmsSigner = errors.New("cms signer certificate not found")
+var errCmsDigest = errors.New("cms message digest mismatch")
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT, tag was set by hand
+}
+
+type cmsEncapContent struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContent     cmsEncapContent
+	Certificates     []asn1.RawValue `asn1:"optional,set,tag:0"`
+	CRLs             []asn1.RawValue `asn1:"optional,set,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	Sid                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue // [0] IMPLICIT SET OF, required here
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type pssParams struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// parsecSigner sign by a parsec key, usable by x509 and cms
+type parsecSigner struct {
+	appName string
+	client  CryptoClient
+	keyName string // versioned
+	alg     jwsAlg
+	pub     crypto.PublicKey
+}
+
+var _ crypto.Signer = (*parsecSigner)(nil)
+
+// signer of current version of the key, alg was got from the key
+func newParsecSigner(appName string, client CryptoClient, keyName string) (*parsecSigner, int32) {
+	keyName, algName, code := signKeyAlg(appName, client, keyName, "")
+	if code != CODE_SUCCESS {
+		return nil, code
+	}
+	pk, err := getPublicKey(appName, client, keyName)
+	if err != nil {
+		return nil, CODE_PARSEC_ERROR
+	}
+	return &parsecSigner{
+		appName: appName,
+		client:  client,
+		keyName: keyName,
+		alg:     jwsAlgs[algName],
+		pub:     pk.key,
+	}, CODE_SUCCESS
+}
+
+func (s *parsecSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// ecdsa signature was returned as DER like crypto/ecdsa
+func (s *parsecSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	signature, err := s.client.PsaSignHash(s.keyName, digest, s.alg.signAlg())
+	if err != nil || !s.alg.ecc {
+		return signature, err
+	}
+	size := len(signature) / 2
+	return asn1.Marshal(ecdsaSignature{
+		R: new(big.Int).SetBytes(signature[:size]),
+		S: new(big.Int).SetBytes(signature[size:]),
+	})
+}
+
+// x509 signature algorithm of certificates made by the signer
+func (s *parsecSigner) x509Algorithm() x509.SignatureAlgorithm {
+	switch {
+	case s.alg.ecc && s.alg.hash == crypto.SHA384:
+		return x509.ECDSAWithSHA384
+	case s.alg.ecc:
+		return x509.ECDSAWithSHA256
+	case s.alg.pss:
+		return x509.SHA256WithRSAPSS
+	}
+	return x509.SHA256WithRSA
+}
+
+func cmsDigestAlgorithm(hash crypto.Hash) pkix.AlgorithmIdentifier {
+	if hash == crypto.SHA384 {
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA384}
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+}
+
+func cmsDigestHash(alg pkix.AlgorithmIdentifier) (crypto.Hash, bool) {
+	switch {
+	case alg.Algorithm.Equal(oidSHA256):
+		return crypto.SHA256, true
+	case alg.Algorithm.Equal(oidSHA384):
+		return crypto.SHA384, true
+	}
+	return 0, false
+}
+
+func (s *parsecSigner) cmsSignatureAlgorithm() pkix.AlgorithmIdentifier {
+	switch {
+	case s.alg.ecc && s.alg.hash == crypto.SHA384:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384}
+	case s.alg.ecc:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	case s.alg.pss:
+		hash := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+		mgfHash, _ := asn1.Marshal(hash)
+		params, _ := asn1.Marshal(pssParams{
+			Hash:       hash,
+			MGF:        pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mgfHash}},
+			SaltLength: s.alg.hash.Size(),
+		})
+		return pkix.AlgorithmIdentifier{Algorithm: oidRSAPSS, Parameters: asn1.RawValue{FullBytes: params}}
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+}
+
+// DER SET OF need sorted elements
+func derSet(elements [][]byte) asn1.RawValue {
+	sort.Slice(elements, func(i, j int) bool { return bytes.Compare(elements[i], elements[j]) < 0 })
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(elements, nil)}
+}
+
+func cmsAttr(oid asn1.ObjectIdentifier, value interface{}) ([]byte, error) {
+	data, err := asn1.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsAttribute{Type: oid, Values: derSet([][]byte{data})})
+}
+
+// buildSignedData sign the digest of content, content was put in only if eContent not nil.
+// cert is the signer, certs were put in the certificates field, extra are more signed attributes.
+func buildSignedData(signer *parsecSigner, cert *x509.Certificate, certs []*x509.Certificate, contentType asn1.ObjectIdentifier, eContent []byte, digest []byte, signingTime time.Time, extra ...[]byte) ([]byte, error) {
+	attrs := append([][]byte{}, extra...)
+	for _, item := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttrContentType, contentType},
+		{oidAttrSigningTime, signingTime.UTC()},
+		{oidAttrMessageDigest, digest},
+	} {
+		attr, err := cmsAttr(item.oid, item.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+
+	// signature is over the attributes as SET, but stored as [0] IMPLICIT
+	signedAttrs := derSet(attrs)
+	toBeSigned, err := asn1.Marshal(signedAttrs)
+	if err != nil {
+		return nil, err
+	}
+	h := signer.alg.hash.New()
+	h.Write(toBeSigned)
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), signer.alg.hash)
+	if err != nil {
+		return nil, err
+	}
+	signedAttrs.Class = asn1.ClassContextSpecific
+	signedAttrs.Tag = 0
+
+	digestAlg := cmsDigestAlgorithm(signer.alg.hash)
+	sd := cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		EncapContent:     cmsEncapContent{EContentType: contentType, EContent: eContent},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			Sid:                cmsIssuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, Serial: cert.SerialNumber},
+			DigestAlgorithm:    digestAlg,
+			SignedAttrs:        signedAttrs,
+			SignatureAlgorithm: signer.cmsSignatureAlgorithm(),
+			Signature:          signature,
+		}},
+	}
+	for _, item := range certs {
+		sd.Certificates = append(sd.Certificates, asn1.RawValue{FullBytes: item.Raw})
+	}
+	if !contentType.Equal(oidData) {
+		sd.Version = 3 // RFC 5652 5.1
+	}
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{ContentType: oidSignedData, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content}})
+}
+
+// parsed SignedData with one signer
+type cmsParsed struct {
+	signedData   cmsSignedData
+	signer       *cmsSignerInfo
+	certs        []*x509.Certificate
+	signerCert   *x509.Certificate
+	digestHash   crypto.Hash
+	contentType  asn1.ObjectIdentifier
+	digest       []byte
+	signingTime  time.Time
+	rawSignedSet []byte // signed attributes as SET, the signed data
+}
+
+func parseSignedData(der []byte) (*cmsParsed, error) {
+	var ci cmsContentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil || len(rest) != 0 || !ci.ContentType.Equal(oidSignedData) {
+		return nil, errCmsFormat
+	}
+	p := &cmsParsed{}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &p.signedData); err != nil {
+		return nil, err
+	}
+	if len(p.signedData.SignerInfos) != 1 {
+		return nil, errCmsFormat
+	}
+	p.signer = &p.signedData.SignerInfos[0]
+
+	for _, raw := range p.signedData.Certificates {
+		cert, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			continue // attribute certificates and so on
+		}
+		p.certs = append(p.certs, cert)
+	}
+	for _, cert := range p.certs {
+		if bytes.Equal(cert.RawIssuer, p.signer.Sid.Issuer.FullBytes) && cert.SerialNumber.Cmp(p.signer.Sid.Serial) == 0 {
+			p.signerCert = cert
+			break
+		}
+	}
+	if p.signerCert == nil {
+		return nil, errCmsSigner
+	}
+
+	var ok bool
+	if p.digestHash, ok = cmsDigestHash(p.signer.DigestAlgorithm); !ok {
+		return nil, errCmsFormat
+	}
+
+	// signed attributes are required here
+	attrs := p.signer.SignedAttrs
+	if attrs.Class != asn1.ClassContextSpecific || attrs.Tag != 0 || len(attrs.Bytes) == 0 {
+		return nil, errCmsFormat
+	}
+	set := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attrs.Bytes}
+	var err error
+	if p.rawSignedSet, err = asn1.Marshal(set); err != nil {
+		return nil, err
+	}
+	rest := p.signer.SignedAttrs.Bytes
+	for len(rest) > 0 {
+		var attr cmsAttribute
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, err
+		}
+		switch {
+		case attr.Type.Equal(oidAttrContentType):
+			_, err = asn1.Unmarshal(attr.Values.Bytes, &p.contentType)
+		case attr.Type.Equal(oidAttrMessageDigest):
+			_, err = asn1.Unmarshal(attr.Values.Bytes, &p.digest)
+		case attr.Type.Equal(oidAttrSigningTime):
+			_, err = asn1.Unmarshal(attr.Values.Bytes, &p.signingTime)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if p.digest == nil || !p.contentType.Equal(p.signedData.EncapContent.EContentType) {
+		return nil, errCmsFormat
+	}
+	return p, nil
+}
+
+// x509 algorithm to check the signer info signature
+func (p *cmsParsed) x509Algorithm() (x509.SignatureAlgorithm, bool) {
+	alg := p.signer.SignatureAlgorithm.Algorithm
+	switch {
+	case alg.Equal(oidRSA) || alg.Equal(oidSHA256WithRSA):
+		if p.digestHash == crypto.SHA384 {
+			return x509.SHA384WithRSA, true
+		}
+		return x509.SHA256WithRSA, true
+	case alg.Equal(oidRSAPSS):
+		if p.digestHash == crypto.SHA384 {
+			return x509.SHA384WithRSAPSS, true
+		}
+		return x509.SHA256WithRSAPSS, true
+	case alg.Equal(oidECDSAWithSHA256):
+		return x509.ECDSAWithSHA256, true
+	case alg.Equal(oidECDSAWithSHA384):
+		return x509.ECDSAWithSHA384, true
+	}
+	return 0, false
+}
+
+// verify the digest of content, signature and the signer certificate chain to roots
+func (p *cmsParsed) verify(contentDigest []byte, roots *x509.CertPool) error {
+	if !bytes.Equal(contentDigest, p.digest) {
+		return errCmsDigest
+	}
+	alg, ok := p.x509Algorithm()
+	if !ok {
+		return errCmsFormat
+	}
+	if err := p.signerCert.CheckSignature(alg, p.rawSignedSet, p.signer.Signature); err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range p.certs {
+		if cert != p.signerCert {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := p.signerCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// self-signed certificate of the parsec key for code signing or time stamping
+func selfSignedCert(signer *parsecSigner, commonName string, validity time.Duration, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    signer.x509Algorithm(),
+	}
+	if usage == x509.ExtKeyUsageTimeStamping {
+		// RFC 3161 2.3, only time stamping and critical
+		ext, err := asn1.Marshal([]asn1.ObjectIdentifier{oidTimeStamping})
+		if err != nil {
+			return nil, err
+		}
+		template.ExtKeyUsage = nil
+		template.ExtraExtensions = []pkix.Extension{{Id: oidExtKeyUsage, Critical: true, Value: ext}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// public key of certificate must be the parsec key
+func certMatchKey(cert *x509.Certificate, key crypto.PublicKey) bool {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return pub.Equal(key)
+	case *ecdsa.PublicKey:
+		return pub.Equal(key)
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func testFileSign(t *testing.T, keyName string, body io.Reader) []byte {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/file/sign?Name=CmsClient&KeyName="+keyName, body)
+	r.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	if w.Code != 200 || w.Header().Get("Content-Type") != cmsMediaType {
+		t.Fatalf("sign: status %d, %s", w.Code, w.Body.String())
+	}
+	return w.Body.Bytes()
+}
+
+func testFileCert(t *testing.T, keyName string) []byte {
+	t.Helper()
+	w := testApi(t, "GET", "/file/cert", &paramAll{Name: "CmsClient", KeyName: keyName})
+	if w.Code != 200 {
+		t.Fatalf("cert: status %d, %s", w.Code, w.Body.String())
+	}
+	return w.Body.Bytes()
+}
+
+// multipart upload of signature, trust and file, the file was streamed by a pipe
+func testFileVerify(t *testing.T, signature []byte, trust []byte, file func(io.Writer)) (*rtnCmsVerify, int32) {
+	t.Helper()
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, _ := mw.CreateFormFile("signature", "fw.p7s")
+		part.Write(signature)
+		part, _ = mw.CreateFormFile("trust", "ca.pem")
+		part.Write(trust)
+		part, _ = mw.CreateFormFile(cmsFilePartName, "fw.bin")
+		file(part)
+		pw.CloseWithError(mw.Close())
+	}()
+	r := httptest.NewRequest("POST", "/file/verify", pr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	if code := testCode(t, w); code != CODE_SUCCESS {
+		return nil, code
+	}
+	var rtn rtnCmsVerify
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil {
+		t.Fatal(err)
+	}
+	return &rtn, CODE_SUCCESS
+}
+
+func testParseCert(t *testing.T, data []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no PEM certificate in %q", data)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestApiFileSign(t *testing.T) {
+	testNewClient(t, "CmsClient")
+	for _, alg := range []string{JWS_RS256, JWS_PS256, JWS_ES256} {
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "CmsClient", KeyName: "CmsKey" + alg, Alg: alg}), CODE_SUCCESS)
+	}
+	content := []byte("firmware image")
+	digest := sha256.Sum256(content)
+
+	for _, alg := range []string{JWS_RS256, JWS_PS256, JWS_ES256} {
+		t.Run(alg, func(t *testing.T) {
+			keyName := "CmsKey" + alg
+			signature := testFileSign(t, keyName, bytes.NewReader(content))
+			trust := testFileCert(t, keyName)
+
+			// leaf for code signing only, not a CA
+			cert := testParseCert(t, trust)
+			if cert.IsCA || cert.KeyUsage != x509.KeyUsageDigitalSignature ||
+				len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageCodeSigning {
+				t.Fatalf("cert IsCA %v, KeyUsage %v, ExtKeyUsage %v", cert.IsCA, cert.KeyUsage, cert.ExtKeyUsage)
+			}
+
+			rtn, code := testFileVerify(t, signature, trust, func(w io.Writer) { w.Write(content) })
+			if code != CODE_SUCCESS || rtn.Digest != hex.EncodeToString(digest[:]) || rtn.Subject != cert.Subject.String() {
+				t.Fatalf("verify %+v, code %d", rtn, code)
+			}
+			if _, code := testFileVerify(t, signature, trust, func(w io.Writer) { w.Write([]byte("other image")) }); code != CODE_VERIFY_FAIL {
+				t.Fatalf("verify other content: code %d", code)
+			}
+		})
+	}
+
+	t.Run("Large", func(t *testing.T) {
+		// 32 MiB was never held as a whole, neither here nor by the handler
+		const size = 32 << 20
+		chunk := bytes.Repeat([]byte{0x5a}, 64<<10)
+		stream := func(w io.Writer) {
+			for n := 0; n < size; n += len(chunk) {
+				w.Write(chunk)
+			}
+		}
+		h := sha256.New()
+		stream(h)
+
+		pr, pw := io.Pipe()
+		go func() {
+			stream(pw)
+			pw.Close()
+		}()
+		signature := testFileSign(t, "CmsKey"+JWS_ES256, pr)
+		rtn, code := testFileVerify(t, signature, testFileCert(t, "CmsKey"+JWS_ES256), stream)
+		if code != CODE_SUCCESS || rtn.Digest != hex.EncodeToString(h.Sum(nil)) {
+			t.Fatalf("verify %+v, code %d", rtn, code)
+		}
+	})
+
+	t.Run("Untrusted", func(t *testing.T) {
+		signature := testFileSign(t, "CmsKey"+JWS_ES256, bytes.NewReader(content))
+		other := testFileCert(t, "CmsKey"+JWS_PS256)
+		if _, code := testFileVerify(t, signature, other, func(w io.Writer) { w.Write(content) }); code != CODE_VERIFY_FAIL {
+			t.Fatalf("verify by other trust: code %d", code)
+		}
+		if _, code := testFileVerify(t, signature, []byte("no certificate"), func(w io.Writer) { w.Write(content) }); code != CODE_INVALID_PARAM {
+			t.Fatalf("verify by empty trust: code %d", code)
+		}
+	})
+
+	t.Run("Openssl", func(t *testing.T) {
+		openssl, err := exec.LookPath("openssl")
+		if err != nil {
+			t.Skip("openssl not found")
+		}
+		dir := t.TempDir()
+		files := map[string][]byte{
+			"fw.bin":   content,
+			"fw.p7s":   testFileSign(t, "CmsKey"+JWS_RS256, bytes.NewReader(content)),
+			"cert.pem": testFileCert(t, "CmsKey"+JWS_RS256),
+		}
+		for name, data := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cmd := exec.Command(openssl, "cms", "-verify", "-binary", "-inform", "DER", "-in", "fw.p7s",
+			"-content", "fw.bin", "-CAfile", "cert.pem", "-purpose", "any", "-out", os.DevNull)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("openssl: %v\n%s", err, out)
+		}
+	})
+}
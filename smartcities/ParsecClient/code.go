@@ -7,4 +7,13 @@ const (
 	CODE_INVALID_CLIENT
 	CODE_INVALID_KEY
 	CODE_VERIFY_FAIL
+	CODE_NOT_ALLOWED
+	CODE_LIMIT_EXCEEDED
+	CODE_RATE_LIMITED
+	CODE_NOT_SUPPORTED
+	CODE_TOKEN_EXPIRED
+	CODE_TOKEN_NOT_ACTIVE
+	CODE_KEY_EXPIRED
+	CODE_KEY_PROTECTED
+	CODE_QUOTA_EXCEEDED
 )
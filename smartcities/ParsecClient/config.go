@@ -1,7 +1,18 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type CfgApp struct {
@@ -14,27 +25,595 @@ type CfgLog struct {
 	MaxSize    int
 	MaxAge     int
 	MaxBackups int
+	Audit      string // file of audit events, empty write them to the main log
+}
+
+type CfgAcl struct {
+	Clients []string // application names allowed to create a client, empty allow all
+}
+
+type CfgLimits struct {
+	MaxClients int // max cached parsec clients, 0 is unlimited
+}
+
+type CfgRotation struct {
+	Grace        time.Duration // retired key version still usable for verify and decrypt
+	ReapInterval time.Duration // check period to destroy retired key versions
+}
+
+type CfgBatch struct {
+	MaxOps   int // max ops in one batch request, 0 is unlimited
+	Parallel int // ops run at same time for one batch request
+}
+
+type CfgLimitRule struct {
+	Name        string  // application name, "*" match all
+	Op          string  // sign verify encrypt decrypt keygen import export delete keys rotate client selftest, "*" match all
+	Rate        float64 // ops per second, 0 is unlimited
+	Burst       int     // bucket size
+	MaxInFlight int     // ops running at same time, 0 is unlimited
+}
+
+type CfgRateLimit struct {
+	Rules []CfgLimitRule // first matched rule was used, put specific ones first
+}
+
+type CfgReconnect struct {
+	InitialBackoff time.Duration // wait before first retry, doubled every retry
+	MaxBackoff     time.Duration // max wait between retries
+	MaxRetries     int           // retries of an op which is safe to repeat, 0 is no retry
+	CheckInterval  time.Duration // period to ping the daemon when it was up
+}
+
+type CfgDaemon struct {
+	Name     string
+	Socket   string   // unix socket path, empty use PARSEC_SERVICE_ENDPOINT or /run/parsec/parsec.sock
+	Provider string   // mbed pkcs11 tpm trusted-service, default mbed
+	Apps     []string // application names always use it
+}
+
+type CfgBackend struct {
+	Type    string      // parsec or software, software keep keys in memory and is NOT secure
+	Default string      // daemon of /client without Backend, default the first one
+	Daemons []CfgDaemon // parsec daemons, empty use one daemon named "default"
+}
+
+type CfgSshAgent struct {
+	Socket string   // unix socket of ssh-agent protocol, empty disable it
+	Name   string   // application name whose keys were used
+	Keys   []string // key names listed as identities, empty list all signing keys
+}
+
+type CfgVaultToken struct {
+	Token string // X-Vault-Token of caller
+	Name  string // application name used for the token
+}
+
+type CfgVault struct {
+	Enabled bool            // serve vault transit compatible routes
+	Mount   string          // routes are under /v1/<mount>
+	Tokens  []CfgVaultToken // X-Vault-Token -> application name, required if enabled
+}
+
+type CfgJwksKey struct {
+	Name string // application name
+	Key  string // sign key name, all versions in grace period were published
+}
+
+type CfgJws struct {
+	Ttl    time.Duration // JWT lifetime when caller did not give ExpiresIn
+	Leeway time.Duration // clock skew allowed when check exp and nbf
+	Jwks   []CfgJwksKey  // keys published by /.well-known/jwks.json
+}
+
+type CfgCms struct {
+	CertDir  string        // signer certificates of /file/sign, one PEM per key version
+	Validity time.Duration // lifetime of self-signed certificates
+}
+
+type CfgMeta struct {
+	Path          string        // bolt file of key metadata, empty disable it
+	FlushInterval time.Duration // period to write last used time of keys
+	ReapInterval  time.Duration // period to destroy expired keys
+}
+
+type CfgTsa struct {
+	Name       string        // application name of the tsa key, empty disable /tsa
+	Key        string        // sign key name
+	Cert       string        // PEM certificate of the key, empty use a self-signed one
+	Policy     string        // default policy OID of tokens, required if name is set
+	Policies   []string      // more policy OIDs accepted in requests
+	Accuracy   time.Duration // accuracy of genTime, 0 omit it
+	SerialFile string        // last serial number, kept across restarts
+}
+
+type CfgDelete struct {
+	ConfirmTtl time.Duration // token of DELETE /keys was valid in it
+}
+
+type CfgJobs struct {
+	Retention       time.Duration // finished jobs were kept in it
+	Callbacks       []string      // url prefixes allowed as job callback, empty deny all
+	CallbackTimeout time.Duration
+}
+
+type CfgEvents struct {
+	Buffer         int           // last events kept for resume
+	VerifyFailures int           // verify_failed was sent after so many failures of a key, 0 disable it
+	VerifyWindow   time.Duration // failures were counted in it
+	Origins        []string      // Origin of browser pages allowed to open the websocket, "*" allow all, empty allow only non-browser clients
+}
+
+type CfgTenant struct {
+	Name     string
+	Apps     []string // application names, "prefix*" match prefix
+	MaxKeys  int      // keys of all its applications, 0 is unlimited
+	KeyBits  []int    // allowed key sizes, empty allow all
+	KeyTypes []string // allowed sign enc aead pub, empty allow all
+	Algs     []string // allowed algorithms of sign keys RS256 PS256 ES256 ES384, empty allow all
+}
+
+type CfgTenancy struct {
+	Strict   bool   // keys of applications not in any tenant were rejected
+	AppsFile string // applications of tenants with keys, counted by quota after restart
+}
+
+type CfgAttest struct {
+	KeyFile  string        // PEM EC key of simulated attestation, made if not exist, empty disable it
+	TrustKey string        // PEM public key trusted by verifier, empty use the key of keyFile
+	Provider string        // provider trusted by verifier, only simulated, empty accept all
+	NonceTtl time.Duration // nonce of prepare was valid in it
 }
 
 type AppConfig struct {
-	App CfgApp `mapstructure:"app"`
-	Log CfgLog `mapstructure:"log"`
+	App       CfgApp       `mapstructure:"app"`
+	Log       CfgLog       `mapstructure:"log"`
+	Acl       CfgAcl       `mapstructure:"acl"`
+	Limits    CfgLimits    `mapstructure:"limits"`
+	Rotation  CfgRotation  `mapstructure:"rotation"`
+	Batch     CfgBatch     `mapstructure:"batch"`
+	RateLimit CfgRateLimit `mapstructure:"ratelimit"`
+	Backend   CfgBackend   `mapstructure:"backend"`
+	Reconnect CfgReconnect `mapstructure:"reconnect"`
+	SshAgent  CfgSshAgent  `mapstructure:"sshagent"`
+	Vault     CfgVault     `mapstructure:"vault"`
+	Jws       CfgJws       `mapstructure:"jws"`
+	Cms       CfgCms       `mapstructure:"cms"`
+	Tsa       CfgTsa       `mapstructure:"tsa"`
+	Meta      CfgMeta      `mapstructure:"meta"`
+	Delete    CfgDelete    `mapstructure:"delete"`
+	Jobs      CfgJobs      `mapstructure:"jobs"`
+	Events    CfgEvents    `mapstructure:"events"`
+	Tenants   []CfgTenant  `mapstructure:"tenants"`
+	Tenancy   CfgTenancy   `mapstructure:"tenancy"`
+	Attest    CfgAttest    `mapstructure:"attest"`
 }
 
+// Conf was only safe to read directly at startup, use GetConf after that
 var Conf AppConfig
+var confLock sync.RWMutex
+
+// called after a reloaded config was applied
+var confReloadHooks []func(oldConf, newConf *AppConfig)
+
+// command line flags, parsed in main
+var flagConfig = pflag.StringP("config", "c", "", "path of ParsecClient.toml")
+
+func setConfigDefaults() {
+	viper.SetDefault("app.port", 8300)
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.filename", "ParsecClient.log")
+	viper.SetDefault("log.maxSize", 200)
+	viper.SetDefault("log.maxAge", 30)
+	viper.SetDefault("log.maxBackups", 5)
+	viper.SetDefault("log.audit", "ParsecClient.audit.log")
+	viper.SetDefault("acl.clients", []string{})
+	viper.SetDefault("limits.maxClients", 0)
+	viper.SetDefault("rotation.grace", "168h")
+	viper.SetDefault("rotation.reapInterval", "10m")
+	viper.SetDefault("batch.maxOps", 256)
+	viper.SetDefault("batch.parallel", 4)
+	viper.SetDefault("backend.type", BACKEND_PARSEC)
+	viper.SetDefault("backend.default", "")
+	viper.SetDefault("reconnect.initialBackoff", "100ms")
+	viper.SetDefault("reconnect.maxBackoff", "5s")
+	viper.SetDefault("reconnect.maxRetries", 3)
+	viper.SetDefault("reconnect.checkInterval", "10s")
+	viper.SetDefault("sshagent.socket", "")
+	viper.SetDefault("sshagent.name", "")
+	viper.SetDefault("sshagent.keys", []string{})
+	viper.SetDefault("vault.enabled", false)
+	viper.SetDefault("vault.mount", "transit")
+	viper.SetDefault("jws.ttl", "1h")
+	viper.SetDefault("jws.leeway", "60s")
+	viper.SetDefault("cms.certDir", "cms")
+	viper.SetDefault("cms.validity", "8760h")
+	viper.SetDefault("tsa.name", "")
+	viper.SetDefault("tsa.policy", "")
+	viper.SetDefault("tsa.policies", []string{})
+	viper.SetDefault("tsa.accuracy", "1s")
+	viper.SetDefault("tsa.serialFile", "tsa.serial")
+	viper.SetDefault("meta.path", "ParsecClient.db")
+	viper.SetDefault("meta.flushInterval", "30s")
+	viper.SetDefault("meta.reapInterval", "1m")
+	viper.SetDefault("delete.confirmTtl", "1m")
+	viper.SetDefault("jobs.retention", "24h")
+	viper.SetDefault("jobs.callbacks", []string{})
+	viper.SetDefault("jobs.callbackTimeout", "10s")
+	viper.SetDefault("events.buffer", 1000)
+	viper.SetDefault("events.verifyFailures", 5)
+	viper.SetDefault("events.verifyWindow", "1m")
+	viper.SetDefault("events.origins", []string{})
+	viper.SetDefault("tenancy.strict", false)
+	viper.SetDefault("tenancy.appsFile", "tenant.apps")
+	viper.SetDefault("attest.keyFile", "")
+	viper.SetDefault("attest.trustKey", "")
+	viper.SetDefault("attest.provider", "")
+	viper.SetDefault("attest.nonceTtl", "5m")
+}
 
-func InitConfig() {
-	viper.SetConfigName("ParsecClient") // config file name
-	viper.SetConfigType("toml")         // config file ext
-	viper.AddConfigPath(".")            // config file find path
-	viper.AddConfigPath("/etc")         // config file find path
-	err := viper.ReadInConfig()         // find and read config
+func InitConfig() error {
+	if len(*flagConfig) != 0 {
+		viper.SetConfigFile(*flagConfig) // config file given by --config
+	} else {
+		viper.SetConfigName("ParsecClient") // config file name
+		viper.AddConfigPath(".")            // config file find path
+		viper.AddConfigPath("/etc")         // config file find path
+	}
+	viper.SetConfigType("toml") // config file ext
+
+	// PARSECCLIENT_APP_PORT override app.port and so on
+	viper.SetEnvPrefix("PARSECCLIENT")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	setConfigDefaults()
+
+	err := viper.ReadInConfig() // find and read config
 	if err != nil {
-		panic(err)
+		// run with defaults and env only if no config file was found
+		var notFound viper.ConfigFileNotFoundError
+		if len(*flagConfig) != 0 || !errors.As(err, &notFound) {
+			return fmt.Errorf("read config: %v", err)
+		}
 	}
 
 	// parse config
-	if err := viper.Unmarshal(&Conf); err != nil {
-		panic(err)
+	var conf AppConfig
+	if err := viper.Unmarshal(&conf); err != nil {
+		return fmt.Errorf("parse config %s: %v", viper.ConfigFileUsed(), err)
+	}
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("invalid config %s: %v", viper.ConfigFileUsed(), err)
+	}
+	Conf = conf
+
+	return nil
+}
+
+// WatchConfig reload the config file when it was changed
+func WatchConfig() {
+	if len(viper.ConfigFileUsed()) == 0 {
+		return // running without config file
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		reloadConfig()
+	})
+	viper.WatchConfig()
+}
+
+// OnConfigReload register fn, it will be called with old and new config after a reload
+func OnConfigReload(fn func(oldConf, newConf *AppConfig)) {
+	confLock.Lock()
+	defer confLock.Unlock()
+	confReloadHooks = append(confReloadHooks, fn)
+}
+
+// GetConf return a copy of the current config
+func GetConf() AppConfig {
+	confLock.RLock()
+	defer confLock.RUnlock()
+	return Conf
+}
+
+func reloadConfig() {
+	var conf AppConfig
+	if err := viper.Unmarshal(&conf); err != nil {
+		zap.L().Error("Reload config fail, keep the old one", zap.Error(err))
+		return
+	}
+	if err := conf.Validate(); err != nil {
+		zap.L().Error("Reload config invalid, keep the old one", zap.Error(err))
+		return
+	}
+
+	confLock.Lock()
+	old := Conf
+	// these settings only take effect after restart
+	if conf.App.Port != old.App.Port {
+		zap.L().Warn("app.port changed, restart required", zap.Int("old", old.App.Port), zap.Int("new", conf.App.Port))
+		conf.App.Port = old.App.Port
+	}
+	if conf.Log.FileName != old.Log.FileName || conf.Log.MaxSize != old.Log.MaxSize ||
+		conf.Log.MaxAge != old.Log.MaxAge || conf.Log.MaxBackups != old.Log.MaxBackups ||
+		conf.Log.Audit != old.Log.Audit {
+		zap.L().Warn("log file settings changed, restart required")
+		conf.Log.FileName = old.Log.FileName
+		conf.Log.MaxSize = old.Log.MaxSize
+		conf.Log.MaxAge = old.Log.MaxAge
+		conf.Log.MaxBackups = old.Log.MaxBackups
+		conf.Log.Audit = old.Log.Audit
+	}
+	if conf.Backend.Type != old.Backend.Type {
+		zap.L().Warn("backend.type changed, restart required", zap.String("old", old.Backend.Type), zap.String("new", conf.Backend.Type))
+		conf.Backend.Type = old.Backend.Type
+	}
+	if fmt.Sprint(conf.Backend.Daemons) != fmt.Sprint(old.Backend.Daemons) || conf.Backend.Default != old.Backend.Default {
+		zap.L().Warn("backend.daemons or backend.default changed, restart required")
+		conf.Backend.Daemons = old.Backend.Daemons
+		conf.Backend.Default = old.Backend.Default
+	}
+	if conf.SshAgent.Socket != old.SshAgent.Socket || conf.SshAgent.Name != old.SshAgent.Name ||
+		strings.Join(conf.SshAgent.Keys, ",") != strings.Join(old.SshAgent.Keys, ",") {
+		zap.L().Warn("sshagent settings changed, restart required")
+		conf.SshAgent = old.SshAgent
+	}
+	if conf.Vault.Enabled != old.Vault.Enabled || conf.Vault.Mount != old.Vault.Mount {
+		zap.L().Warn("vault.enabled or vault.mount changed, restart required")
+		conf.Vault.Enabled = old.Vault.Enabled
+		conf.Vault.Mount = old.Vault.Mount
+	}
+	if conf.Tsa.SerialFile != old.Tsa.SerialFile {
+		zap.L().Warn("tsa.serialFile changed, restart required")
+		conf.Tsa.SerialFile = old.Tsa.SerialFile
+	}
+	if conf.Attest.KeyFile != old.Attest.KeyFile {
+		zap.L().Warn("attest.keyFile changed, restart required")
+		conf.Attest.KeyFile = old.Attest.KeyFile
+	}
+	if conf.Meta != old.Meta {
+		zap.L().Warn("meta settings changed, restart required")
+		conf.Meta = old.Meta
+	}
+	Conf = conf
+	hooks := confReloadHooks
+	confLock.Unlock()
+
+	for _, fn := range hooks {
+		fn(&old, &conf)
+	}
+	zap.L().Info("Config reloaded", zap.String("file", viper.ConfigFileUsed()))
+}
+
+// Validate check all config values, return the first invalid one
+func (conf *AppConfig) Validate() error {
+	if conf.App.Port <= 0 || conf.App.Port > 65535 {
+		return fmt.Errorf("app.port %d out of range 1-65535", conf.App.Port)
+	}
+
+	var lv zapcore.Level
+	if lv.UnmarshalText([]byte(conf.Log.Level)) != nil {
+		return fmt.Errorf("log.level %q unknown, use debug info warn error dpanic panic fatal", conf.Log.Level)
+	}
+	if len(conf.Log.FileName) == 0 {
+		return fmt.Errorf("log.filename is empty")
+	}
+	if conf.Log.MaxSize < 0 || conf.Log.MaxAge < 0 || conf.Log.MaxBackups < 0 {
+		return fmt.Errorf("log.maxSize, log.maxAge and log.maxBackups can not be negative")
+	}
+
+	for _, name := range conf.Acl.Clients {
+		if len(name) == 0 {
+			return fmt.Errorf("acl.clients has empty name")
+		}
+	}
+
+	if conf.Limits.MaxClients < 0 {
+		return fmt.Errorf("limits.maxClients %d can not be negative", conf.Limits.MaxClients)
+	}
+
+	if conf.Rotation.Grace < 0 {
+		return fmt.Errorf("rotation.grace %v can not be negative", conf.Rotation.Grace)
+	}
+	if conf.Rotation.ReapInterval <= 0 {
+		return fmt.Errorf("rotation.reapInterval %v must be positive", conf.Rotation.ReapInterval)
+	}
+
+	if conf.Batch.MaxOps < 0 {
+		return fmt.Errorf("batch.maxOps %d can not be negative", conf.Batch.MaxOps)
+	}
+	if conf.Batch.Parallel <= 0 {
+		return fmt.Errorf("batch.parallel %d must be positive", conf.Batch.Parallel)
+	}
+
+	if conf.Backend.Type != BACKEND_PARSEC && conf.Backend.Type != BACKEND_SOFTWARE {
+		return fmt.Errorf("backend.type %q unknown, use parsec or software", conf.Backend.Type)
+	}
+	daemonNames := map[string]bool{}
+	daemonApps := map[string]string{}
+	for i, d := range conf.Backend.Daemons {
+		if len(d.Name) == 0 {
+			return fmt.Errorf("backend.daemons[%d] need name", i)
+		}
+		if daemonNames[d.Name] {
+			return fmt.Errorf("backend.daemons[%d] name %q duplicated", i, d.Name)
+		}
+		daemonNames[d.Name] = true
+		if _, ok := daemonProviders[d.Provider]; !ok && len(d.Provider) != 0 {
+			return fmt.Errorf("backend.daemons[%d] provider %q unknown, use mbed pkcs11 tpm trusted-service", i, d.Provider)
+		}
+		for _, app := range d.Apps {
+			if other, ok := daemonApps[app]; ok {
+				return fmt.Errorf("backend.daemons[%d] app %q was also in %q", i, app, other)
+			}
+			daemonApps[app] = d.Name
+		}
+	}
+	if len(conf.Backend.Default) != 0 && !daemonNames[conf.Backend.Default] &&
+		!(len(conf.Backend.Daemons) == 0 && conf.Backend.Default == DEFAULT_DAEMON) {
+		return fmt.Errorf("backend.default %q is not in backend.daemons", conf.Backend.Default)
+	}
+
+	if conf.Reconnect.InitialBackoff <= 0 || conf.Reconnect.MaxBackoff < conf.Reconnect.InitialBackoff {
+		return fmt.Errorf("reconnect.initialBackoff must be positive and not more than reconnect.maxBackoff")
+	}
+	if conf.Reconnect.MaxRetries < 0 {
+		return fmt.Errorf("reconnect.maxRetries %d can not be negative", conf.Reconnect.MaxRetries)
+	}
+	if conf.Reconnect.CheckInterval <= 0 {
+		return fmt.Errorf("reconnect.checkInterval %v must be positive", conf.Reconnect.CheckInterval)
+	}
+
+	if len(conf.SshAgent.Socket) != 0 && len(conf.SshAgent.Name) == 0 {
+		return fmt.Errorf("sshagent.name is empty, need the application name whose keys were used")
+	}
+
+	if conf.Vault.Enabled && len(strings.Trim(conf.Vault.Mount, "/")) == 0 {
+		return fmt.Errorf("vault.mount is empty")
+	}
+	if conf.Vault.Enabled && len(conf.Vault.Tokens) == 0 {
+		return fmt.Errorf("vault.tokens is empty, any token would be accepted")
+	}
+	for i, token := range conf.Vault.Tokens {
+		if len(token.Token) == 0 || len(token.Name) == 0 {
+			return fmt.Errorf("vault.tokens[%d] need token and name", i)
+		}
+	}
+
+	if conf.Jws.Ttl <= 0 {
+		return fmt.Errorf("jws.ttl %v must be positive", conf.Jws.Ttl)
+	}
+	if conf.Jws.Leeway < 0 {
+		return fmt.Errorf("jws.leeway %v can not be negative", conf.Jws.Leeway)
+	}
+	for i, item := range conf.Jws.Jwks {
+		if len(item.Name) == 0 || len(item.Key) == 0 {
+			return fmt.Errorf("jws.jwks[%d] need name and key", i)
+		}
+	}
+
+	if len(conf.Cms.CertDir) == 0 {
+		return fmt.Errorf("cms.certDir is empty")
+	}
+	if conf.Cms.Validity <= 0 {
+		return fmt.Errorf("cms.validity %v must be positive", conf.Cms.Validity)
+	}
+
+	if len(conf.Tsa.Name) != 0 && len(conf.Tsa.Key) == 0 {
+		return fmt.Errorf("tsa.key is empty, need the sign key of tsa.name")
+	}
+	// no made up default, the policy is the one of the tsa practice statement
+	if len(conf.Tsa.Name) != 0 && len(conf.Tsa.Policy) == 0 {
+		return fmt.Errorf("tsa.policy is empty, need the policy OID of the tsa")
+	}
+	policies := conf.Tsa.Policies
+	if len(conf.Tsa.Policy) != 0 {
+		policies = append([]string{conf.Tsa.Policy}, policies...)
+	}
+	for _, policy := range policies {
+		if _, ok := parseOid(policy); !ok {
+			return fmt.Errorf("tsa policy %q is not a dotted OID", policy)
+		}
+	}
+	if conf.Tsa.Accuracy < 0 {
+		return fmt.Errorf("tsa.accuracy %v can not be negative", conf.Tsa.Accuracy)
+	}
+	if len(conf.Tsa.SerialFile) == 0 {
+		return fmt.Errorf("tsa.serialFile is empty")
+	}
+
+	if conf.Meta.FlushInterval <= 0 {
+		return fmt.Errorf("meta.flushInterval %v must be positive", conf.Meta.FlushInterval)
+	}
+	if conf.Meta.ReapInterval <= 0 {
+		return fmt.Errorf("meta.reapInterval %v must be positive", conf.Meta.ReapInterval)
+	}
+	if conf.Delete.ConfirmTtl <= 0 {
+		return fmt.Errorf("delete.confirmTtl %v must be positive", conf.Delete.ConfirmTtl)
+	}
+	if conf.Jobs.Retention <= 0 {
+		return fmt.Errorf("jobs.retention %v must be positive", conf.Jobs.Retention)
+	}
+	for _, prefix := range conf.Jobs.Callbacks {
+		// "http://host" would match "http://host.evil.com", the prefix must have a path
+		scheme := strings.Index(prefix, "://")
+		if !strings.HasPrefix(prefix, "http://") && !strings.HasPrefix(prefix, "https://") || !strings.Contains(prefix[scheme+3:], "/") {
+			return fmt.Errorf("jobs.callbacks %q must be a http or https url with path like \"http://host:8080/\"", prefix)
+		}
+	}
+	if conf.Jobs.CallbackTimeout <= 0 {
+		return fmt.Errorf("jobs.callbackTimeout %v must be positive", conf.Jobs.CallbackTimeout)
+	}
+	if conf.Events.Buffer <= 0 {
+		return fmt.Errorf("events.buffer %d must be positive", conf.Events.Buffer)
+	}
+	if conf.Events.VerifyFailures < 0 {
+		return fmt.Errorf("events.verifyFailures %d can not be negative", conf.Events.VerifyFailures)
+	}
+	if conf.Events.VerifyWindow <= 0 {
+		return fmt.Errorf("events.verifyWindow %v must be positive", conf.Events.VerifyWindow)
+	}
+	for _, origin := range conf.Events.Origins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 || len(u.Path) != 0) {
+			return fmt.Errorf("events.origins %q must be \"*\" or like \"https://host:8443\"", origin)
+		}
+	}
+	if p := conf.Attest.Provider; len(p) != 0 && p != ATTEST_PROVIDER_SIMULATED {
+		return fmt.Errorf("attest.provider %q was never attested, only %s", p, ATTEST_PROVIDER_SIMULATED)
+	}
+	if conf.Attest.NonceTtl <= 0 {
+		return fmt.Errorf("attest.nonceTtl %v must be positive", conf.Attest.NonceTtl)
+	}
+	if conf.Tenancy.Strict && len(conf.Tenants) == 0 {
+		return fmt.Errorf("tenancy.strict need tenants")
+	}
+	tenantNames := map[string]bool{}
+	for i, t := range conf.Tenants {
+		if len(t.Name) == 0 || len(t.Apps) == 0 {
+			return fmt.Errorf("tenants[%d] need name and apps", i)
+		}
+		if tenantNames[t.Name] {
+			return fmt.Errorf("tenants[%d] name %q duplicated", i, t.Name)
+		}
+		tenantNames[t.Name] = true
+		if t.MaxKeys < 0 {
+			return fmt.Errorf("tenants[%d] maxKeys %d can not be negative", i, t.MaxKeys)
+		}
+		for _, keyType := range t.KeyTypes {
+			if keyType != KEY_TYPE_SIGN && keyType != KEY_TYPE_ENC && keyType != KEY_TYPE_AEAD && keyType != KEY_TYPE_PUB {
+				return fmt.Errorf("tenants[%d] keyType %q unknown, use sign enc aead pub", i, keyType)
+			}
+		}
+		for _, alg := range t.Algs {
+			if _, ok := jwsAlgs[alg]; !ok {
+				return fmt.Errorf("tenants[%d] alg %q unknown, use RS256 PS256 ES256 ES384", i, alg)
+			}
+		}
+	}
+
+	for i, rule := range conf.RateLimit.Rules {
+		if len(rule.Name) == 0 || len(rule.Op) == 0 {
+			return fmt.Errorf("ratelimit.rules[%d] need name and op", i)
+		}
+		if rule.Rate < 0 || rule.MaxInFlight < 0 {
+			return fmt.Errorf("ratelimit.rules[%d] rate and maxInFlight can not be negative", i)
+		}
+		if rule.Rate > 0 && rule.Burst < 1 {
+			return fmt.Errorf("ratelimit.rules[%d] burst must be at least 1 when rate was set", i)
+		}
+	}
+
+	return nil
+}
+
+// IsClientAllowed check if the application name can create a client
+func (acl *CfgAcl) IsClientAllowed(name string) bool {
+	if len(acl.Clients) == 0 {
+		return true
+	}
+	for _, allowed := range acl.Clients {
+		if allowed == name {
+			return true
+		}
 	}
+	return false
 }
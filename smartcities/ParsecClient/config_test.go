@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// read config from a temp file by --config, the config of runTests was back by cleanup
+func testInitConfig(t *testing.T, config string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ParsecClient.toml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := *flagConfig
+	*flagConfig = path
+	t.Cleanup(func() {
+		*flagConfig = oldPath
+		if err := InitConfig(); err != nil {
+			t.Fatal(err)
+		}
+		reloadConfig() // hooks take the old config again
+	})
+	return InitConfig()
+}
+
+// config of runTests with more sections
+func testConfigWith(sections string) string {
+	return sections + testConfig
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(conf *AppConfig)
+		err    string
+	}{
+		{"Valid", func(conf *AppConfig) {}, ""},
+		{"Port", func(conf *AppConfig) { conf.App.Port = 70000 }, "app.port"},
+		{"LogLevel", func(conf *AppConfig) { conf.Log.Level = "verbose" }, "log.level"},
+		{"LogFile", func(conf *AppConfig) { conf.Log.FileName = "" }, "log.filename"},
+		{"AclEmpty", func(conf *AppConfig) { conf.Acl.Clients = []string{""} }, "acl.clients"},
+		{"BatchParallel", func(conf *AppConfig) { conf.Batch.Parallel = 0 }, "batch.parallel"},
+		{"BackendType", func(conf *AppConfig) { conf.Backend.Type = "hsm" }, "backend.type"},
+		{"DaemonDuplicated", func(conf *AppConfig) {
+			conf.Backend.Daemons = []CfgDaemon{{Name: "a"}, {Name: "a"}}
+		}, "duplicated"},
+		{"DaemonApp", func(conf *AppConfig) {
+			conf.Backend.Daemons = []CfgDaemon{{Name: "a", Apps: []string{"App"}}, {Name: "b", Apps: []string{"App"}}}
+		}, "was also in"},
+		{"DefaultDaemon", func(conf *AppConfig) { conf.Backend.Default = "missing" }, "backend.default"},
+		{"Backoff", func(conf *AppConfig) { conf.Reconnect.MaxBackoff = conf.Reconnect.InitialBackoff / 2 }, "reconnect.initialBackoff"},
+		{"SshAgentName", func(conf *AppConfig) { conf.SshAgent.Socket = "agent.sock"; conf.SshAgent.Name = "" }, "sshagent.name"},
+		{"VaultTokens", func(conf *AppConfig) { conf.Vault.Tokens = nil }, "vault.tokens"},
+		{"TsaPolicy", func(conf *AppConfig) { conf.Tsa.Name = "tsa"; conf.Tsa.Key = "TsaKey"; conf.Tsa.Policy = "" }, "tsa.policy"},
+		{"TsaOid", func(conf *AppConfig) { conf.Tsa.Policies = []string{"policy"} }, "dotted OID"},
+		{"JobsCallback", func(conf *AppConfig) { conf.Jobs.Callbacks = []string{"http://host"} }, "jobs.callbacks"},
+		{"EventsOrigin", func(conf *AppConfig) { conf.Events.Origins = []string{"https://dash/app"} }, "events.origins"},
+		{"EventsOriginAny", func(conf *AppConfig) { conf.Events.Origins = []string{"*", "https://dash:8443"} }, ""},
+		{"TenantKeyType", func(conf *AppConfig) {
+			conf.Tenants = []CfgTenant{{Name: "team", Apps: []string{"App"}, KeyTypes: []string{"hmac"}}}
+		}, "keyType"},
+		{"RuleBurst", func(conf *AppConfig) { conf.RateLimit.Rules = []CfgLimitRule{{Name: "*", Op: "sign", Rate: 1}} }, "burst"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := GetConf()
+			tt.modify(&conf)
+			err := conf.Validate()
+			if len(tt.err) == 0 && err != nil {
+				t.Fatalf("error %v", err)
+			}
+			if len(tt.err) != 0 && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// PARSECCLIENT_* env override the config file and the defaults
+func TestConfigEnv(t *testing.T) {
+	os.Setenv("PARSECCLIENT_APP_PORT", "9200")
+	os.Setenv("PARSECCLIENT_BATCH_MAXOPS", "9")
+	if err := testInitConfig(t, testConfigWith("[app]\nport = 9100\n")); err != nil {
+		t.Fatal(err)
+	}
+	// registered after the cleanup of testInitConfig, so run before it
+	t.Cleanup(func() {
+		os.Unsetenv("PARSECCLIENT_APP_PORT")
+		os.Unsetenv("PARSECCLIENT_BATCH_MAXOPS")
+	})
+
+	conf := GetConf()
+	if conf.App.Port != 9200 || conf.Batch.MaxOps != 9 {
+		t.Fatalf("app.port %d, batch.maxOps %d, want env 9200 and 9", conf.App.Port, conf.Batch.MaxOps)
+	}
+	if conf.Log.Level != "debug" {
+		t.Fatalf("log.level %q of the config file was lost", conf.Log.Level)
+	}
+}
+
+func TestConfigFlag(t *testing.T) {
+	if err := testInitConfig(t, testConfigWith("[app]\nport = 9100\n")); err != nil {
+		t.Fatal(err)
+	}
+	if port := GetConf().App.Port; port != 9100 {
+		t.Fatalf("app.port %d of --config, want 9100", port)
+	}
+
+	// a given --config must exist, no fallback to defaults
+	oldPath := *flagConfig
+	*flagConfig = filepath.Join(t.TempDir(), "missing.toml")
+	err := InitConfig()
+	*flagConfig = oldPath
+	if err == nil || !strings.Contains(err.Error(), "read config") {
+		t.Fatalf("missing --config: error %v", err)
+	}
+
+	old := GetConf()
+	if err := testInitConfig(t, testConfigWith("[app]\nport = 0\n")); err == nil || !strings.Contains(err.Error(), "invalid config") {
+		t.Fatalf("invalid --config: error %v", err)
+	}
+	if GetConf().App.Port != old.App.Port {
+		t.Fatalf("invalid config was taken")
+	}
+}
+
+// settings only taking effect after restart are kept by a reload, the others are changed
+func TestReloadConfig(t *testing.T) {
+	if err := testInitConfig(t, testConfigWith("")); err != nil {
+		t.Fatal(err)
+	}
+	old := GetConf()
+
+	var hookOld, hookNew AppConfig
+	OnConfigReload(func(oldConf, newConf *AppConfig) {
+		hookOld, hookNew = *oldConf, *newConf
+	})
+	t.Cleanup(func() {
+		confLock.Lock()
+		confReloadHooks = confReloadHooks[:len(confReloadHooks)-1]
+		confLock.Unlock()
+	})
+
+	changed := testConfigWith(`
+[app]
+port = 9100
+
+[tsa]
+serialFile = "other.serial"
+
+[batch]
+maxOps = 7
+
+[jws]
+ttl = "2h"
+`)
+	if err := os.WriteFile(*flagConfig, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+
+	conf := GetConf()
+	if conf.App.Port != old.App.Port || conf.Tsa.SerialFile != old.Tsa.SerialFile {
+		t.Fatalf("app.port %d, tsa.serialFile %q changed without restart", conf.App.Port, conf.Tsa.SerialFile)
+	}
+	if conf.Batch.MaxOps != 7 || conf.Jws.Ttl != 2*time.Hour {
+		t.Fatalf("batch.maxOps %d, jws.ttl %v not reloaded", conf.Batch.MaxOps, conf.Jws.Ttl)
+	}
+	if hookOld.Batch.MaxOps != old.Batch.MaxOps || hookNew.Batch.MaxOps != 7 || hookNew.App.Port != old.App.Port {
+		t.Fatalf("hook got old %d new %d", hookOld.Batch.MaxOps, hookNew.Batch.MaxOps)
+	}
+
+	// an invalid file keep the config
+	if err := os.WriteFile(*flagConfig, []byte(testConfigWith("[batch]\nparallel = 0\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+	if conf := GetConf(); conf.Batch.Parallel != old.Batch.Parallel || conf.Batch.MaxOps != 7 {
+		t.Fatalf("invalid reload was taken, batch %+v", conf.Batch)
+	}
+}
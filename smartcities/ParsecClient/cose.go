@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/ugorji/go/codec"
+	"go.uber.org/zap"
+)
+
+// COSE_Sign1 of RFC 9052 signed by parsec ecdsa and rsa pss keys.
+// protected header has alg and kid, kid is the same as JWS "<key name>@v<version>".
+// sign return base64 of tagged COSE_Sign1, or the binary with Accept: application/cose.
+
+const (
+	COSE_ALG_ES256 = -7
+	COSE_ALG_ES384 = -35
+	COSE_ALG_PS256 = -37
+)
+
+const (
+	coseHeaderAlg = 1
+	coseHeaderKid = 4
+	coseSign1Tag  = 18
+	coseMediaType = `application/cose; cose-type="cose-sign1"`
+)
+
+// jws alg name -> cose alg id, rsa pkcs1 v1.5 was not allowed for COSE_Sign1
+var coseAlgs = map[string]int64{
+	JWS_ES256: COSE_ALG_ES256,
+	JWS_ES384: COSE_ALG_ES384,
+	JWS_PS256: COSE_ALG_PS256,
+}
+
+var errCoseFormat = errors.New("invalid COSE_Sign1")
+
+var coseHandle = &codec.CborHandle{}
+
+type coseSign1 struct {
+	_struct     bool `codec:",toarray"`
+	Protected   []byte
+	Unprotected map[interface{}]interface{}
+	Payload     *[]byte // nil if detached, an embedded empty payload is not nil
+	Signature   []byte
+}
+
+type paramCoseSign struct {
+	Name     string
+	KeyName  string
+	Alg      string // ES256 ES384 PS256, default the alg of the key
+	Payload  string // base64
+	Aad      string // base64 external additional data, optional
+	Detached bool   // payload was not put in the message
+}
+
+type paramCoseVerify struct {
+	Name    string
+	KeyName string // optional, message must be signed by this key
+	Message string // base64 COSE_Sign1, tagged or not
+	Payload string // base64, only if detached
+	Aad     string // base64 external additional data, optional
+}
+
+type rtnCose struct {
+	Alg     string
+	Kid     string
+	Payload string // base64
+}
+
+func init() {
+	coseHandle.Canonical = true
+}
+
+// Sig_structure = ["Signature1", protected, external_aad, payload]
+func coseToBeSigned(protected []byte, aad []byte, payload []byte) ([]byte, error) {
+	if aad == nil {
+		aad = []byte{}
+	}
+	if payload == nil {
+		payload = []byte{}
+	}
+	var data []byte
+	err := codec.NewEncoderBytes(&data, coseHandle).Encode([]interface{}{"Signature1", protected, aad, payload})
+	return data, err
+}
+
+func decodeBase64Param(str string) ([]byte, bool) {
+	if len(str) == 0 {
+		return nil, true
+	}
+	data, err := base64.StdEncoding.DecodeString(str)
+	return data, err == nil
+}
+
+// alg and kid from protected header, kid may also be unprotected
+func coseHeaders(msg *coseSign1) (string, string, error) {
+	var protected map[int64]interface{}
+	if len(msg.Protected) == 0 {
+		return "", "", errCoseFormat
+	}
+	if err := codec.NewDecoderBytes(msg.Protected, coseHandle).Decode(&protected); err != nil {
+		return "", "", err
+	}
+
+	var algName string
+	if id, ok := protected[coseHeaderAlg].(int64); ok {
+		for name, algID := range coseAlgs {
+			if algID == id {
+				algName = name
+			}
+		}
+	}
+	if len(algName) == 0 {
+		return "", "", errCoseFormat
+	}
+
+	kid, ok := protected[coseHeaderKid].([]byte)
+	if !ok {
+		for label, value := range msg.Unprotected {
+			if n, isInt := label.(uint64); isInt && n == coseHeaderKid {
+				kid, ok = value.([]byte)
+			}
+		}
+	}
+	if !ok {
+		return "", "", errCoseFormat
+	}
+	return algName, string(kid), nil
+}
+
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyEcKey", "Payload": "SGVsbG8gV29ybGQ="}' 127.0.0.1:8300/cose/sign
+// curl -v -H 'Accept: application/cose' -d '{"Name": "GoClient", "KeyName": "MyEcKey", "Payload": "SGVsbG8gV29ybGQ=", "Detached": true}' 127.0.0.1:8300/cose/sign
+func ApiCoseSign(c *gin.Context) {
+	var data, _ = c.GetRawData()
+	var param paramCoseSign
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Name) == 0 || len(param.KeyName) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	payload, ok := decodeBase64Param(param.Payload)
+	aad, ok2 := decodeBase64Param(param.Aad)
+	if !ok || !ok2 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	if _, ok := coseAlgs[param.Alg]; !ok && len(param.Alg) != 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// get client
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_SIGN)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaSignHash) {
+		return
+	}
+
+	keyName, algName, code := signKeyAlg(param.Name, client, param.KeyName, param.Alg)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	algID, ok := coseAlgs[algName]
+	if !ok {
+		responseError(c, CODE_INVALID_KEY) // RS256 key
+		return
+	}
+	alg := jwsAlgs[algName]
+
+	var protected []byte
+	err := codec.NewEncoderBytes(&protected, coseHandle).Encode(map[int64]interface{}{
+		coseHeaderAlg: algID,
+		coseHeaderKid: []byte(jwsKid(keyName)),
+	})
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	toBeSigned, err := coseToBeSigned(protected, aad, payload)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// parsec ecdsa signature is r || s, the same as COSE
+	signature, err := client.PsaSignHash(keyName, jwsDigest(alg, toBeSigned), alg.signAlg())
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	msg := coseSign1{
+		Protected:   protected,
+		Unprotected: map[interface{}]interface{}{},
+		Signature:   signature,
+	}
+	if !param.Detached {
+		if payload == nil {
+			payload = []byte{} // empty bstr, nil is null of detached
+		}
+		msg.Payload = &payload
+	}
+	var out []byte
+	if err := codec.NewEncoderBytes(&out, coseHandle).Encode(&codec.RawExt{Tag: coseSign1Tag, Value: &msg}); err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	setKeyVersionHeader(c, keyName)
+	accept := c.GetHeader("Accept")
+	if strings.Contains(accept, "application/cose") || strings.Contains(accept, "application/cbor") {
+		c.Data(http.StatusOK, coseMediaType, out)
+		return
+	}
+	c.String(http.StatusOK, base64.StdEncoding.EncodeToString(out))
+}
+
+// curl -v -d '{"Name": "GoClient", "Message": "0oRD..."}' 127.0.0.1:8300/cose/verify
+// curl -v -d '{"Name": "GoClient", "Message": "0oRD...", "Payload": "SGVsbG8gV29ybGQ="}' 127.0.0.1:8300/cose/verify
+func ApiCoseVerify(c *gin.Context) {
+	var data, _ = c.GetRawData()
+	var param paramCoseVerify
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Name) == 0 || len(param.Message) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	raw, ok := decodeBase64Param(param.Message)
+	detached, ok2 := decodeBase64Param(param.Payload)
+	aad, ok3 := decodeBase64Param(param.Aad)
+	if !ok || !ok2 || !ok3 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// strip tag 18 of COSE_Sign1_Tagged
+	if len(raw) > 0 && raw[0] == 0xc0|coseSign1Tag {
+		raw = raw[1:]
+	}
+	var msg coseSign1
+	if err := codec.NewDecoderBytes(raw, coseHandle).Decode(&msg); err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	algName, kid, err := coseHeaders(&msg)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_VERIFY_FAIL)
+		return
+	}
+	// payload embedded or given by caller, never both so the returned one is the signed one
+	payload := detached
+	if msg.Payload != nil {
+		if len(param.Payload) != 0 {
+			responseError(c, CODE_INVALID_PARAM)
+			return
+		}
+		payload = *msg.Payload
+	}
+	baseName, hint, ok := parseJwsKid(kid)
+	if !ok || (len(param.KeyName) != 0 && param.KeyName != baseName) {
+		responseError(c, CODE_INVALID_KEY)
+		return
+	}
+
+	// get client
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_VERIFY)
+	if !ok {
+		return
+	}
+	defer release()
+
+	toBeSigned, err := coseToBeSigned(msg.Protected, aad, payload)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	alg := jwsAlgs[algName]
+	keyName, code := verifyByKid(param.Name, client, baseName, hint, alg, jwsDigest(alg, toBeSigned), msg.Signature)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+
+	setKeyVersionHeader(c, keyName)
+	c.JSON(http.StatusOK, &rtnCose{
+		Alg:     algName,
+		Kid:     kid,
+		Payload: base64.StdEncoding.EncodeToString(payload),
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func testCoseSign(t *testing.T, param *paramCoseSign) string {
+	t.Helper()
+	w := testApi(t, "POST", "/cose/sign", param)
+	testExpect(t, w, CODE_SUCCESS)
+	return w.Body.String()
+}
+
+func testCoseVerify(t *testing.T, param *paramCoseVerify) (*rtnCose, int32) {
+	t.Helper()
+	w := testApi(t, "POST", "/cose/verify", param)
+	if code := testCode(t, w); code != CODE_SUCCESS {
+		return nil, code
+	}
+	var rtn rtnCose
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil {
+		t.Fatal(err)
+	}
+	return &rtn, CODE_SUCCESS
+}
+
+// decode base64 of tagged COSE_Sign1
+func testCoseDecode(t *testing.T, message string) *coseSign1 {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(message)
+	if err != nil || len(raw) == 0 || raw[0] != 0xc0|coseSign1Tag {
+		t.Fatalf("message %q is not tagged COSE_Sign1", message)
+	}
+	var msg coseSign1
+	if err := codec.NewDecoderBytes(raw[1:], coseHandle).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func testCoseEncode(t *testing.T, msg *coseSign1) string {
+	t.Helper()
+	var out []byte
+	if err := codec.NewEncoderBytes(&out, coseHandle).Encode(&codec.RawExt{Tag: coseSign1Tag, Value: msg}); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(out)
+}
+
+func TestApiCose(t *testing.T) {
+	testNewClient(t, "CoseClient")
+	for _, alg := range []string{JWS_ES256, JWS_ES384, JWS_PS256, JWS_RS256} {
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "CoseClient", KeyName: "CoseKey" + alg, Alg: alg}), CODE_SUCCESS)
+	}
+	payload := base64.StdEncoding.EncodeToString([]byte("Hello World"))
+	aad := base64.StdEncoding.EncodeToString([]byte("context"))
+
+	for _, alg := range []string{JWS_ES256, JWS_ES384, JWS_PS256} {
+		t.Run(alg, func(t *testing.T) {
+			keyName := "CoseKey" + alg
+			message := testCoseSign(t, &paramCoseSign{Name: "CoseClient", KeyName: keyName, Payload: payload})
+			rtn, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message})
+			if code != CODE_SUCCESS || rtn.Alg != alg || rtn.Kid != keyName+"@v0" || rtn.Payload != payload {
+				t.Fatalf("verify %+v, code %d", rtn, code)
+			}
+
+			// external aad must be the same
+			message = testCoseSign(t, &paramCoseSign{Name: "CoseClient", KeyName: keyName, Payload: payload, Aad: aad})
+			if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message, Aad: aad}); code != CODE_SUCCESS {
+				t.Fatalf("verify with aad: code %d", code)
+			}
+			if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message}); code != CODE_VERIFY_FAIL {
+				t.Fatalf("verify without aad: code %d", code)
+			}
+
+			msg := testCoseDecode(t, message)
+			msg.Signature[len(msg.Signature)-1] ^= 1
+			if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: testCoseEncode(t, msg), Aad: aad}); code != CODE_VERIFY_FAIL {
+				t.Fatalf("tampered signature: code %d", code)
+			}
+		})
+	}
+
+	t.Run("Detached", func(t *testing.T) {
+		message := testCoseSign(t, &paramCoseSign{Name: "CoseClient", KeyName: "CoseKeyES256", Payload: payload, Detached: true})
+		if msg := testCoseDecode(t, message); msg.Payload != nil {
+			t.Fatalf("detached payload %q was embedded", *msg.Payload)
+		}
+		rtn, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message, Payload: payload})
+		if code != CODE_SUCCESS || rtn.Payload != payload {
+			t.Fatalf("verify %+v, code %d", rtn, code)
+		}
+		other := base64.StdEncoding.EncodeToString([]byte("Hello World!"))
+		if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message, Payload: other}); code != CODE_VERIFY_FAIL {
+			t.Fatalf("other payload: code %d", code)
+		}
+	})
+
+	// an embedded empty payload is not a detached one
+	t.Run("EmptyPayload", func(t *testing.T) {
+		message := testCoseSign(t, &paramCoseSign{Name: "CoseClient", KeyName: "CoseKeyES256"})
+		if msg := testCoseDecode(t, message); msg.Payload == nil || len(*msg.Payload) != 0 {
+			t.Fatalf("empty payload was not embedded")
+		}
+		rtn, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message})
+		if code != CODE_SUCCESS || rtn.Payload != "" {
+			t.Fatalf("verify %+v, code %d", rtn, code)
+		}
+		// caller payload was never taken for the embedded one
+		if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message, Payload: payload}); code != CODE_INVALID_PARAM {
+			t.Fatalf("payload given with embedded empty payload: code %d", code)
+		}
+		message = testCoseSign(t, &paramCoseSign{Name: "CoseClient", KeyName: "CoseKeyES256", Payload: payload})
+		if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message, Payload: payload}); code != CODE_INVALID_PARAM {
+			t.Fatalf("payload given with embedded payload: code %d", code)
+		}
+	})
+
+	t.Run("Kid", func(t *testing.T) {
+		message := testCoseSign(t, &paramCoseSign{Name: "CoseClient", KeyName: "CoseKeyES256", Payload: payload})
+		if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", KeyName: "CoseKeyES384", Message: message}); code != CODE_INVALID_KEY {
+			t.Fatalf("verify by other key name: code %d", code)
+		}
+
+		// protected header of other key, signature of the first one
+		msg := testCoseDecode(t, message)
+		var protected []byte
+		codec.NewEncoderBytes(&protected, coseHandle).Encode(map[int64]interface{}{coseHeaderAlg: COSE_ALG_ES256, coseHeaderKid: []byte("CoseKeyES384@v0")})
+		msg.Protected = protected
+		if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: testCoseEncode(t, msg)}); code != CODE_VERIFY_FAIL {
+			t.Fatalf("kid of other key: code %d", code)
+		}
+		codec.NewEncoderBytes(&protected, coseHandle).Encode(map[int64]interface{}{coseHeaderAlg: COSE_ALG_ES256, coseHeaderKid: []byte("CoseKeyES256@v3")})
+		msg.Protected = protected
+		if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: testCoseEncode(t, msg)}); code != CODE_INVALID_KEY {
+			t.Fatalf("kid of missing version: code %d", code)
+		}
+	})
+
+	t.Run("Binary", func(t *testing.T) {
+		req := &paramCoseSign{Name: "CoseClient", KeyName: "CoseKeyPS256", Payload: payload}
+		data, _ := json.Marshal(req)
+		r := httptest.NewRequest("POST", "/cose/sign", bytes.NewReader(data))
+		r.Header.Set("Accept", "application/cose")
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != coseMediaType {
+			t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+		}
+		message := base64.StdEncoding.EncodeToString(w.Body.Bytes())
+		if _, code := testCoseVerify(t, &paramCoseVerify{Name: "CoseClient", Message: message}); code != CODE_SUCCESS {
+			t.Fatalf("verify binary message: code %d", code)
+		}
+	})
+
+	// rsa pkcs1 v1.5 is not a COSE_Sign1 alg
+	testExpect(t, testApi(t, "POST", "/cose/sign", &paramCoseSign{Name: "CoseClient", KeyName: "CoseKeyRS256", Payload: payload}), CODE_INVALID_KEY)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// protected keys can not be destroyed until the flag was cleared by /key/meta.
+// DELETE /keys need two calls, the first one return a token and the keys to
+// destroy, the second one with the token destroy them and report every key.
+
+// pending bulk delete, token -> confirm
+var deleteConfirms = make(map[string]*deleteConfirm)
+var deleteConfirmsLock sync.Mutex
+
+type deleteConfirm struct {
+	appName   string
+	keys      []string // key names without version
+	expiresAt time.Time
+}
+
+type rtnDeleteConfirm struct {
+	Token     string
+	ExpiresAt time.Time
+	Keys      []string // will be destroyed
+	Protected []string // will be kept
+}
+
+type rtnDeleteResult struct {
+	KeyName   string
+	Code      int32
+	Error     string   `json:",omitempty"`
+	Destroyed []string `json:",omitempty"` // versioned key names
+}
+
+// protection need the meta store
+func keyProtected(appName string, keyName string) bool {
+	base, _ := splitKeyName(keyName)
+	meta, err := loadMeta(appName, base)
+	return err == nil && meta != nil && meta.Protected
+}
+
+func checkKeyProtect(c *gin.Context, param *paramAll) bool {
+	if param.Protected && metaDB == nil {
+		responseError(c, CODE_NOT_SUPPORTED)
+		return false
+	}
+	return true
+}
+
+// destroy all versions of a key, stop at the first version parsec refused
+func destroyKey(appName string, client CryptoClient, keyName string) ([]string, error) {
+	keyNames, err := allKeyNames(appName, client, keyName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keyNames)
+
+	var destroyed []string
+	for _, name := range keyNames {
+		if err = client.PsaDestroyKey(name); err != nil {
+			break
+		}
+		destroyed = append(destroyed, name)
+	}
+	forgetKeyRing(appName, keyName)
+	if err != nil {
+		for _, name := range destroyed {
+			_, version := splitKeyName(name)
+			metaVersionDestroyed(appName, keyName, version)
+		}
+		return destroyed, err
+	}
+	metaKeyDeleted(appName, keyName)
+	return destroyed, nil
+}
+
+func newDeleteConfirm(appName string, keys []string) (string, time.Time, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	expiresAt := time.Now().Add(GetConf().Delete.ConfirmTtl)
+
+	deleteConfirmsLock.Lock()
+	defer deleteConfirmsLock.Unlock()
+	now := time.Now()
+	for t, confirm := range deleteConfirms {
+		if now.After(confirm.expiresAt) {
+			delete(deleteConfirms, t)
+		}
+	}
+	deleteConfirms[token] = &deleteConfirm{appName: appName, keys: keys, expiresAt: expiresAt}
+	return token, expiresAt, nil
+}
+
+// token can be used once and only by the application it was made for
+func takeDeleteConfirm(appName string, token string) (*deleteConfirm, int32) {
+	deleteConfirmsLock.Lock()
+	defer deleteConfirmsLock.Unlock()
+	confirm, ok := deleteConfirms[token]
+	if !ok || confirm.appName != appName {
+		return nil, CODE_INVALID_PARAM
+	}
+	delete(deleteConfirms, token)
+	if time.Now().After(confirm.expiresAt) {
+		return nil, CODE_TOKEN_EXPIRED
+	}
+	return confirm, CODE_SUCCESS
+}
+
+// first step of DELETE /keys
+func confirmDeleteKeys(c *gin.Context, appName string, client CryptoClient) {
+	keys, err := client.ListKeys()
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	found := make(map[string]bool)
+	rtn := rtnDeleteConfirm{Keys: make([]string, 0), Protected: make([]string, 0)}
+	for _, key := range keys {
+		base, _ := splitKeyName(key.Name)
+		if found[base] {
+			continue
+		}
+		found[base] = true
+		if keyProtected(appName, base) {
+			rtn.Protected = append(rtn.Protected, base)
+		} else {
+			rtn.Keys = append(rtn.Keys, base)
+		}
+	}
+	sort.Strings(rtn.Keys)
+	sort.Strings(rtn.Protected)
+
+	rtn.Token, rtn.ExpiresAt, err = newDeleteConfirm(appName, rtn.Keys)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	c.JSON(http.StatusOK, &rtn)
+}
+
+// second step of DELETE /keys, only the keys listed by the first step were destroyed
+func deleteConfirmedKeys(c *gin.Context, appName string, client CryptoClient, token string) {
+	confirm, code := takeDeleteConfirm(appName, token)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+
+	results := make([]rtnDeleteResult, 0, len(confirm.keys))
+	for _, keyName := range confirm.keys {
+		result := rtnDeleteResult{KeyName: keyName, Code: CODE_SUCCESS}
+		// may be protected after the first step
+		if keyProtected(appName, keyName) {
+			result.Code = CODE_KEY_PROTECTED
+			results = append(results, result)
+			continue
+		}
+		destroyed, err := destroyKey(appName, client, keyName)
+		result.Destroyed = destroyed
+		if err != nil {
+			zap.L().Error(err.Error(), zap.String("client", appName), zap.String("key", keyName))
+			result.Code = CODE_PARSEC_ERROR
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+func setKeyProtected(appName string, keyName string, protected bool) {
+	updateMeta(appName, keyName, func(meta *keyMeta) *keyMeta {
+		if meta != nil {
+			meta.Protected = protected
+		}
+		return meta
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+)
+
+func testDeleteConfirm(t *testing.T, name string) rtnDeleteConfirm {
+	t.Helper()
+	w := testApi(t, "DELETE", "/keys", &paramAll{Name: name})
+	var rtn rtnDeleteConfirm
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil || w.Code != http.StatusOK || len(rtn.Token) == 0 {
+		t.Fatalf("delete confirm: status %d, body %q", w.Code, w.Body.String())
+	}
+	return rtn
+}
+
+func testDeleteKeys(t *testing.T, name string, token string) map[string]rtnDeleteResult {
+	t.Helper()
+	w := testApi(t, "DELETE", "/keys", &paramAll{Name: name, Token: token})
+	var list []rtnDeleteResult
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("delete keys: status %d, body %q", w.Code, w.Body.String())
+	}
+	results := make(map[string]rtnDeleteResult)
+	for _, result := range list {
+		results[result.KeyName] = result
+	}
+	return results
+}
+
+func TestApiDeleteKey(t *testing.T) {
+	testNewClient(t, "DeleteClient")
+
+	// protection need the meta store
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "DeleteClient", KeyName: "NoMetaKey", Protected: true}), CODE_NOT_SUPPORTED)
+
+	testMetaDB(t)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "DeleteClient", KeyName: "ProtectedKey", Alg: JWS_ES256, Protected: true}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "DELETE", "/key", &paramAll{Name: "DeleteClient", KeyName: "ProtectedKey"}), CODE_KEY_PROTECTED)
+	if names := testKeyNames(t, "DeleteClient"); !testContains(names, "ProtectedKey") {
+		t.Fatalf("protected key destroyed, keys %v", names)
+	}
+
+	// cleared by /key/meta
+	protected := false
+	testExpect(t, testApi(t, "POST", "/key/meta", &paramKeyMeta{Name: "DeleteClient", KeyName: "ProtectedKey", Protected: &protected}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "DELETE", "/key", &paramAll{Name: "DeleteClient", KeyName: "ProtectedKey"}), CODE_SUCCESS)
+	if names := testKeyNames(t, "DeleteClient"); testContains(names, "ProtectedKey") {
+		t.Fatalf("key not destroyed, keys %v", names)
+	}
+
+	// parsec refused to destroy
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "DeleteClient", KeyName: "FailKey", Alg: JWS_ES256}), CODE_SUCCESS)
+	testMock.InjectFailure(requests.OpPsaDestroyKey, requests.StatusPsaErrorHardwareFailure, 1, false)
+	testExpect(t, testApi(t, "DELETE", "/key", &paramAll{Name: "DeleteClient", KeyName: "FailKey"}), CODE_PARSEC_ERROR)
+	if names := testKeyNames(t, "DeleteClient"); !testContains(names, "FailKey") {
+		t.Fatalf("refused key gone, keys %v", names)
+	}
+	testExpect(t, testApi(t, "DELETE", "/key", &paramAll{Name: "DeleteClient", KeyName: "FailKey"}), CODE_SUCCESS)
+}
+
+func TestApiDeleteKeys(t *testing.T) {
+	testNewClient(t, "DeleteAllClient")
+	testNewClient(t, "DeleteOtherClient")
+	testMetaDB(t)
+	for _, keyName := range []string{"KeyA", "KeyB", "KeyC"} {
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "DeleteAllClient", KeyName: keyName, Alg: JWS_ES256}), CODE_SUCCESS)
+	}
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "DeleteAllClient", KeyName: "KeyP", Alg: JWS_ES256, Protected: true}), CODE_SUCCESS)
+	testRotate(t, "DeleteAllClient", "KeyB")
+
+	// first step list the keys, one name for all versions
+	confirm := testDeleteConfirm(t, "DeleteAllClient")
+	if len(confirm.Keys) != 3 || confirm.Keys[0] != "KeyA" || confirm.Keys[1] != "KeyB" || confirm.Keys[2] != "KeyC" ||
+		len(confirm.Protected) != 1 || confirm.Protected[0] != "KeyP" {
+		t.Fatalf("confirm keys %v, protected %v", confirm.Keys, confirm.Protected)
+	}
+	if d := time.Until(confirm.ExpiresAt); d <= 0 || d > GetConf().Delete.ConfirmTtl {
+		t.Fatalf("confirm expires at %v", confirm.ExpiresAt)
+	}
+	if names := testKeyNames(t, "DeleteAllClient"); len(names) != 5 {
+		t.Fatalf("keys destroyed by first step, keys %v", names)
+	}
+
+	// token of another application
+	testExpect(t, testApi(t, "DELETE", "/keys", &paramAll{Name: "DeleteOtherClient", Token: confirm.Token}), CODE_INVALID_PARAM)
+	testExpect(t, testApi(t, "DELETE", "/keys", &paramAll{Name: "DeleteAllClient", Token: "unknown"}), CODE_INVALID_PARAM)
+
+	// protected after the first step, and parsec refused the first key
+	setKeyProtected("DeleteAllClient", "KeyC", true)
+	testMock.InjectFailure(requests.OpPsaDestroyKey, requests.StatusPsaErrorHardwareFailure, 1, false)
+	results := testDeleteKeys(t, "DeleteAllClient", confirm.Token)
+	if len(results) != 3 {
+		t.Fatalf("results %+v", results)
+	}
+	if r := results["KeyA"]; r.Code != CODE_PARSEC_ERROR || len(r.Error) == 0 || len(r.Destroyed) != 0 {
+		t.Fatalf("KeyA result %+v", r)
+	}
+	if r := results["KeyB"]; r.Code != CODE_SUCCESS || len(r.Destroyed) != 2 || r.Destroyed[0] != "KeyB" || r.Destroyed[1] != "KeyB@v1" {
+		t.Fatalf("KeyB result %+v", r)
+	}
+	if r := results["KeyC"]; r.Code != CODE_KEY_PROTECTED || len(r.Destroyed) != 0 {
+		t.Fatalf("KeyC result %+v", r)
+	}
+	names := testKeyNames(t, "DeleteAllClient")
+	if len(names) != 3 || names[0] != "KeyA" || names[1] != "KeyC" || names[2] != "KeyP" {
+		t.Fatalf("keys left %v, want [KeyA KeyC KeyP]", names)
+	}
+
+	// token was used once
+	testExpect(t, testApi(t, "DELETE", "/keys", &paramAll{Name: "DeleteAllClient", Token: confirm.Token}), CODE_INVALID_PARAM)
+
+	// and expire after delete.confirmTtl
+	testSetConf(t, func(conf *AppConfig) { conf.Delete.ConfirmTtl = 10 * time.Millisecond })
+	confirm = testDeleteConfirm(t, "DeleteAllClient")
+	time.Sleep(20 * time.Millisecond)
+	testExpect(t, testApi(t, "DELETE", "/keys", &paramAll{Name: "DeleteAllClient", Token: confirm.Token}), CODE_TOKEN_EXPIRED)
+	if names := testKeyNames(t, "DeleteAllClient"); len(names) != 3 {
+		t.Fatalf("keys destroyed by expired token, keys %v", names)
+	}
+}
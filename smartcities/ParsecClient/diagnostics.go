@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"go.uber.org/zap"
+)
+
+// self test of every crypto provider of every parsec daemon, to tell if a
+// fault is the daemon, its provider or ParsecClient. a temporary application
+// and its keys were made, used and destroyed by a raw client of the daemon,
+// not the cached clients, so meta store, events and tenants were not touched.
+// run by `ParsecClient selftest` or POST /diagnostics, GET /diagnostics
+// return the last report.
+
+const (
+	SELFTEST_CONNECT      = "connect"
+	SELFTEST_PING         = "ping"
+	SELFTEST_PROVIDERS    = "list providers"
+	SELFTEST_OPCODES      = "opcodes"
+	SELFTEST_GEN_SIGN     = "generate sign key"
+	SELFTEST_SIGN         = "sign"
+	SELFTEST_VERIFY       = "verify"
+	SELFTEST_VERIFY_BAD   = "verify tampered"
+	SELFTEST_GEN_ENC      = "generate encrypt key"
+	SELFTEST_ENCRYPT      = "encrypt"
+	SELFTEST_DECRYPT      = "decrypt"
+	SELFTEST_DESTROY_SIGN = "destroy sign key"
+	SELFTEST_DESTROY_ENC  = "destroy encrypt key"
+	SELFTEST_CLEANUP      = "cleanup"
+)
+
+// name of limit rules for POST /diagnostics
+const DIAGNOSTICS_NAME = "diagnostics"
+
+// one selftest at a time, each make keys in the daemons
+var selftestSlot = make(chan struct{}, 1)
+
+// last report, returned by GET /diagnostics
+var selftestLast *rtnDiagnostics
+var selftestLastLock sync.RWMutex
+
+// parsec status of error text, the client only return fmt errors
+var parsecStatuses = make(map[string]requests.StatusCode)
+
+func init() {
+	for code := requests.StatusCode(1); code <= requests.StatusPsaErrorDataCorrupt; code++ {
+		if code.IsValid() {
+			parsecStatuses[code.ToErr().Error()] = code
+		}
+	}
+}
+
+type rtnSelftestStep struct {
+	Step    string
+	Pass    bool
+	Skipped bool   `json:",omitempty"` // an earlier step failed or op not supported by provider
+	Cost    string // like "1.2ms"
+	Status  uint16 `json:",omitempty"` // parsec status code if the daemon returned one
+	Error   string `json:",omitempty"`
+}
+
+type rtnSelftestProvider struct {
+	Provider string
+	Pass     bool
+	Cost     string
+	Steps    []rtnSelftestStep
+	Leftover []string `json:",omitempty"` // keys could not be destroyed
+}
+
+type rtnSelftestDaemon struct {
+	Name      string
+	Socket    string `json:",omitempty"`
+	Pass      bool
+	Cost      string
+	Steps     []rtnSelftestStep // connect, ping and list providers
+	Providers []rtnSelftestProvider
+}
+
+type rtnDiagnostics struct {
+	Pass    bool
+	Backend string
+	Started time.Time
+	Cost    string
+	Daemons []rtnSelftestDaemon
+}
+
+func parsecStatus(err error) requests.StatusCode {
+	if err == nil {
+		return requests.StatusSuccess
+	}
+	if code, ok := parsecStatuses[err.Error()]; ok {
+		return code
+	}
+	return 0
+}
+
+// steps of one daemon or provider, a step is skipped if any step it needs failed
+type selftest struct {
+	steps  *[]rtnSelftestStep
+	failed map[string]bool
+}
+
+// pass if no step failed, skipped steps are not faults, the step made them
+// skipped is one if any
+func passSteps(steps []rtnSelftestStep) bool {
+	for _, step := range steps {
+		if !step.Pass && !step.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *selftest) run(step string, needs []string, fn func() error) bool {
+	for _, need := range needs {
+		if t.failed[need] {
+			return t.skip(step, "skipped, "+need+" did not pass")
+		}
+	}
+	start := time.Now()
+	err := fn()
+	result := rtnSelftestStep{Step: step, Pass: err == nil, Cost: time.Since(start).String()}
+	if err != nil {
+		t.failed[step] = true
+		result.Status = uint16(parsecStatus(err))
+		result.Error = err.Error()
+	}
+	*t.steps = append(*t.steps, result)
+	return err == nil
+}
+
+func (t *selftest) skip(step string, reason string) bool {
+	t.failed[step] = true
+	*t.steps = append(*t.steps, rtnSelftestStep{Step: step, Skipped: true, Cost: "0s", Error: reason})
+	return false
+}
+
+func newSelftestClient(appName string, d CfgDaemon) (CryptoClient, error) {
+	if GetConf().Backend.Type == BACKEND_SOFTWARE {
+		return newSoftClient(appName), nil
+	}
+	return newParsecClient(appName, d)
+}
+
+// parsec clients list the providers of the daemon and switch among them
+type selftestProviders interface {
+	ListProviders() ([]*parsec.ProviderInfo, error)
+	SetImplicitProvider(provider parsec.ProviderID)
+}
+
+func selftestDaemon(d CfgDaemon) rtnSelftestDaemon {
+	start := time.Now()
+	rtn := rtnSelftestDaemon{Name: d.Name, Socket: d.Socket, Steps: make([]rtnSelftestStep, 0), Providers: make([]rtnSelftestProvider, 0)}
+	t := &selftest{steps: &rtn.Steps, failed: make(map[string]bool)}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	appName := "selftest-" + hex.EncodeToString(b)
+
+	var client CryptoClient
+	t.run(SELFTEST_CONNECT, nil, func() (err error) {
+		client, err = newSelftestClient(appName, d)
+		return err
+	})
+	if client == nil {
+		rtn.Cost = time.Since(start).String()
+		return rtn
+	}
+	defer client.Close()
+
+	t.run(SELFTEST_PING, []string{SELFTEST_CONNECT}, func() error {
+		major, minor, err := client.Ping()
+		if err == nil && (major != 1 || minor != 0) {
+			err = fmt.Errorf("parsec server version %v,%v was not supported", major, minor)
+		}
+		return err
+	})
+
+	// the software backend is one provider, core provider of parsec has no keys
+	providers := []parsec.ProviderID{softProviderID}
+	names := map[parsec.ProviderID]string{softProviderID: BACKEND_SOFTWARE}
+	lister, ok := client.(selftestProviders)
+	if ok {
+		providers = nil
+		t.run(SELFTEST_PROVIDERS, []string{SELFTEST_PING}, func() error {
+			infos, err := lister.ListProviders()
+			for _, info := range infos {
+				if info.ID.HasCrypto() {
+					providers = append(providers, info.ID)
+					names[info.ID] = info.ID.String()
+				}
+			}
+			if err == nil && len(providers) == 0 {
+				err = fmt.Errorf("no crypto provider in the daemon")
+			}
+			return err
+		})
+	}
+	for _, provider := range providers {
+		if ok {
+			lister.SetImplicitProvider(provider)
+		}
+		result := selftestProvider(d, client, appName, provider, t.failed)
+		result.Provider = names[provider]
+		rtn.Providers = append(rtn.Providers, result)
+	}
+
+	rtn.Pass = passSteps(rtn.Steps)
+	for _, p := range rtn.Providers {
+		if !p.Pass {
+			rtn.Pass = false
+		}
+	}
+	rtn.Cost = time.Since(start).String()
+	return rtn
+}
+
+// round-trips by keys of one provider, steps failed on the daemon were needed
+func selftestProvider(d CfgDaemon, client CryptoClient, appName string, provider parsec.ProviderID, daemonFailed map[string]bool) rtnSelftestProvider {
+	start := time.Now()
+	rtn := rtnSelftestProvider{Steps: make([]rtnSelftestStep, 0)}
+	t := &selftest{steps: &rtn.Steps, failed: make(map[string]bool)}
+	for step, failed := range daemonFailed {
+		t.failed[step] = failed
+	}
+	signKey := fmt.Sprintf("%s-%d-sign", appName, provider)
+	encKey := fmt.Sprintf("%s-%d-enc", appName, provider)
+
+	ops := make(map[requests.OpCode]bool)
+	t.run(SELFTEST_OPCODES, []string{SELFTEST_PING}, func() error {
+		opcodes, err := client.ListOpcodes(provider)
+		for _, op := range opcodes {
+			ops[requests.OpCode(op)] = true
+		}
+		return err
+	})
+	// steps of ops the provider has not
+	unsupported := func(step string, op requests.OpCode) bool {
+		if t.failed[SELFTEST_OPCODES] || ops[op] {
+			return false
+		}
+		return !t.skip(step, "skipped, not supported by provider")
+	}
+
+	message := []byte("ParsecClient selftest " + appName)
+	hash := hashMessage(message)
+	signAlg := getSignAttr().KeyPolicy.KeyAlgorithm.GetAsymmetricSignature()
+	encAlg := getEncryptAttr(true).KeyPolicy.KeyAlgorithm.GetAsymmetricEncryption()
+	var signature, ciphertext []byte
+
+	if !unsupported(SELFTEST_GEN_SIGN, requests.OpPsaGenerateKey) {
+		t.run(SELFTEST_GEN_SIGN, []string{SELFTEST_OPCODES}, func() error {
+			return client.PsaGenerateKey(signKey, getSignAttr())
+		})
+	}
+	if !unsupported(SELFTEST_SIGN, requests.OpPsaSignHash) {
+		t.run(SELFTEST_SIGN, []string{SELFTEST_GEN_SIGN}, func() (err error) {
+			signature, err = client.PsaSignHash(signKey, hash, signAlg)
+			return err
+		})
+	}
+	// by parsec, or in process like apis do if the provider can not verify
+	verify := func(hash []byte) error {
+		if ops[requests.OpPsaVerifyHash] {
+			return client.PsaVerifyHash(signKey, hash, signature, signAlg)
+		}
+		data, err := client.PsaExportPublicKey(signKey)
+		if err != nil {
+			return err
+		}
+		pub, err := parsePublicKey(data)
+		if err != nil {
+			return err
+		}
+		if !jwsVerifyLocal(jwsAlgs[JWS_RS256], pub, hash, signature) {
+			return requests.StatusPsaErrorInvalidSignature.ToErr()
+		}
+		return nil
+	}
+	t.run(SELFTEST_VERIFY, []string{SELFTEST_SIGN}, func() error {
+		return verify(hash)
+	})
+	t.run(SELFTEST_VERIFY_BAD, []string{SELFTEST_VERIFY}, func() error {
+		if err := verify(hashMessage(append(message, '!'))); err == nil {
+			return fmt.Errorf("tampered message was verified")
+		}
+		return nil
+	})
+
+	if !unsupported(SELFTEST_GEN_ENC, requests.OpPsaGenerateKey) {
+		t.run(SELFTEST_GEN_ENC, []string{SELFTEST_OPCODES}, func() error {
+			return client.PsaGenerateKey(encKey, getEncryptAttr(true))
+		})
+	}
+	if !unsupported(SELFTEST_ENCRYPT, requests.OpPsaAsymmetricEncrypt) {
+		t.run(SELFTEST_ENCRYPT, []string{SELFTEST_GEN_ENC}, func() (err error) {
+			ciphertext, err = client.PsaAsymmetricEncrypt(encKey, encAlg, []byte{}, message)
+			return err
+		})
+	}
+	if !unsupported(SELFTEST_DECRYPT, requests.OpPsaAsymmetricDecrypt) {
+		t.run(SELFTEST_DECRYPT, []string{SELFTEST_ENCRYPT}, func() error {
+			plaintext, err := client.PsaAsymmetricDecrypt(encKey, encAlg, []byte{}, ciphertext)
+			if err == nil && !bytes.Equal(plaintext, message) {
+				err = fmt.Errorf("decrypted message was not the same")
+			}
+			return err
+		})
+	}
+
+	t.run(SELFTEST_DESTROY_SIGN, []string{SELFTEST_GEN_SIGN}, func() error {
+		return client.PsaDestroyKey(signKey)
+	})
+	t.run(SELFTEST_DESTROY_ENC, []string{SELFTEST_GEN_ENC}, func() error {
+		return client.PsaDestroyKey(encKey)
+	})
+
+	// all keys of the temporary application are ours, destroy any left
+	t.run(SELFTEST_CLEANUP, []string{SELFTEST_PING}, func() error {
+		keys, err := client.ListKeys()
+		if err != nil {
+			if !t.failed[SELFTEST_GEN_SIGN] && t.failed[SELFTEST_DESTROY_SIGN] {
+				rtn.Leftover = append(rtn.Leftover, signKey)
+			}
+			if !t.failed[SELFTEST_GEN_ENC] && t.failed[SELFTEST_DESTROY_ENC] {
+				rtn.Leftover = append(rtn.Leftover, encKey)
+			}
+			return err
+		}
+		for _, key := range keys {
+			if key.ProviderID != provider {
+				continue
+			}
+			if err := client.PsaDestroyKey(key.Name); err != nil {
+				zap.L().Error("Selftest key was not destroyed", zap.String("daemon", d.Name), zap.String("provider", provider.String()), zap.String("client", appName), zap.String("key", key.Name), zap.Error(err))
+				rtn.Leftover = append(rtn.Leftover, key.Name)
+			}
+		}
+		if len(rtn.Leftover) != 0 {
+			return fmt.Errorf("%d keys could not be destroyed", len(rtn.Leftover))
+		}
+		return nil
+	})
+
+	rtn.Pass = passSteps(rtn.Steps)
+	rtn.Cost = time.Since(start).String()
+	return rtn
+}
+
+// selftest all daemons of the backend one by one, false if one was running
+func runSelftest(wait bool) (*rtnDiagnostics, bool) {
+	if wait {
+		selftestSlot <- struct{}{}
+	} else {
+		select {
+		case selftestSlot <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	defer func() { <-selftestSlot }()
+
+	start := time.Now()
+	rtn := &rtnDiagnostics{Pass: true, Backend: GetConf().Backend.Type, Started: start, Daemons: make([]rtnSelftestDaemon, 0)}
+	daemons := backendDaemons()
+	if rtn.Backend == BACKEND_SOFTWARE {
+		daemons = []CfgDaemon{{Name: BACKEND_SOFTWARE}}
+	}
+	for _, d := range daemons {
+		result := selftestDaemon(d)
+		if !result.Pass {
+			rtn.Pass = false
+		}
+		for _, p := range result.Providers {
+			zap.L().Info("Selftest finished", zap.String("daemon", d.Name), zap.String("provider", p.Provider), zap.Bool("pass", p.Pass),
+				zap.String("cost", p.Cost), zap.Strings("leftover", p.Leftover))
+		}
+		rtn.Daemons = append(rtn.Daemons, result)
+	}
+	rtn.Cost = time.Since(start).String()
+
+	selftestLastLock.Lock()
+	selftestLast = rtn
+	selftestLastLock.Unlock()
+	return rtn, true
+}
+
+// `ParsecClient selftest`, print the report and exit 1 if any daemon failed
+func Selftest() {
+	// parsec client print key attributes to stdout, keep stdout for the report
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	rtn, _ := runSelftest(true)
+	os.Stdout = stdout
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rtn); err != nil {
+		fmt.Fprintln(os.Stderr, "Error,", err)
+		os.Exit(1)
+	}
+	if !rtn.Pass {
+		os.Exit(1)
+	}
+}
+
+func diagnosticsStatus(rtn *rtnDiagnostics) int {
+	if !rtn.Pass {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// run a selftest, limited by rules of name "diagnostics" op "selftest"
+// curl -v -X POST 127.0.0.1:8300/diagnostics
+func ApiRunDiagnostics(c *gin.Context) {
+	release, ok := limitOp(c, DIAGNOSTICS_NAME, LIMIT_OP_SELFTEST)
+	if !ok {
+		return
+	}
+	defer release()
+
+	rtn, ok := runSelftest(false)
+	if !ok {
+		zap.L().Warn("Selftest was running")
+		c.Header("Retry-After", "1")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, &rtnCode{
+			Code: CODE_RATE_LIMITED,
+		})
+		return
+	}
+	c.JSON(diagnosticsStatus(rtn), rtn)
+}
+
+// last report, 404 if no selftest was run
+// curl -v 127.0.0.1:8300/diagnostics
+func ApiDiagnostics(c *gin.Context) {
+	selftestLastLock.RLock()
+	rtn := selftestLast
+	selftestLastLock.RUnlock()
+	if rtn == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(diagnosticsStatus(rtn), rtn)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+)
+
+func testDiagnostics(t *testing.T, method string) (int, *rtnDiagnostics) {
+	t.Helper()
+	w := testApi(t, method, "/diagnostics", nil)
+	if w.Code != http.StatusOK && w.Code != http.StatusServiceUnavailable {
+		return w.Code, nil
+	}
+	var rtn rtnDiagnostics
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil {
+		t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+	}
+	return w.Code, &rtn
+}
+
+func TestApiDiagnostics(t *testing.T) {
+	selftestLastLock.Lock()
+	selftestLast = nil
+	selftestLastLock.Unlock()
+
+	if status, _ := testDiagnostics(t, "GET"); status != http.StatusNotFound {
+		t.Fatalf("report before selftest: status %d", status)
+	}
+
+	status, rtn := testDiagnostics(t, "POST")
+	if status != http.StatusOK || !rtn.Pass || len(rtn.Daemons) != 1 {
+		t.Fatalf("selftest: status %d, %+v", status, rtn)
+	}
+	// mock daemon has the core provider without keys and one crypto provider
+	daemon := rtn.Daemons[0]
+	if len(daemon.Providers) != 1 || daemon.Providers[0].Provider != parsec.ProviderMBed.String() {
+		t.Fatalf("providers %+v", daemon.Providers)
+	}
+	for _, step := range append(daemon.Steps, daemon.Providers[0].Steps...) {
+		if !step.Pass {
+			t.Errorf("step %+v", step)
+		}
+	}
+	if len(daemon.Providers[0].Steps) < 10 {
+		t.Errorf("provider steps %+v", daemon.Providers[0].Steps)
+	}
+
+	// GET return the last report, not run again
+	if status, last := testDiagnostics(t, "GET"); status != http.StatusOK || !last.Started.Equal(rtn.Started) {
+		t.Fatalf("last report: status %d, %+v", status, last)
+	}
+
+	// a running selftest is not waited
+	selftestSlot <- struct{}{}
+	w := testApi(t, "POST", "/diagnostics", nil)
+	<-selftestSlot
+	testExpect(t, w, CODE_RATE_LIMITED)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("selftest running: status %d", w.Code)
+	}
+}
+
+func TestApiDiagnosticsLimit(t *testing.T) {
+	resetRateLimit([]CfgLimitRule{{Name: DIAGNOSTICS_NAME, Op: LIMIT_OP_SELFTEST, Rate: 0.001, Burst: 1}})
+	t.Cleanup(func() { resetRateLimit(GetConf().RateLimit.Rules) })
+
+	if status, _ := testDiagnostics(t, "POST"); status != http.StatusOK {
+		t.Fatalf("first selftest: status %d", status)
+	}
+	w := testApi(t, "POST", "/diagnostics", nil)
+	if w.Code != http.StatusTooManyRequests || len(w.Header().Get("Retry-After")) == 0 {
+		t.Fatalf("second selftest: status %d", w.Code)
+	}
+}
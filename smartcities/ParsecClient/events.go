@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+// key lifecycle events for dashboards instead of polling /keys.
+// the last events.buffer events were kept in memory, a client resume from
+// the id it got last by Last-Event-ID or ?cursor=, a "lost" event was sent
+// first if some events after it were dropped or the process was restarted.
+
+const (
+	EVENT_CLIENT_CREATED        = "client_created"
+	EVENT_CLIENT_CLOSED         = "client_closed"
+	EVENT_KEY_GENERATED         = "key_generated"
+	EVENT_KEY_IMPORTED          = "key_imported"
+	EVENT_KEY_ROTATED           = "key_rotated"
+	EVENT_KEY_VERSION_DESTROYED = "key_version_destroyed"
+	EVENT_KEY_DESTROYED         = "key_destroyed"
+	EVENT_VERIFY_FAILED         = "verify_failed"
+	EVENT_LOST                  = "lost"
+)
+
+type event struct {
+	ID       uint64
+	Type     string
+	Name     string `json:",omitempty"` // application name
+	KeyName  string `json:",omitempty"`
+	Version  int    `json:",omitempty"`
+	Failures int    `json:",omitempty"` // verify failures in events.verifyWindow
+	Time     time.Time
+}
+
+var errEventsOrigin = errors.New("websocket origin not allowed")
+
+var eventsLock sync.Mutex
+var eventBuf []event // oldest first
+var eventNext = uint64(time.Now().UnixNano())
+var eventSubs = make(map[chan struct{}]bool)
+
+// application name + key name -> verify failures not reported yet
+var verifyFailures = make(map[string]*verifyFailure)
+var verifyFailuresLock sync.Mutex
+
+type verifyFailure struct {
+	count int
+	first time.Time
+}
+
+func emitEvent(ev event) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	ev.ID = eventNext
+	eventNext++
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	size := GetConf().Events.Buffer
+	if len(eventBuf) >= size {
+		eventBuf = append(eventBuf[:0], eventBuf[len(eventBuf)-size+1:]...)
+	}
+	eventBuf = append(eventBuf, ev)
+
+	// wake subscribers, skip who was not woken yet
+	for ch := range eventSubs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// a failed verify, verify_failed was sent when events.verifyFailures reached in window
+func recordVerifyFailure(appName string, keyName string) {
+	conf := GetConf().Events
+	if conf.VerifyFailures <= 0 {
+		return
+	}
+	base, _ := splitKeyName(keyName)
+	id := appName + "\x00" + base
+	now := time.Now()
+
+	verifyFailuresLock.Lock()
+	f, ok := verifyFailures[id]
+	if !ok || now.Sub(f.first) > conf.VerifyWindow {
+		f = &verifyFailure{first: now}
+		verifyFailures[id] = f
+	}
+	f.count++
+	count := f.count
+	if count >= conf.VerifyFailures {
+		delete(verifyFailures, id)
+	}
+	verifyFailuresLock.Unlock()
+
+	if count >= conf.VerifyFailures {
+		emitEvent(event{Type: EVENT_VERIFY_FAILED, Name: appName, KeyName: base, Failures: count})
+	}
+}
+
+// events after cursor, 0 means from now on, lost if some were dropped
+func eventsSince(cursor uint64) ([]event, uint64, bool) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	last := eventNext - 1
+	if cursor == 0 {
+		return nil, last, false
+	}
+	if cursor > last {
+		// from another run
+		return append([]event(nil), eventBuf...), last, true
+	}
+	if len(eventBuf) == 0 {
+		return nil, last, cursor != last
+	}
+	start := len(eventBuf)
+	for i, ev := range eventBuf {
+		if ev.ID > cursor {
+			start = i
+			break
+		}
+	}
+	lost := cursor+1 < eventBuf[0].ID
+	return append([]event(nil), eventBuf[start:]...), last, lost
+}
+
+func subscribeEvents() chan struct{} {
+	ch := make(chan struct{}, 1)
+	eventsLock.Lock()
+	eventSubs[ch] = true
+	eventsLock.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan struct{}) {
+	eventsLock.Lock()
+	delete(eventSubs, ch)
+	eventsLock.Unlock()
+}
+
+// no Origin was not a browser, others must be listed in events.origins
+func allowEventsOrigin(origin string) bool {
+	if len(origin) == 0 {
+		return true
+	}
+	for _, allowed := range GetConf().Events.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+type eventFilter struct {
+	names map[string]bool
+	types map[string]bool
+}
+
+// comma separated values, empty match all
+func splitFilter(value string) map[string]bool {
+	if len(value) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+func (f *eventFilter) match(ev *event) bool {
+	if ev.Type == EVENT_LOST {
+		return true
+	}
+	if f.names != nil && !f.names[ev.Name] {
+		return false
+	}
+	if f.types != nil && !f.types[ev.Type] {
+		return false
+	}
+	return true
+}
+
+// send events from cursor until send fail or done closed
+func streamEvents(cursor uint64, filter *eventFilter, done <-chan struct{}, send func(ev *event) error, ping func() error) {
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		list, last, lost := eventsSince(cursor)
+		if lost {
+			if err := send(&event{Type: EVENT_LOST, Time: time.Now()}); err != nil {
+				return
+			}
+		}
+		for i := range list {
+			if !filter.match(&list[i]) {
+				continue
+			}
+			if err := send(&list[i]); err != nil {
+				return
+			}
+		}
+		cursor = last
+
+		select {
+		case <-done:
+			return
+		case <-ch:
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// curl -N '127.0.0.1:8300/events?name=GoClient&type=key_rotated,key_destroyed'
+// curl -N -H 'Last-Event-ID: 1700000000000000042' 127.0.0.1:8300/events
+// websocat 'ws://127.0.0.1:8300/events?name=GoClient&cursor=1700000000000000042'
+func ApiEvents(c *gin.Context) {
+	filter := &eventFilter{
+		names: splitFilter(c.Query("name")),
+		types: splitFilter(c.Query("type")),
+	}
+	cursorStr := c.Query("cursor")
+	if len(cursorStr) == 0 {
+		cursorStr = c.GetHeader("Last-Event-ID")
+	}
+	var cursor uint64
+	if len(cursorStr) != 0 {
+		var err error
+		if cursor, err = strconv.ParseUint(cursorStr, 10, 64); err != nil {
+			responseError(c, CODE_INVALID_PARAM)
+			return
+		}
+	}
+
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		server := websocket.Server{
+			// browsers send Origin and do not apply CORS to websocket
+			Handshake: func(_ *websocket.Config, r *http.Request) error {
+				if origin := r.Header.Get("Origin"); !allowEventsOrigin(origin) {
+					zap.L().Warn("Events origin refused", zap.String("origin", origin))
+					return errEventsOrigin
+				}
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) {
+				defer ws.Close()
+				done := make(chan struct{})
+				// nothing expected from client, read until it closed
+				go func() {
+					var msg []byte
+					for websocket.Message.Receive(ws, &msg) == nil {
+					}
+					close(done)
+				}()
+				streamEvents(cursor, filter, done, func(ev *event) error {
+					return websocket.JSON.Send(ws, ev)
+				}, func() error {
+					// closed connection was found by the reader
+					return nil
+				})
+			},
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	w := c.Writer
+	streamEvents(cursor, filter, c.Request.Context().Done(), func(ev *event) error {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			zap.L().Error(err.Error())
+			return nil
+		}
+		if ev.ID != 0 {
+			if _, err := fmt.Fprintf(w, "id: %d\n", ev.ID); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	}, func() error {
+		if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// id of the last event, a cursor to get the events after it
+func testEventCursor() uint64 {
+	_, last, _ := eventsSince(0)
+	return last
+}
+
+// events after cursor sent by streamEvents, it returned after the first batch
+func testEvents(t *testing.T, cursor uint64, filter *eventFilter) []event {
+	t.Helper()
+	done := make(chan struct{})
+	close(done)
+	var list []event
+	streamEvents(cursor, filter, done, func(ev *event) error {
+		list = append(list, *ev)
+		return nil
+	}, func() error { return nil })
+	return list
+}
+
+func testEventTypes(list []event) string {
+	types := make([]string, 0, len(list))
+	for _, ev := range list {
+		types = append(types, ev.Type+":"+ev.Name+":"+ev.KeyName)
+	}
+	return strings.Join(types, " ")
+}
+
+func TestEventsFilter(t *testing.T) {
+	cursor := testEventCursor()
+	emitEvent(event{Type: EVENT_KEY_GENERATED, Name: "EventApp1", KeyName: "KeyA"})
+	emitEvent(event{Type: EVENT_KEY_ROTATED, Name: "EventApp1", KeyName: "KeyA", Version: 1})
+	emitEvent(event{Type: EVENT_KEY_GENERATED, Name: "EventApp2", KeyName: "KeyB"})
+	emitEvent(event{Type: EVENT_KEY_DESTROYED, Name: "EventApp3", KeyName: "KeyC"})
+
+	tests := []struct {
+		name  string
+		types string
+		want  string
+	}{
+		{"EventApp1", "", "key_generated:EventApp1:KeyA key_rotated:EventApp1:KeyA"},
+		{"EventApp1,EventApp2", "key_generated", "key_generated:EventApp1:KeyA key_generated:EventApp2:KeyB"},
+		{"EventApp1, EventApp3", "key_rotated,key_destroyed", "key_rotated:EventApp1:KeyA key_destroyed:EventApp3:KeyC"},
+		{"EventApp2", "key_destroyed", ""},
+		{"", "key_destroyed", "key_destroyed:EventApp3:KeyC"},
+	}
+	for _, tt := range tests {
+		filter := &eventFilter{names: splitFilter(tt.name), types: splitFilter(tt.types)}
+		if got := testEventTypes(testEvents(t, cursor, filter)); got != tt.want {
+			t.Fatalf("name %q type %q: events %q, want %q", tt.name, tt.types, got, tt.want)
+		}
+	}
+
+	// nothing after the last one, and nothing from now on
+	if list := testEvents(t, testEventCursor(), &eventFilter{}); len(list) != 0 {
+		t.Fatalf("events after last %q", testEventTypes(list))
+	}
+	if list := testEvents(t, 0, &eventFilter{}); len(list) != 0 {
+		t.Fatalf("events from now on %q", testEventTypes(list))
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	testSetConf(t, func(conf *AppConfig) { conf.Events.Buffer = 3 })
+	cursor := testEventCursor()
+	filter := &eventFilter{names: splitFilter("ResumeApp")}
+	for _, keyName := range []string{"Key1", "Key2"} {
+		emitEvent(event{Type: EVENT_KEY_GENERATED, Name: "ResumeApp", KeyName: keyName})
+	}
+	list := testEvents(t, cursor, filter)
+	if len(list) != 2 || list[0].ID+1 != list[1].ID {
+		t.Fatalf("events %+v", list)
+	}
+
+	// resume from the id got last
+	emitEvent(event{Type: EVENT_KEY_GENERATED, Name: "ResumeApp", KeyName: "Key3"})
+	if got := testEventTypes(testEvents(t, list[1].ID, filter)); got != "key_generated:ResumeApp:Key3" {
+		t.Fatalf("resumed events %q", got)
+	}
+
+	// Key1 and Key2 were dropped from the buffer
+	for _, keyName := range []string{"Key4", "Key5"} {
+		emitEvent(event{Type: EVENT_KEY_GENERATED, Name: "ResumeApp", KeyName: keyName})
+	}
+	want := "lost:: key_generated:ResumeApp:Key3 key_generated:ResumeApp:Key4 key_generated:ResumeApp:Key5"
+	if got := testEventTypes(testEvents(t, list[0].ID, filter)); got != want {
+		t.Fatalf("events after overflow %q, want %q", got, want)
+	}
+	// the last one kept was not lost
+	if got := testEventTypes(testEvents(t, list[1].ID, filter)); strings.HasPrefix(got, EVENT_LOST) {
+		t.Fatalf("events after kept one %q", got)
+	}
+
+	// cursor of another run
+	if got := testEventTypes(testEvents(t, testEventCursor()+100, filter)); got != want {
+		t.Fatalf("events after restart %q, want %q", got, want)
+	}
+}
+
+func TestEventsVerifyFailed(t *testing.T) {
+	testSetConf(t, func(conf *AppConfig) {
+		conf.Events.VerifyFailures = 3
+		conf.Events.VerifyWindow = time.Minute
+	})
+	filter := &eventFilter{types: splitFilter(EVENT_VERIFY_FAILED), names: splitFilter("VerifyApp")}
+	cursor := testEventCursor()
+
+	// versions count as the key
+	recordVerifyFailure("VerifyApp", "VerifyKey")
+	recordVerifyFailure("VerifyApp", "VerifyKey@v1")
+	recordVerifyFailure("VerifyApp", "OtherKey")
+	if list := testEvents(t, cursor, filter); len(list) != 0 {
+		t.Fatalf("events below threshold %q", testEventTypes(list))
+	}
+	recordVerifyFailure("VerifyApp", "VerifyKey")
+	list := testEvents(t, cursor, filter)
+	if len(list) != 1 || list[0].KeyName != "VerifyKey" || list[0].Failures != 3 {
+		t.Fatalf("events %+v", list)
+	}
+
+	// counted again after the event
+	cursor = list[0].ID
+	recordVerifyFailure("VerifyApp", "VerifyKey")
+	if list := testEvents(t, cursor, filter); len(list) != 0 {
+		t.Fatalf("events after reset %q", testEventTypes(list))
+	}
+
+	// failures out of window were forgotten
+	testSetConf(t, func(conf *AppConfig) { conf.Events.VerifyWindow = time.Millisecond })
+	recordVerifyFailure("VerifyApp", "SlowKey")
+	recordVerifyFailure("VerifyApp", "SlowKey")
+	time.Sleep(5 * time.Millisecond)
+	recordVerifyFailure("VerifyApp", "SlowKey")
+	if list := testEvents(t, cursor, filter); len(list) != 0 {
+		t.Fatalf("events out of window %q", testEventTypes(list))
+	}
+
+	// disabled
+	testSetConf(t, func(conf *AppConfig) { conf.Events.VerifyFailures = 0 })
+	for i := 0; i < 5; i++ {
+		recordVerifyFailure("VerifyApp", "VerifyKey")
+	}
+	if list := testEvents(t, cursor, filter); len(list) != 0 {
+		t.Fatalf("events when disabled %q", testEventTypes(list))
+	}
+}
+
+func TestApiEventsSse(t *testing.T) {
+	server := httptest.NewServer(testRouter)
+	defer server.Close()
+	cursor := testEventCursor()
+	emitEvent(event{Type: EVENT_KEY_ROTATED, Name: "SseApp", KeyName: "SseKey", Version: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/events?name=SseApp", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(cursor, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read %v after %q", err, lines)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "id: "+strconv.FormatUint(cursor+1, 10) || lines[1] != "event: key_rotated" || !strings.Contains(lines[2], `"KeyName":"SseKey"`) {
+		t.Fatalf("sse lines %q", lines)
+	}
+
+	testExpect(t, testApi(t, "GET", "/events?cursor=abc", nil), CODE_INVALID_PARAM)
+}
+
+func TestApiEventsWebsocket(t *testing.T) {
+	server := httptest.NewServer(testRouter)
+	defer server.Close()
+	testSetConf(t, func(conf *AppConfig) { conf.Events.Origins = []string{"https://dash.example.com"} })
+	cursor := testEventCursor()
+	emitEvent(event{Type: EVENT_KEY_GENERATED, Name: "WsApp", KeyName: "WsKey"})
+
+	dial := func(origin string) (*websocket.Conn, error) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/events?name=WsApp&cursor=" + strconv.FormatUint(cursor, 10)
+		return websocket.Dial(url, "", origin)
+	}
+	ws, err := dial("https://dash.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ev event
+	if err := websocket.JSON.Receive(ws, &ev); err != nil || ev.Type != EVENT_KEY_GENERATED || ev.KeyName != "WsKey" {
+		t.Fatalf("event %+v, %v", ev, err)
+	}
+
+	// page of another site
+	if ws, err := dial("https://evil.example.com"); err == nil {
+		ws.Close()
+		t.Fatal("websocket opened by origin not allowed")
+	}
+	testSetConf(t, func(conf *AppConfig) { conf.Events.Origins = nil })
+	if ws, err := dial("https://dash.example.com"); err == nil {
+		ws.Close()
+		t.Fatal("websocket opened by browser when no origin allowed")
+	}
+
+	// clients without Origin are not browsers
+	tests := []struct {
+		origins []string
+		origin  string
+		want    bool
+	}{
+		{nil, "", true},
+		{nil, "https://dash.example.com", false},
+		{[]string{"https://dash.example.com"}, "https://DASH.example.com", true},
+		{[]string{"https://dash.example.com"}, "https://dash.example.com:8443", false},
+		{[]string{"*"}, "https://any.example.com", true},
+	}
+	for _, tt := range tests {
+		testSetConf(t, func(conf *AppConfig) { conf.Events.Origins = tt.origins })
+		if got := allowEventsOrigin(tt.origin); got != tt.want {
+			t.Fatalf("origins %v, origin %q: allowed %v, want %v", tt.origins, tt.origin, got, tt.want)
+		}
+	}
+}
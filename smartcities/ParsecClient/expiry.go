@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// optional expiry of keys made for one session or one attestation round.
+// Ttl or ExpiresAt was given by /keysign /keyenc /key and saved in meta store,
+// expired keys were refused at once and destroyed by the reaper later.
+
+var errKeyExpired = errors.New("key expired")
+
+// application name -> key name without version -> expiry time
+var keyExpiry = make(map[string]map[string]time.Time)
+var keyExpiryLock sync.RWMutex
+
+// expiry time from Ttl like "30m" or ExpiresAt in RFC 3339, zero if none given
+func parseKeyExpiry(ttl string, expiresAt string) (time.Time, bool) {
+	switch {
+	case len(ttl) != 0 && len(expiresAt) != 0:
+		return time.Time{}, false
+	case len(ttl) != 0:
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return time.Time{}, false
+		}
+		return time.Now().Add(d), true
+	case len(expiresAt) != 0:
+		at, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil || !at.After(time.Now()) {
+			return time.Time{}, false
+		}
+		return at, true
+	}
+	return time.Time{}, true
+}
+
+// check Ttl and ExpiresAt of a new key, expiry need the meta store
+func checkKeyExpiry(c *gin.Context, param *paramAll) (time.Time, bool) {
+	at, ok := parseKeyExpiry(param.Ttl, param.ExpiresAt)
+	if !ok {
+		responseError(c, CODE_INVALID_PARAM)
+		return at, false
+	}
+	if !at.IsZero() && metaDB == nil {
+		responseError(c, CODE_NOT_SUPPORTED)
+		return at, false
+	}
+	return at, true
+}
+
+func setKeyExpiry(appName string, keyName string, at *time.Time) {
+	keyExpiryLock.Lock()
+	defer keyExpiryLock.Unlock()
+	if at == nil {
+		delete(keyExpiry[appName], keyName)
+		return
+	}
+	keys, ok := keyExpiry[appName]
+	if !ok {
+		keys = make(map[string]time.Time)
+		keyExpiry[appName] = keys
+	}
+	keys[keyName] = *at
+}
+
+// keyName with or without version
+func keyExpired(appName string, keyName string) bool {
+	base, _ := splitKeyName(keyName)
+	keyExpiryLock.RLock()
+	defer keyExpiryLock.RUnlock()
+	at, ok := keyExpiry[appName][base]
+	return ok && !time.Now().Before(at)
+}
+
+// code for errors of key name lookup
+func keyErrorCode(err error, fallback int32) int32 {
+	if errors.Is(err, errKeyExpired) {
+		return CODE_KEY_EXPIRED
+	}
+	if errors.Is(err, errKeyNotCurrent) {
+		return CODE_INVALID_KEY
+	}
+	return fallback
+}
+
+// expiry of all records, called after the meta store was opened
+func loadKeyExpiry() error {
+	return metaDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).ForEach(func(k, v []byte) error {
+			var meta keyMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			if meta.ExpiresAt != nil {
+				setKeyExpiry(meta.Name, meta.KeyName, meta.ExpiresAt)
+			}
+			return nil
+		})
+	})
+}
+
+// destroy all versions of expired keys
+func reapExpiredKeys(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		type expired struct {
+			appName string
+			keyName string
+			at      time.Time
+		}
+		var list []expired
+		now := time.Now()
+		keyExpiryLock.RLock()
+		for appName, keys := range keyExpiry {
+			for keyName, at := range keys {
+				if !now.Before(at) {
+					list = append(list, expired{appName, keyName, at})
+				}
+			}
+		}
+		keyExpiryLock.RUnlock()
+
+		for _, e := range list {
+			destroyExpiredKey(e.appName, e.keyName, e.at)
+		}
+	}
+}
+
+func destroyExpiredKey(appName string, keyName string, at time.Time) {
+	// still refused, but kept until the flag was cleared
+	if keyProtected(appName, keyName) {
+		zap.L().Debug("Expired key protected", zap.String("client", appName), zap.String("key", keyName))
+		return
+	}
+
+	client, ok := getClient(appName)
+	if !ok {
+		// no client since restart, use a new one if its daemon was known
+		if !appDaemonKnown(appName) {
+			zap.L().Warn("Expired key skipped, backend of client unknown", zap.String("client", appName), zap.String("key", keyName))
+			return
+		}
+		var err error
+		if client, err = newCryptoClient(appName); err != nil {
+			zap.L().Error("Expired key client fail", zap.String("client", appName), zap.Error(err))
+			return
+		}
+		defer client.Close()
+	}
+
+	keyNames, err := allKeyNames(appName, client, keyName)
+	if err != nil {
+		zap.L().Error("Expired key list fail", zap.String("client", appName), zap.String("key", keyName), zap.Error(err))
+		return
+	}
+	var destroyed []string
+	for _, name := range keyNames {
+		if err := client.PsaDestroyKey(name); err != nil {
+			zap.L().Warn("Destroy expired key fail", zap.String("client", appName), zap.String("key", name), zap.Error(err))
+			continue
+		}
+		destroyed = append(destroyed, name)
+	}
+	forgetKeyRing(appName, keyName)
+
+	// a version left in parsec was tried again next time
+	keys, err := client.ListKeys()
+	if err != nil {
+		zap.L().Error("Expired key list fail", zap.String("client", appName), zap.String("key", keyName), zap.Error(err))
+		return
+	}
+	for _, key := range keys {
+		if base, _ := splitKeyName(key.Name); base == keyName {
+			return
+		}
+	}
+	metaKeyDeleted(appName, keyName)
+
+	zap.L().Info("Expired key destroyed", zap.String("client", appName), zap.String("key", keyName))
+	audit("key_expired_destroyed",
+		zap.String("client", appName),
+		zap.String("key", keyName),
+		zap.Strings("versions", destroyed),
+		zap.Time("expiresAt", at),
+	)
+}
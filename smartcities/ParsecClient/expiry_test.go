@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// audit events written while the test runs
+func testAudit(t *testing.T) *observer.ObservedLogs {
+	t.Helper()
+	core, logs := observer.New(zap.InfoLevel)
+	old := auditLogger
+	auditLogger = zap.New(core)
+	t.Cleanup(func() { auditLogger = old })
+	return logs
+}
+
+func TestParseKeyExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		ttl       string
+		expiresAt string
+		want      time.Duration // from now, 0 for no expiry
+		ok        bool
+	}{
+		{"", "", 0, true},
+		{"30m", "", 30 * time.Minute, true},
+		{"1h30m", "", 90 * time.Minute, true},
+		{"", now.Add(2 * time.Hour).Format(time.RFC3339), 2 * time.Hour, true},
+		{"30m", now.Add(time.Hour).Format(time.RFC3339), 0, false},
+		{"30", "", 0, false},
+		{"-5m", "", 0, false},
+		{"0s", "", 0, false},
+		{"", "tomorrow", 0, false},
+		{"", now.Add(-time.Minute).Format(time.RFC3339), 0, false},
+	}
+	for _, tt := range tests {
+		at, ok := parseKeyExpiry(tt.ttl, tt.expiresAt)
+		if ok != tt.ok {
+			t.Fatalf("ttl %q expiresAt %q: ok %v, want %v", tt.ttl, tt.expiresAt, ok, tt.ok)
+		}
+		if !ok {
+			continue
+		}
+		if tt.want == 0 {
+			if !at.IsZero() {
+				t.Fatalf("ttl %q expiresAt %q: expiry %v, want none", tt.ttl, tt.expiresAt, at)
+			}
+			continue
+		}
+		if d := at.Sub(now) - tt.want; d < -time.Second || d > time.Second {
+			t.Fatalf("ttl %q expiresAt %q: expiry %v, want now + %v", tt.ttl, tt.expiresAt, at, tt.want)
+		}
+	}
+}
+
+func TestApiKeyExpiry(t *testing.T) {
+	testNewClient(t, "ExpiryClient")
+
+	// expiry need the meta store
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "ExpiryClient", KeyName: "NoMetaKey", Ttl: "1h"}), CODE_NOT_SUPPORTED)
+
+	testMetaDB(t)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "ExpiryClient", KeyName: "BadTtlKey", Ttl: "soon"}), CODE_INVALID_PARAM)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "ExpiryClient", KeyName: "BadTtlKey", Ttl: "1h", ExpiresAt: "2099-01-01T00:00:00Z"}), CODE_INVALID_PARAM)
+
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "ExpiryClient", KeyName: "ExpiresAtKey", ExpiresAt: "2099-01-01T00:00:00Z"}), CODE_SUCCESS)
+	meta, err := loadMeta("ExpiryClient", "ExpiresAtKey")
+	if err != nil || meta == nil || meta.ExpiresAt == nil || meta.ExpiresAt.Year() != 2099 {
+		t.Fatalf("meta %+v, %v", meta, err)
+	}
+	testSign(t, "ExpiryClient", "ExpiresAtKey", "hello")
+
+	// refused at once when expired, the reaper has not run
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "ExpiryClient", KeyName: "SessionKey", Alg: JWS_ES256, Ttl: "500ms"}), CODE_SUCCESS)
+	testSign(t, "ExpiryClient", "SessionKey", "hello")
+	meta, _ = loadMeta("ExpiryClient", "SessionKey")
+	time.Sleep(time.Until(*meta.ExpiresAt))
+	testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: "ExpiryClient", KeyName: "SessionKey", Message: "hello"}), CODE_KEY_EXPIRED)
+	if names := testKeyNames(t, "ExpiryClient"); !testContains(names, "SessionKey") {
+		t.Fatalf("expired key destroyed before reaper, keys %v", names)
+	}
+}
+
+func TestDestroyExpiredKey(t *testing.T) {
+	testNewClient(t, "ReapClient")
+	testMetaDB(t)
+	logs := testAudit(t)
+
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "ReapClient", KeyName: "ReapKey", Ttl: "1h", Protected: true}), CODE_SUCCESS)
+	testRotate(t, "ReapClient", "ReapKey")
+	at := time.Now().Add(-time.Minute)
+	setKeyExpiry("ReapClient", "ReapKey", &at)
+
+	// protected key was kept and still refused
+	destroyExpiredKey("ReapClient", "ReapKey", at)
+	if names := testKeyNames(t, "ReapClient"); !testContains(names, "ReapKey") || !testContains(names, "ReapKey@v1") {
+		t.Fatalf("protected key destroyed, keys %v", names)
+	}
+	if !keyExpired("ReapClient", "ReapKey") || logs.Len() != 0 {
+		t.Fatalf("protected key expired %v, audit %d", keyExpired("ReapClient", "ReapKey"), logs.Len())
+	}
+
+	// all versions were destroyed after the flag was cleared
+	setKeyProtected("ReapClient", "ReapKey", false)
+	destroyExpiredKey("ReapClient", "ReapKey", at)
+	if names := testKeyNames(t, "ReapClient"); testContains(names, "ReapKey") || testContains(names, "ReapKey@v1") {
+		t.Fatalf("expired key not destroyed, keys %v", names)
+	}
+	if meta, _ := loadMeta("ReapClient", "ReapKey"); meta != nil {
+		t.Fatalf("meta of destroyed key %+v", meta)
+	}
+	if keyExpired("ReapClient", "ReapKey") {
+		t.Fatal("expiry of destroyed key kept")
+	}
+
+	entries := logs.FilterMessage("key_expired_destroyed").All()
+	if len(entries) != 1 {
+		t.Fatalf("%d audit entries, want 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	versions, _ := fields["versions"].([]interface{})
+	if fields["client"] != "ReapClient" || fields["key"] != "ReapKey" || len(versions) != 2 {
+		t.Fatalf("audit fields %v", fields)
+	}
+	if expiresAt, _ := fields["expiresAt"].(time.Time); !expiresAt.Equal(at) {
+		t.Fatalf("audit expiresAt %v, want %v", fields["expiresAt"], at)
+	}
+}
+
+func testContains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
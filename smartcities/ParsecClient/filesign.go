@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"go.uber.org/zap"
+)
+
+// detached CMS signature of files and firmware images.
+// the upload was hashed while reading, so large files never stay in memory.
+// signer certificate was stored per key version under cms.certDir, a self-signed
+// one was made at first use, a CA issued one can be set by POST /file/cert.
+//
+// openssl cms -verify -binary -inform DER -in fw.p7s -content fw.bin -CAfile cert.pem -purpose any
+
+const (
+	cmsMediaType    = "application/pkcs7-signature"
+	cmsMaxPartSize  = 1 << 20 // signature and trust bundle
+	cmsFilePartName = "file"
+)
+
+var errCmsNoFile = errors.New("no file part in upload")
+var errCmsTrust = errors.New("no certificate in trust bundle")
+
+type paramCmsCert struct {
+	Name    string
+	KeyName string
+	Message string // PEM certificate of the current key version, for POST
+}
+
+type rtnCmsVerify struct {
+	Subject     string
+	Issuer      string
+	Serial      string
+	SigningTime time.Time
+	DigestAlg   string
+	Digest      string // hex
+}
+
+// file of signer certificate, one per versioned key and usage
+func cmsCertPath(appName string, keyName string, usage x509.ExtKeyUsage) string {
+	name := url.PathEscape(appName + "_" + keyName)
+	if usage == x509.ExtKeyUsageTimeStamping {
+		name += ".tsa"
+	}
+	return filepath.Join(GetConf().Cms.CertDir, name+".pem")
+}
+
+func loadCertFile(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errCmsFormat
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func storeCmsCert(appName string, keyName string, usage x509.ExtKeyUsage, cert *x509.Certificate) error {
+	path := cmsCertPath(appName, keyName, usage)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stored certificate of the signer key, self-signed one was made if none or expired
+func signerCmsCert(signer *parsecSigner, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	cert, err := loadCertFile(cmsCertPath(signer.appName, signer.keyName, usage))
+	if err == nil && certMatchKey(cert, signer.pub) {
+		// self-signed ones of older versions were CA, made again as leaf
+		selfSigned := bytes.Equal(cert.RawIssuer, cert.RawSubject)
+		if !selfSigned || (time.Now().Before(cert.NotAfter) && !cert.IsCA) {
+			return cert, nil
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	base, _ := splitKeyName(signer.keyName)
+	cert, err = selfSignedCert(signer, signer.appName+"_"+base, GetConf().Cms.Validity, usage)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeCmsCert(signer.appName, signer.keyName, usage, cert); err != nil {
+		return nil, err
+	}
+	zap.L().Info("Self-signed cms certificate made", zap.String("client", signer.appName), zap.String("key", signer.keyName))
+	return cert, nil
+}
+
+// the "file" part of multipart upload, or the raw body
+func uploadReader(c *gin.Context) (io.Reader, error) {
+	if !strings.HasPrefix(c.ContentType(), "multipart/") {
+		return c.Request.Body, nil
+	}
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, errCmsNoFile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == cmsFilePartName {
+			return part, nil
+		}
+	}
+}
+
+// DER, or PEM of "CMS" or "PKCS7"
+func decodeCmsSignature(data []byte) []byte {
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes
+	}
+	return data
+}
+
+func readSmallPart(part *multipart.Part) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(part, cmsMaxPartSize+1))
+	if err == nil && len(data) > cmsMaxPartSize {
+		err = errors.New("part " + part.FormName() + " too large")
+	}
+	return data, err
+}
+
+// curl -v --data-binary @fw.bin -o fw.p7s '127.0.0.1:8300/file/sign?Name=GoClient&KeyName=MyKey'
+// curl -v -F file=@fw.bin -o fw.p7s '127.0.0.1:8300/file/sign?Name=GoClient&KeyName=MyKey'
+func ApiFileSign(c *gin.Context) {
+	name, keyName := c.Query("Name"), c.Query("KeyName")
+	if len(name) == 0 || len(keyName) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// get client
+	client, ok := getClient(name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	release, ok := limitOp(c, name, LIMIT_OP_SIGN)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, name, requests.OpPsaSignHash) {
+		return
+	}
+
+	signer, code := newParsecSigner(name, client, keyName)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	cert, err := signerCmsCert(signer, x509.ExtKeyUsageCodeSigning)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	// hash while reading the upload
+	reader, err := uploadReader(c)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	h := signer.alg.hash.New()
+	size, err := io.Copy(h, reader)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	der, err := buildSignedData(signer, cert, []*x509.Certificate{cert}, oidData, nil, h.Sum(nil), time.Now())
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	zap.L().Info("File signed", zap.String("client", name), zap.String("key", signer.keyName), zap.Int64("size", size))
+
+	setKeyVersionHeader(c, signer.keyName)
+	c.Data(http.StatusOK, cmsMediaType, der)
+}
+
+// curl -v -F signature=@fw.p7s -F trust=@ca.pem -F file=@fw.bin 127.0.0.1:8300/file/verify
+func ApiFileVerify(c *gin.Context) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// parts may come in any order, so the file was hashed by all digest algs
+	hashes := map[crypto.Hash]hash.Hash{
+		crypto.SHA256: crypto.SHA256.New(),
+		crypto.SHA384: crypto.SHA384.New(),
+	}
+	var signature, trust []byte
+	var hasFile bool
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			zap.L().Error(err.Error())
+			responseError(c, CODE_INVALID_PARAM)
+			return
+		}
+		switch part.FormName() {
+		case cmsFilePartName:
+			hasFile = true
+			_, err = io.Copy(io.MultiWriter(hashes[crypto.SHA256], hashes[crypto.SHA384]), part)
+		case "signature":
+			signature, err = readSmallPart(part)
+		case "trust":
+			trust, err = readSmallPart(part)
+		}
+		if err != nil {
+			zap.L().Error(err.Error())
+			responseError(c, CODE_INVALID_PARAM)
+			return
+		}
+	}
+	if !hasFile || len(signature) == 0 || len(trust) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(trust) {
+		zap.L().Error(errCmsTrust.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	parsed, err := parseSignedData(decodeCmsSignature(signature))
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	digest := hashes[parsed.digestHash].Sum(nil)
+	if err := parsed.verify(digest, roots); err != nil {
+		zap.L().Info("File verify fail", zap.Error(err))
+		responseError(c, CODE_VERIFY_FAIL)
+		return
+	}
+
+	c.JSON(http.StatusOK, &rtnCmsVerify{
+		Subject:     parsed.signerCert.Subject.String(),
+		Issuer:      parsed.signerCert.Issuer.String(),
+		Serial:      parsed.signerCert.SerialNumber.Text(16),
+		SigningTime: parsed.signingTime,
+		DigestAlg:   parsed.digestHash.String(),
+		Digest:      hex.EncodeToString(digest),
+	})
+}
+
+// curl -v -X GET -d '{"Name": "GoClient", "KeyName": "MyKey"}' 127.0.0.1:8300/file/cert
+func ApiGetFileCert(c *gin.Context) {
+	param, ok := checkParam(c, 1)
+	if !ok {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// get client
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	// may sign a self-signed certificate
+	release, ok := limitOp(c, param.Name, LIMIT_OP_SIGN)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaSignHash) {
+		return
+	}
+
+	signer, code := newParsecSigner(param.Name, client, param.KeyName)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	cert, err := signerCmsCert(signer, x509.ExtKeyUsageCodeSigning)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	setKeyVersionHeader(c, signer.keyName)
+	c.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// set a CA issued certificate of current key version
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Message": "-----BEGIN CERTIFICATE-----\n..."}' 127.0.0.1:8300/file/cert
+func ApiSetFileCert(c *gin.Context) {
+	var data, _ = c.GetRawData()
+	var param paramCmsCert
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Name) == 0 || len(param.KeyName) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	block, _ := pem.Decode([]byte(param.Message))
+	if block == nil || block.Type != "CERTIFICATE" {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// get client
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_IMPORT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	signer, code := newParsecSigner(param.Name, client, param.KeyName)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	if !certMatchKey(cert, signer.pub) {
+		responseError(c, CODE_INVALID_KEY)
+		return
+	}
+	if err := storeCmsCert(param.Name, signer.keyName, x509.ExtKeyUsageCodeSigning, cert); err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	setKeyVersionHeader(c, signer.keyName)
+	c.Status(http.StatusOK)
+}
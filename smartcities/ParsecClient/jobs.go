@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// slow ops like rsa key generation on a tpm run in background with ?async=1.
+// jobs were kept in the meta store if enabled, a job running when the process
+// stopped was failed after restart, its key may or may not exist in parsec.
+
+const (
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+)
+
+// steps of a key job, the key exist in parsec since JOB_STAGE_RECORD
+const (
+	JOB_STAGE_GENERATE = "generate" // parsec generating the key
+	JOB_STAGE_RECORD   = "record"   // key made, keeping its version meta and protection
+)
+
+var jobBucket = []byte("jobs")
+
+var jobs = make(map[string]*job)
+var jobsLock sync.RWMutex
+
+type job struct {
+	ID       string
+	Op       string // keysign keyenc
+	Name     string
+	KeyName  string
+	Status   string // running done failed
+	Stage    string `json:",omitempty"` // step running, or the last one of a finished job
+	Code     int32  // result code when finished
+	Error    string `json:",omitempty"`
+	Callback string `json:",omitempty"` // url posted with the job when finished
+	Created  time.Time
+	Finished *time.Time `json:",omitempty"`
+}
+
+func InitJobs() {
+	if metaDB == nil {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(jobBucket)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		return bucket.ForEach(func(k, v []byte) error {
+			var j job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			if j.Status == JOB_RUNNING {
+				j.Status = JOB_FAILED
+				j.Code = CODE_PARSEC_ERROR
+				j.Error = "interrupted by restart"
+				if j.Stage == JOB_STAGE_RECORD {
+					j.Error = "interrupted by restart, key was generated"
+				}
+				j.Finished = &now
+				data, err := json.Marshal(&j)
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put(k, data); err != nil {
+					return err
+				}
+			}
+			jobs[j.ID] = &j
+			return nil
+		})
+	})
+	if err != nil {
+		zap.L().Fatal("Load jobs fail", zap.Error(err))
+	}
+	purgeJobs()
+}
+
+// copy of the job, it may be changed by its goroutine
+func getJob(id string) (job, bool) {
+	jobsLock.RLock()
+	defer jobsLock.RUnlock()
+	j, ok := jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// must hold jobsLock
+func saveJob(j *job) {
+	if metaDB == nil {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(jobBucket).Put([]byte(j.ID), data)
+	})
+	if err != nil {
+		zap.L().Error("Save job fail", zap.String("job", j.ID), zap.Error(err))
+	}
+}
+
+// forget finished jobs older than jobs.retention
+func purgeJobs() {
+	deadline := time.Now().Add(-GetConf().Jobs.Retention)
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	for id, j := range jobs {
+		if j.Finished == nil || j.Finished.After(deadline) {
+			continue
+		}
+		delete(jobs, id)
+		if metaDB != nil {
+			metaDB.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(jobBucket).Delete([]byte(id))
+			})
+		}
+	}
+}
+
+func allowCallback(url string) bool {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return false
+	}
+	// no prefix deny all, the server must not post to any url a caller give
+	for _, prefix := range GetConf().Jobs.Callbacks {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// run fn in background and response the job, release was called when fn finished.
+// fn report its steps by stage.
+func startJob(c *gin.Context, op string, param *paramAll, release func(), fn func(stage func(string)) int32) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		release()
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	purgeJobs()
+
+	j := &job{
+		ID:       hex.EncodeToString(b),
+		Op:       op,
+		Name:     param.Name,
+		KeyName:  param.KeyName,
+		Status:   JOB_RUNNING,
+		Callback: param.Callback,
+		Created:  time.Now(),
+	}
+	jobsLock.Lock()
+	jobs[j.ID] = j
+	saveJob(j)
+	rtn := *j
+	jobsLock.Unlock()
+
+	stage := func(s string) {
+		jobsLock.Lock()
+		j.Stage = s
+		saveJob(j)
+		jobsLock.Unlock()
+	}
+	go func() {
+		code := fn(stage)
+		release()
+
+		now := time.Now()
+		jobsLock.Lock()
+		j.Code = code
+		j.Finished = &now
+		if code == CODE_SUCCESS {
+			j.Status = JOB_DONE
+		} else {
+			j.Status = JOB_FAILED
+		}
+		saveJob(j)
+		done := *j
+		jobsLock.Unlock()
+
+		zap.L().Info("Job finished", zap.String("job", done.ID), zap.String("op", done.Op),
+			zap.String("client", done.Name), zap.String("key", done.KeyName), zap.Int32("code", done.Code))
+		if len(done.Callback) != 0 {
+			notifyJob(&done)
+		}
+	}()
+
+	c.Header("Location", "/jobs/"+rtn.ID)
+	c.JSON(http.StatusAccepted, &rtn)
+}
+
+// post the finished job to its callback once
+func notifyJob(j *job) {
+	data, err := json.Marshal(j)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return
+	}
+	client := http.Client{Timeout: GetConf().Jobs.CallbackTimeout}
+	resp, err := client.Post(j.Callback, "application/json", bytes.NewReader(data))
+	if err != nil {
+		zap.L().Warn("Job callback fail", zap.String("job", j.ID), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		zap.L().Warn("Job callback fail", zap.String("job", j.ID), zap.Int("status", resp.StatusCode))
+	}
+}
+
+// curl -v 127.0.0.1:8300/jobs/0123456789abcdef0123456789abcdef
+func ApiGetJob(c *gin.Context) {
+	j, ok := getJob(c.Param("id"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, &rtnCode{Code: CODE_INVALID_PARAM})
+		return
+	}
+	c.JSON(http.StatusOK, &j)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+)
+
+func TestJobAllowCallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		callbacks []string
+		url       string
+		allowed   bool
+	}{
+		{"NoPrefix", nil, "http://127.0.0.1:8080/done", false},
+		{"Prefix", []string{"http://127.0.0.1:8080/"}, "http://127.0.0.1:8080/done", true},
+		{"OtherHost", []string{"http://127.0.0.1:8080/"}, "http://169.254.169.254/latest/meta-data", false},
+		{"HostSuffix", []string{"http://hooks.example.com/"}, "http://hooks.example.com.evil.com/", false},
+		{"NotHttp", []string{"http://127.0.0.1:8080/"}, "file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testSetConf(t, func(conf *AppConfig) {
+				conf.Jobs.Callbacks = tt.callbacks
+			})
+			if allowed := allowCallback(tt.url); allowed != tt.allowed {
+				t.Fatalf("allowCallback(%q) = %v with %v", tt.url, allowed, tt.callbacks)
+			}
+		})
+	}
+
+	conf := GetConf()
+	for _, prefix := range []string{"http://hooks.example.com", "ftp://hooks.example.com/"} {
+		conf.Jobs.Callbacks = []string{prefix}
+		if err := conf.Validate(); err == nil {
+			t.Errorf("jobs.callbacks %q: no error", prefix)
+		}
+	}
+}
+
+// async key generation, the finished job was posted to the callback
+func TestJobAsyncKey(t *testing.T) {
+	const name = "JobClient"
+	testNewClient(t, name)
+
+	posted := make(chan job, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var j job
+		if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+			t.Errorf("callback body: %v", err)
+		}
+		posted <- j
+	}))
+	defer server.Close()
+
+	// no callbacks configured deny the callback
+	w := testApi(t, "POST", "/keysign?async=1", &paramAll{Name: name, KeyName: "JobKey", Callback: server.URL + "/done"})
+	testExpect(t, w, CODE_NOT_ALLOWED)
+
+	testSetConf(t, func(conf *AppConfig) {
+		conf.Jobs.Callbacks = []string{server.URL + "/"}
+	})
+	tests := []struct {
+		name   string
+		fail   bool
+		status string
+		stage  string
+	}{
+		{"Done", false, JOB_DONE, JOB_STAGE_RECORD},
+		{"GenerateFail", true, JOB_FAILED, JOB_STAGE_GENERATE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer testMock.ClearFailures()
+			if tt.fail {
+				testMock.InjectFailure(requests.OpPsaGenerateKey, requests.StatusPsaErrorInsufficientStorage, 1, false)
+			}
+			w := testApi(t, "POST", "/keysign?async=1", &paramAll{Name: name, KeyName: "JobKey" + tt.name, Callback: server.URL + "/done"})
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+			}
+			var started job
+			if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+				t.Fatal(err)
+			}
+			if started.Status != JOB_RUNNING || w.Header().Get("Location") != "/jobs/"+started.ID {
+				t.Fatalf("started job %+v, location %q", started, w.Header().Get("Location"))
+			}
+
+			var done job
+			select {
+			case done = <-posted:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("callback not posted")
+			}
+			if done.ID != started.ID || done.Status != tt.status || done.Stage != tt.stage || done.Finished == nil {
+				t.Fatalf("posted job %+v, want status %s stage %s", done, tt.status, tt.stage)
+			}
+
+			w = testApi(t, "GET", "/jobs/"+started.ID, nil)
+			var got job
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("get job: status %d, %v", w.Code, err)
+			}
+			if got.Status != tt.status || got.Stage != tt.stage {
+				t.Fatalf("get job %+v, want status %s stage %s", got, tt.status, tt.stage)
+			}
+		})
+	}
+}
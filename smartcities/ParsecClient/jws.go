@@ -0,0 +1,599 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+	"go.uber.org/zap"
+)
+
+// compact JWS and JWT signed by parsec keys, kid is "<key name>@v<version>".
+// sign keys made by /keysign with Alg, default RS256 is the same as before.
+
+const (
+	JWS_RS256 = "RS256"
+	JWS_PS256 = "PS256"
+	JWS_ES256 = "ES256"
+	JWS_ES384 = "ES384"
+)
+
+type jwsAlg struct {
+	hash    crypto.Hash
+	psaHash algorithm.HashAlgorithmType
+	keyBits uint32
+	ecc     bool
+	pss     bool
+}
+
+var jwsAlgs = map[string]jwsAlg{
+	JWS_RS256: {hash: crypto.SHA256, psaHash: algorithm.HashAlgorithmTypeSHA256, keyBits: 2048},
+	JWS_PS256: {hash: crypto.SHA256, psaHash: algorithm.HashAlgorithmTypeSHA256, keyBits: 2048, pss: true},
+	JWS_ES256: {hash: crypto.SHA256, psaHash: algorithm.HashAlgorithmTypeSHA256, keyBits: 256, ecc: true},
+	JWS_ES384: {hash: crypto.SHA384, psaHash: algorithm.HashAlgorithmTypeSHA384, keyBits: 384, ecc: true},
+}
+
+// algs in order of preference
+var jwsAlgOrder = []string{JWS_RS256, JWS_PS256, JWS_ES256, JWS_ES384}
+
+var errJwsFormat = errors.New("invalid compact jws")
+
+type jwsHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+type paramJwsSign struct {
+	Name      string
+	KeyName   string
+	Alg       string                 // RS256 PS256 ES256 ES384, default the alg of the key
+	Claims    map[string]interface{} // JWT claims, iss iat nbf exp jti were added if not given
+	Payload   string                 // sign raw payload instead of JWT claims
+	ExpiresIn int64                  // seconds, 0 use jws.ttl
+}
+
+type paramJwsVerify struct {
+	Name    string
+	KeyName string // optional, token must be signed by this key
+	Token   string
+}
+
+type rtnJws struct {
+	Header  jwsHeader
+	Claims  json.RawMessage `json:",omitempty"`
+	Payload string          `json:",omitempty"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type rtnJwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func (a jwsAlg) signAlg() *algorithm.AsymmetricSignatureAlgorithm {
+	factory := algorithm.NewAsymmetricSignature()
+	switch {
+	case a.ecc:
+		return factory.Ecdsa(a.psaHash).GetAsymmetricSignature()
+	case a.pss:
+		return factory.RsaPss(a.psaHash).GetAsymmetricSignature()
+	}
+	return factory.RsaPkcs1V15Sign(a.psaHash).GetAsymmetricSignature()
+}
+
+func (a jwsAlg) keyAttr() *parsec.KeyAttributes {
+	keyAttr := getSignAttr()
+	keyAttr.KeyBits = a.keyBits
+	factory := algorithm.NewAsymmetricSignature()
+	switch {
+	case a.ecc:
+		keyAttr.KeyType = parsec.NewKeyType().EccKeyPair(parsec.KeyTypeSECPR1)
+		keyAttr.KeyPolicy.KeyAlgorithm = factory.Ecdsa(a.psaHash)
+	case a.pss:
+		keyAttr.KeyPolicy.KeyAlgorithm = factory.RsaPss(a.psaHash)
+	default:
+		keyAttr.KeyPolicy.KeyAlgorithm = factory.RsaPkcs1V15Sign(a.psaHash)
+	}
+	return keyAttr
+}
+
+// attributes of new sign key, empty alg is RS256
+func signKeyAttr(alg string) (*parsec.KeyAttributes, bool) {
+	if len(alg) == 0 {
+		return getSignAttr(), true
+	}
+	a, ok := jwsAlgs[alg]
+	if !ok {
+		return nil, false
+	}
+	return a.keyAttr(), true
+}
+
+// alg of the sign key by its attributes, or the alg kept in meta store.
+// parsec ListKeys only return key bits, a key made before restart without
+// meta store has no known alg and can not sign.
+func keyJwsAlg(appName string, keyName string) (string, bool) {
+	base, _ := splitKeyName(keyName)
+	keyRingsLock.Lock()
+	var attr *parsec.KeyAttributes
+	if ring, ok := keyRings[appName][base]; ok {
+		attr = ring.attr
+	}
+	keyRingsLock.Unlock()
+
+	if attr != nil {
+		return attrJwsAlg(attr)
+	}
+	if meta, err := loadMeta(appName, base); err == nil && meta != nil && meta.Type == KEY_TYPE_SIGN {
+		if _, ok := jwsAlgs[meta.Alg]; ok {
+			return meta.Alg, true
+		}
+	}
+	return "", false
+}
+
+// alg of a public key by its type, imported rsa keys are RS256
+func pubKeyJwsAlg(key crypto.PublicKey) (string, bool) {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return JWS_RS256, true
+	case *ecdsa.PublicKey:
+		for _, name := range jwsAlgOrder {
+			a := jwsAlgs[name]
+			if a.ecc && a.keyBits == uint32(pub.Curve.Params().BitSize) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// alg of the sign key attributes
+func attrJwsAlg(attr *parsec.KeyAttributes) (string, bool) {
+	if attr == nil || !attr.KeyPolicy.KeyUsageFlags.SignHash {
+		return "", false
+	}
+	for _, name := range jwsAlgOrder {
+		a := jwsAlgs[name]
+		if attr.KeyBits != a.keyBits {
+			continue
+		}
+		sign := attr.KeyPolicy.KeyAlgorithm.GetAsymmetricSignature()
+		switch {
+		case a.ecc && sign.GetEcdsa() != nil, a.pss && sign.GetRsaPss() != nil,
+			!a.ecc && !a.pss && sign.GetRsaPkcs1V15Sign() != nil:
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// "MyKey@v2" -> "MyKey@v2", "MyKey" -> "MyKey@v0"
+func jwsKid(keyName string) string {
+	name, version := splitKeyName(keyName)
+	return name + keyVersionSep + strconv.Itoa(version)
+}
+
+// "MyKey@v2" -> "MyKey", "v2"
+func parseJwsKid(kid string) (string, string, bool) {
+	idx := strings.LastIndex(kid, keyVersionSep)
+	if idx <= 0 {
+		return "", "", false
+	}
+	hint := kid[idx+1:]
+	if _, err := parseVersionHint(hint); err != nil {
+		return "", "", false
+	}
+	return kid[:idx], hint, true
+}
+
+func jwsEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func jwsDigest(a jwsAlg, signingInput []byte) []byte {
+	h := a.hash.New()
+	h.Write(signingInput)
+	return h.Sum(nil)
+}
+
+// current key version and alg to sign, empty alg use the alg of the key
+func signKeyAlg(appName string, client CryptoClient, keyName string, algName string) (string, string, int32) {
+	keyName, err := currentKeyName(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", "", keyErrorCode(err, CODE_PARSEC_ERROR)
+	}
+	if len(algName) == 0 {
+		var ok bool
+		if algName, ok = keyJwsAlg(appName, keyName); !ok {
+			return "", "", CODE_INVALID_KEY
+		}
+	}
+	return keyName, algName, CODE_SUCCESS
+}
+
+// verify by the key version of kid, it must be current or still in grace period
+func verifyByKid(appName string, client CryptoClient, baseName string, hint string, alg jwsAlg, digest []byte, signature []byte) (string, int32) {
+	version, _ := parseVersionHint(hint)
+	keyName := versionedKeyName(baseName, version)
+	keyNames, err := candidateKeyNames(appName, client, baseName, "")
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", keyErrorCode(err, CODE_PARSEC_ERROR)
+	}
+	found := false
+	for _, name := range keyNames {
+		if name == keyName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", CODE_INVALID_KEY
+	}
+	// alg of the token must be the alg of the key, not any alg fit the key type (RFC 8725 3.1)
+	if keyAlg, err := verifyKeyAlg(appName, client, keyName); err != nil || keyAlg != alg {
+		recordVerifyFailure(appName, keyName)
+		return "", CODE_VERIFY_FAIL
+	}
+
+	var ok bool
+	if pk, err := getPublicKey(appName, client, keyName); err == nil {
+		ok = jwsVerifyLocal(alg, pk.key, digest, signature)
+	} else if supportOp(appName, requests.OpPsaVerifyHash) {
+		zap.L().Debug("Verify by parsec, public key not available for " + keyName + ": " + err.Error())
+		ok = client.PsaVerifyHash(keyName, digest, signature, alg.signAlg()) == nil
+	} else {
+		return "", CODE_NOT_SUPPORTED
+	}
+	if !ok {
+		recordVerifyFailure(appName, keyName)
+		return "", CODE_VERIFY_FAIL
+	}
+	return keyName, CODE_SUCCESS
+}
+
+// check public key type fit the alg, so a rsa key can not verify as ecdsa and so on
+func jwsKeyFit(a jwsAlg, key crypto.PublicKey) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return !a.ecc
+	case *ecdsa.PublicKey:
+		return a.ecc && uint32(pub.Curve.Params().BitSize) == a.keyBits
+	}
+	return false
+}
+
+func jwsVerifyLocal(a jwsAlg, key crypto.PublicKey, digest []byte, signature []byte) bool {
+	if !jwsKeyFit(a, key) {
+		return false
+	}
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if a.pss {
+			return rsa.VerifyPSS(pub, a.hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) == nil
+		}
+		return rsa.VerifyPKCS1v15(pub, a.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := int(a.keyBits+7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// iss iat nbf exp jti of JWT, the ones given by caller were kept
+func jwtClaims(param *paramJwsSign, ttl time.Duration) ([]byte, error) {
+	claims := param.Claims
+	if claims == nil {
+		claims = make(map[string]interface{})
+	}
+	now := time.Now().Unix()
+	if param.ExpiresIn > 0 {
+		ttl = time.Duration(param.ExpiresIn) * time.Second
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, err
+	}
+	for name, value := range map[string]interface{}{
+		"iss": param.Name,
+		"iat": now,
+		"nbf": now,
+		"exp": now + int64(ttl/time.Second),
+		"jti": hex.EncodeToString(jti),
+	} {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+	return json.Marshal(claims)
+}
+
+// check exp and nbf of JWT claims with leeway, payload not a json object was not checked
+func checkJwtTime(payload []byte, leeway time.Duration) int32 {
+	var claims map[string]json.RawMessage
+	if json.Unmarshal(payload, &claims) != nil {
+		return CODE_SUCCESS
+	}
+	claimTime := func(name string) (time.Time, bool, bool) {
+		raw, ok := claims[name]
+		if !ok {
+			return time.Time{}, false, true
+		}
+		var value float64
+		if json.Unmarshal(raw, &value) != nil {
+			return time.Time{}, true, false // not a number
+		}
+		return time.Unix(int64(value), 0), true, true
+	}
+
+	now := time.Now()
+	exp, has, ok := claimTime("exp")
+	if !ok {
+		return CODE_INVALID_PARAM
+	}
+	if has && now.Add(-leeway).After(exp) {
+		return CODE_TOKEN_EXPIRED
+	}
+	nbf, has, ok := claimTime("nbf")
+	if !ok {
+		return CODE_INVALID_PARAM
+	}
+	if has && now.Add(leeway).Before(nbf) {
+		return CODE_TOKEN_NOT_ACTIVE
+	}
+	return CODE_SUCCESS
+}
+
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Claims": {"sub": "edge-01"}, "ExpiresIn": 600}' 127.0.0.1:8300/jws/sign
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyEcKey", "Alg": "ES256", "Payload": "Hello World"}' 127.0.0.1:8300/jws/sign
+func ApiJwsSign(c *gin.Context) {
+	var data, _ = c.GetRawData()
+	var param paramJwsSign
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Name) == 0 || len(param.KeyName) == 0 || param.ExpiresIn < 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	if _, ok := jwsAlgs[param.Alg]; !ok && len(param.Alg) != 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// get client
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_SIGN)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaSignHash) {
+		return
+	}
+
+	keyName, algName, code := signKeyAlg(param.Name, client, param.KeyName, param.Alg)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	alg := jwsAlgs[algName]
+
+	header := jwsHeader{Alg: algName, Kid: jwsKid(keyName)}
+	payload := []byte(param.Payload)
+	var err error
+	if len(param.Payload) == 0 {
+		header.Typ = "JWT"
+		payload, err = jwtClaims(&param, GetConf().Jws.Ttl)
+		if err != nil {
+			zap.L().Error(err.Error())
+			responseError(c, CODE_INVALID_PARAM)
+			return
+		}
+	}
+	headerJson, _ := json.Marshal(&header)
+	signingInput := jwsEncode(headerJson) + "." + jwsEncode(payload)
+
+	// parsec ecdsa signature is r || s, the same as JWS
+	signature, err := client.PsaSignHash(keyName, jwsDigest(alg, []byte(signingInput)), alg.signAlg())
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	setKeyVersionHeader(c, keyName)
+	c.String(http.StatusOK, signingInput+"."+jwsEncode(signature))
+}
+
+// curl -v -d '{"Name": "GoClient", "Token": "xxx.yyy.zzz"}' 127.0.0.1:8300/jws/verify
+func ApiJwsVerify(c *gin.Context) {
+	var data, _ = c.GetRawData()
+	var param paramJwsVerify
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Name) == 0 || len(param.Token) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// header.payload.signature
+	parts := strings.Split(param.Token, ".")
+	if len(parts) != 3 {
+		zap.L().Error(errJwsFormat.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	var header jwsHeader
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(headerJson, &header)
+	}
+	payload, err2 := base64.RawURLEncoding.DecodeString(parts[1])
+	signature, err3 := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || err2 != nil || err3 != nil {
+		zap.L().Error(errJwsFormat.Error())
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	// "none" and hmac were never accepted
+	alg, ok := jwsAlgs[header.Alg]
+	if !ok {
+		responseError(c, CODE_VERIFY_FAIL)
+		return
+	}
+	baseName, hint, ok := parseJwsKid(header.Kid)
+	if !ok || (len(param.KeyName) != 0 && param.KeyName != baseName) {
+		responseError(c, CODE_INVALID_KEY)
+		return
+	}
+
+	// get client
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_VERIFY)
+	if !ok {
+		return
+	}
+	defer release()
+
+	digest := jwsDigest(alg, []byte(parts[0]+"."+parts[1]))
+	keyName, code := verifyByKid(param.Name, client, baseName, hint, alg, digest, signature)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+
+	if code := checkJwtTime(payload, GetConf().Jws.Leeway); code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+
+	rtn := rtnJws{Header: header}
+	if json.Valid(payload) {
+		rtn.Claims = payload
+	} else {
+		rtn.Payload = string(payload)
+	}
+	setKeyVersionHeader(c, keyName)
+	c.JSON(http.StatusOK, &rtn)
+}
+
+func newJwk(kid string, key crypto.PublicKey) (jwk, bool) {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		// RS256 or PS256 was not known from the public key
+		return jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Kid: kid,
+			N:   jwsEncode(pub.N.Bytes()),
+			E:   jwsEncode(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k := jwk{
+			Kty: "EC",
+			Use: "sig",
+			Kid: kid,
+			Crv: pub.Curve.Params().Name,
+			X:   jwsEncode(pub.X.FillBytes(make([]byte, size))),
+			Y:   jwsEncode(pub.Y.FillBytes(make([]byte, size))),
+		}
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			k.Alg = JWS_ES256
+		case 384:
+			k.Alg = JWS_ES384
+		default:
+			return jwk{}, false
+		}
+		return k, true
+	}
+	return jwk{}, false
+}
+
+// open clients of jws.jwks once, the unauthenticated jwks api never open one
+func InitJwks() {
+	conf := GetConf()
+	for _, item := range conf.Jws.Jwks {
+		if !conf.Acl.IsClientAllowed(item.Name) {
+			continue
+		}
+		if code := openClient(item.Name); code != CODE_SUCCESS {
+			zap.L().Error("Jwks client not usable", zap.String("client", item.Name), zap.Int32("code", code))
+		}
+	}
+}
+
+// public keys of jws.jwks, all versions still in grace period were published.
+// only clients already made were read.
+// curl -v 127.0.0.1:8300/.well-known/jwks.json
+func ApiJwks(c *gin.Context) {
+	conf := GetConf()
+	rtn := rtnJwks{Keys: make([]jwk, 0)}
+	for _, item := range conf.Jws.Jwks {
+		if !conf.Acl.IsClientAllowed(item.Name) {
+			continue
+		}
+		client, ok := getClient(item.Name)
+		if !ok {
+			continue
+		}
+		keyNames, err := candidateKeyNames(item.Name, client, item.Key, "")
+		if err != nil {
+			zap.L().Error(err.Error())
+			continue
+		}
+		for _, keyName := range keyNames {
+			pk, err := getPublicKey(item.Name, client, keyName)
+			if err != nil {
+				zap.L().Error("Jwks export key fail", zap.String("client", item.Name), zap.String("key", keyName), zap.Error(err))
+				continue
+			}
+			if k, ok := newJwk(jwsKid(keyName), pk.key); ok {
+				rtn.Keys = append(rtn.Keys, k)
+			}
+		}
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, &rtn)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testJwsSign(t *testing.T, param *paramJwsSign) string {
+	t.Helper()
+	w := testApi(t, "POST", "/jws/sign", param)
+	testExpect(t, w, CODE_SUCCESS)
+	return w.Body.String()
+}
+
+// token with the header changed, signature kept
+func testJwsHeader(t *testing.T, token string, fn func(header *jwsHeader)) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	data, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	var header jwsHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		t.Fatal(err)
+	}
+	fn(&header)
+	data, _ = json.Marshal(&header)
+	return jwsEncode(data) + "." + parts[1] + "." + parts[2]
+}
+
+func TestApiJws(t *testing.T) {
+	testNewClient(t, "JwsClient")
+	for _, alg := range []string{JWS_RS256, JWS_ES256} {
+		testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "JwsClient", KeyName: "JwsKey" + alg, Alg: alg}), CODE_SUCCESS)
+	}
+	verify := func(token string) *paramJwsVerify {
+		return &paramJwsVerify{Name: "JwsClient", Token: token}
+	}
+
+	token := testJwsSign(t, &paramJwsSign{Name: "JwsClient", KeyName: "JwsKeyES256", Claims: map[string]interface{}{"sub": "edge-01"}})
+	w := testApi(t, "POST", "/jws/verify", verify(token))
+	var rtn rtnJws
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d, body %q", w.Code, w.Body.String())
+	}
+	if rtn.Header.Alg != JWS_ES256 || rtn.Header.Kid != "JwsKeyES256@v0" || !strings.Contains(string(rtn.Claims), `"sub":"edge-01"`) {
+		t.Fatalf("verified %+v %s", rtn.Header, rtn.Claims)
+	}
+
+	// alg of the header must be the alg of the key
+	testExpect(t, testApi(t, "POST", "/jws/verify", verify(testJwsHeader(t, token, func(h *jwsHeader) { h.Alg = JWS_ES384 }))), CODE_VERIFY_FAIL)
+	testExpect(t, testApi(t, "POST", "/jws/verify", verify(testJwsHeader(t, token, func(h *jwsHeader) { h.Alg = "none" }))), CODE_VERIFY_FAIL)
+	token = testJwsSign(t, &paramJwsSign{Name: "JwsClient", KeyName: "JwsKeyRS256", Payload: "Hello World"})
+	testExpect(t, testApi(t, "POST", "/jws/verify", verify(token)), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/jws/verify", verify(testJwsHeader(t, token, func(h *jwsHeader) { h.Alg = JWS_PS256 }))), CODE_VERIFY_FAIL)
+
+	// a key only sign by its own alg
+	testExpect(t, testApi(t, "POST", "/jws/sign", &paramJwsSign{Name: "JwsClient", KeyName: "JwsKeyRS256", Alg: JWS_PS256}), CODE_PARSEC_ERROR)
+
+	// kid of other key or version
+	testExpect(t, testApi(t, "POST", "/jws/verify", verify(testJwsHeader(t, token, func(h *jwsHeader) { h.Kid = "JwsKeyRS256@v1" }))), CODE_INVALID_KEY)
+	testExpect(t, testApi(t, "POST", "/jws/verify", verify(testJwsHeader(t, token, func(h *jwsHeader) { h.Kid = "JwsKeyES256@v0" }))), CODE_VERIFY_FAIL)
+	testExpect(t, testApi(t, "POST", "/jws/verify", &paramJwsVerify{Name: "JwsClient", KeyName: "JwsKeyES256", Token: token}), CODE_INVALID_KEY)
+}
+
+func TestApiJwks(t *testing.T) {
+	testSetConf(t, func(conf *AppConfig) {
+		conf.Jws.Jwks = []CfgJwksKey{{Name: "JwksClient", Key: "JwksKey"}}
+	})
+	jwks := func() []jwk {
+		t.Helper()
+		w := testApi(t, "GET", "/.well-known/jwks.json", nil)
+		var rtn rtnJwks
+		if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("jwks: status %d, body %q", w.Code, w.Body.String())
+		}
+		return rtn.Keys
+	}
+
+	// the unauthenticated api never make a client
+	if keys := jwks(); len(keys) != 0 {
+		t.Fatalf("keys %+v without client", keys)
+	}
+	if _, ok := getClient("JwksClient"); ok {
+		t.Fatalf("client made by jwks")
+	}
+
+	InitJwks()
+	if _, ok := getClient("JwksClient"); !ok {
+		t.Fatalf("client of jws.jwks not opened at start")
+	}
+	t.Cleanup(func() { testApi(t, "DELETE", "/client", &paramAll{Name: "JwksClient"}) })
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "JwksClient", KeyName: "JwksKey", Alg: JWS_ES256}), CODE_SUCCESS)
+	keys := jwks()
+	if len(keys) != 1 || keys[0].Kid != "JwksKey@v0" || keys[0].Alg != JWS_ES256 || keys[0].Crv != "P-256" {
+		t.Fatalf("keys %+v", keys)
+	}
+}
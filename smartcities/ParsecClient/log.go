@@ -6,6 +6,11 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+var logLevel = zap.NewAtomicLevel()
+
+// audit events like destroyed keys, one json per line
+var auditLogger *zap.Logger
+
 func InitLog() {
 	// lumberjack write log in multi files
 	loggerIO := &lumberjack.Logger{
@@ -23,13 +28,40 @@ func InitLog() {
 	encoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout("2006-01-02 15:04:05")
 	encoder := zapcore.NewConsoleEncoder(encoderConfig)
 
-	// custom lv
-	var lv = new(zapcore.Level)
-	if lv.UnmarshalText([]byte(Conf.Log.Level)) != nil {
+	// custom lv, can be changed by config reload
+	if logLevel.UnmarshalText([]byte(Conf.Log.Level)) != nil {
 		panic("Error, unkonw debug level")
 	}
+	OnConfigReload(func(oldConf, newConf *AppConfig) {
+		if oldConf.Log.Level != newConf.Log.Level {
+			logLevel.UnmarshalText([]byte(newConf.Log.Level))
+		}
+	})
 
-	core := zapcore.NewCore(encoder, writeSyncer, lv)
+	core := zapcore.NewCore(encoder, writeSyncer, logLevel)
 	logger := zap.New(core, zap.AddCaller())
 	zap.ReplaceGlobals(logger)
+
+	if len(Conf.Log.Audit) != 0 {
+		auditIO := &lumberjack.Logger{
+			Filename:   Conf.Log.Audit,
+			MaxSize:    Conf.Log.MaxSize,
+			MaxBackups: Conf.Log.MaxBackups,
+			MaxAge:     Conf.Log.MaxAge,
+		}
+		auditConfig := zap.NewProductionEncoderConfig()
+		auditConfig.TimeKey = "time"
+		auditConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		auditCore := zapcore.NewCore(zapcore.NewJSONEncoder(auditConfig), zapcore.AddSync(auditIO), zap.InfoLevel)
+		auditLogger = zap.New(auditCore)
+	}
+}
+
+// write an audit event, to the main log if no audit file
+func audit(event string, fields ...zap.Field) {
+	if auditLogger == nil {
+		zap.L().Info("Audit "+event, fields...)
+		return
+	}
+	auditLogger.Info(event, fields...)
 }
@@ -1,11 +1,38 @@
 package main
 
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
 func init() {
 	InitParsec()
 }
 
 func main() {
-	InitConfig()
+	pflag.Parse()
+	if err := InitConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error,", err)
+		os.Exit(1)
+	}
 	InitLog()
+	InitBackend()
+	if pflag.Arg(0) == "selftest" {
+		// check daemons and exit, no server
+		Selftest()
+		return
+	}
+	InitReconnect()
+	InitPubKeyCache()
+	InitMeta()
+	InitJobs()
+	WatchConfig()
+	InitRotation()
+	InitRateLimit()
+	InitSshAgent()
+	InitJwks()
+	InitAttest()
 	InitApis()
 }
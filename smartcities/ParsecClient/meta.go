@@ -0,0 +1,586 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// key metadata kept in a bolt file, parsec only know key names and attributes.
+// one record per application and key name without version, the versions made
+// by rotation are the lineage. last used time was kept in memory and written
+// every meta.flushInterval.
+
+var metaBucket = []byte("keys")
+
+var errMetaDisabled = errors.New("meta store disabled")
+
+var metaDB *bolt.DB
+
+// application name -> key name -> last used time, not flushed yet
+var metaUsed = make(map[string]map[string]time.Time)
+var metaUsedLock sync.Mutex
+
+// Type of keys
+const (
+	KEY_TYPE_SIGN = "sign" // made by /keysign
+	KEY_TYPE_ENC  = "enc"  // made by /keyenc
+	KEY_TYPE_AEAD = "aead" // aes key made by vault aes256-gcm96
+	KEY_TYPE_PUB  = "pub"  // imported by /key
+)
+
+type keyVersionMeta struct {
+	Version   int
+	Created   time.Time
+	Retired   *time.Time `json:",omitempty"`
+	Destroyed *time.Time `json:",omitempty"`
+}
+
+type keyMeta struct {
+	Name        string // application name
+	KeyName     string // without version
+	Labels      map[string]string
+	Description string
+	Caller      string // ip of caller who made the key, empty if found by reconcile
+	Imported    bool   // public key set by /key
+	Type        string `json:",omitempty"` // sign enc aead pub, empty if found by reconcile
+	Alg         string `json:",omitempty"` // jws alg of sign key
+	Created     time.Time
+	LastUsed    *time.Time `json:",omitempty"`
+	ExpiresAt   *time.Time `json:",omitempty"` // destroyed by reaper after it
+	Protected   bool       // can not be destroyed
+	Versions    []keyVersionMeta
+}
+
+type paramKeyMeta struct {
+	Name        string
+	KeyName     string
+	Labels      map[string]string // all must match when list
+	Description string
+	Protected   *bool // keep it if not given
+}
+
+// metaClient record last used time of keys and refuse expired keys, ops were done by the wrapped client
+type metaClient struct {
+	CryptoClient
+	name string
+}
+
+var _ CryptoClient = (*metaClient)(nil)
+
+func InitMeta() {
+	conf := Conf.Meta
+	if len(conf.Path) == 0 {
+		return
+	}
+	db, err := bolt.Open(conf.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		zap.L().Fatal("Open meta store fail", zap.String("path", conf.Path), zap.Error(err))
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		zap.L().Fatal("Create meta bucket fail", zap.Error(err))
+	}
+	metaDB = db
+	if err := loadKeyExpiry(); err != nil {
+		zap.L().Fatal("Load key expiry fail", zap.Error(err))
+	}
+	if err := loadAppDaemons(); err != nil {
+		zap.L().Fatal("Load client backends fail", zap.Error(err))
+	}
+	reconcileAllMeta()
+
+	go flushMetaUsed(conf.FlushInterval)
+	go reapExpiredKeys(conf.ReapInterval)
+}
+
+// applications known by meta store or acl, others are reconciled when their client was made
+func reconcileAllMeta() {
+	names := map[string]bool{}
+	for _, name := range Conf.Acl.Clients {
+		names[name] = true
+	}
+	metaDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).ForEach(func(k, v []byte) error {
+			names[strings.SplitN(string(k), "\x00", 2)[0]] = true
+			return nil
+		})
+	})
+	for name := range names {
+		// listing another daemon would remove all its records
+		if !appDaemonKnown(name) {
+			zap.L().Warn("Meta reconcile skipped, backend of client unknown", zap.String("client", name))
+			continue
+		}
+		client, err := newCryptoClient(name)
+		if err != nil {
+			zap.L().Warn("Meta reconcile skipped", zap.String("client", name), zap.Error(err))
+			continue
+		}
+		if err := reconcileMeta(name, client); err != nil {
+			zap.L().Warn("Meta reconcile fail", zap.String("client", name), zap.Error(err))
+		}
+		client.Close()
+	}
+}
+
+func metaKey(appName string, keyName string) []byte {
+	return []byte(appName + "\x00" + keyName)
+}
+
+func getMeta(tx *bolt.Tx, appName string, keyName string) (*keyMeta, error) {
+	data := tx.Bucket(metaBucket).Get(metaKey(appName, keyName))
+	if data == nil {
+		return nil, nil
+	}
+	var meta keyMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func putMeta(tx *bolt.Tx, meta *keyMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(metaBucket).Put(metaKey(meta.Name, meta.KeyName), data)
+}
+
+// update one record, fn get nil if there is no record, return nil to delete it
+func updateMeta(appName string, keyName string, fn func(meta *keyMeta) *keyMeta) {
+	if metaDB == nil {
+		return
+	}
+	err := metaDB.Update(func(tx *bolt.Tx) error {
+		meta, err := getMeta(tx, appName, keyName)
+		if err != nil {
+			return err
+		}
+		meta = fn(meta)
+		if meta == nil {
+			return tx.Bucket(metaBucket).Delete(metaKey(appName, keyName))
+		}
+		return putMeta(tx, meta)
+	})
+	if err != nil {
+		zap.L().Error("Update key meta fail", zap.String("client", appName), zap.String("key", keyName), zap.Error(err))
+	}
+}
+
+// record of a new key made by /keysign /keyenc or imported by /key, zero expiresAt never expire
+func metaKeyCreated(appName string, keyName string, version int, attr *parsec.KeyAttributes, caller string, imported bool, labels map[string]string, description string, expiresAt time.Time) {
+	now := time.Now()
+	keyType := keyAttrType(attr)
+	alg := ""
+	if keyType == KEY_TYPE_SIGN {
+		alg, _ = attrJwsAlg(attr)
+	}
+	var expiry *time.Time
+	if !expiresAt.IsZero() {
+		expiry = &expiresAt
+	}
+	setKeyExpiry(appName, keyName, expiry)
+	if imported {
+		emitEvent(event{Type: EVENT_KEY_IMPORTED, Name: appName, KeyName: keyName, Version: version})
+	} else {
+		emitEvent(event{Type: EVENT_KEY_GENERATED, Name: appName, KeyName: keyName, Version: version})
+	}
+	updateMeta(appName, keyName, func(meta *keyMeta) *keyMeta {
+		return &keyMeta{
+			Name:        appName,
+			KeyName:     keyName,
+			Labels:      labels,
+			Description: description,
+			Caller:      caller,
+			Imported:    imported,
+			Type:        keyType,
+			Alg:         alg,
+			Created:     now,
+			ExpiresAt:   expiry,
+			Versions:    []keyVersionMeta{{Version: version, Created: now}},
+		}
+	})
+}
+
+// new version made by rotation, the old current version was retired
+func metaKeyRotated(appName string, keyName string, version int) {
+	now := time.Now()
+	emitEvent(event{Type: EVENT_KEY_ROTATED, Name: appName, KeyName: keyName, Version: version})
+	updateMeta(appName, keyName, func(meta *keyMeta) *keyMeta {
+		if meta == nil {
+			meta = &keyMeta{Name: appName, KeyName: keyName, Created: now}
+		}
+		for i := range meta.Versions {
+			if meta.Versions[i].Retired == nil && meta.Versions[i].Destroyed == nil {
+				meta.Versions[i].Retired = &now
+			}
+		}
+		meta.Versions = append(meta.Versions, keyVersionMeta{Version: version, Created: now})
+		return meta
+	})
+}
+
+// one retired version was destroyed by the reaper
+func metaVersionDestroyed(appName string, keyName string, version int) {
+	now := time.Now()
+	emitEvent(event{Type: EVENT_KEY_VERSION_DESTROYED, Name: appName, KeyName: keyName, Version: version})
+	updateMeta(appName, keyName, func(meta *keyMeta) *keyMeta {
+		if meta == nil {
+			return nil
+		}
+		for i := range meta.Versions {
+			if meta.Versions[i].Version == version {
+				meta.Versions[i].Destroyed = &now
+			}
+		}
+		return meta
+	})
+}
+
+// all versions were destroyed
+func metaKeyDeleted(appName string, keyName string) {
+	emitEvent(event{Type: EVENT_KEY_DESTROYED, Name: appName, KeyName: keyName})
+	updateMeta(appName, keyName, func(meta *keyMeta) *keyMeta {
+		return nil
+	})
+	setKeyExpiry(appName, keyName, nil)
+	metaUsedLock.Lock()
+	delete(metaUsed[appName], keyName)
+	metaUsedLock.Unlock()
+}
+
+// records of the application, keys in parsec without a record were added
+// and records of keys not in parsec were removed
+func reconcileMeta(appName string, client CryptoClient) error {
+	if metaDB == nil {
+		return nil
+	}
+	keys, err := client.ListKeys()
+	if err != nil {
+		return err
+	}
+	versions := make(map[string][]int)
+	for _, key := range keys {
+		name, version := splitKeyName(key.Name)
+		versions[name] = append(versions[name], version)
+	}
+
+	now := time.Now()
+	var added, removed int
+	err = metaDB.Update(func(tx *bolt.Tx) error {
+		// removed after the scan, Next after a cursor Delete may skip the record behind
+		bucket := tx.Bucket(metaBucket)
+		cursor := bucket.Cursor()
+		prefix := metaKey(appName, "")
+		var stale []string
+		for k, _ := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = cursor.Next() {
+			if _, ok := versions[string(k[len(prefix):])]; !ok {
+				stale = append(stale, string(k[len(prefix):]))
+			}
+		}
+		for _, keyName := range stale {
+			if err := bucket.Delete(metaKey(appName, keyName)); err != nil {
+				return err
+			}
+			setKeyExpiry(appName, keyName, nil)
+			removed++
+		}
+
+		for keyName, list := range versions {
+			meta, err := getMeta(tx, appName, keyName)
+			if err != nil {
+				return err
+			}
+			if meta == nil {
+				meta = &keyMeta{Name: appName, KeyName: keyName, Created: now}
+				added++
+			}
+			// versions destroyed while ParsecClient was not running
+			exist := make(map[int]bool)
+			for _, version := range list {
+				exist[version] = true
+			}
+			for i := range meta.Versions {
+				kv := &meta.Versions[i]
+				if !exist[kv.Version] && kv.Destroyed == nil {
+					kv.Destroyed = &now
+				}
+				delete(exist, kv.Version)
+			}
+			for version := range exist {
+				meta.Versions = append(meta.Versions, keyVersionMeta{Version: version, Created: now})
+			}
+			sort.Slice(meta.Versions, func(i, j int) bool { return meta.Versions[i].Version < meta.Versions[j].Version })
+			if err := putMeta(tx, meta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		zap.L().Info("Key meta reconciled", zap.String("client", appName), zap.Int("keys", len(versions)), zap.Int("added", added), zap.Int("removed", removed))
+	}
+	return err
+}
+
+func touchMeta(appName string, keyName string) {
+	base, _ := splitKeyName(keyName)
+	metaUsedLock.Lock()
+	used, ok := metaUsed[appName]
+	if !ok {
+		used = make(map[string]time.Time)
+		metaUsed[appName] = used
+	}
+	used[base] = time.Now()
+	metaUsedLock.Unlock()
+}
+
+func flushMetaUsed(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		flushMetaUsedNow()
+	}
+}
+
+// write last used times kept in memory, keys without record were dropped
+func flushMetaUsedNow() {
+	metaUsedLock.Lock()
+	used := metaUsed
+	metaUsed = make(map[string]map[string]time.Time)
+	metaUsedLock.Unlock()
+
+	for appName, keys := range used {
+		for keyName, at := range keys {
+			at := at
+			updateMeta(appName, keyName, func(meta *keyMeta) *keyMeta {
+				if meta != nil {
+					meta.LastUsed = &at
+				}
+				return meta
+			})
+		}
+	}
+}
+
+// record with last used time not flushed yet
+func loadMeta(appName string, keyName string) (*keyMeta, error) {
+	if metaDB == nil {
+		return nil, errMetaDisabled
+	}
+	var meta *keyMeta
+	err := metaDB.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getMeta(tx, appName, keyName)
+		return err
+	})
+	if meta != nil {
+		metaUsedLock.Lock()
+		if at, ok := metaUsed[appName][keyName]; ok {
+			meta.LastUsed = &at
+		}
+		metaUsedLock.Unlock()
+	}
+	return meta, err
+}
+
+// records of the application which have all the labels
+func listMeta(appName string, labels map[string]string) ([]*keyMeta, error) {
+	if metaDB == nil {
+		return nil, errMetaDisabled
+	}
+	list := make([]*keyMeta, 0)
+	err := metaDB.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(metaBucket).Cursor()
+		prefix := metaKey(appName, "")
+		for k, v := cursor.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = cursor.Next() {
+			var meta keyMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			match := true
+			for label, value := range labels {
+				if meta.Labels[label] != value {
+					match = false
+					break
+				}
+			}
+			if match {
+				list = append(list, &meta)
+			}
+		}
+		return nil
+	})
+	metaUsedLock.Lock()
+	for _, meta := range list {
+		if at, ok := metaUsed[appName][meta.KeyName]; ok {
+			at := at
+			meta.LastUsed = &at
+		}
+	}
+	metaUsedLock.Unlock()
+	return list, err
+}
+
+func (mc *metaClient) PsaSignHash(name string, hash []byte, alg *algorithm.AsymmetricSignatureAlgorithm) ([]byte, error) {
+	if keyExpired(mc.name, name) {
+		return nil, errKeyExpired
+	}
+	touchMeta(mc.name, name)
+	return mc.CryptoClient.PsaSignHash(name, hash, alg)
+}
+
+func (mc *metaClient) PsaVerifyHash(name string, hash, signature []byte, alg *algorithm.AsymmetricSignatureAlgorithm) error {
+	if keyExpired(mc.name, name) {
+		return errKeyExpired
+	}
+	touchMeta(mc.name, name)
+	return mc.CryptoClient.PsaVerifyHash(name, hash, signature, alg)
+}
+
+func (mc *metaClient) PsaAsymmetricEncrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, plaintext []byte) ([]byte, error) {
+	if keyExpired(mc.name, name) {
+		return nil, errKeyExpired
+	}
+	touchMeta(mc.name, name)
+	return mc.CryptoClient.PsaAsymmetricEncrypt(name, alg, salt, plaintext)
+}
+
+func (mc *metaClient) PsaAsymmetricDecrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, ciphertext []byte) ([]byte, error) {
+	if keyExpired(mc.name, name) {
+		return nil, errKeyExpired
+	}
+	touchMeta(mc.name, name)
+	return mc.CryptoClient.PsaAsymmetricDecrypt(name, alg, salt, ciphertext)
+}
+
+func (mc *metaClient) PsaAeadEncrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, plaintext []byte) ([]byte, error) {
+	if keyExpired(mc.name, name) {
+		return nil, errKeyExpired
+	}
+	touchMeta(mc.name, name)
+	return mc.CryptoClient.PsaAeadEncrypt(name, alg, nonce, additionalData, plaintext)
+}
+
+func (mc *metaClient) PsaAeadDecrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, ciphertext []byte) ([]byte, error) {
+	if keyExpired(mc.name, name) {
+		return nil, errKeyExpired
+	}
+	touchMeta(mc.name, name)
+	return mc.CryptoClient.PsaAeadDecrypt(name, alg, nonce, additionalData, ciphertext)
+}
+
+func checkMetaParam(c *gin.Context, needKey bool) (*paramKeyMeta, bool) {
+	var data, _ = c.GetRawData()
+	var param paramKeyMeta
+	if err := json.Unmarshal(data, &param); err != nil || len(param.Name) == 0 || (needKey && len(param.KeyName) == 0) {
+		responseError(c, CODE_INVALID_PARAM)
+		return nil, false
+	}
+	if metaDB == nil {
+		responseError(c, CODE_NOT_SUPPORTED)
+		return nil, false
+	}
+	if _, ok := getClient(param.Name); !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return nil, false
+	}
+	return &param, true
+}
+
+// curl -v -X GET -d '{"Name": "GoClient", "KeyName": "MyKey"}' 127.0.0.1:8300/key/meta
+func ApiGetKeyMeta(c *gin.Context) {
+	param, ok := checkMetaParam(c, true)
+	if !ok {
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_KEYS)
+	if !ok {
+		return
+	}
+	defer release()
+
+	keyName, _ := splitKeyName(param.KeyName)
+	meta, err := loadMeta(param.Name, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	if meta == nil {
+		responseError(c, CODE_INVALID_KEY)
+		return
+	}
+	c.JSON(http.StatusOK, meta)
+}
+
+// labels and description were replaced
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Labels": {"site": "gate-3"}, "Description": "camera evidence"}' 127.0.0.1:8300/key/meta
+func ApiSetKeyMeta(c *gin.Context) {
+	param, ok := checkMetaParam(c, true)
+	if !ok {
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_KEYS)
+	if !ok {
+		return
+	}
+	defer release()
+
+	keyName, _ := splitKeyName(param.KeyName)
+	found := false
+	updateMeta(param.Name, keyName, func(meta *keyMeta) *keyMeta {
+		if meta != nil {
+			found = true
+			meta.Labels = param.Labels
+			meta.Description = param.Description
+			if param.Protected != nil {
+				meta.Protected = *param.Protected
+			}
+		}
+		return meta
+	})
+	if !found {
+		responseError(c, CODE_INVALID_KEY)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// curl -v -X GET -d '{"Name": "GoClient", "Labels": {"site": "gate-3"}}' 127.0.0.1:8300/keys/meta
+func ApiListKeyMeta(c *gin.Context) {
+	param, ok := checkMetaParam(c, false)
+	if !ok {
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_KEYS)
+	if !ok {
+		return
+	}
+	defer release()
+
+	list, err := listMeta(param.Name, param.Labels)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
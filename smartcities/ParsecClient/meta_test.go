@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+)
+
+// client listing the given key names only
+type testKeysClient struct {
+	CryptoClient
+	names []string
+}
+
+func (c *testKeysClient) ListKeys() ([]*parsec.KeyInfo, error) {
+	keys := make([]*parsec.KeyInfo, 0, len(c.names))
+	for _, name := range c.names {
+		keys = append(keys, &parsec.KeyInfo{Name: name})
+	}
+	return keys, nil
+}
+
+func testPutMeta(t *testing.T, meta *keyMeta) {
+	t.Helper()
+	updateMeta(meta.Name, meta.KeyName, func(*keyMeta) *keyMeta { return meta })
+}
+
+func testMetaNames(t *testing.T, appName string, labels map[string]string) []string {
+	t.Helper()
+	list, err := listMeta(appName, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(list))
+	for _, meta := range list {
+		names = append(names, meta.KeyName)
+	}
+	return names
+}
+
+func TestReconcileMeta(t *testing.T) {
+	testMetaDB(t)
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	// stale records next to each other, and one of another application
+	for _, keyName := range []string{"KeyA", "KeyB", "KeyC", "KeyD", "KeyE"} {
+		testPutMeta(t, &keyMeta{Name: "MetaApp", KeyName: keyName, Created: created, Versions: []keyVersionMeta{{Version: 0, Created: created}}})
+	}
+	testPutMeta(t, &keyMeta{Name: "MetaApp2", KeyName: "KeyA", Created: created})
+
+	client := &testKeysClient{names: []string{"KeyD", "KeyD@v2", "KeyF"}}
+	if err := reconcileMeta("MetaApp", client); err != nil {
+		t.Fatal(err)
+	}
+	names := testMetaNames(t, "MetaApp", nil)
+	if len(names) != 2 || names[0] != "KeyD" || names[1] != "KeyF" {
+		t.Fatalf("records %v, want [KeyD KeyF]", names)
+	}
+	if names := testMetaNames(t, "MetaApp2", nil); len(names) != 1 {
+		t.Fatalf("records of other application %v", names)
+	}
+
+	// known record kept its creation, new version added
+	meta, err := loadMeta("MetaApp", "KeyD")
+	if err != nil || meta == nil || !meta.Created.Equal(created) || len(meta.Versions) != 2 || meta.Versions[1].Version != 2 {
+		t.Fatalf("KeyD meta %+v, %v", meta, err)
+	}
+	// key found in parsec has a record without caller and type
+	meta, err = loadMeta("MetaApp", "KeyF")
+	if err != nil || meta == nil || meta.Caller != "" || meta.Type != "" || len(meta.Versions) != 1 || meta.Versions[0].Version != 0 {
+		t.Fatalf("KeyF meta %+v, %v", meta, err)
+	}
+
+	// version destroyed while not running
+	client.names = []string{"KeyD@v2", "KeyF"}
+	if err := reconcileMeta("MetaApp", client); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ = loadMeta("MetaApp", "KeyD")
+	if meta.Versions[0].Destroyed == nil || meta.Versions[1].Destroyed != nil {
+		t.Fatalf("KeyD versions %+v", meta.Versions)
+	}
+
+	// nothing left in parsec
+	client.names = nil
+	if err := reconcileMeta("MetaApp", client); err != nil {
+		t.Fatal(err)
+	}
+	if names := testMetaNames(t, "MetaApp", nil); len(names) != 0 {
+		t.Fatalf("records %v, want none", names)
+	}
+}
+
+func TestListMeta(t *testing.T) {
+	testMetaDB(t)
+	testPutMeta(t, &keyMeta{Name: "MetaApp", KeyName: "Gate1", Labels: map[string]string{"site": "gate", "env": "prod"}})
+	testPutMeta(t, &keyMeta{Name: "MetaApp", KeyName: "Gate2", Labels: map[string]string{"site": "gate", "env": "test"}})
+	testPutMeta(t, &keyMeta{Name: "MetaApp", KeyName: "Plain"})
+	testPutMeta(t, &keyMeta{Name: "MetaApp2", KeyName: "Gate3", Labels: map[string]string{"site": "gate"}})
+
+	tests := []struct {
+		labels map[string]string
+		want   []string
+	}{
+		{nil, []string{"Gate1", "Gate2", "Plain"}},
+		{map[string]string{"site": "gate"}, []string{"Gate1", "Gate2"}},
+		{map[string]string{"site": "gate", "env": "prod"}, []string{"Gate1"}},
+		{map[string]string{"site": "other"}, []string{}},
+		{map[string]string{"env": ""}, []string{"Plain"}},
+	}
+	for _, tt := range tests {
+		names := testMetaNames(t, "MetaApp", tt.labels)
+		if len(names) != len(tt.want) {
+			t.Fatalf("labels %v: records %v, want %v", tt.labels, names, tt.want)
+		}
+		for i := range names {
+			if names[i] != tt.want[i] {
+				t.Fatalf("labels %v: records %v, want %v", tt.labels, names, tt.want)
+			}
+		}
+	}
+
+	metaDB = nil
+	if _, err := listMeta("MetaApp", nil); err != errMetaDisabled {
+		t.Fatalf("list without store: %v", err)
+	}
+}
+
+func TestFlushMetaUsed(t *testing.T) {
+	testMetaDB(t)
+	testPutMeta(t, &keyMeta{Name: "MetaApp", KeyName: "Used"})
+	testPutMeta(t, &keyMeta{Name: "MetaApp", KeyName: "Unused"})
+
+	touchMeta("MetaApp", "Used@v1")
+	touchMeta("MetaApp", "NoRecord")
+
+	// in memory until flushed, but already seen by load and list
+	meta, _ := loadMeta("MetaApp", "Used")
+	if meta.LastUsed == nil {
+		t.Fatal("last used not seen before flush")
+	}
+	list, _ := listMeta("MetaApp", nil)
+	for _, meta := range list {
+		if (meta.KeyName == "Used") != (meta.LastUsed != nil) {
+			t.Fatalf("listed %s last used %v", meta.KeyName, meta.LastUsed)
+		}
+	}
+
+	flushMetaUsedNow()
+	metaUsedLock.Lock()
+	pending := len(metaUsed)
+	metaUsedLock.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d applications not flushed", pending)
+	}
+	meta, _ = loadMeta("MetaApp", "Used")
+	if meta.LastUsed == nil || time.Since(*meta.LastUsed) > time.Minute {
+		t.Fatalf("flushed last used %v", meta.LastUsed)
+	}
+	meta, _ = loadMeta("MetaApp", "Unused")
+	if meta.LastUsed != nil {
+		t.Fatalf("unused key last used %v", meta.LastUsed)
+	}
+	// a used key without record was not added
+	if meta, _ := loadMeta("MetaApp", "NoRecord"); meta != nil {
+		t.Fatalf("record made by flush %+v", meta)
+	}
+}
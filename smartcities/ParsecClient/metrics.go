@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metrics in prometheus text format, every collector return its samples when scraped
+
+type metricSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+type metricCollector struct {
+	name    string
+	help    string
+	kind    string // gauge or counter
+	collect func() []metricSample
+}
+
+var metricCollectors []*metricCollector
+var metricLock sync.Mutex
+
+// RegisterMetric add a collector to /metrics
+func RegisterMetric(name string, help string, kind string, collect func() []metricSample) {
+	metricLock.Lock()
+	defer metricLock.Unlock()
+	metricCollectors = append(metricCollectors, &metricCollector{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		collect: collect,
+	})
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// curl -v 127.0.0.1:8300/metrics
+func ApiMetrics(c *gin.Context) {
+	metricLock.Lock()
+	collectors := metricCollectors
+	metricLock.Unlock()
+
+	var sb strings.Builder
+	for _, mc := range collectors {
+		fmt.Fprintf(&sb, "# HELP %s %s\n", mc.name, mc.help)
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", mc.name, mc.kind)
+		for _, sample := range mc.collect() {
+			fmt.Fprintf(&sb, "%s%s %v\n", mc.name, formatLabels(sample.Labels), sample.Value)
+		}
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(sb.String()))
+}
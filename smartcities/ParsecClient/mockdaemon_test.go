@@ -0,0 +1,667 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/auth"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/listauthenticators"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/listkeys"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/listopcodes"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/listproviders"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/ping"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaaeaddecrypt"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaaeadencrypt"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaalgorithm"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaasymmetricdecrypt"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaasymmetricencrypt"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psadestroykey"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaexportpublickey"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psageneratekey"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psageneraterandom"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psahashcompute"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaimportkey"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psakeyattributes"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psasignhash"
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psaverifyhash"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Mock parsec daemon speak the parsec wire protocol on a unix socket, keys are
+// software keys of softbackend.go. It let the real parsec-client-go path run
+// without TPM or the rust daemon, only built into tests.
+
+const (
+	mockMagicNumber      uint32 = 0x5EC0A710
+	mockHeaderSize       uint16 = 30
+	mockMaxBodySize      uint32 = 1 << 20
+	mockProviderCore            = 0
+	mockProviderMBed            = 1
+	mockAuthDirect              = 1
+	mockVersionMajor            = 1
+	mockVersionMinor            = 0
+	mockCoreProviderUuid        = "47049873-2a43-4845-9d72-831eab668784"
+	mockMBedProviderUuid        = "1c1139dc-ad7c-47dc-ad6b-db6fdb466552"
+)
+
+// fixed part of the wire header, little endian without padding
+type mockWireHeader struct {
+	Magic       uint32
+	HdrSize     uint16
+	VersionMaj  uint8
+	VersionMin  uint8
+	Flags       uint16
+	Provider    uint8
+	Session     uint64
+	ContentType uint8
+	AcceptType  uint8
+	AuthType    uint8
+	BodyLen     uint32
+	AuthLen     uint16
+	OpCode      uint32
+	Status      uint16
+	Reserved1   uint8
+	Reserved2   uint8
+}
+
+// failure injected for an opcode
+type mockFailure struct {
+	status requests.StatusCode
+	times  int  // left times, 0 is forever
+	drop   bool // close connection without response, like daemon crashed
+}
+
+type mockHandler func(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode)
+
+type MockDaemon struct {
+	path     string
+	listener net.Listener
+	failures map[requests.OpCode]*mockFailure
+	attrs    map[string]map[string]*psakeyattributes.KeyAttributes // application -> key -> wire attributes for ListKeys
+	hook     func(op requests.OpCode)                              // called before each request was handled, nil if none
+	hidden   map[requests.OpCode]bool                              // not listed by ListOpcodes, like a provider lacking them
+	lock     sync.Mutex
+	wg       sync.WaitGroup
+}
+
+var mockHandlers map[requests.OpCode]mockHandler
+
+// set in init, ListOpcodes handler refer to the map
+func init() {
+	mockHandlers = map[requests.OpCode]mockHandler{
+		requests.OpPing:                 mockPing,
+		requests.OpListProviders:        mockListProviders,
+		requests.OpListOpcodes:          mockListOpcodes,
+		requests.OpListAuthenticators:   mockListAuthenticators,
+		requests.OpListKeys:             mockListKeys,
+		requests.OpPsaGenerateKey:       mockGenerateKey,
+		requests.OpPsaImportKey:         mockImportKey,
+		requests.OpPsaExportPublicKey:   mockExportPublicKey,
+		requests.OpPsaDestroyKey:        mockDestroyKey,
+		requests.OpPsaHashCompute:       mockHashCompute,
+		requests.OpPsaSignHash:          mockSignHash,
+		requests.OpPsaVerifyHash:        mockVerifyHash,
+		requests.OpPsaAsymmetricEncrypt: mockAsymmetricEncrypt,
+		requests.OpPsaAsymmetricDecrypt: mockAsymmetricDecrypt,
+		requests.OpPsaAeadEncrypt:       mockAeadEncrypt,
+		requests.OpPsaAeadDecrypt:       mockAeadDecrypt,
+		requests.OpPsaGenerateRandom:    mockGenerateRandom,
+	}
+}
+
+// StartMockDaemon listen on the unix socket path and serve in background
+func StartMockDaemon(path string) (*MockDaemon, error) {
+	os.Remove(path) // stale socket of last run
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &MockDaemon{
+		path:     path,
+		listener: listener,
+		failures: make(map[requests.OpCode]*mockFailure),
+		attrs:    make(map[string]map[string]*psakeyattributes.KeyAttributes),
+	}
+	d.wg.Add(1)
+	go d.serve()
+	return d, nil
+}
+
+// InjectFailure make next times requests of op fail with status, times 0 is forever.
+// drop close the connection without response instead.
+func (d *MockDaemon) InjectFailure(op requests.OpCode, status requests.StatusCode, times int, drop bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.failures[op] = &mockFailure{status: status, times: times, drop: drop}
+}
+
+// ClearFailures remove all injected failures
+func (d *MockDaemon) ClearFailures() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.failures = make(map[requests.OpCode]*mockFailure)
+}
+
+// HideOpcodes make ListOpcodes not list ops, clients made later see a trimmed
+// provider. no ops list all again
+func (d *MockDaemon) HideOpcodes(ops ...requests.OpCode) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.hidden = make(map[requests.OpCode]bool)
+	for _, op := range ops {
+		d.hidden[op] = true
+	}
+}
+
+// OnRequest call fn before each request was handled, nil remove it
+func (d *MockDaemon) OnRequest(fn func(op requests.OpCode)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.hook = fn
+}
+
+func (d *MockDaemon) Close() error {
+	err := d.listener.Close()
+	d.wg.Wait()
+	os.Remove(d.path)
+	return err
+}
+
+func (d *MockDaemon) serve() {
+	defer d.wg.Done()
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				zap.L().Error("Mock parsec accept fail", zap.Error(err))
+			}
+			return
+		}
+		go d.handleConn(conn)
+	}
+}
+
+// take the injected failure of op, nil if none
+func (d *MockDaemon) takeFailure(op requests.OpCode) *mockFailure {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	f, ok := d.failures[op]
+	if !ok {
+		return nil
+	}
+	if f.times > 0 {
+		f.times--
+		if f.times == 0 {
+			delete(d.failures, op)
+		}
+	}
+	return f
+}
+
+// one request per connection like the real daemon, client read response until EOF
+func (d *MockDaemon) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var hdr mockWireHeader
+	if err := binary.Read(conn, binary.LittleEndian, &hdr); err != nil {
+		zap.L().Debug("Mock parsec read header fail", zap.Error(err))
+		return
+	}
+	if hdr.Magic != mockMagicNumber || hdr.HdrSize != mockHeaderSize {
+		zap.L().Debug("Mock parsec invalid header")
+		return
+	}
+	if hdr.BodyLen > mockMaxBodySize {
+		d.respond(conn, &hdr, nil, requests.StatusBodySizeExceedsLimit)
+		return
+	}
+	body := make([]byte, hdr.BodyLen)
+	authData := make([]byte, hdr.AuthLen)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, authData); err != nil {
+		return
+	}
+
+	if hdr.VersionMaj != mockVersionMajor || hdr.VersionMin != mockVersionMinor {
+		d.respond(conn, &hdr, nil, requests.StatusWireProtocolVersionNotSupported)
+		return
+	}
+
+	op := requests.OpCode(hdr.OpCode)
+	d.lock.Lock()
+	hook := d.hook
+	d.lock.Unlock()
+	if hook != nil {
+		hook(op)
+	}
+	if f := d.takeFailure(op); f != nil {
+		if f.drop {
+			return
+		}
+		d.respond(conn, &hdr, nil, f.status)
+		return
+	}
+
+	handler, ok := mockHandlers[op]
+	if !ok {
+		d.respond(conn, &hdr, nil, requests.StatusOpcodeDoesNotExist)
+		return
+	}
+
+	// direct authenticator send the application name
+	var app string
+	if auth.AuthenticationType(hdr.AuthType) == auth.AuthDirect {
+		app = string(authData)
+	}
+
+	result, status := handler(d, app, body)
+	d.respond(conn, &hdr, result, status)
+}
+
+func (d *MockDaemon) respond(conn net.Conn, req *mockWireHeader, result proto.Message, status requests.StatusCode) {
+	var body []byte
+	if result != nil && status == requests.StatusSuccess {
+		var err error
+		body, err = proto.Marshal(result)
+		if err != nil {
+			body, status = nil, requests.StatusSerializingBodyFailed
+		}
+	}
+
+	hdr := *req
+	hdr.VersionMaj = mockVersionMajor
+	hdr.VersionMin = mockVersionMinor
+	hdr.AcceptType = 0
+	hdr.BodyLen = uint32(len(body))
+	hdr.AuthLen = 0
+	hdr.Status = uint16(status)
+	if err := binary.Write(conn, binary.LittleEndian, &hdr); err != nil {
+		return
+	}
+	conn.Write(body)
+}
+
+// status of an error from the software keys
+func mockStatus(err error) requests.StatusCode {
+	if err == nil {
+		return requests.StatusSuccess
+	}
+	var se *softStatusError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return requests.StatusPsaErrorGenericError
+}
+
+// parse request body and check the application was authenticated
+func mockParse(app string, body []byte, op proto.Message) requests.StatusCode {
+	if err := proto.Unmarshal(body, op); err != nil {
+		return requests.StatusDeserializingBodyFailed
+	}
+	if len(app) == 0 {
+		return requests.StatusNotAuthenticated
+	}
+	return requests.StatusSuccess
+}
+
+func mockKeyAttributes(wire *psakeyattributes.KeyAttributes) (*parsec.KeyAttributes, error) {
+	if wire == nil || wire.KeyType == nil || wire.KeyPolicy == nil || wire.KeyPolicy.KeyUsageFlags == nil {
+		return nil, softError(requests.StatusPsaErrorInvalidArgument)
+	}
+
+	var keyType *parsec.KeyType
+	switch v := wire.KeyType.Variant.(type) {
+	case *psakeyattributes.KeyType_RsaKeyPair_:
+		keyType = parsec.NewKeyType().RsaKeyPair()
+	case *psakeyattributes.KeyType_RsaPublicKey_:
+		keyType = parsec.NewKeyType().RsaPublicKey()
+	case *psakeyattributes.KeyType_EccKeyPair_:
+		keyType = parsec.NewKeyType().EccKeyPair(parsec.EccFamily(v.EccKeyPair.CurveFamily))
+	case *psakeyattributes.KeyType_EccPublicKey_:
+		keyType = parsec.NewKeyType().EccPublicKey(parsec.EccFamily(v.EccPublicKey.CurveFamily))
+	case *psakeyattributes.KeyType_Aes_:
+		keyType = parsec.NewKeyType().Aes()
+	default:
+		return nil, softError(requests.StatusPsaErrorNotSupported)
+	}
+
+	alg, err := algorithm.NewAlgorithmFromWireInterface(wire.KeyPolicy.KeyAlgorithm)
+	if err != nil {
+		return nil, softError(requests.StatusPsaErrorInvalidArgument)
+	}
+	flags := wire.KeyPolicy.KeyUsageFlags
+	return &parsec.KeyAttributes{
+		KeyType: keyType,
+		KeyBits: wire.KeyBits,
+		KeyPolicy: &parsec.KeyPolicy{
+			KeyAlgorithm: alg,
+			KeyUsageFlags: &parsec.UsageFlags{
+				Export:        flags.Export,
+				Copy:          flags.Copy,
+				Cache:         flags.Cache,
+				Encrypt:       flags.Encrypt,
+				Decrypt:       flags.Decrypt,
+				SignMessage:   flags.SignMessage,
+				VerifyMessage: flags.VerifyMessage,
+				SignHash:      flags.SignHash,
+				VerifyHash:    flags.VerifyHash,
+				Derive:        flags.Derive,
+			},
+		},
+	}, nil
+}
+
+func mockAlgorithm(wire *psaalgorithm.Algorithm) (*algorithm.Algorithm, requests.StatusCode) {
+	alg, err := algorithm.NewAlgorithmFromWireInterface(wire)
+	if err != nil {
+		return nil, requests.StatusPsaErrorInvalidArgument
+	}
+	return alg, requests.StatusSuccess
+}
+
+func mockSignAlgorithm(wire *psaalgorithm.Algorithm_AsymmetricSignature) (*algorithm.AsymmetricSignatureAlgorithm, requests.StatusCode) {
+	alg, status := mockAlgorithm(&psaalgorithm.Algorithm{
+		Variant: &psaalgorithm.Algorithm_AsymmetricSignature_{AsymmetricSignature: wire},
+	})
+	if status != requests.StatusSuccess || alg.GetAsymmetricSignature() == nil {
+		return nil, requests.StatusPsaErrorInvalidArgument
+	}
+	return alg.GetAsymmetricSignature(), requests.StatusSuccess
+}
+
+func mockEncryptAlgorithm(wire *psaalgorithm.Algorithm_AsymmetricEncryption) (*algorithm.AsymmetricEncryptionAlgorithm, requests.StatusCode) {
+	alg, status := mockAlgorithm(&psaalgorithm.Algorithm{
+		Variant: &psaalgorithm.Algorithm_AsymmetricEncryption_{AsymmetricEncryption: wire},
+	})
+	if status != requests.StatusSuccess || alg.GetAsymmetricEncryption() == nil {
+		return nil, requests.StatusPsaErrorInvalidArgument
+	}
+	return alg.GetAsymmetricEncryption(), requests.StatusSuccess
+}
+
+func mockAeadAlgorithm(wire *psaalgorithm.Algorithm_Aead) (*algorithm.AeadAlgorithm, requests.StatusCode) {
+	alg, status := mockAlgorithm(&psaalgorithm.Algorithm{
+		Variant: &psaalgorithm.Algorithm_Aead_{Aead: wire},
+	})
+	if status != requests.StatusSuccess || alg.GetAead() == nil {
+		return nil, requests.StatusPsaErrorInvalidArgument
+	}
+	return alg.GetAead(), requests.StatusSuccess
+}
+
+func mockPing(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	return &ping.Result{
+		WireProtocolVersionMaj: mockVersionMajor,
+		WireProtocolVersionMin: mockVersionMinor,
+	}, requests.StatusSuccess
+}
+
+func mockListProviders(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	return &listproviders.Result{
+		Providers: []*listproviders.ProviderInfo{
+			{Uuid: mockMBedProviderUuid, Description: "Mock provider with software keys", Vendor: "ParsecClient", VersionMaj: 0, VersionMin: 1, Id: mockProviderMBed},
+			{Uuid: mockCoreProviderUuid, Description: "Mock core provider", Vendor: "ParsecClient", VersionMaj: 0, VersionMin: 1, Id: mockProviderCore},
+		},
+	}, requests.StatusSuccess
+}
+
+func mockListOpcodes(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op listopcodes.Operation
+	if err := proto.Unmarshal(body, &op); err != nil {
+		return nil, requests.StatusDeserializingBodyFailed
+	}
+
+	core := map[requests.OpCode]bool{
+		requests.OpPing:               true,
+		requests.OpListProviders:      true,
+		requests.OpListOpcodes:        true,
+		requests.OpListAuthenticators: true,
+		requests.OpListKeys:           true,
+	}
+	d.lock.Lock()
+	hidden := d.hidden
+	d.lock.Unlock()
+	var opcodes []uint32
+	for code := range mockHandlers {
+		if core[code] == (op.ProviderId == mockProviderCore) && !hidden[code] {
+			opcodes = append(opcodes, uint32(code))
+		}
+	}
+	sort.Slice(opcodes, func(i, j int) bool { return opcodes[i] < opcodes[j] })
+	return &listopcodes.Result{Opcodes: opcodes}, requests.StatusSuccess
+}
+
+func mockListAuthenticators(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	return &listauthenticators.Result{
+		Authenticators: []*listauthenticators.AuthenticatorInfo{
+			{Description: "Direct authenticator", VersionMaj: 0, VersionMin: 1, Id: mockAuthDirect},
+		},
+	}, requests.StatusSuccess
+}
+
+func mockListKeys(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op listkeys.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+
+	keys, err := newSoftClient(app).ListKeys()
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	result := &listkeys.Result{}
+	for _, key := range keys {
+		result.Keys = append(result.Keys, &listkeys.KeyInfo{
+			ProviderId: mockProviderMBed,
+			Name:       key.Name,
+			Attributes: d.attrs[app][key.Name],
+		})
+	}
+	return result, requests.StatusSuccess
+}
+
+func (d *MockDaemon) setAttrs(app string, name string, attr *psakeyattributes.KeyAttributes) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if attr == nil {
+		delete(d.attrs[app], name)
+		return
+	}
+	if _, ok := d.attrs[app]; !ok {
+		d.attrs[app] = make(map[string]*psakeyattributes.KeyAttributes)
+	}
+	d.attrs[app][name] = attr
+}
+
+func mockGenerateKey(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psageneratekey.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	attr, err := mockKeyAttributes(op.Attributes)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	if err := newSoftClient(app).PsaGenerateKey(op.KeyName, attr); err != nil {
+		return nil, mockStatus(err)
+	}
+	d.setAttrs(app, op.KeyName, op.Attributes)
+	return &psageneratekey.Result{}, requests.StatusSuccess
+}
+
+func mockImportKey(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psaimportkey.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	attr, err := mockKeyAttributes(op.Attributes)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	if err := newSoftClient(app).PsaImportKey(op.KeyName, attr, op.Data); err != nil {
+		return nil, mockStatus(err)
+	}
+	d.setAttrs(app, op.KeyName, op.Attributes)
+	return &psaimportkey.Result{}, requests.StatusSuccess
+}
+
+func mockExportPublicKey(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psaexportpublickey.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	data, err := newSoftClient(app).PsaExportPublicKey(op.KeyName)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psaexportpublickey.Result{Data: data}, requests.StatusSuccess
+}
+
+func mockDestroyKey(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psadestroykey.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	if err := newSoftClient(app).PsaDestroyKey(op.KeyName); err != nil {
+		return nil, mockStatus(err)
+	}
+	d.setAttrs(app, op.KeyName, nil)
+	return &psadestroykey.Result{}, requests.StatusSuccess
+}
+
+func mockHashCompute(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psahashcompute.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	hash, err := newSoftClient(app).PsaHashCompute(op.Input, algorithm.HashAlgorithmType(op.Alg))
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psahashcompute.Result{Hash: hash}, requests.StatusSuccess
+}
+
+func mockSignHash(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psasignhash.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	alg, status := mockSignAlgorithm(op.Alg)
+	if status != requests.StatusSuccess {
+		return nil, status
+	}
+	signature, err := newSoftClient(app).PsaSignHash(op.KeyName, op.Hash, alg)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psasignhash.Result{Signature: signature}, requests.StatusSuccess
+}
+
+func mockVerifyHash(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psaverifyhash.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	alg, status := mockSignAlgorithm(op.Alg)
+	if status != requests.StatusSuccess {
+		return nil, status
+	}
+	if err := newSoftClient(app).PsaVerifyHash(op.KeyName, op.Hash, op.Signature, alg); err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psaverifyhash.Result{}, requests.StatusSuccess
+}
+
+func mockAsymmetricEncrypt(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psaasymmetricencrypt.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	alg, status := mockEncryptAlgorithm(op.Alg)
+	if status != requests.StatusSuccess {
+		return nil, status
+	}
+	ciphertext, err := newSoftClient(app).PsaAsymmetricEncrypt(op.KeyName, alg, op.Salt, op.Plaintext)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psaasymmetricencrypt.Result{Ciphertext: ciphertext}, requests.StatusSuccess
+}
+
+func mockAsymmetricDecrypt(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psaasymmetricdecrypt.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	alg, status := mockEncryptAlgorithm(op.Alg)
+	if status != requests.StatusSuccess {
+		return nil, status
+	}
+	plaintext, err := newSoftClient(app).PsaAsymmetricDecrypt(op.KeyName, alg, op.Salt, op.Ciphertext)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psaasymmetricdecrypt.Result{Plaintext: plaintext}, requests.StatusSuccess
+}
+
+func mockAeadEncrypt(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psaaeadencrypt.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	alg, status := mockAeadAlgorithm(op.Alg)
+	if status != requests.StatusSuccess {
+		return nil, status
+	}
+	ciphertext, err := newSoftClient(app).PsaAeadEncrypt(op.KeyName, alg, op.Nonce, op.AdditionalData, op.Plaintext)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psaaeadencrypt.Result{Ciphertext: ciphertext}, requests.StatusSuccess
+}
+
+func mockAeadDecrypt(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psaaeaddecrypt.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	alg, status := mockAeadAlgorithm(op.Alg)
+	if status != requests.StatusSuccess {
+		return nil, status
+	}
+	plaintext, err := newSoftClient(app).PsaAeadDecrypt(op.KeyName, alg, op.Nonce, op.AdditionalData, op.Ciphertext)
+	if err != nil {
+		return nil, mockStatus(err)
+	}
+	return &psaaeaddecrypt.Result{Plaintext: plaintext}, requests.StatusSuccess
+}
+
+func mockGenerateRandom(d *MockDaemon, app string, body []byte) (proto.Message, requests.StatusCode) {
+	var op psageneraterandom.Operation
+	if status := mockParse(app, body, &op); status != requests.StatusSuccess {
+		return nil, status
+	}
+	if op.Size > uint64(mockMaxBodySize) {
+		return nil, requests.StatusPsaErrorInvalidArgument
+	}
+	data := make([]byte, op.Size)
+	if _, err := rand.Read(data); err != nil {
+		return nil, requests.StatusPsaErrorInsufficientEntropy
+	}
+	return &psageneraterandom.Result{RandomBytes: data}, requests.StatusSuccess
+}
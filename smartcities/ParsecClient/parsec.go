@@ -6,20 +6,36 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
 	"github.com/parallaxsecond/parsec-client-go/parsec"
 	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
 	"go.uber.org/zap"
 )
 
-var clients map[string]*parsec.BasicClient
+var clients map[string]CryptoClient
+var clientsLock sync.RWMutex
 
 type paramAll struct {
 	Name    string
 	KeyName string
 	Message string
 	Sign    string
+	Version string // key version hint like "v2", used by verify and decrypt
+	Alg     string // algorithm of new sign key, RS256 PS256 ES256 ES384, default RS256
+
+	Labels      map[string]string // metadata of new key
+	Description string
+	Ttl         string // new key expire after it, like "30m"
+	ExpiresAt   string // or expire at RFC 3339 time
+	Protected   bool   // new key can not be destroyed
+
+	Token string // confirm token of DELETE /keys
+
+	Callback string // url posted with the job of ?async=1 when finished
+	Backend  string // parsec daemon of new client, default backend.default
 }
 
 type rtnCode struct {
@@ -29,6 +45,7 @@ type rtnCode struct {
 type rtnKey struct {
 	Name       string
 	ProviderID uint32
+	Meta       *keyMeta `json:",omitempty"` // if meta store enabled
 }
 
 func responseError(c *gin.Context, code int32) {
@@ -106,10 +123,93 @@ func getEncryptAttr(isPair bool) *parsec.KeyAttributes {
 }
 
 func InitParsec() {
-	clients = make(map[string]*parsec.BasicClient)
+	clients = make(map[string]CryptoClient)
+}
+
+// provider of parsec daemon used for crypto ops if the daemon has no provider
+const parsecProvider = parsec.ProviderMBed
+
+// new parsec client of the daemon, DirectAuthenticator
+func newParsecClient(name string, d CfgDaemon) (*parsec.BasicClient, error) {
+	cfg := parsec.NewClientConfig().
+		Provider(d.providerID()).
+		Authenticator(parsec.NewDirectAuthenticator(name))
+	if len(d.Socket) != 0 {
+		cfg = cfg.Connection(&socketConnection{path: d.Socket})
+	}
+	return parsec.CreateConfiguredClient(cfg)
+}
+
+// get cached client by application name
+func getClient(name string) (CryptoClient, bool) {
+	clientsLock.RLock()
+	defer clientsLock.RUnlock()
+	client, ok := clients[name]
+	return client, ok
+}
+
+// create client of application name and cache it, nothing to do if it was cached
+func openClient(name string) int32 {
+	if _, ok := getClient(name); ok {
+		return CODE_SUCCESS
+	}
+
+	client, err := newCryptoClient(name)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return CODE_PARSEC_ERROR
+	}
+	// ping to check if ok
+	majver, minver, err := client.Ping()
+	if err != nil {
+		zap.L().Error(err.Error())
+		client.Close()
+		return CODE_PARSEC_ERROR
+	}
+	if majver != 1 || minver != 0 {
+		str := fmt.Sprintf("Parsec server version %v,%v was not supported!", majver, minver)
+		zap.L().Error(str)
+		client.Close()
+		return CODE_PARSEC_ERROR
+	}
+	// ops supported by provider
+	caps, err := discoverCaps(name, client)
+	if err != nil {
+		zap.L().Error(err.Error())
+		client.Close()
+		return CODE_PARSEC_ERROR
+	}
+	if !caps.hasDirectAuth() {
+		zap.L().Error("Parsec server has no direct authenticator")
+		client.Close()
+		return CODE_NOT_SUPPORTED
+	}
+	// cache it
+	maxClients := GetConf().Limits.MaxClients
+	clientsLock.Lock()
+	if _, ok := clients[name]; ok {
+		client.Close() // created by another request at same time
+	} else if maxClients > 0 && len(clients) >= maxClients {
+		clientsLock.Unlock()
+		client.Close()
+		return CODE_LIMIT_EXCEEDED
+	} else {
+		clients[name] = client
+		setCaps(name, caps)
+		emitEvent(event{Type: EVENT_CLIENT_CREATED, Name: name})
+	}
+	clientsLock.Unlock()
+	keepAppDaemon(name)
+	resetKeyRings(name)
+	if err := reconcileMeta(name, client); err != nil {
+		zap.L().Warn("Meta reconcile fail", zap.String("client", name), zap.Error(err))
+	}
+
+	return CODE_SUCCESS
 }
 
 // curl -v -d '{"Name": "GoClient"}' 127.0.0.1:8300/client
+// curl -v -d '{"Name": "GoClient", "Backend": "se0"}' 127.0.0.1:8300/client
 func ApiNewClient(c *gin.Context) {
 	param, ok := checkParam(c, 0)
 	if !ok {
@@ -117,35 +217,29 @@ func ApiNewClient(c *gin.Context) {
 		return
 	}
 
-	// if not found in cache
-	if _, ok := clients[param.Name]; !ok {
-		// new parsec, ProviderMBed, DirectAuthenticator
-		cfg := parsec.NewClientConfig().
-			Provider(parsec.ProviderMBed).
-			Authenticator(parsec.NewDirectAuthenticator(param.Name))
-		client, err := parsec.CreateConfiguredClient(cfg)
-		if err != nil {
-			zap.L().Error(err.Error())
-			responseError(c, CODE_PARSEC_ERROR)
-			return
-		}
-		// ping to check if ok
-		majver, minver, err := client.Ping()
-		if err != nil {
-			zap.L().Error(err.Error())
-			client.Close()
-			responseError(c, CODE_PARSEC_ERROR)
-			return
-		}
-		if majver != 1 && minver != 0 {
-			str := fmt.Sprintf("Parsec server version %v,%v was not supported!", majver, minver)
-			zap.L().Error(str)
-			client.Close()
-			responseError(c, CODE_PARSEC_ERROR)
+	conf := GetConf()
+	if !conf.Acl.IsClientAllowed(param.Name) {
+		zap.L().Warn("Client not allowed by acl: " + param.Name)
+		responseError(c, CODE_NOT_ALLOWED)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_CLIENT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if len(param.Backend) != 0 {
+		if code := selectDaemon(param.Name, param.Backend); code != CODE_SUCCESS {
+			responseError(c, code)
 			return
 		}
-		// cache it
-		clients[param.Name] = client
+	}
+
+	if code := openClient(param.Name); code != CODE_SUCCESS {
+		responseError(c, code)
+		return
 	}
 
 	c.Status(http.StatusOK)
@@ -160,10 +254,15 @@ func ApiDeleteClient(c *gin.Context) {
 	}
 
 	// if found in cache
+	clientsLock.Lock()
 	if client, ok := clients[param.Name]; ok {
 		client.Close()
 		delete(clients, param.Name)
+		forgetCaps(param.Name)
+		emitEvent(event{Type: EVENT_CLIENT_CLOSED, Name: param.Name})
 	}
+	clientsLock.Unlock()
+	resetKeyRings(param.Name)
 
 	c.Status(http.StatusOK)
 }
@@ -177,12 +276,18 @@ func ApiGetKeys(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
+	release, ok := limitOp(c, param.Name, LIMIT_OP_KEYS)
+	if !ok {
+		return
+	}
+	defer release()
+
 	keys, err := client.ListKeys()
 	if err != nil {
 		zap.L().Error(err.Error())
@@ -190,11 +295,21 @@ func ApiGetKeys(c *gin.Context) {
 		return
 	}
 
+	// metadata of key name without version
+	metas := make(map[string]*keyMeta)
+	if list, err := listMeta(param.Name, nil); err == nil {
+		for _, meta := range list {
+			metas[meta.KeyName] = meta
+		}
+	}
+
 	sliceKeys := make([]rtnKey, 0)
 	for _, key := range keys {
+		keyName, _ := splitKeyName(key.Name)
 		sliceKeys = append(sliceKeys, rtnKey{
 			Name:       key.Name,
 			ProviderID: uint32(key.ProviderID),
+			Meta:       metas[keyName],
 		})
 	}
 
@@ -202,6 +317,7 @@ func ApiGetKeys(c *gin.Context) {
 }
 
 // curl -v -X DELETE -d '{"Name": "GoClient"}' 127.0.0.1:8300/keys
+// curl -v -X DELETE -d '{"Name": "GoClient", "Token": "token returned above"}' 127.0.0.1:8300/keys
 func ApiDeleteKeys(c *gin.Context) {
 	param, ok := checkParam(c, 0)
 	if !ok {
@@ -210,24 +326,27 @@ func ApiDeleteKeys(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
-	keys, err := client.ListKeys()
-	if err != nil {
-		zap.L().Error(err.Error())
-		responseError(c, CODE_PARSEC_ERROR)
+	release, ok := limitOp(c, param.Name, LIMIT_OP_DELETE)
+	if !ok {
 		return
 	}
+	defer release()
 
-	for _, key := range keys {
-		client.PsaDestroyKey(key.Name)
+	if !requireOp(c, param.Name, requests.OpPsaDestroyKey) {
+		return
 	}
 
-	c.Status(http.StatusOK)
+	if len(param.Token) == 0 {
+		confirmDeleteKeys(c, param.Name, client)
+		return
+	}
+	deleteConfirmedKeys(c, param.Name, client, param.Token)
 }
 
 func newKey(c *gin.Context, isSign bool) {
@@ -238,24 +357,115 @@ func newKey(c *gin.Context, isSign bool) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
+	// tpm may take tens of seconds, run it as a job
+	async := c.Query("async") == "1"
+	if len(param.Callback) != 0 && (!async || !allowCallback(param.Callback)) {
+		responseError(c, CODE_NOT_ALLOWED)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_KEYGEN)
+	if !ok {
+		return
+	}
+	// job release it when finished
+	held := true
+	defer func() {
+		if held {
+			release()
+		}
+	}()
+
+	if !requireOp(c, param.Name, requests.OpPsaGenerateKey) {
+		return
+	}
+
+	expiresAt, ok := checkKeyExpiry(c, param)
+	if !ok || !checkKeyProtect(c, param) {
+		return
+	}
+
+	// "@vN" was kept for versions made by /key/rotate
+	if isVersionedKeyName(param.KeyName) {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// a rotated key need use /key/rotate to get new version
+	exist, err := hasKeyRing(param.Name, client, param.KeyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	if exist {
+		responseError(c, CODE_INVALID_KEY)
+		return
+	}
+
 	var keyAttr *parsec.KeyAttributes
+	keyType, alg := KEY_TYPE_ENC, ""
 	if isSign {
-		keyAttr = getSignAttr()
+		keyAttr, ok = signKeyAttr(param.Alg)
+		if !ok {
+			responseError(c, CODE_INVALID_PARAM)
+			return
+		}
+		keyType, alg = KEY_TYPE_SIGN, param.Alg
+		if len(alg) == 0 {
+			alg = JWS_RS256
+		}
 	} else {
 		keyAttr = getEncryptAttr(true)
 	}
+	reserved, code := checkTenantKey(param.Name, param.KeyName, keyType, alg, int(keyAttr.KeyBits))
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	// quota of tenant was released with the limit
+	limited := release
+	release = func() {
+		reserved()
+		limited()
+	}
 
 	// new key
-	err := client.PsaGenerateKey(param.KeyName, keyAttr)
-	if err != nil {
-		zap.L().Error(err.Error())
-		responseError(c, CODE_PARSEC_ERROR)
+	caller := c.ClientIP()
+	generate := func(stage func(string)) int32 {
+		stage(JOB_STAGE_GENERATE)
+		err := client.PsaGenerateKey(param.KeyName, keyAttr)
+		if err != nil {
+			zap.L().Error(err.Error())
+			return CODE_PARSEC_ERROR
+		}
+		stage(JOB_STAGE_RECORD)
+		keyName, version := splitKeyName(param.KeyName)
+		addKeyVersion(param.Name, keyName, version, keyAttr)
+		metaKeyCreated(param.Name, keyName, version, keyAttr, caller, false, param.Labels, param.Description, expiresAt)
+		if param.Protected {
+			setKeyProtected(param.Name, keyName, true)
+		}
+		return CODE_SUCCESS
+	}
+
+	if async {
+		op := "keyenc"
+		if isSign {
+			op = "keysign"
+		}
+		held = false
+		startJob(c, op, param, release, generate)
+		return
+	}
+	if code := generate(func(string) {}); code != CODE_SUCCESS {
+		responseError(c, code)
 		return
 	}
 
@@ -263,11 +473,16 @@ func newKey(c *gin.Context, isSign bool) {
 }
 
 // curl -v -d '{"Name": "GoClient", "KeyName": "MyKey"}' 127.0.0.1:8300/keysign
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Labels": {"site": "gate-3"}, "Description": "camera evidence"}' 127.0.0.1:8300/keysign
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyEcKey", "Alg": "ES256"}' 127.0.0.1:8300/keysign
+// curl -v -d '{"Name": "GoClient", "KeyName": "SessionKey", "Ttl": "30m"}' 127.0.0.1:8300/keysign
+// curl -v -d '{"Name": "GoClient", "KeyName": "TpmKey", "Callback": "http://127.0.0.1:8080/done"}' '127.0.0.1:8300/keysign?async=1'
 func ApiNewSignKey(c *gin.Context) {
 	newKey(c, true)
 }
 
 // curl -v -d '{"Name": "GoClient", "KeyName": "MyEncKey"}' 127.0.0.1:8300/keyenc
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyEncKey"}' '127.0.0.1:8300/keyenc?async=1'
 func ApiNewEncKey(c *gin.Context) {
 	newKey(c, false)
 }
@@ -281,12 +496,31 @@ func ApiSetKeyPub(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
+	release, ok := limitOp(c, param.Name, LIMIT_OP_IMPORT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaImportKey) {
+		return
+	}
+
+	expiresAt, ok := checkKeyExpiry(c, param)
+	if !ok || !checkKeyProtect(c, param) {
+		return
+	}
+	if isVersionedKeyName(param.KeyName) {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
 	// ssh-rsa pub -> []byte
 	strs := strings.Split(param.Message, " ")
 	if len(strs) != 3 {
@@ -307,12 +541,28 @@ func ApiSetKeyPub(c *gin.Context) {
 	}
 
 	keyAttr := getEncryptAttr(false)
+	bits := sshKeyBits(pubkey)
+	if bits == 0 {
+		bits = int(keyAttr.KeyBits)
+	}
+	reserved, code := checkTenantKey(param.Name, param.KeyName, KEY_TYPE_PUB, "", bits)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	defer reserved()
 	err = client.PsaImportKey(param.KeyName, keyAttr, pubkey)
 	if err != nil {
 		zap.L().Error(err.Error())
 		responseError(c, CODE_PARSEC_ERROR)
 		return
 	}
+	keyName, version := splitKeyName(param.KeyName)
+	addKeyVersion(param.Name, keyName, version, keyAttr)
+	metaKeyCreated(param.Name, keyName, version, keyAttr, c.ClientIP(), true, param.Labels, param.Description, expiresAt)
+	if param.Protected {
+		setKeyProtected(param.Name, keyName, true)
+	}
 
 	c.Status(http.StatusOK)
 }
@@ -326,23 +576,42 @@ func ApiGetKeyPub(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
+	release, ok := limitOp(c, param.Name, LIMIT_OP_EXPORT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaExportPublicKey) {
+		return
+	}
+
+	// current version, or a retired one given by caller to verify its old signatures
+	keyNames, err := candidateKeyNames(param.Name, client, param.KeyName, "")
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, keyErrorCode(err, CODE_PARSEC_ERROR))
+		return
+	}
+
 	// get key
-	b, err := client.PsaExportPublicKey(param.KeyName)
+	pk, err := getPublicKey(param.Name, client, keyNames[0])
 	if err != nil {
 		zap.L().Error(err.Error())
 		responseError(c, CODE_PARSEC_ERROR)
 		return
 	}
 
-	// []byte -> ssh-rsa pub
-	str := base64.StdEncoding.EncodeToString(b)
-	str = "ssh-rsa " + str + " " + param.Name + "_" + param.KeyName
+	// []byte -> ssh-rsa pub, ecc keys are "ecdsa-sha2-nistp256 <base64 of uncompressed point>"
+	str := base64.StdEncoding.EncodeToString(pk.data)
+	str = pubKeyPrefix(pk.key) + " " + str + " " + param.Name + "_" + param.KeyName
+	setKeyVersionHeader(c, keyNames[0])
 	c.String(http.StatusOK, str)
 }
 
@@ -355,17 +624,146 @@ func ApiDeleteKey(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
-	client.PsaDestroyKey(param.KeyName)
+	release, ok := limitOp(c, param.Name, LIMIT_OP_DELETE)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaDestroyKey) {
+		return
+	}
+
+	if keyProtected(param.Name, param.KeyName) {
+		responseError(c, CODE_KEY_PROTECTED)
+		return
+	}
+
+	// destroy all versions
+	if _, err := destroyKey(param.Name, client, param.KeyName); err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
 
 	c.Status(http.StatusOK)
 }
 
+// sign message with current key version, return key name used and signature
+func signMessage(appName string, client CryptoClient, keyName string, message []byte) (string, []byte, int32) {
+	if !supportOp(appName, requests.OpPsaSignHash) {
+		return "", nil, CODE_NOT_SUPPORTED
+	}
+
+	// sign with current key version
+	keyName, err := currentKeyName(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, keyErrorCode(err, CODE_PARSEC_ERROR)
+	}
+
+	// ONLY support sign hash, by the alg of the key policy
+	algName, ok := keyJwsAlg(appName, keyName)
+	if !ok {
+		return "", nil, CODE_INVALID_KEY
+	}
+	a := jwsAlgs[algName]
+	signature, err := client.PsaSignHash(keyName, jwsDigest(a, message), a.signAlg())
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, CODE_PARSEC_ERROR
+	}
+
+	return keyName, signature, CODE_SUCCESS
+}
+
+// verify signature by key versions from newest one, return key name matched
+func verifyMessage(appName string, client CryptoClient, keyName string, message []byte, signature []byte, hint string) (string, int32) {
+	// verify by public key in process, or by parsec
+	if !supportOp(appName, requests.OpPsaExportPublicKey) && !supportOp(appName, requests.OpPsaVerifyHash) {
+		return "", CODE_NOT_SUPPORTED
+	}
+
+	keyNames, err := candidateKeyNames(appName, client, keyName, hint)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", keyErrorCode(err, CODE_INVALID_PARAM)
+	}
+
+	// try versions from newest one
+	err = errKeyNotFound
+	for _, keyName := range keyNames {
+		var a jwsAlg
+		if a, err = verifyKeyAlg(appName, client, keyName); err != nil {
+			continue
+		}
+		err = verifyHash(appName, client, keyName, a, jwsDigest(a, message), signature)
+		if err == nil {
+			return keyName, CODE_SUCCESS
+		}
+	}
+
+	zap.L().Error(err.Error())
+	recordVerifyFailure(appName, keyName)
+	return "", CODE_VERIFY_FAIL
+}
+
+// encrypt with current key version, return key name used and ciphertext
+func encryptMessage(appName string, client CryptoClient, keyName string, plaintext []byte) (string, []byte, int32) {
+	if !supportOp(appName, requests.OpPsaAsymmetricEncrypt) {
+		return "", nil, CODE_NOT_SUPPORTED
+	}
+
+	keyName, err := currentKeyName(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, keyErrorCode(err, CODE_PARSEC_ERROR)
+	}
+	keyAttr := getEncryptAttr(true)
+	keyalg := keyAttr.KeyPolicy.KeyAlgorithm.GetAsymmetricEncryption()
+
+	ciphertext, err := client.PsaAsymmetricEncrypt(keyName, keyalg, []byte{}, plaintext)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, CODE_PARSEC_ERROR
+	}
+
+	return keyName, ciphertext, CODE_SUCCESS
+}
+
+// decrypt by key versions from newest one, return key name matched and plaintext
+func decryptMessage(appName string, client CryptoClient, keyName string, ciphertext []byte, hint string) (string, []byte, int32) {
+	if !supportOp(appName, requests.OpPsaAsymmetricDecrypt) {
+		return "", nil, CODE_NOT_SUPPORTED
+	}
+
+	keyNames, err := candidateKeyNames(appName, client, keyName, hint)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, keyErrorCode(err, CODE_INVALID_PARAM)
+	}
+
+	keyAttr := getEncryptAttr(true)
+	keyalg := keyAttr.KeyPolicy.KeyAlgorithm.GetAsymmetricEncryption()
+
+	// try versions from newest one
+	for _, keyName := range keyNames {
+		plaintext, err := client.PsaAsymmetricDecrypt(keyName, keyalg, []byte{}, ciphertext)
+		if err == nil {
+			return keyName, plaintext, CODE_SUCCESS
+		}
+		zap.L().Debug("Decrypt fail with " + keyName + ": " + err.Error())
+	}
+
+	return "", nil, CODE_PARSEC_ERROR
+}
+
 // curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Message": "Hello World"}' 127.0.0.1:8300/sign
 func ApiSign(c *gin.Context) {
 	param, ok := checkParam(c, 2)
@@ -375,35 +773,32 @@ func ApiSign(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
-	// ONLY support sign hash
-	hash, err := client.PsaHashCompute([]byte(param.Message), algorithm.HashAlgorithmTypeSHA256)
-	if err != nil {
-		responseError(c, CODE_PARSEC_ERROR)
+	release, ok := limitOp(c, param.Name, LIMIT_OP_SIGN)
+	if !ok {
 		return
 	}
+	defer release()
 
-	// sign
-	keyAttr := getSignAttr()
-	keyalg := keyAttr.KeyPolicy.KeyAlgorithm.GetAsymmetricSignature()
-	signature, err := client.PsaSignHash(param.KeyName, hash, keyalg)
-	if err != nil {
-		zap.L().Error(err.Error())
-		responseError(c, CODE_PARSEC_ERROR)
+	keyName, signature, code := signMessage(param.Name, client, param.KeyName, []byte(param.Message))
+	if code != CODE_SUCCESS {
+		responseError(c, code)
 		return
 	}
 
 	// []byte -> base64
 	str := base64.StdEncoding.EncodeToString(signature)
+	setKeyVersionHeader(c, keyName)
 	c.String(http.StatusOK, str)
 }
 
 // curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Message": "Hello World", "Sign": "xxx"}' 127.0.0.1:8300/verify
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyKey", "Message": "Hello World", "Sign": "xxx", "Version": "v1"}' 127.0.0.1:8300/verify
 func ApiVerify(c *gin.Context) {
 	param, ok := checkParam(c, 3)
 	if !ok {
@@ -412,18 +807,17 @@ func ApiVerify(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
-	hash, err := client.PsaHashCompute([]byte(param.Message), algorithm.HashAlgorithmTypeSHA256)
-	if err != nil {
-		zap.L().Error(err.Error())
-		responseError(c, CODE_PARSEC_ERROR)
+	release, ok := limitOp(c, param.Name, LIMIT_OP_VERIFY)
+	if !ok {
 		return
 	}
+	defer release()
 
 	signature, err := base64.StdEncoding.DecodeString(param.Sign)
 	if err != nil {
@@ -432,16 +826,13 @@ func ApiVerify(c *gin.Context) {
 		return
 	}
 
-	keyAttr := getSignAttr()
-	keyalg := keyAttr.KeyPolicy.KeyAlgorithm.GetAsymmetricSignature()
-
-	err = client.PsaVerifyHash(param.KeyName, hash, signature, keyalg)
-	if err != nil {
-		zap.L().Error(err.Error())
-		responseError(c, CODE_VERIFY_FAIL)
+	keyName, code := verifyMessage(param.Name, client, param.KeyName, []byte(param.Message), signature, param.Version)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
 		return
 	}
 
+	setKeyVersionHeader(c, keyName)
 	c.Status(http.StatusOK)
 }
 
@@ -454,28 +845,32 @@ func ApiEncrypt(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
-	keyAttr := getEncryptAttr(true)
-	keyalg := keyAttr.KeyPolicy.KeyAlgorithm.GetAsymmetricEncryption()
+	release, ok := limitOp(c, param.Name, LIMIT_OP_ENCRYPT)
+	if !ok {
+		return
+	}
+	defer release()
 
-	ciphertext, err := client.PsaAsymmetricEncrypt(param.KeyName, keyalg, []byte{}, []byte(param.Message))
-	if err != nil {
-		zap.L().Error(err.Error())
-		responseError(c, CODE_PARSEC_ERROR)
+	keyName, ciphertext, code := encryptMessage(param.Name, client, param.KeyName, []byte(param.Message))
+	if code != CODE_SUCCESS {
+		responseError(c, code)
 		return
 	}
 
 	// []byte -> base64
 	str := base64.StdEncoding.EncodeToString(ciphertext)
+	setKeyVersionHeader(c, keyName)
 	c.String(http.StatusOK, str)
 }
 
 // curl -v -d '{"Name": "GoClient", "KeyName": "MyEncKey", "Message": "xxxx"}' 127.0.0.1:8300/decrypt
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyEncKey", "Message": "xxxx", "Version": "v1"}' 127.0.0.1:8300/decrypt
 func ApiDecrypt(c *gin.Context) {
 	param, ok := checkParam(c, 2)
 	if !ok {
@@ -484,12 +879,18 @@ func ApiDecrypt(c *gin.Context) {
 	}
 
 	// get client
-	client, ok := clients[param.Name]
+	client, ok := getClient(param.Name)
 	if !ok {
 		responseError(c, CODE_INVALID_CLIENT)
 		return
 	}
 
+	release, ok := limitOp(c, param.Name, LIMIT_OP_DECRYPT)
+	if !ok {
+		return
+	}
+	defer release()
+
 	ciphertext, err := base64.StdEncoding.DecodeString(param.Message)
 	if err != nil {
 		zap.L().Error(err.Error())
@@ -497,15 +898,12 @@ func ApiDecrypt(c *gin.Context) {
 		return
 	}
 
-	keyAttr := getEncryptAttr(true)
-	keyalg := keyAttr.KeyPolicy.KeyAlgorithm.GetAsymmetricEncryption()
-
-	plaintext, err := client.PsaAsymmetricDecrypt(param.KeyName, keyalg, []byte{}, ciphertext)
-	if err != nil {
-		zap.L().Error(err.Error())
-		responseError(c, CODE_PARSEC_ERROR)
+	keyName, plaintext, code := decryptMessage(param.Name, client, param.KeyName, ciphertext, param.Version)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
 		return
 	}
 
+	setKeyVersionHeader(c, keyName)
 	c.String(http.StatusOK, string(plaintext))
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"go.uber.org/zap"
+)
+
+// exported public keys cache, so verify and get public key need no daemon call.
+// entries were dropped when the key was deleted, rotated or its client removed.
+
+type cachedPubKey struct {
+	data []byte           // as exported by parsec, rsa PKCS#1 DER or ecc uncompressed point
+	key  crypto.PublicKey // *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+var errPubKeyFormat = errors.New("unknown public key format")
+
+// application name -> key name without version -> versioned key name -> public key
+var pubKeys = make(map[string]map[string]map[string]*cachedPubKey)
+var pubKeysLock sync.RWMutex
+var pubKeyHits, pubKeyMisses uint64
+
+func InitPubKeyCache() {
+	RegisterMetric("parsecclient_pubkey_cache_hits_total", "Public key found in cache", "counter", func() []metricSample {
+		pubKeysLock.RLock()
+		defer pubKeysLock.RUnlock()
+		return []metricSample{{Value: float64(pubKeyHits)}}
+	})
+	RegisterMetric("parsecclient_pubkey_cache_misses_total", "Public key exported from parsec", "counter", func() []metricSample {
+		pubKeysLock.RLock()
+		defer pubKeysLock.RUnlock()
+		return []metricSample{{Value: float64(pubKeyMisses)}}
+	})
+}
+
+// sha256 of message, hash is public computation and done in process
+func hashMessage(message []byte) []byte {
+	hash := sha256.Sum256(message)
+	return hash[:]
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	if pub, err := x509.ParsePKCS1PublicKey(data); err == nil {
+		return pub, nil
+	}
+	// uncompressed point 0x04 || x || y
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		size := (curve.Params().BitSize + 7) / 8
+		if len(data) != 1+2*size {
+			continue
+		}
+		x, y := elliptic.Unmarshal(curve, data)
+		if x == nil {
+			break
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errPubKeyFormat
+}
+
+// key type of /key output, named like openssh
+func pubKeyPrefix(key crypto.PublicKey) string {
+	if pub, ok := key.(*ecdsa.PublicKey); ok {
+		return "ecdsa-sha2-nistp" + strconv.Itoa(pub.Curve.Params().BitSize)
+	}
+	return "ssh-rsa"
+}
+
+func lookupPublicKey(appName string, keyName string) (*cachedPubKey, bool) {
+	base, _ := splitKeyName(keyName)
+	pubKeysLock.Lock()
+	defer pubKeysLock.Unlock()
+	pk, ok := pubKeys[appName][base][keyName]
+	if ok {
+		pubKeyHits++
+	} else {
+		pubKeyMisses++
+	}
+	return pk, ok
+}
+
+// getPublicKey return the public key of a versioned key name, export it if not cached
+func getPublicKey(appName string, client CryptoClient, keyName string) (*cachedPubKey, error) {
+	if pk, ok := lookupPublicKey(appName, keyName); ok {
+		return pk, nil
+	}
+
+	data, err := client.PsaExportPublicKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	pk := &cachedPubKey{data: data, key: key}
+
+	base, _ := splitKeyName(keyName)
+	pubKeysLock.Lock()
+	defer pubKeysLock.Unlock()
+	if _, ok := pubKeys[appName]; !ok {
+		pubKeys[appName] = make(map[string]map[string]*cachedPubKey)
+	}
+	if _, ok := pubKeys[appName][base]; !ok {
+		pubKeys[appName][base] = make(map[string]*cachedPubKey)
+	}
+	pubKeys[appName][base][keyName] = pk
+	return pk, nil
+}
+
+// drop all versions of the key
+func forgetPublicKey(appName string, keyName string) {
+	base, _ := splitKeyName(keyName)
+	pubKeysLock.Lock()
+	defer pubKeysLock.Unlock()
+	delete(pubKeys[appName], base)
+}
+
+// drop all keys of the application
+func resetPublicKeys(appName string) {
+	pubKeysLock.Lock()
+	defer pubKeysLock.Unlock()
+	delete(pubKeys, appName)
+}
+
+// alg to verify with the key, of the sign key policy, or by the type of imported public key
+func verifyKeyAlg(appName string, client CryptoClient, keyName string) (jwsAlg, error) {
+	if name, ok := keyJwsAlg(appName, keyName); ok {
+		return jwsAlgs[name], nil
+	}
+	pk, err := getPublicKey(appName, client, keyName)
+	if err != nil {
+		return jwsAlg{}, err
+	}
+	name, ok := pubKeyJwsAlg(pk.key)
+	if !ok {
+		return jwsAlg{}, errPubKeyFormat
+	}
+	return jwsAlgs[name], nil
+}
+
+// verify in process with cached public key, use parsec if the key can not be exported
+func verifyHash(appName string, client CryptoClient, keyName string, a jwsAlg, digest []byte, signature []byte) error {
+	pk, err := getPublicKey(appName, client, keyName)
+	if err == nil {
+		if !jwsVerifyLocal(a, pk.key, digest, signature) {
+			return requests.StatusPsaErrorInvalidSignature.ToErr()
+		}
+		return nil
+	}
+	zap.L().Debug("Verify by parsec, public key not available for " + keyName + ": " + err.Error())
+
+	return client.PsaVerifyHash(keyName, digest, signature, a.signAlg())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+)
+
+// count requests to the mock daemon by op, stopped by cleanup
+func testCountOps(t *testing.T) func(op requests.OpCode) int {
+	t.Helper()
+	var lock sync.Mutex
+	counts := make(map[requests.OpCode]int)
+	testMock.OnRequest(func(op requests.OpCode) {
+		lock.Lock()
+		counts[op]++
+		lock.Unlock()
+	})
+	t.Cleanup(func() { testMock.OnRequest(nil) })
+	return func(op requests.OpCode) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return counts[op]
+	}
+}
+
+func testPubKey(t *testing.T, name string, keyName string) string {
+	t.Helper()
+	w := testApi(t, "GET", "/key", &paramAll{Name: name, KeyName: keyName})
+	testExpect(t, w, CODE_SUCCESS)
+	return w.Body.String()
+}
+
+func testCached(appName string, keyName string) bool {
+	base, _ := splitKeyName(keyName)
+	pubKeysLock.RLock()
+	defer pubKeysLock.RUnlock()
+	_, ok := pubKeys[appName][base][keyName]
+	return ok
+}
+
+// public key was exported once, then verify and /key use the cache
+func TestPubKeyCache(t *testing.T) {
+	testNewClient(t, "PubKeyClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "PubKeyClient", KeyName: "PubKey"}), CODE_SUCCESS)
+	count := testCountOps(t)
+
+	pub := testPubKey(t, "PubKeyClient", "PubKey")
+	if testPubKey(t, "PubKeyClient", "PubKey") != pub {
+		t.Fatalf("public key changed")
+	}
+	sign := testSign(t, "PubKeyClient", "PubKey", "hello")
+	testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: "PubKeyClient", KeyName: "PubKey", Message: "hello", Sign: sign}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: "PubKeyClient", KeyName: "PubKey", Message: "changed", Sign: sign}), CODE_VERIFY_FAIL)
+	if n := count(requests.OpPsaExportPublicKey); n != 1 {
+		t.Fatalf("public key exported %d times, want once", n)
+	}
+	if n := count(requests.OpPsaVerifyHash); n != 0 {
+		t.Fatalf("verified by parsec %d times, want in process", n)
+	}
+}
+
+func TestPubKeyCacheRotate(t *testing.T) {
+	testNewClient(t, "PubKeyRotateClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "PubKeyRotateClient", KeyName: "RotateKey"}), CODE_SUCCESS)
+	old := testPubKey(t, "PubKeyRotateClient", "RotateKey")
+	if !testCached("PubKeyRotateClient", "RotateKey") {
+		t.Fatalf("public key not cached")
+	}
+
+	testRotate(t, "PubKeyRotateClient", "RotateKey")
+	if testCached("PubKeyRotateClient", "RotateKey") {
+		t.Fatalf("cache kept after rotate")
+	}
+	if testPubKey(t, "PubKeyRotateClient", "RotateKey") == old {
+		t.Fatalf("public key of the retired version after rotate")
+	}
+	if !testCached("PubKeyRotateClient", "RotateKey@v1") {
+		t.Fatalf("public key of the new version not cached")
+	}
+}
+
+func TestPubKeyCacheDelete(t *testing.T) {
+	testNewClient(t, "PubKeyDeleteClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "PubKeyDeleteClient", KeyName: "DeleteKey"}), CODE_SUCCESS)
+	old := testPubKey(t, "PubKeyDeleteClient", "DeleteKey")
+
+	testExpect(t, testApi(t, "DELETE", "/key", &paramAll{Name: "PubKeyDeleteClient", KeyName: "DeleteKey"}), CODE_SUCCESS)
+	if testCached("PubKeyDeleteClient", "DeleteKey") {
+		t.Fatalf("cache kept after delete")
+	}
+
+	// a new key of the same name is never verified by the old public key
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "PubKeyDeleteClient", KeyName: "DeleteKey"}), CODE_SUCCESS)
+	if testPubKey(t, "PubKeyDeleteClient", "DeleteKey") == old {
+		t.Fatalf("public key of the deleted key")
+	}
+}
+
+// key whose export was refused by the provider is verified by parsec
+func TestPubKeyExportRefused(t *testing.T) {
+	testNewClient(t, "PubKeyRefusedClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "PubKeyRefusedClient", KeyName: "RefusedKey"}), CODE_SUCCESS)
+	sign := testSign(t, "PubKeyRefusedClient", "RefusedKey", "hello")
+
+	testMock.InjectFailure(requests.OpPsaExportPublicKey, requests.StatusPsaErrorNotPermitted, 0, false)
+	count := testCountOps(t)
+	testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: "PubKeyRefusedClient", KeyName: "RefusedKey", Message: "hello", Sign: sign}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: "PubKeyRefusedClient", KeyName: "RefusedKey", Message: "changed", Sign: sign}), CODE_VERIFY_FAIL)
+	if n := count(requests.OpPsaVerifyHash); n != 2 {
+		t.Fatalf("verified by parsec %d times, want 2", n)
+	}
+	if testCached("PubKeyRefusedClient", "RefusedKey") {
+		t.Fatalf("refused public key cached")
+	}
+	testExpect(t, testApi(t, "GET", "/key", &paramAll{Name: "PubKeyRefusedClient", KeyName: "RefusedKey"}), CODE_PARSEC_ERROR)
+}
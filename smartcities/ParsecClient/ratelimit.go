@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// op types for limit rules
+const (
+	LIMIT_OP_CLIENT   = "client"
+	LIMIT_OP_KEYS     = "keys"
+	LIMIT_OP_KEYGEN   = "keygen"
+	LIMIT_OP_IMPORT   = "import"
+	LIMIT_OP_EXPORT   = "export"
+	LIMIT_OP_DELETE   = "delete"
+	LIMIT_OP_ROTATE   = "rotate"
+	LIMIT_OP_SIGN     = "sign"
+	LIMIT_OP_VERIFY   = "verify"
+	LIMIT_OP_ENCRYPT  = "encrypt"
+	LIMIT_OP_DECRYPT  = "decrypt"
+	LIMIT_OP_SELFTEST = "selftest" // POST /diagnostics, name is diagnostics
+)
+
+const limitMatchAll = "*"
+
+// usage of one rule by one application
+type limitState struct {
+	rule     *CfgLimitRule
+	tokens   float64
+	last     time.Time
+	inFlight int
+	rejected map[string]uint64 // reason -> count
+}
+
+type limitKey struct {
+	name string
+	op   string
+}
+
+// rebuilt when config reload, old states still can be released
+var limitStates map[limitKey]*limitState
+var limitRules []CfgLimitRule
+var limitLock sync.Mutex
+
+func InitRateLimit() {
+	resetRateLimit(GetConf().RateLimit.Rules)
+	OnConfigReload(func(oldConf, newConf *AppConfig) {
+		resetRateLimit(newConf.RateLimit.Rules)
+	})
+
+	RegisterMetric("parsecclient_ratelimit_tokens", "Tokens left in bucket", "gauge", func() []metricSample {
+		return collectLimit(func(st *limitState) float64 { return math.Floor(st.tokens) })
+	})
+	RegisterMetric("parsecclient_inflight_ops", "Ops running now", "gauge", func() []metricSample {
+		return collectLimit(func(st *limitState) float64 { return float64(st.inFlight) })
+	})
+	RegisterMetric("parsecclient_ratelimit_rejected_total", "Ops rejected by limit", "counter", collectLimitRejected)
+}
+
+func resetRateLimit(rules []CfgLimitRule) {
+	limitLock.Lock()
+	defer limitLock.Unlock()
+	limitRules = rules
+	limitStates = make(map[limitKey]*limitState)
+}
+
+// first rule in config order which match the application and op
+func matchLimitRule(name string, op string) *CfgLimitRule {
+	for i := range limitRules {
+		rule := &limitRules[i]
+		if (rule.Name == name || rule.Name == limitMatchAll) && (rule.Op == op || rule.Op == limitMatchAll) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// add tokens for the time passed, must hold limitLock
+func (st *limitState) refill() {
+	now := time.Now()
+	st.tokens = math.Min(float64(st.rule.Burst), st.tokens+now.Sub(st.last).Seconds()*st.rule.Rate)
+	st.last = now
+}
+
+// acquireLimit take a token and an in flight slot. return release func if ok,
+// or how long to wait before retry
+func acquireLimit(name string, op string) (func(), time.Duration, bool) {
+	limitLock.Lock()
+	defer limitLock.Unlock()
+
+	rule := matchLimitRule(name, op)
+	if rule == nil {
+		return func() {}, 0, true // no limit
+	}
+
+	key := limitKey{name: name, op: op}
+	st, ok := limitStates[key]
+	if !ok {
+		st = &limitState{
+			rule:     rule,
+			tokens:   float64(rule.Burst),
+			last:     time.Now(),
+			rejected: make(map[string]uint64),
+		}
+		limitStates[key] = st
+	}
+
+	if rule.MaxInFlight > 0 && st.inFlight >= rule.MaxInFlight {
+		st.rejected["inflight"]++
+		return nil, time.Second, false
+	}
+
+	if rule.Rate > 0 {
+		st.refill()
+		if st.tokens < 1 {
+			st.rejected["rate"]++
+			wait := time.Duration((1 - st.tokens) / rule.Rate * float64(time.Second))
+			return nil, wait, false
+		}
+		st.tokens--
+	}
+
+	st.inFlight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limitLock.Lock()
+			st.inFlight--
+			limitLock.Unlock()
+		})
+	}, 0, true
+}
+
+// limitOp acquire limit for api, response 429 with Retry-After if over limit
+func limitOp(c *gin.Context, name string, op string) (func(), bool) {
+	release, wait, ok := acquireLimit(name, op)
+	if !ok {
+		zap.L().Warn("Over limit", zap.String("client", name), zap.String("op", op))
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, &rtnCode{
+			Code: CODE_RATE_LIMITED,
+		})
+		return nil, false
+	}
+	return release, true
+}
+
+func collectLimit(value func(st *limitState) float64) []metricSample {
+	limitLock.Lock()
+	defer limitLock.Unlock()
+
+	samples := make([]metricSample, 0, len(limitStates))
+	for key, st := range limitStates {
+		// refill before report, so idle bucket show its real tokens
+		if st.rule.Rate > 0 {
+			st.refill()
+		}
+		samples = append(samples, metricSample{
+			Labels: map[string]string{"name": key.name, "op": key.op},
+			Value:  value(st),
+		})
+	}
+	return samples
+}
+
+func collectLimitRejected() []metricSample {
+	limitLock.Lock()
+	defer limitLock.Unlock()
+
+	samples := make([]metricSample, 0, len(limitStates))
+	for key, st := range limitStates {
+		for reason, count := range st.rejected {
+			samples = append(samples, metricSample{
+				Labels: map[string]string{"name": key.name, "op": key.op, "reason": reason},
+				Value:  float64(count),
+			})
+		}
+	}
+	return samples
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// limit rules of one test, the rules of config were back by cleanup
+func testLimitRules(t *testing.T, rules ...CfgLimitRule) {
+	t.Helper()
+	resetRateLimit(rules)
+	t.Cleanup(func() { resetRateLimit(GetConf().RateLimit.Rules) })
+}
+
+func testMetrics(t *testing.T) string {
+	t.Helper()
+	w := testApi(t, "GET", "/metrics", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics: status %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestApiRateLimit(t *testing.T) {
+	testNewClient(t, "LimitClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "LimitClient", KeyName: "LimitKey"}), CODE_SUCCESS)
+	testLimitRules(t, CfgLimitRule{Name: "LimitClient", Op: LIMIT_OP_SIGN, Rate: 0.01, Burst: 2})
+
+	sign := &paramAll{Name: "LimitClient", KeyName: "LimitKey", Message: "hello"}
+	testExpect(t, testApi(t, "POST", "/sign", sign), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/sign", sign), CODE_SUCCESS)
+	w := testApi(t, "POST", "/sign", sign)
+	testExpect(t, w, CODE_RATE_LIMITED)
+	// one token come after 100s at 0.01 per second
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over limit: status %d", w.Code)
+	}
+	if wait, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || wait < 90 || wait > 100 {
+		t.Fatalf("Retry-After %q, want about 100", w.Header().Get("Retry-After"))
+	}
+
+	// other ops and applications are not limited by the rule
+	testExpect(t, testApi(t, "POST", "/verify", &paramAll{Name: "LimitClient", KeyName: "LimitKey", Message: "hello", Sign: "c2lnbg=="}), CODE_VERIFY_FAIL)
+	testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: "OtherLimitClient", KeyName: "LimitKey", Message: "hello"}), CODE_INVALID_CLIENT)
+
+	metrics := testMetrics(t)
+	for _, line := range []string{
+		`parsecclient_ratelimit_tokens{name="LimitClient",op="sign"} 0`,
+		`parsecclient_inflight_ops{name="LimitClient",op="sign"} 0`,
+		`parsecclient_ratelimit_rejected_total{name="LimitClient",op="sign",reason="rate"} 1`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("metrics has no %q:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestApiInFlightLimit(t *testing.T) {
+	testNewClient(t, "InFlightClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "InFlightClient", KeyName: "InFlightKey"}), CODE_SUCCESS)
+	testLimitRules(t, CfgLimitRule{Name: "InFlightClient", Op: LIMIT_OP_SIGN, MaxInFlight: 1})
+
+	// a running op hold the only slot
+	release, _, ok := acquireLimit("InFlightClient", LIMIT_OP_SIGN)
+	if !ok {
+		t.Fatalf("first op was limited")
+	}
+	if !strings.Contains(testMetrics(t), `parsecclient_inflight_ops{name="InFlightClient",op="sign"} 1`+"\n") {
+		t.Fatalf("metrics has no running op")
+	}
+	sign := &paramAll{Name: "InFlightClient", KeyName: "InFlightKey", Message: "hello"}
+	w := testApi(t, "POST", "/sign", sign)
+	testExpect(t, w, CODE_RATE_LIMITED)
+	if w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Retry-After %q, want 1", w.Header().Get("Retry-After"))
+	}
+
+	// release twice free only one slot
+	release()
+	release()
+	testExpect(t, testApi(t, "POST", "/sign", sign), CODE_SUCCESS)
+	release, _, ok = acquireLimit("InFlightClient", LIMIT_OP_SIGN)
+	if !ok {
+		t.Fatalf("slot was not released by the api")
+	}
+	if _, _, ok := acquireLimit("InFlightClient", LIMIT_OP_SIGN); ok {
+		t.Fatalf("two ops in flight")
+	}
+	release()
+
+	if !strings.Contains(testMetrics(t), `parsecclient_ratelimit_rejected_total{name="InFlightClient",op="sign",reason="inflight"} 2`+"\n") {
+		t.Fatalf("metrics has no inflight rejects")
+	}
+}
+
+// first matched rule in config order, "*" match any application or op
+func TestMatchLimitRule(t *testing.T) {
+	testLimitRules(t,
+		CfgLimitRule{Name: "MatchClient", Op: LIMIT_OP_SIGN, Rate: 1, Burst: 1},
+		CfgLimitRule{Name: "MatchClient", Op: limitMatchAll, Rate: 2, Burst: 1},
+		CfgLimitRule{Name: limitMatchAll, Op: LIMIT_OP_SIGN, Rate: 3, Burst: 1},
+	)
+	tests := []struct {
+		name string
+		op   string
+		rate float64
+	}{
+		{"MatchClient", LIMIT_OP_SIGN, 1},
+		{"MatchClient", LIMIT_OP_DECRYPT, 2},
+		{"OtherClient", LIMIT_OP_SIGN, 3},
+		{"OtherClient", LIMIT_OP_DECRYPT, 0},
+	}
+	limitLock.Lock()
+	defer limitLock.Unlock()
+	for _, tt := range tests {
+		rule := matchLimitRule(tt.name, tt.op)
+		if tt.rate == 0 && rule != nil || tt.rate != 0 && (rule == nil || rule.Rate != tt.rate) {
+			t.Errorf("%s %s: rule %+v, want rate %v", tt.name, tt.op, rule, tt.rate)
+		}
+	}
+}
+
+// rules were changed by config reload, states started again
+func TestRateLimitReload(t *testing.T) {
+	if err := testInitConfig(t, testConfigWith("")); err != nil {
+		t.Fatal(err)
+	}
+	testLimitRules(t)
+	if _, _, ok := acquireLimit("ReloadClient", LIMIT_OP_KEYS); !ok {
+		t.Fatalf("limited without rules")
+	}
+
+	rules := `
+[[ratelimit.rules]]
+name = "ReloadClient"
+op = "keys"
+rate = 0.01
+burst = 1
+`
+	if err := os.WriteFile(*flagConfig, []byte(testConfigWith(rules)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+
+	if _, _, ok := acquireLimit("ReloadClient", LIMIT_OP_KEYS); !ok {
+		t.Fatalf("first op after reload was limited")
+	}
+	if _, _, ok := acquireLimit("ReloadClient", LIMIT_OP_KEYS); ok {
+		t.Fatalf("rule of reloaded config was not used")
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+	"go.uber.org/zap"
+)
+
+// reconnectClient run ops of one application on parsec clients. a parsec client
+// has one connection and can not be used by two ops at same time, so every op take
+// an idle client or make a new one. the client broken by daemon connection was
+// closed instead of put back, and the ops which are safe to repeat were retried.
+// key create, import and destroy were not retried, they may be done by daemon
+// before the connection broken.
+type reconnectClient struct {
+	name   string
+	daemon CfgDaemon
+	idle   []CryptoClient
+	closed bool
+	lock   sync.Mutex
+}
+
+// idle clients kept for one application, more were made for a burst and closed after
+const reconnectIdleClients = 4
+
+var _ CryptoClient = (*reconnectClient)(nil)
+
+// connectivity of parsec daemon, updated by ops and the watch loop
+type daemonState struct {
+	up              bool
+	since           time.Time
+	reconnects      uint64
+	transportErrors uint64
+}
+
+// daemon name -> state, all made by InitReconnect
+var daemons = make(map[string]*daemonState)
+var daemonLock sync.Mutex
+
+type rtnDaemonHealth struct {
+	Name            string
+	Socket          string `json:",omitempty"`
+	Provider        string
+	Daemon          string // up or down
+	Since           string
+	Reconnects      uint64
+	TransportErrors uint64
+}
+
+type rtnHealth struct {
+	Status     string // ok or degraded
+	Backend    string
+	Daemon     string `json:",omitempty"` // up or down of default daemon, only for parsec backend
+	Since      string `json:",omitempty"`
+	Reconnects uint64
+	Daemons    []rtnDaemonHealth `json:",omitempty"`
+}
+
+// one sample per daemon labeled by backend
+func daemonSamples(value func(state *daemonState) float64) []metricSample {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	samples := make([]metricSample, 0, len(daemons))
+	for _, d := range backendDaemons() {
+		samples = append(samples, metricSample{
+			Labels: map[string]string{"backend": d.Name},
+			Value:  value(daemons[d.Name]),
+		})
+	}
+	return samples
+}
+
+func InitReconnect() {
+	for _, d := range backendDaemons() {
+		daemons[d.Name] = &daemonState{up: true, since: time.Now()}
+	}
+
+	RegisterMetric("parsecclient_daemon_up", "Parsec daemon was reachable", "gauge", func() []metricSample {
+		return daemonSamples(func(state *daemonState) float64 {
+			if state.up {
+				return 1
+			}
+			return 0
+		})
+	})
+	RegisterMetric("parsecclient_daemon_reconnects_total", "Parsec clients re-created after connection broken", "counter", func() []metricSample {
+		return daemonSamples(func(state *daemonState) float64 {
+			return float64(state.reconnects)
+		})
+	})
+	RegisterMetric("parsecclient_daemon_transport_errors_total", "Ops failed by broken daemon connection", "counter", func() []metricSample {
+		return daemonSamples(func(state *daemonState) float64 {
+			return float64(state.transportErrors)
+		})
+	})
+
+	if Conf.Backend.Type == BACKEND_PARSEC {
+		for _, d := range backendDaemons() {
+			go watchDaemon(d)
+		}
+	}
+}
+
+func newReconnectClient(name string, d CfgDaemon) (*reconnectClient, error) {
+	client, err := newParsecClient(name, d)
+	if err != nil {
+		return nil, err
+	}
+	return &reconnectClient{name: name, daemon: d, idle: []CryptoClient{client}}, nil
+}
+
+// connection errors of unix socket, parsec-client-go lost the error type
+// when it failed to read the response
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{"failed to read header", "connection refused", "no such file or directory", "broken pipe", "connection reset"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold daemonLock, daemons removed from config after start were not tracked
+func daemonStateOf(name string) *daemonState {
+	state, ok := daemons[name]
+	if !ok {
+		state = &daemonState{up: true, since: time.Now()}
+		daemons[name] = state
+	}
+	return state
+}
+
+func daemonUp(name string) (bool, time.Time) {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	state := daemonStateOf(name)
+	return state.up, state.since
+}
+
+func setDaemonUp(name string, up bool) {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	state := daemonStateOf(name)
+	if state.up == up {
+		return
+	}
+	state.up = up
+	state.since = time.Now()
+	if up {
+		zap.L().Info("Parsec daemon connection restored", zap.String("backend", name))
+	} else {
+		zap.L().Error("Parsec daemon connection lost", zap.String("backend", name))
+	}
+}
+
+// backoff of the attempt, doubled every time and capped by maxBackoff
+func reconnectBackoff(attempt int) time.Duration {
+	conf := GetConf().Reconnect
+	backoff := conf.InitialBackoff
+	for i := 0; i < attempt && backoff < conf.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > conf.MaxBackoff {
+		backoff = conf.MaxBackoff
+	}
+	return backoff
+}
+
+// take an idle client for one op, or make a new one
+func (rc *reconnectClient) acquire() (CryptoClient, error) {
+	rc.lock.Lock()
+	if n := len(rc.idle); n > 0 {
+		client := rc.idle[n-1]
+		rc.idle = rc.idle[:n-1]
+		rc.lock.Unlock()
+		return client, nil
+	}
+	rc.lock.Unlock()
+
+	client, err := newParsecClient(rc.name, rc.daemon)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// put the client back after the op, a broken or extra one was closed
+func (rc *reconnectClient) release(client CryptoClient, broken bool) {
+	rc.lock.Lock()
+	if !broken && !rc.closed && len(rc.idle) < reconnectIdleClients {
+		rc.idle = append(rc.idle, client)
+		rc.lock.Unlock()
+		return
+	}
+	rc.lock.Unlock()
+	client.Close()
+
+	if broken {
+		daemonLock.Lock()
+		daemonStateOf(rc.daemon.Name).reconnects++
+		daemonLock.Unlock()
+		zap.L().Warn("Parsec client dropped by broken connection: " + rc.name)
+	}
+}
+
+func (rc *reconnectClient) call(retry bool, fn func(client CryptoClient) error) error {
+	maxRetries := GetConf().Reconnect.MaxRetries
+	for attempt := 0; ; attempt++ {
+		client, err := rc.acquire()
+		if err == nil {
+			err = fn(client)
+			rc.release(client, isTransportError(err))
+		}
+		if !isTransportError(err) {
+			setDaemonUp(rc.daemon.Name, true)
+			return err
+		}
+
+		daemonLock.Lock()
+		daemonStateOf(rc.daemon.Name).transportErrors++
+		daemonLock.Unlock()
+		setDaemonUp(rc.daemon.Name, false)
+		if !retry || attempt >= maxRetries {
+			return err
+		}
+		time.Sleep(reconnectBackoff(attempt))
+	}
+}
+
+// ping the daemon, check period was backoff when it was down
+func watchDaemon(d CfgDaemon) {
+	attempt := 0
+	for {
+		client, err := newParsecClient("", d)
+		if err == nil {
+			_, _, err = client.Ping()
+			client.Close()
+		}
+		if err == nil || !isTransportError(err) {
+			setDaemonUp(d.Name, true)
+			attempt = 0
+			time.Sleep(GetConf().Reconnect.CheckInterval)
+			continue
+		}
+		setDaemonUp(d.Name, false)
+		zap.L().Debug("Parsec daemon still down", zap.String("backend", d.Name), zap.Error(err))
+		time.Sleep(reconnectBackoff(attempt))
+		attempt++
+	}
+}
+
+func (rc *reconnectClient) Ping() (uint8, uint8, error) {
+	var majver, minver uint8
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		majver, minver, err = client.Ping()
+		return err
+	})
+	return majver, minver, err
+}
+
+func (rc *reconnectClient) ListOpcodes(providerID parsec.ProviderID) ([]uint32, error) {
+	var opcodes []uint32
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		opcodes, err = client.ListOpcodes(providerID)
+		return err
+	})
+	return opcodes, err
+}
+
+func (rc *reconnectClient) ListAuthenticators() ([]*parsec.AuthenticatorInfo, error) {
+	var authenticators []*parsec.AuthenticatorInfo
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		authenticators, err = client.ListAuthenticators()
+		return err
+	})
+	return authenticators, err
+}
+
+func (rc *reconnectClient) ListKeys() ([]*parsec.KeyInfo, error) {
+	var keys []*parsec.KeyInfo
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		keys, err = client.ListKeys()
+		return err
+	})
+	return keys, err
+}
+
+func (rc *reconnectClient) PsaGenerateKey(name string, attributes *parsec.KeyAttributes) error {
+	return rc.call(false, func(client CryptoClient) error {
+		return client.PsaGenerateKey(name, attributes)
+	})
+}
+
+func (rc *reconnectClient) PsaImportKey(name string, attributes *parsec.KeyAttributes, data []byte) error {
+	return rc.call(false, func(client CryptoClient) error {
+		return client.PsaImportKey(name, attributes, data)
+	})
+}
+
+func (rc *reconnectClient) PsaExportPublicKey(name string) ([]byte, error) {
+	var data []byte
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		data, err = client.PsaExportPublicKey(name)
+		return err
+	})
+	return data, err
+}
+
+func (rc *reconnectClient) PsaDestroyKey(name string) error {
+	return rc.call(false, func(client CryptoClient) error {
+		return client.PsaDestroyKey(name)
+	})
+}
+
+func (rc *reconnectClient) PsaHashCompute(message []byte, alg algorithm.HashAlgorithmType) ([]byte, error) {
+	var hash []byte
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		hash, err = client.PsaHashCompute(message, alg)
+		return err
+	})
+	return hash, err
+}
+
+func (rc *reconnectClient) PsaSignHash(name string, hash []byte, alg *algorithm.AsymmetricSignatureAlgorithm) ([]byte, error) {
+	var signature []byte
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		signature, err = client.PsaSignHash(name, hash, alg)
+		return err
+	})
+	return signature, err
+}
+
+func (rc *reconnectClient) PsaVerifyHash(name string, hash, signature []byte, alg *algorithm.AsymmetricSignatureAlgorithm) error {
+	return rc.call(true, func(client CryptoClient) error {
+		return client.PsaVerifyHash(name, hash, signature, alg)
+	})
+}
+
+func (rc *reconnectClient) PsaAsymmetricEncrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, plaintext []byte) ([]byte, error) {
+	var ciphertext []byte
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		ciphertext, err = client.PsaAsymmetricEncrypt(name, alg, salt, plaintext)
+		return err
+	})
+	return ciphertext, err
+}
+
+func (rc *reconnectClient) PsaAsymmetricDecrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, ciphertext []byte) ([]byte, error) {
+	var plaintext []byte
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		plaintext, err = client.PsaAsymmetricDecrypt(name, alg, salt, ciphertext)
+		return err
+	})
+	return plaintext, err
+}
+
+func (rc *reconnectClient) PsaAeadEncrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, plaintext []byte) ([]byte, error) {
+	var ciphertext []byte
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		ciphertext, err = client.PsaAeadEncrypt(name, alg, nonce, additionalData, plaintext)
+		return err
+	})
+	return ciphertext, err
+}
+
+func (rc *reconnectClient) PsaAeadDecrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, ciphertext []byte) ([]byte, error) {
+	var plaintext []byte
+	err := rc.call(true, func(client CryptoClient) error {
+		var err error
+		plaintext, err = client.PsaAeadDecrypt(name, alg, nonce, additionalData, ciphertext)
+		return err
+	})
+	return plaintext, err
+}
+
+// close idle clients, the ones used by running ops were closed when they finished
+func (rc *reconnectClient) Close() error {
+	rc.lock.Lock()
+	idle := rc.idle
+	rc.idle = nil
+	rc.closed = true
+	rc.lock.Unlock()
+
+	var err error
+	for _, client := range idle {
+		if e := client.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// degraded when a parsec daemon was down, 503 when all were down
+// curl -v 127.0.0.1:8300/health
+func ApiHealth(c *gin.Context) {
+	conf := GetConf()
+	rtn := rtnHealth{
+		Status:  "ok",
+		Backend: conf.Backend.Type,
+	}
+	status := http.StatusOK
+	if rtn.Backend == BACKEND_PARSEC {
+		defaultName := appDaemon("").Name
+		down := 0
+		for _, d := range backendDaemons() {
+			up, since := daemonUp(d.Name)
+			health := rtnDaemonHealth{
+				Name:     d.Name,
+				Socket:   d.Socket,
+				Provider: d.providerID().String(),
+				Daemon:   "up",
+				Since:    since.Format(time.RFC3339),
+			}
+			if !up {
+				health.Daemon = "down"
+				down++
+			}
+			daemonLock.Lock()
+			state := daemonStateOf(d.Name)
+			health.Reconnects = state.reconnects
+			health.TransportErrors = state.transportErrors
+			daemonLock.Unlock()
+
+			rtn.Reconnects += health.Reconnects
+			if d.Name == defaultName {
+				rtn.Daemon = health.Daemon
+				rtn.Since = health.Since
+			}
+			rtn.Daemons = append(rtn.Daemons, health)
+		}
+		if down > 0 {
+			rtn.Status = "degraded"
+		}
+		if down == len(rtn.Daemons) {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(status, &rtn)
+}
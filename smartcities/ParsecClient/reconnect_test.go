@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+)
+
+func testDaemonCounters() (uint64, uint64) {
+	daemonLock.Lock()
+	defer daemonLock.Unlock()
+	state := daemonStateOf(DEFAULT_DAEMON)
+	return state.transportErrors, state.reconnects
+}
+
+func TestReconnectConcurrentOps(t *testing.T) {
+	rc, err := newReconnectClient("ReconnectConcurrent", appDaemon(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	a := jwsAlgs[JWS_ES256]
+	if err := rc.PsaGenerateKey("MyKey", a.keyAttr()); err != nil {
+		t.Fatal(err)
+	}
+	hash := hashMessage([]byte("Hello World"))
+	transportErrors, reconnects := testDaemonCounters()
+
+	// ops at same time must not share one connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				signature, err := rc.PsaSignHash("MyKey", hash, a.signAlg())
+				if err == nil {
+					err = rc.PsaVerifyHash("MyKey", hash, signature, a.signAlg())
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if e, r := testDaemonCounters(); e != transportErrors || r != reconnects {
+		t.Fatalf("transport errors %d -> %d, reconnects %d -> %d", transportErrors, e, reconnects, r)
+	}
+	if up, _ := daemonUp(DEFAULT_DAEMON); !up {
+		t.Fatalf("daemon marked down")
+	}
+	rc.lock.Lock()
+	idle := len(rc.idle)
+	rc.lock.Unlock()
+	if idle == 0 || idle > reconnectIdleClients {
+		t.Fatalf("idle clients %d", idle)
+	}
+}
+
+func TestReconnectDroppedConnection(t *testing.T) {
+	rc, err := newReconnectClient("ReconnectDropped", appDaemon(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	defer testMock.ClearFailures()
+
+	a := jwsAlgs[JWS_RS256]
+	if err := rc.PsaGenerateKey("MyKey", a.keyAttr()); err != nil {
+		t.Fatal(err)
+	}
+	hash := hashMessage([]byte("Hello World"))
+	transportErrors, reconnects := testDaemonCounters()
+
+	// sign is safe to repeat, it was retried on a new client
+	testMock.InjectFailure(requests.OpPsaSignHash, 0, 1, true)
+	if _, err := rc.PsaSignHash("MyKey", hash, a.signAlg()); err != nil {
+		t.Fatalf("sign after dropped connection: %v", err)
+	}
+	if e, r := testDaemonCounters(); e != transportErrors+1 || r != reconnects+1 {
+		t.Fatalf("transport errors %d -> %d, reconnects %d -> %d", transportErrors, e, reconnects, r)
+	}
+
+	// destroy may be done by daemon before the connection broken, not retried
+	testMock.InjectFailure(requests.OpPsaDestroyKey, 0, 1, true)
+	if err := rc.PsaDestroyKey("MyKey"); !isTransportError(err) {
+		t.Fatalf("destroy with dropped connection: got %v", err)
+	}
+	if err := rc.PsaDestroyKey("MyKey"); err != nil {
+		t.Fatalf("destroy: %v", err)
+	}
+	if up, _ := daemonUp(DEFAULT_DAEMON); !up {
+		t.Fatalf("daemon still marked down after ops succeeded")
+	}
+}
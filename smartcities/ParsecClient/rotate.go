@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"go.uber.org/zap"
+)
+
+// A rotated key lives in parsec as "<name>@vN", the key without suffix is
+// version 0. The newest version is the current one and used by sign and
+// encrypt. Older versions are retired, they still can verify and decrypt
+// until the grace period ended, then the reaper destroy them.
+
+const keyVersionSep = "@v"
+
+var errKeyNotFound = errors.New("key not found")
+var errKeyNotRotatable = errors.New("imported public key can not be rotated")
+var errKeyAttrUnknown = errors.New("key attributes unknown, made before restart without meta store")
+var errKeyNotCurrent = errors.New("key version is retired, only the current one can sign and encrypt")
+
+type keyVersion struct {
+	version   int
+	retiredAt time.Time // zero if current
+}
+
+type keyRing struct {
+	current  int
+	versions map[int]*keyVersion
+	attr     *parsec.KeyAttributes // used to generate next version, nil if unknown
+	bits     uint32                // of current version, listed by parsec even if attr is unknown
+}
+
+type rtnKeyVersion struct {
+	Name    string
+	KeyName string
+	Version int
+}
+
+// application name -> key name -> ring, loaded by ListKeys when first used
+var keyRings = make(map[string]map[string]*keyRing)
+var keyRingsLock sync.Mutex
+
+// application name \x00 key name -> lock held by rotation from generate to commit
+var rotateLocks = make(map[string]*sync.Mutex)
+var rotateLocksLock sync.Mutex
+
+func InitRotation() {
+	go reapRetiredKeys()
+}
+
+func versionedKeyName(name string, version int) string {
+	if version == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s%s%d", name, keyVersionSep, version)
+}
+
+// "MyKey@v2" -> "MyKey", 2
+func splitKeyName(name string) (string, int) {
+	idx := strings.LastIndex(name, keyVersionSep)
+	if idx <= 0 {
+		return name, 0
+	}
+	version, err := strconv.Atoi(name[idx+len(keyVersionSep):])
+	if err != nil || version <= 0 {
+		return name, 0
+	}
+	return name[:idx], version
+}
+
+// name of new key can not look like a version made by rotation
+func isVersionedKeyName(name string) bool {
+	return strings.Contains(name, keyVersionSep)
+}
+
+// "v2" or "2" -> 2
+func parseVersionHint(hint string) (int, error) {
+	version, err := strconv.Atoi(strings.TrimPrefix(hint, "v"))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid key version %q", hint)
+	}
+	return version, nil
+}
+
+// forget all rings of the application, reload them when used next time
+func resetKeyRings(appName string) {
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	delete(keyRings, appName)
+	resetPublicKeys(appName)
+}
+
+// forget one ring, used after its keys were destroyed
+func forgetKeyRing(appName string, keyName string) {
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	if rings, ok := keyRings[appName]; ok {
+		delete(rings, keyName)
+	}
+	forgetPublicKey(appName, keyName)
+}
+
+// must hold keyRingsLock
+func loadKeyRings(appName string, client CryptoClient) (map[string]*keyRing, error) {
+	if rings, ok := keyRings[appName]; ok {
+		return rings, nil
+	}
+
+	keys, err := client.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	rings := make(map[string]*keyRing)
+	for _, key := range keys {
+		name, version := splitKeyName(key.Name)
+		ring, ok := rings[name]
+		if !ok {
+			ring = &keyRing{versions: make(map[int]*keyVersion)}
+			rings[name] = ring
+		}
+		ring.versions[version] = &keyVersion{version: version}
+		if version >= ring.current {
+			ring.current = version
+			if key.Attributes != nil {
+				ring.bits = key.Attributes.KeyBits
+			}
+		}
+	}
+	// retire time was kept in meta store, without it start grace period from now
+	now := time.Now()
+	for name, ring := range rings {
+		if len(ring.versions) == 1 {
+			continue
+		}
+		retired := map[int]time.Time{}
+		if meta, err := loadMeta(appName, name); err == nil && meta != nil {
+			for _, v := range meta.Versions {
+				if v.Retired != nil {
+					retired[v.Version] = *v.Retired
+				}
+			}
+		}
+		for _, kv := range ring.versions {
+			if kv.version == ring.current {
+				continue
+			}
+			kv.retiredAt = now
+			if at, ok := retired[kv.version]; ok {
+				kv.retiredAt = at
+			}
+		}
+	}
+
+	keyRings[appName] = rings
+	return rings, nil
+}
+
+// get key name of the current version, used by sign and encrypt.
+// a version given by caller must be the current one.
+func currentKeyName(appName string, client CryptoClient, keyName string) (string, error) {
+	name, version := splitKeyName(keyName)
+	if keyExpired(appName, name) {
+		return "", errKeyExpired
+	}
+
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	rings, err := loadKeyRings(appName, client)
+	if err != nil {
+		return "", err
+	}
+	ring, ok := rings[name]
+	if !ok {
+		return keyName, nil // unknown here, let parsec report it
+	}
+	if version > 0 && version != ring.current {
+		return "", errKeyNotCurrent
+	}
+	return versionedKeyName(name, ring.current), nil
+}
+
+// get key names to try for verify and decrypt, newest first.
+// with a hint only that version, or all versions still in grace period.
+func candidateKeyNames(appName string, client CryptoClient, keyName string, hint string) ([]string, error) {
+	if keyExpired(appName, keyName) {
+		return nil, errKeyExpired
+	}
+	if len(hint) != 0 {
+		version, err := parseVersionHint(hint)
+		if err != nil {
+			return nil, err
+		}
+		return []string{versionedKeyName(keyName, version)}, nil
+	}
+	if _, version := splitKeyName(keyName); version > 0 {
+		return []string{keyName}, nil
+	}
+
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	rings, err := loadKeyRings(appName, client)
+	if err != nil {
+		return nil, err
+	}
+	ring, ok := rings[keyName]
+	if !ok {
+		return []string{keyName}, nil
+	}
+
+	grace := GetConf().Rotation.Grace
+	now := time.Now()
+	versions := make([]int, 0, len(ring.versions))
+	for _, kv := range ring.versions {
+		if kv.version == ring.current || now.Sub(kv.retiredAt) < grace {
+			versions = append(versions, kv.version)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	names := make([]string, 0, len(versions))
+	for _, version := range versions {
+		names = append(names, versionedKeyName(keyName, version))
+	}
+	return names, nil
+}
+
+// get key names of all versions, used by delete
+func allKeyNames(appName string, client CryptoClient, keyName string) ([]string, error) {
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	rings, err := loadKeyRings(appName, client)
+	if err != nil {
+		return nil, err
+	}
+	ring, ok := rings[keyName]
+	if !ok {
+		return []string{keyName}, nil
+	}
+	names := make([]string, 0, len(ring.versions))
+	for version := range ring.versions {
+		names = append(names, versionedKeyName(keyName, version))
+	}
+	return names, nil
+}
+
+// "MyKey@v2" -> "v2"
+func keyVersionLabel(keyName string) string {
+	_, version := splitKeyName(keyName)
+	return "v" + strconv.Itoa(version)
+}
+
+// set header for caller to know which key version was used
+func setKeyVersionHeader(c *gin.Context, keyName string) {
+	c.Header("X-Key-Version", keyVersionLabel(keyName))
+}
+
+// check if the key has versions already, new key need use rotate instead
+func hasKeyRing(appName string, client CryptoClient, keyName string) (bool, error) {
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	rings, err := loadKeyRings(appName, client)
+	if err != nil {
+		return false, err
+	}
+	_, ok := rings[keyName]
+	return ok, nil
+}
+
+// add a new key version to ring after the key was generated
+func addKeyVersion(appName string, keyName string, version int, attr *parsec.KeyAttributes) {
+	keyRingsLock.Lock()
+	defer keyRingsLock.Unlock()
+	rings, ok := keyRings[appName]
+	if !ok {
+		return // not loaded, will get it by ListKeys
+	}
+	ring, ok := rings[keyName]
+	if !ok {
+		ring = &keyRing{current: version, versions: make(map[int]*keyVersion)}
+		rings[keyName] = ring
+	}
+	ring.versions[version] = &keyVersion{version: version}
+	ring.attr = attr
+	if version >= ring.current {
+		ring.bits = attr.KeyBits
+		if old, ok := ring.versions[ring.current]; ok && ring.current != version {
+			old.retiredAt = time.Now()
+		}
+		ring.current = version
+	}
+}
+
+// get attributes to generate next version of the key
+func nextKeyAttr(appName string, keyName string) (*parsec.KeyAttributes, error) {
+	keyRingsLock.Lock()
+	var attr *parsec.KeyAttributes
+	if ring, ok := keyRings[appName][keyName]; ok {
+		attr = ring.attr
+	}
+	keyRingsLock.Unlock()
+
+	if attr != nil {
+		if attr.KeyPolicy.KeyUsageFlags.Decrypt || attr.KeyPolicy.KeyUsageFlags.SignHash {
+			return attr, nil
+		}
+		return nil, errKeyNotRotatable
+	}
+
+	// parsec ListKeys only return key bits, not the type and policy.
+	// the key was made before restart, use the type kept in meta store.
+	return metaKeyAttr(appName, keyName)
+}
+
+// kind of key by its attributes, KEY_TYPE_*
+func keyAttrType(attr *parsec.KeyAttributes) string {
+	switch {
+	case attr == nil:
+		return ""
+	case attr.KeyPolicy.KeyAlgorithm != nil && attr.KeyPolicy.KeyAlgorithm.GetAead() != nil:
+		return KEY_TYPE_AEAD
+	case attr.KeyPolicy.KeyUsageFlags.SignHash:
+		return KEY_TYPE_SIGN
+	case attr.KeyPolicy.KeyUsageFlags.Decrypt:
+		return KEY_TYPE_ENC
+	}
+	return KEY_TYPE_PUB
+}
+
+// attributes to generate next version by the type kept in meta store
+func metaKeyAttr(appName string, keyName string) (*parsec.KeyAttributes, error) {
+	meta, err := loadMeta(appName, keyName)
+	if err != nil || meta == nil {
+		return nil, errKeyAttrUnknown
+	}
+	if meta.Imported || meta.Type == KEY_TYPE_PUB {
+		return nil, errKeyNotRotatable
+	}
+	switch meta.Type {
+	case KEY_TYPE_SIGN:
+		if a, ok := jwsAlgs[meta.Alg]; ok {
+			return a.keyAttr(), nil
+		}
+	case KEY_TYPE_ENC:
+		return getEncryptAttr(true), nil
+	case KEY_TYPE_AEAD:
+		return vaultAeadAttr(), nil
+	}
+	return nil, errKeyAttrUnknown
+}
+
+// hold it while a version of the key was generated and committed, return unlock
+func lockRotate(appName string, keyName string) func() {
+	rotateLocksLock.Lock()
+	l, ok := rotateLocks[appName+"\x00"+keyName]
+	if !ok {
+		l = &sync.Mutex{}
+		rotateLocks[appName+"\x00"+keyName] = l
+	}
+	rotateLocksLock.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// generate next version with the same attributes as the current one
+func rotateKey(appName string, client CryptoClient, keyName string) (string, int, error) {
+	keyName, _ = splitKeyName(keyName)
+	// concurrent rotations would generate the same next version
+	defer lockRotate(appName, keyName)()
+	exist, err := hasKeyRing(appName, client, keyName)
+	if err != nil {
+		return "", 0, err
+	}
+	if !exist {
+		return "", 0, errKeyNotFound
+	}
+	current, err := currentKeyName(appName, client, keyName)
+	if err != nil {
+		return "", 0, err
+	}
+
+	attr, err := nextKeyAttr(appName, keyName)
+	if err != nil {
+		return "", 0, err
+	}
+
+	_, version := splitKeyName(current)
+	newName := versionedKeyName(keyName, version+1)
+	if err := client.PsaGenerateKey(newName, attr); err != nil {
+		return "", 0, err
+	}
+	addKeyVersion(appName, keyName, version+1, attr)
+	forgetPublicKey(appName, keyName)
+	metaKeyRotated(appName, keyName, version+1)
+
+	zap.L().Info("Key rotated", zap.String("client", appName), zap.String("key", newName))
+	return newName, version + 1, nil
+}
+
+// destroy retired versions whose grace period ended
+func reapRetiredKeys() {
+	for {
+		time.Sleep(GetConf().Rotation.ReapInterval)
+		reapRetiredVersions(GetConf().Rotation.Grace)
+	}
+}
+
+func reapRetiredVersions(grace time.Duration) {
+	type expired struct {
+		appName string
+		keyName string
+		version int
+	}
+	var list []expired
+	now := time.Now()
+	keyRingsLock.Lock()
+	for appName, rings := range keyRings {
+		for keyName, ring := range rings {
+			for _, kv := range ring.versions {
+				if kv.version != ring.current && now.Sub(kv.retiredAt) >= grace {
+					list = append(list, expired{appName, keyName, kv.version})
+				}
+			}
+		}
+	}
+	keyRingsLock.Unlock()
+
+	for _, e := range list {
+		client, ok := getClient(e.appName)
+		if !ok {
+			continue
+		}
+		name := versionedKeyName(e.keyName, e.version)
+		if err := client.PsaDestroyKey(name); err != nil {
+			zap.L().Error("Destroy retired key fail", zap.String("client", e.appName), zap.String("key", name), zap.Error(err))
+			continue
+		}
+		zap.L().Info("Retired key destroyed", zap.String("client", e.appName), zap.String("key", name))
+
+		keyRingsLock.Lock()
+		if ring, ok := keyRings[e.appName][e.keyName]; ok {
+			delete(ring.versions, e.version)
+		}
+		keyRingsLock.Unlock()
+		forgetPublicKey(e.appName, e.keyName)
+		metaVersionDestroyed(e.appName, e.keyName, e.version)
+	}
+}
+
+// curl -v -d '{"Name": "GoClient", "KeyName": "MyEncKey"}' 127.0.0.1:8300/key/rotate
+func ApiRotateKey(c *gin.Context) {
+	param, ok := checkParam(c, 1)
+	if !ok {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+
+	// get client
+	client, ok := getClient(param.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	release, ok := limitOp(c, param.Name, LIMIT_OP_ROTATE)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !requireOp(c, param.Name, requests.OpPsaGenerateKey) {
+		return
+	}
+
+	name, version, err := rotateKey(param.Name, client, param.KeyName)
+	if err == errKeyNotFound || err == errKeyNotRotatable {
+		responseError(c, CODE_INVALID_KEY)
+		return
+	}
+	if err == errKeyAttrUnknown {
+		responseError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	c.JSON(http.StatusOK, &rtnKeyVersion{
+		Name:    param.Name,
+		KeyName: name,
+		Version: version,
+	})
+}
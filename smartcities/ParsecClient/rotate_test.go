@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// meta store in a temp dir for one test, disabled again by cleanup
+func testMetaDB(t *testing.T) {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "meta.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaDB = db
+	t.Cleanup(func() {
+		metaDB = nil
+		db.Close()
+	})
+}
+
+func testRotate(t *testing.T, name string, keyName string) rtnKeyVersion {
+	t.Helper()
+	w := testApi(t, "POST", "/key/rotate", &paramAll{Name: name, KeyName: keyName})
+	var rtn rtnKeyVersion
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("rotate: status %d, body %q", w.Code, w.Body.String())
+	}
+	return rtn
+}
+
+func testSign(t *testing.T, name string, keyName string, message string) string {
+	t.Helper()
+	w := testApi(t, "POST", "/sign", &paramAll{Name: name, KeyName: keyName, Message: message})
+	testExpect(t, w, CODE_SUCCESS)
+	return w.Body.String()
+}
+
+// key names in parsec of the application
+func testKeyNames(t *testing.T, name string) []string {
+	t.Helper()
+	client, ok := getClient(name)
+	if !ok {
+		t.Fatalf("client %s not found", name)
+	}
+	keys, err := client.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotateKey(t *testing.T) {
+	testNewClient(t, "RotateClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "RotateClient", KeyName: "RotateKey"}), CODE_SUCCESS)
+	oldSign := testSign(t, "RotateClient", "RotateKey", "hello")
+
+	rtn := testRotate(t, "RotateClient", "RotateKey")
+	if rtn.Version != 1 || rtn.KeyName != "RotateKey@v1" {
+		t.Fatalf("rotate %+v, want RotateKey@v1", rtn)
+	}
+	w := testApi(t, "POST", "/sign", &paramAll{Name: "RotateClient", KeyName: "RotateKey", Message: "hello"})
+	testExpect(t, w, CODE_SUCCESS)
+	if v := w.Header().Get("X-Key-Version"); v != "v1" {
+		t.Fatalf("sign by key version %q, want v1", v)
+	}
+	testSign(t, "RotateClient", "RotateKey@v1", "hello")
+
+	// old signature was verified by the retired version in grace period
+	verify := func(hint string) *paramAll {
+		return &paramAll{Name: "RotateClient", KeyName: "RotateKey", Message: "hello", Sign: oldSign, Version: hint}
+	}
+	w = testApi(t, "POST", "/verify", verify(""))
+	testExpect(t, w, CODE_SUCCESS)
+	if v := w.Header().Get("X-Key-Version"); v != "v0" {
+		t.Fatalf("verified by key version %q, want v0", v)
+	}
+	testExpect(t, testApi(t, "POST", "/verify", verify("v0")), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/verify", verify("v1")), CODE_VERIFY_FAIL)
+
+	// retired version can not sign any more
+	testRotate(t, "RotateClient", "RotateKey")
+	testExpect(t, testApi(t, "POST", "/sign", &paramAll{Name: "RotateClient", KeyName: "RotateKey@v1", Message: "hello"}), CODE_INVALID_KEY)
+
+	// grace period ended, only the current version was tried
+	testSetConf(t, func(conf *AppConfig) { conf.Rotation.Grace = time.Nanosecond })
+	testExpect(t, testApi(t, "POST", "/verify", verify("")), CODE_VERIFY_FAIL)
+	testExpect(t, testApi(t, "POST", "/verify", verify("v0")), CODE_SUCCESS)
+
+	reapRetiredVersions(time.Nanosecond)
+	if names := testKeyNames(t, "RotateClient"); fmt.Sprint(names) != "[RotateKey@v2]" {
+		t.Fatalf("keys after reap %v, want only RotateKey@v2", names)
+	}
+	testExpect(t, testApi(t, "POST", "/verify", verify("v0")), CODE_VERIFY_FAIL)
+}
+
+func TestRotateEncryptKey(t *testing.T) {
+	testNewClient(t, "RotateEncClient")
+	testExpect(t, testApi(t, "POST", "/keyenc", &paramAll{Name: "RotateEncClient", KeyName: "RotateEncKey"}), CODE_SUCCESS)
+	w := testApi(t, "POST", "/encrypt", &paramAll{Name: "RotateEncClient", KeyName: "RotateEncKey", Message: "hello"})
+	testExpect(t, w, CODE_SUCCESS)
+	ciphertext := w.Body.String()
+
+	testRotate(t, "RotateEncClient", "RotateEncKey")
+	w = testApi(t, "POST", "/encrypt", &paramAll{Name: "RotateEncClient", KeyName: "RotateEncKey", Message: "hello"})
+	testExpect(t, w, CODE_SUCCESS)
+	if v := w.Header().Get("X-Key-Version"); v != "v1" {
+		t.Fatalf("encrypt by key version %q, want v1", v)
+	}
+
+	for _, hint := range []string{"", "v0"} {
+		w = testApi(t, "POST", "/decrypt", &paramAll{Name: "RotateEncClient", KeyName: "RotateEncKey", Message: ciphertext, Version: hint})
+		testExpect(t, w, CODE_SUCCESS)
+		if w.Body.String() != "hello" || w.Header().Get("X-Key-Version") != "v0" {
+			t.Fatalf("hint %q: decrypted %q by %s", hint, w.Body.String(), w.Header().Get("X-Key-Version"))
+		}
+	}
+	testExpect(t, testApi(t, "POST", "/decrypt", &paramAll{Name: "RotateEncClient", KeyName: "RotateEncKey", Message: ciphertext, Version: "v1"}), CODE_PARSEC_ERROR)
+	testExpect(t, testApi(t, "POST", "/encrypt", &paramAll{Name: "RotateEncClient", KeyName: "RotateEncKey@v1", Message: "hello"}), CODE_SUCCESS)
+}
+
+func TestRotateKeyInvalid(t *testing.T) {
+	testNewClient(t, "RotateMissingClient")
+	testExpect(t, testApi(t, "POST", "/key/rotate", &paramAll{Name: "RotateMissingClient", KeyName: "MissingKey"}), CODE_INVALID_KEY)
+
+	// names of versions can not be taken by new keys
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "RotateMissingClient", KeyName: "OtherKey@v2"}), CODE_INVALID_PARAM)
+	testExpect(t, testApi(t, "POST", "/keyenc", &paramAll{Name: "RotateMissingClient", KeyName: "OtherKey@v1"}), CODE_INVALID_PARAM)
+	pub := "ssh-rsa " + base64.StdEncoding.EncodeToString([]byte("public key")) + " key"
+	testExpect(t, testApi(t, "POST", "/key", &paramAll{Name: "RotateMissingClient", KeyName: "OtherKey@v1", Message: pub}), CODE_INVALID_PARAM)
+	if names := testKeyNames(t, "RotateMissingClient"); len(names) != 0 {
+		t.Fatalf("keys %v were made", names)
+	}
+}
+
+// concurrent rotations each get their own version
+func TestRotateKeyConcurrent(t *testing.T) {
+	testNewClient(t, "RotateConcurrentClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "RotateConcurrentClient", KeyName: "ConcurrentKey"}), CODE_SUCCESS)
+
+	versions := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range versions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := testApi(t, "POST", "/key/rotate", &paramAll{Name: "RotateConcurrentClient", KeyName: "ConcurrentKey"})
+			var rtn rtnKeyVersion
+			json.Unmarshal(w.Body.Bytes(), &rtn)
+			versions[i] = rtn.Version
+		}(i)
+	}
+	wg.Wait()
+	sort.Ints(versions)
+	if fmt.Sprint(versions) != "[1 2 3 4 5]" {
+		t.Fatalf("versions %v, want 1 to 5", versions)
+	}
+	if names := testKeyNames(t, "RotateConcurrentClient"); len(names) != 6 {
+		t.Fatalf("keys %v, want 6 versions", names)
+	}
+}
+
+// retire time was kept by meta store after restart, without it grace started again
+func TestRotateKeyRestart(t *testing.T) {
+	testMetaDB(t)
+	testNewClient(t, "RotateRestartClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "RotateRestartClient", KeyName: "RestartKey"}), CODE_SUCCESS)
+	testRotate(t, "RotateRestartClient", "RestartKey")
+
+	retired := time.Now().Add(-200 * time.Hour)
+	updateMeta("RotateRestartClient", "RestartKey", func(meta *keyMeta) *keyMeta {
+		meta.Versions[0].Retired = &retired
+		return meta
+	})
+	client, _ := getClient("RotateRestartClient")
+	candidates := func() []string {
+		resetKeyRings("RotateRestartClient")
+		names, err := candidateKeyNames("RotateRestartClient", client, "RestartKey", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	if names := candidates(); fmt.Sprint(names) != "[RestartKey@v1]" {
+		t.Fatalf("candidates %v, retired version out of grace by meta", names)
+	}
+
+	metaDB = nil
+	if names := candidates(); fmt.Sprint(names) != "[RestartKey@v1 RestartKey]" {
+		t.Fatalf("candidates %v without meta store, want grace from now", names)
+	}
+}
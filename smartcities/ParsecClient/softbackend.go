@@ -0,0 +1,544 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"math/big"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/operations/psakeyattributes"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+)
+
+// Software backend keep keys in process memory with pure go crypto.
+// It is NOT secure and keys are lost after restart, only for unit test
+// and develop without parsec daemon. Keys formats are same as parsec:
+// rsa PKCS#1 DER, ecc uncompressed point or private scalar, aes raw bytes.
+
+const (
+	softKeyRsaPair = iota
+	softKeyRsaPublic
+	softKeyEccPair
+	softKeyEccPublic
+	softKeyAes
+)
+
+// software keys do not belong to any parsec provider
+const softProviderID = parsec.ProviderCore
+
+type softKey struct {
+	kind int
+	attr *parsec.KeyAttributes
+	priv crypto.Signer    // *rsa.PrivateKey or *ecdsa.PrivateKey, nil for public key
+	pub  crypto.PublicKey // *rsa.PublicKey or *ecdsa.PublicKey
+	sym  []byte           // aes key
+}
+
+// application name -> key name -> key, shared by clients of same application like parsec
+var softKeys = make(map[string]map[string]*softKey)
+var softKeysLock sync.RWMutex
+
+type softClient struct {
+	app string
+}
+
+var _ CryptoClient = (*softClient)(nil)
+
+func newSoftClient(name string) *softClient {
+	return &softClient{app: name}
+}
+
+// error with the parsec status code, so mock daemon can send it back
+type softStatusError struct {
+	code requests.StatusCode
+}
+
+func (e *softStatusError) Error() string {
+	return e.code.ToErr().Error()
+}
+
+func softError(code requests.StatusCode) error {
+	return &softStatusError{code: code}
+}
+
+func softKeyKind(attr *parsec.KeyAttributes) (int, error) {
+	if attr == nil || attr.KeyType == nil {
+		return 0, softError(requests.StatusPsaErrorInvalidArgument)
+	}
+	keyType, ok := attr.KeyType.ToWireInterface().(*psakeyattributes.KeyType)
+	if !ok {
+		return 0, softError(requests.StatusPsaErrorInvalidArgument)
+	}
+	switch keyType.Variant.(type) {
+	case *psakeyattributes.KeyType_RsaKeyPair_:
+		return softKeyRsaPair, nil
+	case *psakeyattributes.KeyType_RsaPublicKey_:
+		return softKeyRsaPublic, nil
+	case *psakeyattributes.KeyType_EccKeyPair_:
+		return softKeyEccPair, nil
+	case *psakeyattributes.KeyType_EccPublicKey_:
+		return softKeyEccPublic, nil
+	case *psakeyattributes.KeyType_Aes_:
+		return softKeyAes, nil
+	}
+	return 0, softError(requests.StatusPsaErrorNotSupported)
+}
+
+// only SECP R1 curves, parsec-client-go does not keep the curve family
+func softCurve(bits uint32) (elliptic.Curve, error) {
+	switch bits {
+	case 224:
+		return elliptic.P224(), nil
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	}
+	return nil, softError(requests.StatusPsaErrorNotSupported)
+}
+
+func softHash(alg algorithm.HashAlgorithmType) (crypto.Hash, error) {
+	switch alg {
+	case algorithm.HashAlgorithmTypeSHA224:
+		return crypto.SHA224, nil
+	case algorithm.HashAlgorithmTypeSHA256:
+		return crypto.SHA256, nil
+	case algorithm.HashAlgorithmTypeSHA384:
+		return crypto.SHA384, nil
+	case algorithm.HashAlgorithmTypeSHA512:
+		return crypto.SHA512, nil
+	case algorithm.HashAlgorithmTypeSHA512_224:
+		return crypto.SHA512_224, nil
+	case algorithm.HashAlgorithmTypeSHA512_256:
+		return crypto.SHA512_256, nil
+	}
+	return 0, softError(requests.StatusPsaErrorNotSupported)
+}
+
+// hash of the sign algorithm, any hash was decided by the digest length
+func softSignHash(signHash *algorithm.AsymmetricSignatureSignHash, digestLen int) (crypto.Hash, error) {
+	if signHash != nil && signHash.GetAny() == nil {
+		h, err := softHash(signHash.GetSpecific())
+		if err != nil {
+			return 0, err
+		}
+		if h.Size() != digestLen {
+			return 0, softError(requests.StatusPsaErrorInvalidArgument)
+		}
+		return h, nil
+	}
+	for _, h := range []crypto.Hash{crypto.SHA224, crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		if h.Size() == digestLen {
+			return h, nil
+		}
+	}
+	return 0, softError(requests.StatusPsaErrorInvalidArgument)
+}
+
+func (c *softClient) getKey(name string) (*softKey, error) {
+	softKeysLock.RLock()
+	defer softKeysLock.RUnlock()
+	key, ok := softKeys[c.app][name]
+	if !ok {
+		return nil, softError(requests.StatusPsaErrorDoesNotExist)
+	}
+	return key, nil
+}
+
+func (c *softClient) putKey(name string, key *softKey) error {
+	softKeysLock.Lock()
+	defer softKeysLock.Unlock()
+	keys, ok := softKeys[c.app]
+	if !ok {
+		keys = make(map[string]*softKey)
+		softKeys[c.app] = keys
+	}
+	if _, ok := keys[name]; ok {
+		return softError(requests.StatusPsaErrorAlreadyExists)
+	}
+	keys[name] = key
+	return nil
+}
+
+func (c *softClient) Ping() (uint8, uint8, error) {
+	return 1, 0, nil
+}
+
+// all crypto ops of software keys, provider was ignored
+func (c *softClient) ListOpcodes(providerID parsec.ProviderID) ([]uint32, error) {
+	return []uint32{
+		uint32(requests.OpPsaGenerateKey),
+		uint32(requests.OpPsaDestroyKey),
+		uint32(requests.OpPsaSignHash),
+		uint32(requests.OpPsaVerifyHash),
+		uint32(requests.OpPsaImportKey),
+		uint32(requests.OpPsaExportPublicKey),
+		uint32(requests.OpPsaAsymmetricEncrypt),
+		uint32(requests.OpPsaAsymmetricDecrypt),
+		uint32(requests.OpPsaHashCompute),
+		uint32(requests.OpPsaAeadEncrypt),
+		uint32(requests.OpPsaAeadDecrypt),
+	}, nil
+}
+
+func (c *softClient) ListAuthenticators() ([]*parsec.AuthenticatorInfo, error) {
+	return []*parsec.AuthenticatorInfo{
+		{ID: parsec.AuthDirect, Description: "Software backend, application name only"},
+	}, nil
+}
+
+func (c *softClient) ListKeys() ([]*parsec.KeyInfo, error) {
+	softKeysLock.RLock()
+	defer softKeysLock.RUnlock()
+
+	keys := make([]*parsec.KeyInfo, 0, len(softKeys[c.app]))
+	for name, key := range softKeys[c.app] {
+		keys = append(keys, &parsec.KeyInfo{
+			ProviderID: softProviderID,
+			Name:       name,
+			Attributes: key.attr,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+func (c *softClient) PsaGenerateKey(name string, attributes *parsec.KeyAttributes) error {
+	kind, err := softKeyKind(attributes)
+	if err != nil {
+		return err
+	}
+
+	key := &softKey{kind: kind, attr: attributes}
+	switch kind {
+	case softKeyRsaPair:
+		priv, err := rsa.GenerateKey(rand.Reader, int(attributes.KeyBits))
+		if err != nil {
+			return err
+		}
+		key.priv, key.pub = priv, &priv.PublicKey
+	case softKeyEccPair:
+		curve, err := softCurve(attributes.KeyBits)
+		if err != nil {
+			return err
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return err
+		}
+		key.priv, key.pub = priv, &priv.PublicKey
+	case softKeyAes:
+		if attributes.KeyBits != 128 && attributes.KeyBits != 192 && attributes.KeyBits != 256 {
+			return softError(requests.StatusPsaErrorNotSupported)
+		}
+		key.sym = make([]byte, attributes.KeyBits/8)
+		if _, err := rand.Read(key.sym); err != nil {
+			return err
+		}
+	default:
+		return softError(requests.StatusPsaErrorInvalidArgument) // can not generate public key
+	}
+
+	return c.putKey(name, key)
+}
+
+func (c *softClient) PsaImportKey(name string, attributes *parsec.KeyAttributes, data []byte) error {
+	kind, err := softKeyKind(attributes)
+	if err != nil {
+		return err
+	}
+
+	key := &softKey{kind: kind, attr: attributes}
+	switch kind {
+	case softKeyRsaPair:
+		priv, err := x509.ParsePKCS1PrivateKey(data)
+		if err != nil {
+			return softError(requests.StatusPsaErrorInvalidArgument)
+		}
+		key.priv, key.pub = priv, &priv.PublicKey
+	case softKeyRsaPublic:
+		pub, err := x509.ParsePKCS1PublicKey(data)
+		if err != nil {
+			return softError(requests.StatusPsaErrorInvalidArgument)
+		}
+		key.pub = pub
+	case softKeyEccPair:
+		curve, err := softCurve(attributes.KeyBits)
+		if err != nil {
+			return err
+		}
+		priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(data)}
+		priv.Curve = curve
+		priv.X, priv.Y = curve.ScalarBaseMult(data)
+		key.priv, key.pub = priv, &priv.PublicKey
+	case softKeyEccPublic:
+		curve, err := softCurve(attributes.KeyBits)
+		if err != nil {
+			return err
+		}
+		x, y := elliptic.Unmarshal(curve, data)
+		if x == nil {
+			return softError(requests.StatusPsaErrorInvalidArgument)
+		}
+		key.pub = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case softKeyAes:
+		if len(data) != 16 && len(data) != 24 && len(data) != 32 {
+			return softError(requests.StatusPsaErrorInvalidArgument)
+		}
+		key.sym = append([]byte{}, data...)
+	}
+
+	return c.putKey(name, key)
+}
+
+func (c *softClient) PsaExportPublicKey(name string) ([]byte, error) {
+	key, err := c.getKey(name)
+	if err != nil {
+		return nil, err
+	}
+	switch pub := key.pub.(type) {
+	case *rsa.PublicKey:
+		return x509.MarshalPKCS1PublicKey(pub), nil
+	case *ecdsa.PublicKey:
+		return elliptic.Marshal(pub.Curve, pub.X, pub.Y), nil
+	}
+	return nil, softError(requests.StatusPsaErrorInvalidArgument)
+}
+
+func (c *softClient) PsaDestroyKey(name string) error {
+	softKeysLock.Lock()
+	defer softKeysLock.Unlock()
+	if _, ok := softKeys[c.app][name]; !ok {
+		return softError(requests.StatusPsaErrorDoesNotExist)
+	}
+	delete(softKeys[c.app], name)
+	return nil
+}
+
+func (c *softClient) PsaHashCompute(message []byte, alg algorithm.HashAlgorithmType) ([]byte, error) {
+	h, err := softHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	hasher := h.New()
+	hasher.Write(message)
+	return hasher.Sum(nil), nil
+}
+
+// like psa the alg must be the one of the key policy, a PS256 key can not sign RS256
+func softSignAlgPermitted(attr *parsec.KeyAttributes, alg *algorithm.AsymmetricSignatureAlgorithm) bool {
+	if attr.KeyPolicy.KeyAlgorithm == nil {
+		return true
+	}
+	return reflect.DeepEqual(attr.KeyPolicy.KeyAlgorithm.GetAsymmetricSignature(), alg)
+}
+
+func (c *softClient) PsaSignHash(name string, hash []byte, alg *algorithm.AsymmetricSignatureAlgorithm) ([]byte, error) {
+	key, err := c.getKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if key.priv == nil || !key.attr.KeyPolicy.KeyUsageFlags.SignHash || !softSignAlgPermitted(key.attr, alg) {
+		return nil, softError(requests.StatusPsaErrorNotPermitted)
+	}
+
+	switch priv := key.priv.(type) {
+	case *rsa.PrivateKey:
+		if a := alg.GetRsaPkcs1V15Sign(); a != nil {
+			h, err := softSignHash(a.SignHash, len(hash))
+			if err != nil {
+				return nil, err
+			}
+			return rsa.SignPKCS1v15(rand.Reader, priv, h, hash)
+		}
+		if a := alg.GetRsaPss(); a != nil {
+			h, err := softSignHash(a.SignHash, len(hash))
+			if err != nil {
+				return nil, err
+			}
+			return rsa.SignPSS(rand.Reader, priv, h, hash, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PrivateKey:
+		if alg.GetEcdsa() != nil || alg.GetEcdsaAny() != nil || alg.GetDeterministicEcdsa() != nil {
+			r, s, err := ecdsa.Sign(rand.Reader, priv, hash)
+			if err != nil {
+				return nil, err
+			}
+			// psa format: r || s with fixed length
+			size := (priv.Curve.Params().BitSize + 7) / 8
+			signature := make([]byte, 2*size)
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+			return signature, nil
+		}
+	}
+	return nil, softError(requests.StatusPsaErrorNotSupported)
+}
+
+func (c *softClient) PsaVerifyHash(name string, hash, signature []byte, alg *algorithm.AsymmetricSignatureAlgorithm) error {
+	key, err := c.getKey(name)
+	if err != nil {
+		return err
+	}
+	if !key.attr.KeyPolicy.KeyUsageFlags.VerifyHash || !softSignAlgPermitted(key.attr, alg) {
+		return softError(requests.StatusPsaErrorNotPermitted)
+	}
+
+	switch pub := key.pub.(type) {
+	case *rsa.PublicKey:
+		if a := alg.GetRsaPkcs1V15Sign(); a != nil {
+			h, err := softSignHash(a.SignHash, len(hash))
+			if err != nil {
+				return err
+			}
+			if rsa.VerifyPKCS1v15(pub, h, hash, signature) != nil {
+				return softError(requests.StatusPsaErrorInvalidSignature)
+			}
+			return nil
+		}
+		if a := alg.GetRsaPss(); a != nil {
+			h, err := softSignHash(a.SignHash, len(hash))
+			if err != nil {
+				return err
+			}
+			if rsa.VerifyPSS(pub, h, hash, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+				return softError(requests.StatusPsaErrorInvalidSignature)
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg.GetEcdsa() != nil || alg.GetEcdsaAny() != nil || alg.GetDeterministicEcdsa() != nil {
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return softError(requests.StatusPsaErrorInvalidSignature)
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(pub, hash, r, s) {
+				return softError(requests.StatusPsaErrorInvalidSignature)
+			}
+			return nil
+		}
+	}
+	return softError(requests.StatusPsaErrorNotSupported)
+}
+
+func (c *softClient) PsaAsymmetricEncrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, plaintext []byte) ([]byte, error) {
+	key, err := c.getKey(name)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.pub.(*rsa.PublicKey)
+	if !ok || !key.attr.KeyPolicy.KeyUsageFlags.Encrypt {
+		return nil, softError(requests.StatusPsaErrorNotPermitted)
+	}
+
+	if alg.GetRsaPkcs1V15Crypt() != nil {
+		return rsa.EncryptPKCS1v15(rand.Reader, pub, plaintext)
+	}
+	if a := alg.GetRsaOaep(); a != nil {
+		h, err := softHash(a.HashAlg)
+		if err != nil {
+			return nil, err
+		}
+		return rsa.EncryptOAEP(h.New(), rand.Reader, pub, plaintext, salt)
+	}
+	return nil, softError(requests.StatusPsaErrorNotSupported)
+}
+
+func (c *softClient) PsaAsymmetricDecrypt(name string, alg *algorithm.AsymmetricEncryptionAlgorithm, salt, ciphertext []byte) ([]byte, error) {
+	key, err := c.getKey(name)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.priv.(*rsa.PrivateKey)
+	if !ok || !key.attr.KeyPolicy.KeyUsageFlags.Decrypt {
+		return nil, softError(requests.StatusPsaErrorNotPermitted)
+	}
+
+	var plaintext []byte
+	if alg.GetRsaPkcs1V15Crypt() != nil {
+		plaintext, err = rsa.DecryptPKCS1v15(rand.Reader, priv, ciphertext)
+	} else if a := alg.GetRsaOaep(); a != nil {
+		var h crypto.Hash
+		h, err = softHash(a.HashAlg)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err = rsa.DecryptOAEP(h.New(), rand.Reader, priv, ciphertext, salt)
+	} else {
+		return nil, softError(requests.StatusPsaErrorNotSupported)
+	}
+	if err != nil {
+		return nil, softError(requests.StatusPsaErrorInvalidPadding)
+	}
+	return plaintext, nil
+}
+
+// only AES-GCM with default tag length
+func (c *softClient) softGcm(name string, alg *algorithm.AeadAlgorithm, encrypt bool) (cipher.AEAD, error) {
+	key, err := c.getKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if key.sym == nil {
+		return nil, softError(requests.StatusPsaErrorInvalidArgument)
+	}
+	flags := key.attr.KeyPolicy.KeyUsageFlags
+	if (encrypt && !flags.Encrypt) || (!encrypt && !flags.Decrypt) {
+		return nil, softError(requests.StatusPsaErrorNotPermitted)
+	}
+	if a := alg.GetAeadDefaultLengthTag(); a == nil || a.AeadAlg != algorithm.AeadAlgorithmGCM {
+		return nil, softError(requests.StatusPsaErrorNotSupported)
+	}
+
+	block, err := aes.NewCipher(key.sym)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *softClient) PsaAeadEncrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, plaintext []byte) ([]byte, error) {
+	gcm, err := c.softGcm(name, alg, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, softError(requests.StatusPsaErrorInvalidArgument)
+	}
+	return gcm.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func (c *softClient) PsaAeadDecrypt(name string, alg *algorithm.AeadAlgorithm, nonce, additionalData, ciphertext []byte) ([]byte, error) {
+	gcm, err := c.softGcm(name, alg, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, softError(requests.StatusPsaErrorInvalidArgument)
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, softError(requests.StatusPsaErrorInvalidSignature)
+	}
+	return plaintext, nil
+}
+
+func (c *softClient) Close() error {
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+)
+
+func softStatus(err error) requests.StatusCode {
+	if e, ok := err.(*softStatusError); ok {
+		return e.code
+	}
+	return requests.StatusSuccess
+}
+
+func softEncryptAttr(alg *algorithm.Algorithm) *parsec.KeyAttributes {
+	attr := getEncryptAttr(true)
+	attr.KeyPolicy.KeyAlgorithm = alg
+	return attr
+}
+
+func softAeadAttr(bits uint32) *parsec.KeyAttributes {
+	return &parsec.KeyAttributes{
+		KeyBits: bits,
+		KeyType: parsec.NewKeyType().Aes(),
+		KeyPolicy: &parsec.KeyPolicy{
+			KeyAlgorithm:  algorithm.NewAead().Aead(algorithm.AeadAlgorithmGCM),
+			KeyUsageFlags: &parsec.UsageFlags{Encrypt: true, Decrypt: true},
+		},
+	}
+}
+
+func TestSoftSignVerify(t *testing.T) {
+	client := newSoftClient("TestSoftSignVerify")
+	for _, name := range jwsAlgOrder {
+		a := jwsAlgs[name]
+		t.Run(name, func(t *testing.T) {
+			if err := client.PsaGenerateKey(name, a.keyAttr()); err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			defer client.PsaDestroyKey(name)
+
+			h := a.hash.New()
+			h.Write([]byte("Hello World"))
+			digest := h.Sum(nil)
+			signature, err := client.PsaSignHash(name, digest, a.signAlg())
+			if err != nil {
+				t.Fatalf("sign: %v", err)
+			}
+			if err := client.PsaVerifyHash(name, digest, signature, a.signAlg()); err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+
+			signature[len(signature)-1] ^= 1
+			err = client.PsaVerifyHash(name, digest, signature, a.signAlg())
+			if softStatus(err) != requests.StatusPsaErrorInvalidSignature {
+				t.Fatalf("verify tampered signature: got %v", err)
+			}
+
+			// rsa digest length must match the hash of the alg, ecdsa truncate it
+			if _, err := client.PsaSignHash(name, digest[:20], a.signAlg()); err == nil && !a.ecc {
+				t.Fatalf("sign short digest: no error")
+			}
+		})
+	}
+}
+
+func TestSoftSignNotPermitted(t *testing.T) {
+	client := newSoftClient("TestSoftSignNotPermitted")
+	if err := client.PsaGenerateKey("Enc", getEncryptAttr(true)); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	digest := sha256.Sum256([]byte("Hello World"))
+	_, err := client.PsaSignHash("Enc", digest[:], jwsAlgs[JWS_RS256].signAlg())
+	if softStatus(err) != requests.StatusPsaErrorNotPermitted {
+		t.Fatalf("sign by encrypt key: got %v", err)
+	}
+	_, err = client.PsaSignHash("NoKey", digest[:], jwsAlgs[JWS_RS256].signAlg())
+	if softStatus(err) != requests.StatusPsaErrorDoesNotExist {
+		t.Fatalf("sign by missing key: got %v", err)
+	}
+
+	// alg other than the key policy
+	if err := client.PsaGenerateKey("Pss", jwsAlgs[JWS_PS256].keyAttr()); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	_, err = client.PsaSignHash("Pss", digest[:], jwsAlgs[JWS_RS256].signAlg())
+	if softStatus(err) != requests.StatusPsaErrorNotPermitted {
+		t.Fatalf("sign RS256 by PS256 key: got %v", err)
+	}
+	if err := client.PsaGenerateKey("Es384", jwsAlgs[JWS_ES384].keyAttr()); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	_, err = client.PsaSignHash("Es384", digest[:], jwsAlgs[JWS_ES256].signAlg())
+	if softStatus(err) != requests.StatusPsaErrorNotPermitted {
+		t.Fatalf("sign ES256 by ES384 key: got %v", err)
+	}
+}
+
+func TestSoftEncryptDecrypt(t *testing.T) {
+	client := newSoftClient("TestSoftEncryptDecrypt")
+	factory := algorithm.NewAsymmetricEncryption()
+	tests := []struct {
+		name string
+		alg  *algorithm.Algorithm
+		salt []byte
+	}{
+		{"Pkcs1v15", factory.RsaPkcs1V15Crypt(), nil},
+		{"OaepSha256", factory.RsaOaep(algorithm.HashAlgorithmTypeSHA256), nil},
+		{"OaepSha512Label", factory.RsaOaep(algorithm.HashAlgorithmTypeSHA512), []byte("label")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := client.PsaGenerateKey(tt.name, softEncryptAttr(tt.alg)); err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			defer client.PsaDestroyKey(tt.name)
+
+			alg := tt.alg.GetAsymmetricEncryption()
+			plaintext := []byte("Hello World")
+			ciphertext, err := client.PsaAsymmetricEncrypt(tt.name, alg, tt.salt, plaintext)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			decrypted, err := client.PsaAsymmetricDecrypt(tt.name, alg, tt.salt, ciphertext)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("decrypt: got %q, want %q", decrypted, plaintext)
+			}
+
+			ciphertext[0] ^= 1
+			decrypted, err = client.PsaAsymmetricDecrypt(tt.name, alg, tt.salt, ciphertext)
+			if softStatus(err) != requests.StatusPsaErrorInvalidPadding || decrypted != nil {
+				t.Fatalf("decrypt tampered: got %q, %v", decrypted, err)
+			}
+		})
+	}
+}
+
+func TestSoftDecryptOaepFail(t *testing.T) {
+	client := newSoftClient("TestSoftDecryptOaepFail")
+	factory := algorithm.NewAsymmetricEncryption()
+	if err := client.PsaGenerateKey("Oaep", softEncryptAttr(factory.RsaOaep(algorithm.HashAlgorithmTypeSHA256))); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	sha256Alg := factory.RsaOaep(algorithm.HashAlgorithmTypeSHA256).GetAsymmetricEncryption()
+	sha512Alg := factory.RsaOaep(algorithm.HashAlgorithmTypeSHA512).GetAsymmetricEncryption()
+	ciphertext, err := client.PsaAsymmetricEncrypt("Oaep", sha256Alg, []byte("label"), []byte("Hello World"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		alg        *algorithm.AsymmetricEncryptionAlgorithm
+		salt       []byte
+		ciphertext []byte
+	}{
+		{"WrongLabel", sha256Alg, []byte("other"), ciphertext},
+		{"WrongHash", sha512Alg, []byte("label"), ciphertext},
+		{"ShortCiphertext", sha256Alg, []byte("label"), ciphertext[:len(ciphertext)/2]},
+		{"Garbage", sha256Alg, []byte("label"), bytes.Repeat([]byte{1}, len(ciphertext))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := client.PsaAsymmetricDecrypt("Oaep", tt.alg, tt.salt, tt.ciphertext)
+			if err == nil {
+				t.Fatalf("decrypt: no error, got %q", plaintext)
+			}
+			if softStatus(err) != requests.StatusPsaErrorInvalidPadding {
+				t.Fatalf("decrypt: got %v", err)
+			}
+		})
+	}
+}
+
+func TestSoftEncryptNotPermitted(t *testing.T) {
+	client := newSoftClient("TestSoftEncryptNotPermitted")
+	a := jwsAlgs[JWS_RS256]
+	if err := client.PsaGenerateKey("Sign", a.keyAttr()); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	alg := algorithm.NewAsymmetricEncryption().RsaPkcs1V15Crypt().GetAsymmetricEncryption()
+	_, err := client.PsaAsymmetricEncrypt("Sign", alg, nil, []byte("Hello World"))
+	if softStatus(err) != requests.StatusPsaErrorNotPermitted {
+		t.Fatalf("encrypt by sign key: got %v", err)
+	}
+}
+
+func TestSoftAead(t *testing.T) {
+	client := newSoftClient("TestSoftAead")
+	alg := algorithm.NewAead().Aead(algorithm.AeadAlgorithmGCM).GetAead()
+	nonce := make([]byte, 12)
+	plaintext := []byte("Hello World")
+	additional := []byte("additional")
+
+	for _, bits := range []uint32{128, 192, 256} {
+		name := fmt.Sprintf("Aes%d", bits)
+		t.Run(name, func(t *testing.T) {
+			if err := client.PsaGenerateKey(name, softAeadAttr(bits)); err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			defer client.PsaDestroyKey(name)
+
+			ciphertext, err := client.PsaAeadEncrypt(name, alg, nonce, additional, plaintext)
+			if err != nil {
+				t.Fatalf("encrypt: %v", err)
+			}
+			decrypted, err := client.PsaAeadDecrypt(name, alg, nonce, additional, ciphertext)
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatalf("decrypt: got %q, want %q", decrypted, plaintext)
+			}
+
+			tests := []struct {
+				name       string
+				nonce      []byte
+				additional []byte
+				ciphertext []byte
+				status     requests.StatusCode
+			}{
+				{"WrongAdditional", nonce, []byte("other"), ciphertext, requests.StatusPsaErrorInvalidSignature},
+				{"Tampered", nonce, additional, append([]byte{ciphertext[0] ^ 1}, ciphertext[1:]...), requests.StatusPsaErrorInvalidSignature},
+				{"ShortNonce", nonce[:8], additional, ciphertext, requests.StatusPsaErrorInvalidArgument},
+			}
+			for _, tt := range tests {
+				_, err := client.PsaAeadDecrypt(name, alg, tt.nonce, tt.additional, tt.ciphertext)
+				if softStatus(err) != tt.status {
+					t.Errorf("%s: got %v, want %v", tt.name, err, tt.status.ToErr())
+				}
+			}
+		})
+	}
+
+	if err := client.PsaGenerateKey("Aes100", softAeadAttr(100)); softStatus(err) != requests.StatusPsaErrorNotSupported {
+		t.Fatalf("generate 100 bits aes: got %v", err)
+	}
+}
+
+func TestSoftImportExport(t *testing.T) {
+	client := newSoftClient("TestSoftImportExport")
+	for _, name := range jwsAlgOrder {
+		a := jwsAlgs[name]
+		t.Run(name, func(t *testing.T) {
+			if err := client.PsaGenerateKey(name, a.keyAttr()); err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+			data, err := client.PsaExportPublicKey(name)
+			if err != nil {
+				t.Fatalf("export: %v", err)
+			}
+
+			attr := a.keyAttr()
+			attr.KeyPolicy.KeyUsageFlags.SignHash = false
+			if a.ecc {
+				attr.KeyType = parsec.NewKeyType().EccPublicKey(parsec.KeyTypeSECPR1)
+			} else {
+				attr.KeyType = parsec.NewKeyType().RsaPublicKey()
+			}
+			if err := client.PsaImportKey(name+"Pub", attr, data); err != nil {
+				t.Fatalf("import: %v", err)
+			}
+
+			h := a.hash.New()
+			h.Write([]byte("Hello World"))
+			hash := h.Sum(nil)
+			signature, err := client.PsaSignHash(name, hash, a.signAlg())
+			if err != nil {
+				t.Fatalf("sign: %v", err)
+			}
+			if err := client.PsaVerifyHash(name+"Pub", hash, signature, a.signAlg()); err != nil {
+				t.Fatalf("verify by imported key: %v", err)
+			}
+			if _, err := client.PsaSignHash(name+"Pub", hash, a.signAlg()); softStatus(err) != requests.StatusPsaErrorNotPermitted {
+				t.Fatalf("sign by public key: got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ssh-agent protocol on a unix socket, the signing keys of one application
+// were listed as identities and sign requests go to parsec PsaSignHash.
+// the private keys never leave parsec, so add and remove were refused.
+// rsa keys of /keysign have sha256 policy, rsa-sha2-512 was refused for them and
+// OpenSSH need be told to use rsa-sha2-256, or use ES256 keys instead.
+//
+// export SSH_AUTH_SOCK=/run/parsecclient/agent.sock; ssh-add -L
+// ssh -o PubkeyAcceptedAlgorithms=rsa-sha2-256,ecdsa-sha2-nistp256 edge-node
+
+var errAgentReadOnly = errors.New("parsec agent is read only, generate keys by ParsecClient api")
+var errAgentUnknownKey = errors.New("parsec agent has no such key")
+var errAgentSignFlags = errors.New("parsec agent only sign with rsa-sha2-256 or ecdsa-sha2-nistp256, key policy allow sha256 only")
+
+type sshIdentity struct {
+	keyName string // versioned key name in parsec
+	pub     ssh.PublicKey
+}
+
+// parsecAgent implement agent.ExtendedAgent, one client of application name
+type parsecAgent struct {
+	name   string
+	keys   []string // key names without version, empty list all
+	client CryptoClient
+	lock   sync.Mutex
+	ids    map[string]*sshIdentity // ssh wire format of public key -> identity
+}
+
+var _ agent.ExtendedAgent = (*parsecAgent)(nil)
+
+// InitSshAgent serve ssh-agent protocol if sshagent.socket was set
+func InitSshAgent() {
+	conf := Conf.SshAgent
+	if len(conf.Socket) == 0 {
+		return
+	}
+	if !Conf.Acl.IsClientAllowed(conf.Name) {
+		zap.L().Fatal("sshagent.name not allowed by acl", zap.String("client", conf.Name))
+	}
+
+	client, err := newCryptoClient(conf.Name)
+	if err != nil {
+		zap.L().Fatal("Create ssh agent client fail", zap.Error(err))
+	}
+	a := &parsecAgent{
+		name:   conf.Name,
+		keys:   conf.Keys,
+		client: client,
+		ids:    make(map[string]*sshIdentity),
+	}
+
+	os.Remove(conf.Socket) // stale socket of last run
+	listener, err := net.Listen("unix", conf.Socket)
+	if err != nil {
+		zap.L().Fatal("Listen ssh agent socket fail", zap.Error(err))
+	}
+	// only the owner can ask to sign
+	if err := os.Chmod(conf.Socket, 0600); err != nil {
+		zap.L().Fatal("Chmod ssh agent socket fail", zap.Error(err))
+	}
+	zap.L().Info("Ssh agent listening", zap.String("socket", conf.Socket), zap.String("client", conf.Name))
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				zap.L().Error("Ssh agent accept fail", zap.Error(err))
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := agent.ServeAgent(a, conn); err != nil && !errors.Is(err, io.EOF) {
+					zap.L().Debug("Ssh agent connection closed", zap.Error(err))
+				}
+			}()
+		}
+	}()
+}
+
+// only rsa and ecdsa P-256 keys have a ssh signature format here
+func sshPublicKey(pk *cachedPubKey) (ssh.PublicKey, bool) {
+	switch pub := pk.key.(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	sshPub, err := ssh.NewPublicKey(pk.key)
+	if err != nil {
+		return nil, false
+	}
+	return sshPub, true
+}
+
+func (a *parsecAgent) wanted(keyName string) bool {
+	if len(a.keys) == 0 {
+		return true
+	}
+	for _, name := range a.keys {
+		if name == keyName {
+			return true
+		}
+	}
+	return false
+}
+
+// current version of each signing key, must hold a.lock
+func (a *parsecAgent) loadIdentities() ([]*sshIdentity, error) {
+	keyRingsLock.Lock()
+	rings, err := loadKeyRings(a.name, a.client)
+	var names []string
+	if err == nil {
+		for keyName, ring := range rings {
+			if !a.wanted(keyName) {
+				continue
+			}
+			// attributes are unknown for keys made before restart, let sign fail for them
+			if ring.attr != nil && !ring.attr.KeyPolicy.KeyUsageFlags.SignHash {
+				continue
+			}
+			names = append(names, versionedKeyName(keyName, ring.current))
+		}
+	}
+	keyRingsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]*sshIdentity, 0, len(names))
+	a.ids = make(map[string]*sshIdentity)
+	for _, keyName := range names {
+		pk, err := getPublicKey(a.name, a.client, keyName)
+		if err != nil {
+			zap.L().Debug("Ssh agent skip key "+keyName, zap.Error(err))
+			continue
+		}
+		pub, ok := sshPublicKey(pk)
+		if !ok {
+			continue
+		}
+		id := &sshIdentity{keyName: keyName, pub: pub}
+		a.ids[string(pub.Marshal())] = id
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (a *parsecAgent) List() ([]*agent.Key, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ids, err := a.loadIdentities()
+	if err != nil {
+		zap.L().Error(err.Error())
+		return nil, err
+	}
+	keys := make([]*agent.Key, 0, len(ids))
+	for _, id := range ids {
+		base, _ := splitKeyName(id.keyName)
+		keys = append(keys, &agent.Key{
+			Format:  id.pub.Type(),
+			Blob:    id.pub.Marshal(),
+			Comment: a.name + "_" + base,
+		})
+	}
+	return keys, nil
+}
+
+func (a *parsecAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *parsecAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	id, ok := a.ids[string(key.Marshal())]
+	if !ok {
+		// key was rotated or ssh skipped the list request
+		if _, err := a.loadIdentities(); err != nil {
+			return nil, err
+		}
+		if id, ok = a.ids[string(key.Marshal())]; !ok {
+			return nil, errAgentUnknownKey
+		}
+	}
+
+	var format string
+	var digest []byte
+	var alg *algorithm.Algorithm
+	switch id.pub.Type() {
+	case ssh.KeyAlgoRSA:
+		// ssh-rsa is sha1 and rsa-sha2-512 is sha512, both not allowed by the key policy
+		if flags != agent.SignatureFlagRsaSha256 {
+			zap.L().Warn("Ssh agent refused rsa signature flags", zap.String("client", a.name), zap.String("key", id.keyName), zap.Uint32("flags", uint32(flags)))
+			return nil, errAgentSignFlags
+		}
+		format = ssh.SigAlgoRSASHA2256
+		hash := sha256.Sum256(data)
+		digest = hash[:]
+		alg = algorithm.NewAsymmetricSignature().RsaPkcs1V15Sign(algorithm.HashAlgorithmTypeSHA256)
+	case ssh.KeyAlgoECDSA256:
+		format = ssh.KeyAlgoECDSA256
+		hash := sha256.Sum256(data)
+		digest = hash[:]
+		alg = algorithm.NewAsymmetricSignature().Ecdsa(algorithm.HashAlgorithmTypeSHA256)
+	default:
+		return nil, errAgentSignFlags
+	}
+
+	signature, err := a.client.PsaSignHash(id.keyName, digest, alg.GetAsymmetricSignature())
+	if err != nil {
+		zap.L().Error("Ssh agent sign fail", zap.String("client", a.name), zap.String("key", id.keyName), zap.Error(err))
+		return nil, err
+	}
+	zap.L().Info("Ssh agent signed", zap.String("client", a.name), zap.String("key", id.keyName), zap.String("format", format))
+
+	if format == ssh.KeyAlgoECDSA256 {
+		// parsec r || s -> ssh mpint r, mpint s
+		if len(signature) != 64 {
+			return nil, errPubKeyFormat
+		}
+		signature = ssh.Marshal(struct {
+			R *big.Int
+			S *big.Int
+		}{
+			R: new(big.Int).SetBytes(signature[:32]),
+			S: new(big.Int).SetBytes(signature[32:]),
+		})
+	}
+	return &ssh.Signature{Format: format, Blob: signature}, nil
+}
+
+func (a *parsecAgent) Add(key agent.AddedKey) error {
+	return errAgentReadOnly
+}
+
+func (a *parsecAgent) Remove(key ssh.PublicKey) error {
+	return errAgentReadOnly
+}
+
+func (a *parsecAgent) RemoveAll() error {
+	return errAgentReadOnly
+}
+
+func (a *parsecAgent) Lock(passphrase []byte) error {
+	return errAgentReadOnly
+}
+
+func (a *parsecAgent) Unlock(passphrase []byte) error {
+	return errAgentReadOnly
+}
+
+func (a *parsecAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errAgentReadOnly
+}
+
+func (a *parsecAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
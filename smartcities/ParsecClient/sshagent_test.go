@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agent client of x/crypto/ssh talking to parsecAgent, keys were made by the apis
+func testSshAgent(t *testing.T, name string) agent.ExtendedAgent {
+	t.Helper()
+	testNewClient(t, name)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "RsaKey"}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: name, KeyName: "EcKey", Alg: JWS_ES256}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/keyenc", &paramAll{Name: name, KeyName: "EncKey"}), CODE_SUCCESS)
+
+	client, _ := getClient(name)
+	a := &parsecAgent{
+		name:   name,
+		client: client,
+		ids:    make(map[string]*sshIdentity),
+	}
+	serverConn, clientConn := net.Pipe()
+	go agent.ServeAgent(a, serverConn)
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	return agent.NewClient(clientConn)
+}
+
+func testAgentKey(t *testing.T, keys []*agent.Key, format string) ssh.PublicKey {
+	t.Helper()
+	for _, key := range keys {
+		if key.Format == format {
+			pub, err := ssh.ParsePublicKey(key.Blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pub
+		}
+	}
+	t.Fatalf("no %s key listed", format)
+	return nil
+}
+
+func TestSshAgentSign(t *testing.T) {
+	ac := testSshAgent(t, "SshAgentSign")
+	keys, err := ac.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("listed %d keys, want the 2 signing keys", len(keys))
+	}
+	rsaPub := testAgentKey(t, keys, ssh.KeyAlgoRSA)
+	ecPub := testAgentKey(t, keys, ssh.KeyAlgoECDSA256)
+
+	data := []byte("session data")
+	tests := []struct {
+		name   string
+		key    ssh.PublicKey
+		flags  agent.SignatureFlags
+		format string // empty was refused
+	}{
+		{"RsaSha256", rsaPub, agent.SignatureFlagRsaSha256, ssh.SigAlgoRSASHA2256},
+		{"RsaSha512", rsaPub, agent.SignatureFlagRsaSha512, ""},
+		{"RsaSha1", rsaPub, 0, ""},
+		{"Ecdsa", ecPub, 0, ssh.KeyAlgoECDSA256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature, err := ac.SignWithFlags(tt.key, data, tt.flags)
+			if len(tt.format) == 0 {
+				if err == nil {
+					t.Fatalf("signed with flags %d, format %s", tt.flags, signature.Format)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sign: %v", err)
+			}
+			if signature.Format != tt.format {
+				t.Fatalf("format %s, want %s", signature.Format, tt.format)
+			}
+			if err := tt.key.Verify(data, signature); err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if err := tt.key.Verify([]byte("other data"), signature); err == nil {
+				t.Fatalf("verify other data: no error")
+			}
+		})
+	}
+
+	if err := ac.RemoveAll(); err == nil {
+		t.Fatalf("remove all: no error")
+	}
+}
+
+// ssh handshake of x/crypto client and server, the client authenticate by the agent
+func TestSshAgentHandshake(t *testing.T) {
+	ac := testSshAgent(t, "SshAgentHandshake")
+	keys, err := ac.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	// this x/crypto client sign rsa keys with ssh-rsa, only accept the ecdsa key
+	ecPub := testAgentKey(t, keys, ssh.KeyAlgoECDSA256)
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), ecPub.Marshal()) {
+				return nil, errAgentUnknownKey
+			}
+			return &ssh.Permissions{}, nil
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+
+	// both sides write the version first, net.Pipe would block them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer serverConn.Close()
+		conn, chans, reqs, err := ssh.NewServerConn(serverConn, serverConfig)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "test")
+				}
+			}()
+			conn.Close()
+		}
+		serverErr <- err
+	}()
+
+	clientConfig := &ssh.ClientConfig{
+		User:            "edge",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(ac.Signers)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	}
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	conn, _, _, err := ssh.NewClientConn(clientConn, "edge-node", clientConfig)
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	conn.Close()
+	if err := <-serverErr; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// tenants group application names of one team, with quota of keys and
+// allowed key types, sizes and algorithms. applications not in any tenant
+// were not limited, or rejected by tenancy.strict.
+
+type rtnTenantApp struct {
+	Name string
+	Keys int
+
+	names map[string]bool // key names without version
+}
+
+type rtnTenantUsage struct {
+	Name    string
+	MaxKeys int // 0 is unlimited
+	Keys    int
+	Apps    []rtnTenantApp
+}
+
+// "prefix*" match names start with prefix
+func matchAppName(pattern string, name string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == name
+}
+
+func (t *CfgTenant) hasApp(name string) bool {
+	for _, pattern := range t.Apps {
+		if matchAppName(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tenant of the application, first matched one
+func appTenant(appName string) (CfgTenant, bool) {
+	for _, t := range GetConf().Tenants {
+		if t.hasApp(appName) {
+			return t, true
+		}
+	}
+	return CfgTenant{}, false
+}
+
+func allowedIn(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applications of tenants with keys, loaded from tenancy.appsFile when first used
+var tenancyApps map[string]bool
+var tenancyAppsFile string
+var tenancyAppsLock sync.Mutex
+
+func loadTenancyApps(path string) error {
+	if tenancyApps != nil && tenancyAppsFile == path {
+		return nil
+	}
+	apps := map[string]bool{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range strings.Split(string(data), "\n") {
+		if name = strings.TrimSpace(name); len(name) != 0 {
+			apps[name] = true
+		}
+	}
+	tenancyApps, tenancyAppsFile = apps, path
+	return nil
+}
+
+// keep the application in tenancy.appsFile, so its keys were counted
+// even not cached and without meta store
+func recordTenancyApp(appName string) error {
+	path := GetConf().Tenancy.AppsFile
+	if len(path) == 0 {
+		return nil
+	}
+	tenancyAppsLock.Lock()
+	defer tenancyAppsLock.Unlock()
+	if err := loadTenancyApps(path); err != nil {
+		return err
+	}
+	if tenancyApps[appName] {
+		return nil
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(appName + "\n")
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	tenancyApps[appName] = true
+	return nil
+}
+
+// applications of the tenant: its names without "*", cached clients,
+// meta store and tenancy.appsFile
+func tenantApps(t *CfgTenant) ([]string, error) {
+	names := map[string]bool{}
+	for _, pattern := range t.Apps {
+		if !strings.HasSuffix(pattern, "*") {
+			names[pattern] = true
+		}
+	}
+	if path := GetConf().Tenancy.AppsFile; len(path) != 0 {
+		tenancyAppsLock.Lock()
+		err := loadTenancyApps(path)
+		for name := range tenancyApps {
+			names[name] = true
+		}
+		tenancyAppsLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	clientsLock.RLock()
+	for name := range clients {
+		names[name] = true
+	}
+	clientsLock.RUnlock()
+	if metaDB != nil {
+		metaDB.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(metaBucket).ForEach(func(k, v []byte) error {
+				names[strings.SplitN(string(k), "\x00", 2)[0]] = true
+				return nil
+			})
+		})
+	}
+	apps := make([]string, 0, len(names))
+	for name := range names {
+		if owner, ok := appTenant(name); ok && owner.Name == t.Name {
+			apps = append(apps, name)
+		}
+	}
+	sort.Strings(apps)
+	return apps, nil
+}
+
+// keys without version of one application, a new client was used if none cached
+func appKeyNames(appName string) (map[string]bool, error) {
+	client, ok := getClient(appName)
+	if !ok {
+		var err error
+		if client, err = newCryptoClient(appName); err != nil {
+			return nil, err
+		}
+		defer client.Close()
+	}
+	keys, err := client.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	bases := map[string]bool{}
+	for _, key := range keys {
+		base, _ := splitKeyName(key.Name)
+		bases[base] = true
+	}
+	return bases, nil
+}
+
+func tenantUsage(t *CfgTenant) (*rtnTenantUsage, error) {
+	apps, err := tenantApps(t)
+	if err != nil {
+		return nil, err
+	}
+	usage := &rtnTenantUsage{Name: t.Name, MaxKeys: t.MaxKeys, Apps: make([]rtnTenantApp, 0)}
+	for _, app := range apps {
+		names, err := appKeyNames(app)
+		if err != nil {
+			return nil, err
+		}
+		usage.Keys += len(names)
+		usage.Apps = append(usage.Apps, rtnTenantApp{Name: app, Keys: len(names), names: names})
+	}
+	return usage, nil
+}
+
+func (u *rtnTenantUsage) hasKey(appName string, keyName string) bool {
+	for _, app := range u.Apps {
+		if app.Name == appName {
+			return app.names[keyName]
+		}
+	}
+	return false
+}
+
+// keys of a tenant being made, counted by quota until listed by parsec.
+// its lock was held from count to reserve, so concurrent or async
+// generations can not pass the quota together.
+type tenantReserve struct {
+	sync.Mutex
+	keys map[string]int // application \x00 key name -> generations
+}
+
+var tenantReserves = make(map[string]*tenantReserve)
+var tenantReservesLock sync.Mutex
+
+func getTenantReserve(name string) *tenantReserve {
+	tenantReservesLock.Lock()
+	defer tenantReservesLock.Unlock()
+	r, ok := tenantReserves[name]
+	if !ok {
+		r = &tenantReserve{keys: make(map[string]int)}
+		tenantReserves[name] = r
+	}
+	return r
+}
+
+// bits of an imported ssh public key, 0 if unknown
+func sshKeyBits(data []byte) int {
+	pub, err := ssh.ParsePublicKey(data)
+	if err != nil {
+		return 0
+	}
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	}
+	return 0
+}
+
+func noRelease() {}
+
+// check a new key of the application by its tenant, alg only for sign keys.
+// the key was reserved in quota of the tenant, release it after the key was
+// made or failed.
+func checkTenantKey(appName string, keyName string, keyType string, alg string, bits int) (func(), int32) {
+	t, ok := appTenant(appName)
+	if !ok {
+		if GetConf().Tenancy.Strict {
+			zap.L().Warn("Client not in any tenant", zap.String("client", appName))
+			return noRelease, CODE_NOT_ALLOWED
+		}
+		return noRelease, CODE_SUCCESS
+	}
+	if !allowedIn(t.KeyTypes, keyType) {
+		zap.L().Warn("Key type not allowed by tenant", zap.String("tenant", t.Name), zap.String("client", appName), zap.String("type", keyType))
+		return noRelease, CODE_NOT_ALLOWED
+	}
+	if keyType == KEY_TYPE_SIGN && !allowedIn(t.Algs, alg) {
+		zap.L().Warn("Key alg not allowed by tenant", zap.String("tenant", t.Name), zap.String("client", appName), zap.String("alg", alg))
+		return noRelease, CODE_NOT_ALLOWED
+	}
+	if len(t.KeyBits) != 0 {
+		found := false
+		for _, b := range t.KeyBits {
+			if b == bits {
+				found = true
+				break
+			}
+		}
+		if !found {
+			zap.L().Warn("Key size not allowed by tenant", zap.String("tenant", t.Name), zap.String("client", appName), zap.Int("bits", bits))
+			return noRelease, CODE_NOT_ALLOWED
+		}
+	}
+	if err := recordTenancyApp(appName); err != nil {
+		zap.L().Error(err.Error())
+		return noRelease, CODE_PARSEC_ERROR
+	}
+	if t.MaxKeys <= 0 {
+		return noRelease, CODE_SUCCESS
+	}
+
+	r := getTenantReserve(t.Name)
+	r.Lock()
+	defer r.Unlock()
+	usage, err := tenantUsage(&t)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return noRelease, CODE_PARSEC_ERROR
+	}
+	keys := usage.Keys
+	for reserved := range r.keys {
+		names := strings.SplitN(reserved, "\x00", 2)
+		if !usage.hasKey(names[0], names[1]) {
+			keys++
+		}
+	}
+	if keys >= t.MaxKeys {
+		zap.L().Warn("Key quota of tenant exceeded", zap.String("tenant", t.Name), zap.String("client", appName), zap.Int("keys", keys))
+		return noRelease, CODE_QUOTA_EXCEEDED
+	}
+
+	base, _ := splitKeyName(keyName)
+	reserved := appName + "\x00" + base
+	r.keys[reserved]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.Lock()
+			if r.keys[reserved]--; r.keys[reserved] <= 0 {
+				delete(r.keys, reserved)
+			}
+			r.Unlock()
+		})
+	}, CODE_SUCCESS
+}
+
+// curl -v 127.0.0.1:8300/tenants
+// curl -v '127.0.0.1:8300/tenants?name=team-a'
+func ApiTenantUsage(c *gin.Context) {
+	name := c.Query("name")
+	list := make([]*rtnTenantUsage, 0)
+	for _, t := range GetConf().Tenants {
+		if len(name) != 0 && t.Name != name {
+			continue
+		}
+		usage, err := tenantUsage(&t)
+		if err != nil {
+			zap.L().Error(err.Error())
+			responseError(c, CODE_PARSEC_ERROR)
+			return
+		}
+		list = append(list, usage)
+	}
+	if len(name) != 0 && len(list) == 0 {
+		responseError(c, CODE_INVALID_PARAM)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// tenants of the test, apps file in a temp dir and forgotten like after restart
+func testTenants(t *testing.T, strict bool, tenants ...CfgTenant) {
+	t.Helper()
+	appsFile := filepath.Join(t.TempDir(), "tenant.apps")
+	testSetConf(t, func(conf *AppConfig) {
+		conf.Tenants = tenants
+		conf.Tenancy = CfgTenancy{Strict: strict, AppsFile: appsFile}
+	})
+	testResetTenancyApps()
+	t.Cleanup(testResetTenancyApps)
+}
+
+func testResetTenancyApps() {
+	tenancyAppsLock.Lock()
+	tenancyApps = nil
+	tenancyAppsLock.Unlock()
+}
+
+func TestTenantStrict(t *testing.T) {
+	testTenants(t, true, CfgTenant{Name: "team-strict", Apps: []string{"StrictClient"}})
+	testNewClient(t, "StrictClient")
+	testNewClient(t, "LooseClient")
+
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "StrictClient", KeyName: "StrictKey"}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "LooseClient", KeyName: "LooseKey"}), CODE_NOT_ALLOWED)
+
+	conf := GetConf()
+	conf.Tenants = nil
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("tenancy.strict without tenants: no error")
+	}
+}
+
+// keys of an application not cached and without meta store were still counted
+func TestTenantQuotaUncached(t *testing.T) {
+	testTenants(t, false, CfgTenant{Name: "team-uncached", Apps: []string{"Uncached*"}, MaxKeys: 2})
+	testNewClient(t, "UncachedA")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "UncachedA", KeyName: "UncachedKey"}), CODE_SUCCESS)
+	testApi(t, "DELETE", "/client", &paramAll{Name: "UncachedA"})
+	testResetTenancyApps()
+
+	testNewClient(t, "UncachedB")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "UncachedB", KeyName: "UncachedKey"}), CODE_SUCCESS)
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "UncachedB", KeyName: "UncachedKey2"}), CODE_QUOTA_EXCEEDED)
+
+	usage, err := tenantUsage(&GetConf().Tenants[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Keys != 2 || len(usage.Apps) != 2 || usage.Apps[0].Name != "UncachedA" || usage.Apps[0].Keys != 1 {
+		t.Fatalf("usage %+v, want 1 key of UncachedA and UncachedB", usage)
+	}
+}
+
+// concurrent generations can not pass the quota together
+func TestTenantQuotaConcurrent(t *testing.T) {
+	const maxKeys = 3
+	testTenants(t, false, CfgTenant{Name: "team-concurrent", Apps: []string{"ConcurrentClient"}, MaxKeys: maxKeys})
+	testNewClient(t, "ConcurrentClient")
+
+	codes := make([]int32, 8)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := testApi(t, "POST", "/keysign", &paramAll{Name: "ConcurrentClient", KeyName: fmt.Sprintf("ConcurrentKey%d", i)})
+			codes[i] = testCode(t, w)
+		}(i)
+	}
+	wg.Wait()
+
+	made := 0
+	for _, code := range codes {
+		switch code {
+		case CODE_SUCCESS:
+			made++
+		case CODE_QUOTA_EXCEEDED:
+		default:
+			t.Fatalf("codes %v", codes)
+		}
+	}
+	if made != maxKeys {
+		t.Fatalf("%d keys made, want %d, codes %v", made, maxKeys, codes)
+	}
+	tenantReservesLock.Lock()
+	defer tenantReservesLock.Unlock()
+	if r := tenantReserves["team-concurrent"]; r == nil || len(r.keys) != 0 {
+		t.Fatalf("reserved keys left %+v", r)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"go.uber.org/zap"
+)
+
+// RFC 3161 time stamping authority, the token is CMS SignedData of TSTInfo
+// signed by the parsec key tsa.key of application tsa.name.
+// serial numbers were saved in tsa.serialFile before each response, so they
+// only grow across restarts.
+//
+// openssl ts -query -data photo.jpg -sha256 -cert -out req.tsq
+// curl -H 'Content-Type: application/timestamp-query' --data-binary @req.tsq -o resp.tsr 127.0.0.1:8300/tsa
+// openssl ts -verify -in resp.tsr -queryfile req.tsq -CAfile tsa.pem
+
+const (
+	tsaQueryType = "application/timestamp-query"
+	tsaReplyType = "application/timestamp-reply"
+)
+
+// PKIStatus
+const (
+	TSA_STATUS_GRANTED   = 0
+	TSA_STATUS_REJECTION = 2
+)
+
+// bits of PKIFailureInfo
+const (
+	TSA_FAIL_BAD_ALG              = 0
+	TSA_FAIL_BAD_REQUEST          = 2
+	TSA_FAIL_BAD_DATA_FORMAT      = 5
+	TSA_FAIL_UNACCEPTED_POLICY    = 15
+	TSA_FAIL_UNACCEPTED_EXTENSION = 16
+	TSA_FAIL_SYSTEM_FAILURE       = 25
+)
+
+var (
+	oidSHA512                   = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidTSTInfo                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttrSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	errTsaCertKey               = errors.New("tsa.cert is not the certificate of current key version")
+	errTsaSerialFormat          = errors.New("invalid serial number in tsa.serialFile")
+	tsaHashes                   = map[string]crypto.Hash{oidSHA256.String(): crypto.SHA256, oidSHA384.String(): crypto.SHA384, oidSHA512.String(): crypto.SHA512}
+	tsaSerialLock               sync.Mutex
+	tsaLastSerial               *big.Int // nil before loaded from file
+)
+
+type tsaImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     []asn1.RawValue       `asn1:"optional,tag:0"`
+}
+
+type tsaAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tsaInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       tsaAccuracy   `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	Tsa            asn1.RawValue `asn1:"optional"` // [0] EXPLICIT GeneralName
+}
+
+type tsaStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"` // UTF8String
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type tsaResponse struct {
+	Status tsaStatusInfo
+	Token  asn1.RawValue `asn1:"optional"`
+}
+
+// ESSCertIDv2 with default sha256
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// dotted string like "1.2.3.4.1"
+func parseOid(str string) (asn1.ObjectIdentifier, bool) {
+	parts := strings.Split(str, ".")
+	if len(parts) < 2 {
+		return nil, false
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		oid[i] = n
+	}
+	return oid, true
+}
+
+func tsaReject(c *gin.Context, failBit int, text string) {
+	fail := asn1.BitString{Bytes: make([]byte, failBit/8+1), BitLength: failBit + 1}
+	fail.Bytes[failBit/8] |= 0x80 >> uint(failBit%8)
+	out, err := asn1.Marshal(tsaResponse{Status: tsaStatusInfo{
+		Status:       TSA_STATUS_REJECTION,
+		StatusString: []asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte(text)}},
+		FailInfo:     fail,
+	}})
+	if err != nil {
+		zap.L().Error(err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	zap.L().Warn("Time stamp rejected", zap.String("reason", text))
+	c.Data(http.StatusOK, tsaReplyType, out)
+}
+
+// next serial, saved to file before it was used
+func nextTsaSerial(path string) (*big.Int, error) {
+	tsaSerialLock.Lock()
+	defer tsaSerialLock.Unlock()
+
+	if tsaLastSerial == nil {
+		data, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+			tsaLastSerial = new(big.Int)
+		case err != nil:
+			return nil, err
+		default:
+			last, ok := new(big.Int).SetString(strings.TrimSpace(string(data)), 10)
+			if !ok || last.Sign() < 0 {
+				return nil, errTsaSerialFormat
+			}
+			tsaLastSerial = last
+		}
+	}
+
+	serial := new(big.Int).Add(tsaLastSerial, big.NewInt(1))
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.WriteString(serial.String() + "\n")
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	tsaLastSerial = serial
+	return serial, nil
+}
+
+// tsa.cert if set, or self-signed time stamping certificate of the key
+func tsaSignerCert(signer *parsecSigner, certFile string) (*x509.Certificate, error) {
+	if len(certFile) == 0 {
+		return signerCmsCert(signer, x509.ExtKeyUsageTimeStamping)
+	}
+	cert, err := loadCertFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !certMatchKey(cert, signer.pub) {
+		return nil, errTsaCertKey
+	}
+	return cert, nil
+}
+
+// policy of the request if accepted, or the default one
+func tsaPolicy(conf *CfgTsa, reqPolicy asn1.ObjectIdentifier) (asn1.ObjectIdentifier, bool) {
+	policy, _ := parseOid(conf.Policy)
+	if len(reqPolicy) == 0 || reqPolicy.Equal(policy) {
+		return policy, true
+	}
+	for _, str := range conf.Policies {
+		if oid, _ := parseOid(str); reqPolicy.Equal(oid) {
+			return oid, true
+		}
+	}
+	return nil, false
+}
+
+func tsaAccuracyOf(d time.Duration) tsaAccuracy {
+	return tsaAccuracy{
+		Seconds: int(d / time.Second),
+		Millis:  int(d % time.Second / time.Millisecond),
+		Micros:  int(d % time.Millisecond / time.Microsecond),
+	}
+}
+
+// curl -v -H 'Content-Type: application/timestamp-query' --data-binary @req.tsq -o resp.tsr 127.0.0.1:8300/tsa
+func ApiTsa(c *gin.Context) {
+	conf := GetConf().Tsa
+	if len(conf.Name) == 0 {
+		responseError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+
+	if c.ContentType() != tsaQueryType {
+		tsaReject(c, TSA_FAIL_BAD_REQUEST, "content type must be "+tsaQueryType)
+		return
+	}
+	var data, _ = c.GetRawData()
+	var req tsaRequest
+	if rest, err := asn1.Unmarshal(data, &req); err != nil || len(rest) != 0 || req.Version != 1 {
+		tsaReject(c, TSA_FAIL_BAD_DATA_FORMAT, "invalid TimeStampReq")
+		return
+	}
+	hash, ok := tsaHashes[req.MessageImprint.HashAlgorithm.Algorithm.String()]
+	if !ok || len(req.MessageImprint.HashedMessage) != hash.Size() {
+		tsaReject(c, TSA_FAIL_BAD_ALG, "hash algorithm not supported, use sha256 sha384 or sha512")
+		return
+	}
+	policy, ok := tsaPolicy(&conf, req.ReqPolicy)
+	if !ok {
+		tsaReject(c, TSA_FAIL_UNACCEPTED_POLICY, "policy "+req.ReqPolicy.String()+" not accepted")
+		return
+	}
+	if len(req.Extensions) != 0 {
+		tsaReject(c, TSA_FAIL_UNACCEPTED_EXTENSION, "extensions not supported")
+		return
+	}
+
+	// get client
+	if code := openClient(conf.Name); code != CODE_SUCCESS {
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "parsec client not available")
+		return
+	}
+	client, ok := getClient(conf.Name)
+	if !ok {
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "parsec client not available")
+		return
+	}
+
+	release, _, ok := acquireLimit(conf.Name, LIMIT_OP_SIGN)
+	if !ok {
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "rate limited")
+		return
+	}
+	defer release()
+
+	if !supportOp(conf.Name, requests.OpPsaSignHash) {
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "sign not supported by parsec provider")
+		return
+	}
+
+	signer, code := newParsecSigner(conf.Name, client, conf.Key)
+	if code != CODE_SUCCESS {
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "tsa key not available")
+		return
+	}
+	cert, err := tsaSignerCert(signer, conf.Cert)
+	if err != nil {
+		zap.L().Error(err.Error())
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "tsa certificate not available")
+		return
+	}
+	serial, err := nextTsaSerial(conf.SerialFile)
+	if err != nil {
+		zap.L().Error(err.Error())
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "serial number not available")
+		return
+	}
+
+	// tsa name is directoryName of the certificate subject
+	tsaName, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: cert.RawSubject})
+	if err != nil {
+		zap.L().Error(err.Error())
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "encode tsa name fail")
+		return
+	}
+	genTime := time.Now().UTC()
+	info, err := asn1.Marshal(tsaInfo{
+		Version:        1,
+		Policy:         policy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   serial,
+		GenTime:        genTime,
+		Accuracy:       tsaAccuracyOf(conf.Accuracy),
+		Nonce:          req.Nonce,
+		Tsa:            asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsaName},
+	})
+	if err != nil {
+		zap.L().Error(err.Error())
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "encode TSTInfo fail")
+		return
+	}
+
+	// RFC 5816 signing certificate v2 identify the tsa certificate
+	certHash := sha256.Sum256(cert.Raw)
+	essAttr, err := cmsAttr(oidAttrSigningCertificateV2, signingCertificateV2{Certs: []essCertIDv2{{CertHash: certHash[:]}}})
+	if err != nil {
+		zap.L().Error(err.Error())
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "encode signing certificate fail")
+		return
+	}
+	var certs []*x509.Certificate
+	if req.CertReq {
+		certs = append(certs, cert)
+	}
+	h := signer.alg.hash.New()
+	h.Write(info)
+	token, err := buildSignedData(signer, cert, certs, oidTSTInfo, info, h.Sum(nil), genTime, essAttr)
+	if err != nil {
+		zap.L().Error(err.Error())
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "sign fail")
+		return
+	}
+
+	out, err := asn1.Marshal(tsaResponse{
+		Status: tsaStatusInfo{Status: TSA_STATUS_GRANTED},
+		Token:  asn1.RawValue{FullBytes: token},
+	})
+	if err != nil {
+		zap.L().Error(err.Error())
+		tsaReject(c, TSA_FAIL_SYSTEM_FAILURE, "encode TimeStampResp fail")
+		return
+	}
+	zap.L().Info("Time stamp granted", zap.String("client", conf.Name), zap.String("key", signer.keyName), zap.String("serial", serial.String()))
+
+	setKeyVersionHeader(c, signer.keyName)
+	c.Data(http.StatusOK, tsaReplyType, out)
+}
+
+// curl -v 127.0.0.1:8300/tsa/cert
+func ApiTsaCert(c *gin.Context) {
+	conf := GetConf().Tsa
+	if len(conf.Name) == 0 {
+		responseError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+	if code := openClient(conf.Name); code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	client, ok := getClient(conf.Name)
+	if !ok {
+		responseError(c, CODE_INVALID_CLIENT)
+		return
+	}
+
+	// may sign a self-signed certificate
+	release, ok := limitOp(c, conf.Name, LIMIT_OP_SIGN)
+	if !ok {
+		return
+	}
+	defer release()
+
+	signer, code := newParsecSigner(conf.Name, client, conf.Key)
+	if code != CODE_SUCCESS {
+		responseError(c, code)
+		return
+	}
+	cert, err := tsaSignerCert(signer, conf.Cert)
+	if err != nil {
+		zap.L().Error(err.Error())
+		responseError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	setKeyVersionHeader(c, signer.keyName)
+	c.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTsaPolicy = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+var testTsaPolicy2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+
+// tsa of application TsaClient, serial file in a temp dir
+func testTsa(t *testing.T, keyName string) string {
+	t.Helper()
+	testNewClient(t, "TsaClient")
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "TsaClient", KeyName: keyName, Alg: JWS_ES256}), CODE_SUCCESS)
+
+	serialFile := filepath.Join(t.TempDir(), "tsa.serial")
+	testSetConf(t, func(conf *AppConfig) {
+		conf.Tsa = CfgTsa{
+			Name:       "TsaClient",
+			Key:        keyName,
+			Policy:     testTsaPolicy.String(),
+			Policies:   []string{testTsaPolicy2.String()},
+			Accuracy:   1500 * time.Millisecond,
+			SerialFile: serialFile,
+		}
+	})
+	testResetTsaSerial()
+	t.Cleanup(testResetTsaSerial)
+	return serialFile
+}
+
+// forget the serial in memory like after restart
+func testResetTsaSerial() {
+	tsaSerialLock.Lock()
+	tsaLastSerial = nil
+	tsaSerialLock.Unlock()
+}
+
+func testTsaRequest(t *testing.T, req tsaRequest) tsaResponse {
+	t.Helper()
+	data, err := asn1.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/tsa", bytes.NewReader(data))
+	r.Header.Set("Content-Type", tsaQueryType)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, r)
+	if w.Code != 200 || w.Header().Get("Content-Type") != tsaReplyType {
+		t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var resp tsaResponse
+	if rest, err := asn1.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(rest) != 0 {
+		t.Fatalf("invalid TimeStampResp: %v", err)
+	}
+	return resp
+}
+
+// TSTInfo of a granted token, its signature was verified by the signer certificate
+func testTsaInfo(t *testing.T, resp tsaResponse) tsaInfo {
+	t.Helper()
+	if resp.Status.Status != TSA_STATUS_GRANTED {
+		t.Fatalf("status %d, want granted", resp.Status.Status)
+	}
+	p, err := parseSignedData(resp.Token.FullBytes)
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if !p.contentType.Equal(oidTSTInfo) {
+		t.Fatalf("content type %v", p.contentType)
+	}
+	content := p.signedData.EncapContent.EContent
+	h := p.digestHash.New()
+	h.Write(content)
+	roots := x509.NewCertPool()
+	roots.AddCert(p.signerCert)
+	if err := p.verify(h.Sum(nil), roots); err != nil {
+		t.Fatalf("verify token: %v", err)
+	}
+
+	var info tsaInfo
+	if rest, err := asn1.Unmarshal(content, &info); err != nil || len(rest) != 0 {
+		t.Fatalf("invalid TSTInfo: %v", err)
+	}
+	return info
+}
+
+func TestTsaGranted(t *testing.T) {
+	serialFile := testTsa(t, "TsaGrantedKey")
+	digest := sha256.Sum256([]byte("photo.jpg"))
+	imprint := tsaImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: digest[:]}
+
+	before := time.Now().Add(-time.Second)
+	info := testTsaInfo(t, testTsaRequest(t, tsaRequest{Version: 1, MessageImprint: imprint, Nonce: big.NewInt(42), CertReq: true}))
+	if info.Version != 1 {
+		t.Errorf("version %d", info.Version)
+	}
+	if !info.Policy.Equal(testTsaPolicy) {
+		t.Errorf("policy %v, want default %v", info.Policy, testTsaPolicy)
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		t.Errorf("message imprint %v", info.MessageImprint)
+	}
+	if info.SerialNumber.Cmp(big.NewInt(1)) != 0 {
+		t.Errorf("serial %v, want 1", info.SerialNumber)
+	}
+	if info.Nonce == nil || info.Nonce.Cmp(big.NewInt(42)) != 0 {
+		t.Errorf("nonce %v, want 42", info.Nonce)
+	}
+	if info.GenTime.Before(before) || info.GenTime.After(time.Now().Add(time.Second)) {
+		t.Errorf("genTime %v", info.GenTime)
+	}
+	if info.Accuracy.Seconds != 1 || info.Accuracy.Millis != 500 || info.Accuracy.Micros != 0 {
+		t.Errorf("accuracy %+v, want 1s 500ms", info.Accuracy)
+	}
+
+	// accepted policy of request
+	info = testTsaInfo(t, testTsaRequest(t, tsaRequest{Version: 1, MessageImprint: imprint, ReqPolicy: testTsaPolicy2, CertReq: true}))
+	if !info.Policy.Equal(testTsaPolicy2) || info.SerialNumber.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("policy %v serial %v, want %v 2", info.Policy, info.SerialNumber, testTsaPolicy2)
+	}
+
+	// serial was kept in file, it still grow after restart
+	testResetTsaSerial()
+	info = testTsaInfo(t, testTsaRequest(t, tsaRequest{Version: 1, MessageImprint: imprint, CertReq: true}))
+	if info.SerialNumber.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("serial after restart %v, want 3", info.SerialNumber)
+	}
+	data, err := os.ReadFile(serialFile)
+	if err != nil || strings.TrimSpace(string(data)) != "3" {
+		t.Errorf("serial file %q, %v", data, err)
+	}
+}
+
+func TestTsaRejected(t *testing.T) {
+	testTsa(t, "TsaRejectedKey")
+	digest := sha256.Sum256([]byte("photo.jpg"))
+	imprint := tsaImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: digest[:]}
+
+	tests := []struct {
+		name    string
+		req     tsaRequest
+		failBit int
+	}{
+		{"Policy", tsaRequest{Version: 1, MessageImprint: imprint, ReqPolicy: asn1.ObjectIdentifier{1, 2, 3}}, TSA_FAIL_UNACCEPTED_POLICY},
+		{"ShortImprint", tsaRequest{Version: 1, MessageImprint: tsaImprint{HashAlgorithm: imprint.HashAlgorithm, HashedMessage: digest[:20]}}, TSA_FAIL_BAD_ALG},
+		{"Version", tsaRequest{Version: 2, MessageImprint: imprint}, TSA_FAIL_BAD_DATA_FORMAT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testTsaRequest(t, tt.req)
+			if resp.Status.Status != TSA_STATUS_REJECTION || resp.Status.FailInfo.At(tt.failBit) != 1 {
+				t.Fatalf("status %d fail info %v, want fail bit %d", resp.Status.Status, resp.Status.FailInfo, tt.failBit)
+			}
+		})
+	}
+
+	// rejected requests do not use serials
+	tsaSerialLock.Lock()
+	defer tsaSerialLock.Unlock()
+	if tsaLastSerial != nil && tsaLastSerial.Sign() != 0 {
+		t.Fatalf("serial %v used by rejected requests", tsaLastSerial)
+	}
+}
+
+func TestTsaPolicyRequired(t *testing.T) {
+	conf := GetConf()
+	conf.Tsa = CfgTsa{Name: "TsaClient", Key: "TsaKey", SerialFile: "tsa.serial"}
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("tsa without policy: no error")
+	}
+	conf.Tsa.Policy = "1.2.x"
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("tsa policy not an OID: no error")
+	}
+	conf.Tsa.Policy = testTsaPolicy.String()
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("tsa with policy: %v", err)
+	}
+}
@@ -0,0 +1,960 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parallaxsecond/parsec-client-go/interface/requests"
+	"github.com/parallaxsecond/parsec-client-go/parsec"
+	"github.com/parallaxsecond/parsec-client-go/parsec/algorithm"
+	"go.uber.org/zap"
+)
+
+// subset of vault transit secrets engine, mapped to parsec keys of an application.
+// the application was got from X-Vault-Token by vault.tokens.
+// key types:
+//   aes256-gcm96 (vault default) -> parsec aes 256 key, AES-GCM with 96 bits nonce before ciphertext like vault
+//   rsa-2048                     -> sign key like /keysign, RS256 sha2-256 and pkcs1v15 only
+//   ecdsa-p256 ecdsa-p384        -> sign key of ES256 ES384, signature is asn1 or jws marshaled
+// sign keys of /keysign with Alg were used by their alg, PS256 is rsa-2048 of pss.
+// keys of /keyenc were shown as rsa-2048 with encryption, rsa pkcs1 v1.5, plaintext max 245 bytes.
+// vault version N is parsec key version N-1, "MyKey" is vault:v1, "MyKey@v1" is vault:v2.
+
+const (
+	VAULT_KEY_AES256     = "aes256-gcm96"
+	VAULT_KEY_RSA        = "rsa-2048"
+	VAULT_KEY_ECDSA_P256 = "ecdsa-p256"
+	VAULT_KEY_ECDSA_P384 = "ecdsa-p384"
+)
+
+// vault sign key type -> jws alg of the parsec key
+var vaultKeyAlgs = map[string]string{
+	VAULT_KEY_RSA:        JWS_RS256,
+	VAULT_KEY_ECDSA_P256: JWS_ES256,
+	VAULT_KEY_ECDSA_P384: JWS_ES384,
+}
+
+var vaultHashNames = map[crypto.Hash]string{
+	crypto.SHA256: "sha2-256",
+	crypto.SHA384: "sha2-384",
+}
+
+const vaultPrefix = "vault:v"
+
+const vaultNonceSize = 12
+
+type paramVaultKey struct {
+	Type string `json:"type"`
+}
+
+type paramVaultEncrypt struct {
+	Plaintext  string            `json:"plaintext"`
+	Ciphertext string            `json:"ciphertext"`
+	BatchInput []json.RawMessage `json:"batch_input"`
+}
+
+type paramVaultSign struct {
+	Input               string `json:"input"`
+	Signature           string `json:"signature"`
+	HashAlgorithm       string `json:"hash_algorithm"`
+	SignatureAlgorithm  string `json:"signature_algorithm"`
+	MarshalingAlgorithm string `json:"marshaling_algorithm"`
+	Prehashed           bool   `json:"prehashed"`
+}
+
+// ecdsa signature of vault default asn1 marshaling
+type vaultEcdsaSignature struct {
+	R, S *big.Int
+}
+
+type rtnVault struct {
+	Data interface{} `json:"data"`
+}
+
+type rtnVaultErrors struct {
+	Errors []string `json:"errors"`
+}
+
+type rtnVaultKey struct {
+	Name                 string                 `json:"name"`
+	Type                 string                 `json:"type"`
+	LatestVersion        int                    `json:"latest_version"`
+	MinDecryptionVersion int                    `json:"min_decryption_version"`
+	MinEncryptionVersion int                    `json:"min_encryption_version"`
+	DeletionAllowed      bool                   `json:"deletion_allowed"`
+	Exportable           bool                   `json:"exportable"`
+	SupportsEncryption   bool                   `json:"supports_encryption"`
+	SupportsDecryption   bool                   `json:"supports_decryption"`
+	SupportsSigning      bool                   `json:"supports_signing"`
+	SupportsDerivation   bool                   `json:"supports_derivation"`
+	Keys                 map[string]interface{} `json:"keys"`
+}
+
+type rtnVaultKeyVersion struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+func vaultError(c *gin.Context, status int, msg string) {
+	c.AbortWithStatusJSON(status, &rtnVaultErrors{Errors: []string{msg}})
+}
+
+// error code of core functions -> vault error
+func vaultCodeError(c *gin.Context, code int32) {
+	switch code {
+	case CODE_INVALID_PARAM:
+		vaultError(c, http.StatusBadRequest, "invalid request")
+	case CODE_INVALID_CLIENT, CODE_NOT_ALLOWED:
+		vaultError(c, http.StatusForbidden, "permission denied")
+	case CODE_INVALID_KEY:
+		vaultError(c, http.StatusBadRequest, "key not usable for this operation")
+	case CODE_LIMIT_EXCEEDED, CODE_RATE_LIMITED:
+		vaultError(c, http.StatusTooManyRequests, "rate limited")
+	case CODE_NOT_SUPPORTED:
+		vaultError(c, http.StatusBadRequest, "operation not supported by parsec provider")
+	case CODE_KEY_EXPIRED:
+		vaultError(c, http.StatusBadRequest, "key expired")
+	case CODE_KEY_PROTECTED:
+		vaultError(c, http.StatusBadRequest, "deletion is not allowed for this key")
+	case CODE_QUOTA_EXCEEDED:
+		vaultError(c, http.StatusForbidden, "key quota exceeded")
+	default:
+		vaultError(c, http.StatusInternalServerError, "parsec error")
+	}
+}
+
+// "MyKey@v1" -> "vault:v2:"
+func vaultVersionPrefix(keyName string) string {
+	_, version := splitKeyName(keyName)
+	return vaultPrefix + strconv.Itoa(version+1) + ":"
+}
+
+// "vault:v2:xxx" -> "v1", "xxx"
+func parseVaultValue(value string) (string, string, bool) {
+	if !strings.HasPrefix(value, vaultPrefix) {
+		return "", "", false
+	}
+	strs := strings.SplitN(value[len(vaultPrefix):], ":", 2)
+	if len(strs) != 2 {
+		return "", "", false
+	}
+	version, err := strconv.Atoi(strs[0])
+	if err != nil || version < 1 {
+		return "", "", false
+	}
+	return "v" + strconv.Itoa(version-1), strs[1], true
+}
+
+// application name of the vault token
+func vaultAppName(conf *CfgVault, token string) (string, bool) {
+	if len(token) == 0 {
+		return "", false
+	}
+	for _, rule := range conf.Tokens {
+		if rule.Token == token {
+			return rule.Name, true
+		}
+	}
+	return "", false
+}
+
+// get application name and its client, create the client if not cached
+func vaultClient(c *gin.Context) (string, CryptoClient, bool) {
+	conf := GetConf()
+	token := c.GetHeader("X-Vault-Token")
+	if len(token) == 0 {
+		token = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	appName, ok := vaultAppName(&conf.Vault, token)
+	if !ok || !conf.Acl.IsClientAllowed(appName) {
+		zap.L().Warn("Vault token not allowed")
+		vaultError(c, http.StatusForbidden, "permission denied")
+		return "", nil, false
+	}
+
+	if code := openClient(appName); code != CODE_SUCCESS {
+		vaultCodeError(c, code)
+		return "", nil, false
+	}
+	client, ok := getClient(appName)
+	if !ok {
+		vaultError(c, http.StatusForbidden, "permission denied")
+		return "", nil, false
+	}
+	return appName, client, true
+}
+
+func vaultLimit(c *gin.Context, appName string, op string) (func(), bool) {
+	release, wait, ok := acquireLimit(appName, op)
+	if !ok {
+		zap.L().Warn("Over limit", zap.String("client", appName), zap.String("op", op))
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		vaultError(c, http.StatusTooManyRequests, "rate limited")
+		return nil, false
+	}
+	return release, true
+}
+
+func vaultBind(c *gin.Context, param interface{}) bool {
+	data, _ := c.GetRawData()
+	if len(data) == 0 {
+		return true
+	}
+	if err := json.Unmarshal(data, param); err != nil {
+		vaultError(c, http.StatusBadRequest, "failed to parse JSON input: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// aes key of aes256-gcm96, the provider need support aead ops
+func vaultAeadAttr() *parsec.KeyAttributes {
+	return &parsec.KeyAttributes{
+		KeyBits: 256,
+		KeyType: parsec.NewKeyType().Aes(),
+		KeyPolicy: &parsec.KeyPolicy{
+			KeyAlgorithm: algorithm.NewAead().Aead(algorithm.AeadAlgorithmGCM),
+			KeyUsageFlags: &parsec.UsageFlags{
+				Cache:         false,
+				Copy:          false,
+				Decrypt:       true,
+				Derive:        false,
+				Encrypt:       true,
+				Export:        false,
+				SignHash:      false,
+				SignMessage:   false,
+				VerifyHash:    false,
+				VerifyMessage: false,
+			},
+		},
+	}
+}
+
+// aes key or rsa encrypt key, by attributes, meta store, or key bits listed by parsec
+func vaultKeyAead(appName string, client CryptoClient, keyName string) (bool, error) {
+	base, _ := splitKeyName(keyName)
+	keyRingsLock.Lock()
+	rings, err := loadKeyRings(appName, client)
+	var ring keyRing
+	found := false
+	if err == nil {
+		if r, ok := rings[base]; ok {
+			ring, found = *r, true
+		}
+	}
+	keyRingsLock.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, errKeyNotFound
+	}
+
+	if ring.attr != nil {
+		return keyAttrType(ring.attr) == KEY_TYPE_AEAD, nil
+	}
+	if meta, err := loadMeta(appName, base); err == nil && meta != nil && len(meta.Type) != 0 {
+		return meta.Type == KEY_TYPE_AEAD, nil
+	}
+	// made before restart without meta store, aes keys have 256 bits and rsa 2048
+	return ring.bits == vaultAeadAttr().KeyBits, nil
+}
+
+// AES-GCM with current key version, return key name used and nonce || ciphertext
+func vaultAeadEncrypt(appName string, client CryptoClient, keyName string, plaintext []byte) (string, []byte, int32) {
+	if !supportOp(appName, requests.OpPsaAeadEncrypt) {
+		return "", nil, CODE_NOT_SUPPORTED
+	}
+
+	keyName, err := currentKeyName(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, keyErrorCode(err, CODE_PARSEC_ERROR)
+	}
+	nonce := make([]byte, vaultNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, CODE_PARSEC_ERROR
+	}
+	alg := vaultAeadAttr().KeyPolicy.KeyAlgorithm.GetAead()
+
+	ciphertext, err := client.PsaAeadEncrypt(keyName, alg, nonce, nil, plaintext)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, CODE_PARSEC_ERROR
+	}
+
+	return keyName, append(nonce, ciphertext...), CODE_SUCCESS
+}
+
+// AES-GCM decrypt by key versions from newest one, return key name matched and plaintext
+func vaultAeadDecrypt(appName string, client CryptoClient, keyName string, ciphertext []byte, hint string) (string, []byte, int32) {
+	if !supportOp(appName, requests.OpPsaAeadDecrypt) {
+		return "", nil, CODE_NOT_SUPPORTED
+	}
+	if len(ciphertext) <= vaultNonceSize {
+		return "", nil, CODE_INVALID_PARAM
+	}
+
+	keyNames, err := candidateKeyNames(appName, client, keyName, hint)
+	if err != nil {
+		zap.L().Error(err.Error())
+		return "", nil, keyErrorCode(err, CODE_INVALID_PARAM)
+	}
+	nonce, sealed := ciphertext[:vaultNonceSize], ciphertext[vaultNonceSize:]
+	alg := vaultAeadAttr().KeyPolicy.KeyAlgorithm.GetAead()
+
+	// try versions from newest one
+	for _, keyName := range keyNames {
+		plaintext, err := client.PsaAeadDecrypt(keyName, alg, nonce, nil, sealed)
+		if err == nil {
+			return keyName, plaintext, CODE_SUCCESS
+		}
+		zap.L().Debug("Decrypt fail with " + keyName + ": " + err.Error())
+	}
+
+	return "", nil, CODE_PARSEC_ERROR
+}
+
+// aes key of the name param or not, abort the request if key not found
+func vaultKeyType(c *gin.Context, appName string, client CryptoClient) (bool, bool) {
+	aead, err := vaultKeyAead(appName, client, c.Param("name"))
+	if err == errKeyNotFound {
+		vaultError(c, http.StatusBadRequest, "encryption key not found")
+		return false, false
+	}
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return false, false
+	}
+	return aead, true
+}
+
+// curl -v -H "X-Vault-Token: s.xxxx" -d '{"type": "rsa-2048"}' 127.0.0.1:8300/v1/transit/keys/MyKey
+func ApiVaultCreateKey(c *gin.Context) {
+	var param paramVaultKey
+	if !vaultBind(c, &param) {
+		return
+	}
+	keyName := c.Param("name")
+	if isVersionedKeyName(keyName) {
+		vaultError(c, http.StatusBadRequest, fmt.Sprintf("key name can not contain %s", keyVersionSep))
+		return
+	}
+
+	var keyAttr *parsec.KeyAttributes
+	keyType, alg := KEY_TYPE_AEAD, ""
+	switch param.Type {
+	case "", VAULT_KEY_AES256:
+		keyAttr = vaultAeadAttr()
+	case VAULT_KEY_RSA, VAULT_KEY_ECDSA_P256, VAULT_KEY_ECDSA_P384:
+		keyType, alg = KEY_TYPE_SIGN, vaultKeyAlgs[param.Type]
+		keyAttr = jwsAlgs[alg].keyAttr()
+	default:
+		vaultError(c, http.StatusBadRequest, fmt.Sprintf("unsupported key type %s, use %s %s %s or %s", param.Type,
+			VAULT_KEY_AES256, VAULT_KEY_RSA, VAULT_KEY_ECDSA_P256, VAULT_KEY_ECDSA_P384))
+		return
+	}
+
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_KEYGEN)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !supportOp(appName, requests.OpPsaGenerateKey) {
+		vaultCodeError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+	if keyType == KEY_TYPE_AEAD && (!supportOp(appName, requests.OpPsaAeadEncrypt) || !supportOp(appName, requests.OpPsaAeadDecrypt)) {
+		vaultError(c, http.StatusBadRequest, "aes256-gcm96 is not supported by parsec provider, use a provider with aead ops")
+		return
+	}
+
+	// vault create an existing key is no-op
+	exist, err := hasKeyRing(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	if !exist {
+		reserved, code := checkTenantKey(appName, keyName, keyType, alg, int(keyAttr.KeyBits))
+		if code != CODE_SUCCESS {
+			vaultCodeError(c, code)
+			return
+		}
+		defer reserved()
+		if err := client.PsaGenerateKey(keyName, keyAttr); err != nil {
+			zap.L().Error(err.Error())
+			vaultCodeError(c, CODE_PARSEC_ERROR)
+			return
+		}
+		addKeyVersion(appName, keyName, 0, keyAttr)
+		metaKeyCreated(appName, keyName, 0, keyAttr, c.ClientIP(), false, nil, "", time.Time{})
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// curl -v -H "X-Vault-Token: s.xxxx" 127.0.0.1:8300/v1/transit/keys/MyKey
+func ApiVaultReadKey(c *gin.Context) {
+	keyName := c.Param("name")
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_EXPORT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	exist, err := hasKeyRing(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	if !exist {
+		vaultError(c, http.StatusNotFound, "encryption key not found")
+		return
+	}
+	keyNames, err := allKeyNames(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	current, err := currentKeyName(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	attr, err := nextKeyAttr(appName, keyName)
+	if err == errKeyNotRotatable {
+		vaultCodeError(c, CODE_INVALID_KEY)
+		return
+	}
+	if err == errKeyAttrUnknown {
+		vaultCodeError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	isSign := attr.KeyPolicy.KeyUsageFlags.SignHash
+	_, latest := splitKeyName(current)
+	rtn := rtnVaultKey{
+		Name:                 keyName,
+		Type:                 VAULT_KEY_RSA,
+		LatestVersion:        latest + 1,
+		MinDecryptionVersion: 1,
+		DeletionAllowed:      true,
+		SupportsEncryption:   !isSign,
+		SupportsDecryption:   !isSign,
+		SupportsSigning:      isSign,
+		Keys:                 make(map[string]interface{}),
+	}
+	if keyAttrType(attr) == KEY_TYPE_AEAD {
+		rtn.Type = VAULT_KEY_AES256
+	}
+	if algName, ok := attrJwsAlg(attr); ok {
+		rtn.Type = vaultSignKeyType(algName)
+	}
+	sort.Strings(keyNames)
+	for _, name := range keyNames {
+		_, version := splitKeyName(name)
+		label := strconv.Itoa(version + 1)
+		if !isSign {
+			rtn.Keys[label] = 0 // creation time was not known by parsec
+			continue
+		}
+		// public key of sign key, like vault
+		pk, err := getPublicKey(appName, client, name)
+		if err != nil {
+			zap.L().Debug("Vault read key, no public key of " + name + ": " + err.Error())
+			rtn.Keys[label] = 0
+			continue
+		}
+		der, err := x509.MarshalPKIXPublicKey(pk.key)
+		if err != nil {
+			rtn.Keys[label] = 0
+			continue
+		}
+		rtn.Keys[label] = &rtnVaultKeyVersion{
+			Name:      rtn.Type,
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		}
+	}
+
+	c.JSON(http.StatusOK, &rtnVault{Data: &rtn})
+}
+
+// curl -v -X LIST -H "X-Vault-Token: s.xxxx" 127.0.0.1:8300/v1/transit/keys
+// curl -v -H "X-Vault-Token: s.xxxx" '127.0.0.1:8300/v1/transit/keys?list=true'
+func ApiVaultListKeys(c *gin.Context) {
+	if c.Request.Method == http.MethodGet && c.Query("list") != "true" {
+		vaultError(c, http.StatusMethodNotAllowed, "unsupported operation")
+		return
+	}
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_KEYS)
+	if !ok {
+		return
+	}
+	defer release()
+
+	keyRingsLock.Lock()
+	rings, err := loadKeyRings(appName, client)
+	names := make([]string, 0, len(rings))
+	for name := range rings {
+		names = append(names, name)
+	}
+	keyRingsLock.Unlock()
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+	if len(names) == 0 {
+		c.Status(http.StatusNotFound) // vault return 404 for empty list
+		return
+	}
+	sort.Strings(names)
+
+	c.JSON(http.StatusOK, &rtnVault{Data: gin.H{"keys": names}})
+}
+
+// curl -v -X DELETE -H "X-Vault-Token: s.xxxx" 127.0.0.1:8300/v1/transit/keys/MyKey
+func ApiVaultDeleteKey(c *gin.Context) {
+	keyName := c.Param("name")
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_DELETE)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !supportOp(appName, requests.OpPsaDestroyKey) {
+		vaultCodeError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+
+	if keyProtected(appName, keyName) {
+		vaultCodeError(c, CODE_KEY_PROTECTED)
+		return
+	}
+
+	if _, err := destroyKey(appName, client, keyName); err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// curl -v -X POST -H "X-Vault-Token: s.xxxx" 127.0.0.1:8300/v1/transit/keys/MyKey/rotate
+func ApiVaultRotateKey(c *gin.Context) {
+	keyName := c.Param("name")
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_ROTATE)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !supportOp(appName, requests.OpPsaGenerateKey) {
+		vaultCodeError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+
+	_, _, err := rotateKey(appName, client, keyName)
+	if err == errKeyNotFound {
+		vaultError(c, http.StatusNotFound, "encryption key not found")
+		return
+	}
+	if err == errKeyNotRotatable {
+		vaultCodeError(c, CODE_INVALID_KEY)
+		return
+	}
+	if err == errKeyAttrUnknown {
+		vaultCodeError(c, CODE_NOT_SUPPORTED)
+		return
+	}
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_PARSEC_ERROR)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// curl -v -H "X-Vault-Token: s.xxxx" -d '{"plaintext": "SGVsbG8gV29ybGQ="}' 127.0.0.1:8300/v1/transit/encrypt/MyEncKey
+func ApiVaultEncrypt(c *gin.Context) {
+	var param paramVaultEncrypt
+	if !vaultBind(c, &param) {
+		return
+	}
+	if len(param.BatchInput) != 0 {
+		vaultError(c, http.StatusBadRequest, "batch_input is not supported, use /batch")
+		return
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(param.Plaintext)
+	if err != nil {
+		vaultError(c, http.StatusBadRequest, "failed to base64-decode plaintext")
+		return
+	}
+
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_ENCRYPT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	aead, ok := vaultKeyType(c, appName, client)
+	if !ok {
+		return
+	}
+	encrypt := encryptMessage
+	if aead {
+		encrypt = vaultAeadEncrypt
+	}
+	keyName, ciphertext, code := encrypt(appName, client, c.Param("name"), plaintext)
+	if code != CODE_SUCCESS {
+		vaultCodeError(c, code)
+		return
+	}
+
+	_, version := splitKeyName(keyName)
+	c.JSON(http.StatusOK, &rtnVault{Data: gin.H{
+		"ciphertext":  vaultVersionPrefix(keyName) + base64.StdEncoding.EncodeToString(ciphertext),
+		"key_version": version + 1,
+	}})
+}
+
+// curl -v -H "X-Vault-Token: s.xxxx" -d '{"ciphertext": "vault:v1:xxx"}' 127.0.0.1:8300/v1/transit/decrypt/MyEncKey
+func ApiVaultDecrypt(c *gin.Context) {
+	var param paramVaultEncrypt
+	if !vaultBind(c, &param) {
+		return
+	}
+	if len(param.BatchInput) != 0 {
+		vaultError(c, http.StatusBadRequest, "batch_input is not supported, use /batch")
+		return
+	}
+	hint, value, ok := parseVaultValue(param.Ciphertext)
+	if !ok {
+		vaultError(c, http.StatusBadRequest, "invalid ciphertext: no prefix")
+		return
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		vaultError(c, http.StatusBadRequest, "invalid ciphertext: could not decode base64")
+		return
+	}
+
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_DECRYPT)
+	if !ok {
+		return
+	}
+	defer release()
+
+	aead, ok := vaultKeyType(c, appName, client)
+	if !ok {
+		return
+	}
+	decrypt := decryptMessage
+	if aead {
+		decrypt = vaultAeadDecrypt
+	}
+	_, plaintext, code := decrypt(appName, client, c.Param("name"), ciphertext, hint)
+	if code != CODE_SUCCESS {
+		vaultCodeError(c, code)
+		return
+	}
+
+	c.JSON(http.StatusOK, &rtnVault{Data: gin.H{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	}})
+}
+
+// sign keys have sha2-256 and pkcs1v15 policy, vault default rsa pss was not possible
+func checkVaultSignParam(c *gin.Context, param *paramVaultSign) ([]byte, bool) {
+	if param.Prehashed {
+		vaultError(c, http.StatusBadRequest, "prehashed input is not supported")
+		return nil, false
+	}
+	input, err := base64.StdEncoding.DecodeString(param.Input)
+	if err != nil {
+		vaultError(c, http.StatusBadRequest, "unable to decode input as base64")
+		return nil, false
+	}
+	return input, true
+}
+
+// vault key type of the sign key alg
+func vaultSignKeyType(algName string) string {
+	for keyType, name := range vaultKeyAlgs {
+		if name == algName {
+			return keyType
+		}
+	}
+	return VAULT_KEY_RSA // PS256
+}
+
+// alg of the sign key, the request must fit its policy.
+// vault default sha2-256 and pss were used only if the key really sign so.
+func vaultSignAlg(c *gin.Context, appName string, client CryptoClient, param *paramVaultSign) (jwsAlg, bool) {
+	keyName, err := currentKeyName(appName, client, c.Param("name"))
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, keyErrorCode(err, CODE_PARSEC_ERROR))
+		return jwsAlg{}, false
+	}
+	a, err := verifyKeyAlg(appName, client, keyName)
+	if err != nil {
+		zap.L().Error(err.Error())
+		vaultCodeError(c, CODE_INVALID_KEY)
+		return jwsAlg{}, false
+	}
+
+	hashName := vaultHashNames[a.hash]
+	hashAlg := param.HashAlgorithm
+	if urlAlg := c.Param("hash"); len(urlAlg) != 0 {
+		hashAlg = urlAlg
+	}
+	if len(hashAlg) == 0 && a.hash != crypto.SHA256 {
+		vaultError(c, http.StatusBadRequest, "hash_algorithm is required, key only sign "+hashName)
+		return jwsAlg{}, false
+	}
+	if len(hashAlg) != 0 && hashAlg != hashName {
+		vaultError(c, http.StatusBadRequest, "unsupported hash algorithm "+hashAlg+", key only sign "+hashName)
+		return jwsAlg{}, false
+	}
+
+	if a.ecc {
+		if m := param.MarshalingAlgorithm; len(m) != 0 && m != "asn1" && m != "jws" {
+			vaultError(c, http.StatusBadRequest, "unsupported marshaling algorithm "+m+", use asn1 or jws")
+			return jwsAlg{}, false
+		}
+		return a, true
+	}
+	sigName := "pkcs1v15"
+	if a.pss {
+		sigName = "pss"
+	}
+	// vault default is pss, an omitted one can not be signed as pkcs1v15 silently
+	if len(param.SignatureAlgorithm) == 0 && !a.pss {
+		vaultError(c, http.StatusBadRequest, "signature_algorithm is required, key only sign "+sigName)
+		return jwsAlg{}, false
+	}
+	if len(param.SignatureAlgorithm) != 0 && param.SignatureAlgorithm != sigName {
+		vaultError(c, http.StatusBadRequest, "unsupported signature algorithm "+param.SignatureAlgorithm+", key only sign "+sigName)
+		return jwsAlg{}, false
+	}
+	return a, true
+}
+
+// vault jws marshaling is base64url of r || s
+func vaultSignEncoding(param *paramVaultSign) *base64.Encoding {
+	if param.MarshalingAlgorithm == "jws" {
+		return base64.RawURLEncoding
+	}
+	return base64.StdEncoding
+}
+
+// ecdsa r || s -> asn1
+func vaultMarshalEcdsa(signature []byte) ([]byte, error) {
+	size := len(signature) / 2
+	return asn1.Marshal(vaultEcdsaSignature{
+		R: new(big.Int).SetBytes(signature[:size]),
+		S: new(big.Int).SetBytes(signature[size:]),
+	})
+}
+
+// asn1 -> ecdsa r || s of the key size
+func vaultUnmarshalEcdsa(a jwsAlg, der []byte) ([]byte, bool) {
+	var sig vaultEcdsaSignature
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) != 0 || sig.R == nil || sig.S == nil || sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
+		return nil, false
+	}
+	size := int(a.keyBits+7) / 8
+	if len(sig.R.Bytes()) > size || len(sig.S.Bytes()) > size {
+		return nil, false
+	}
+	signature := make([]byte, 2*size)
+	sig.R.FillBytes(signature[:size])
+	sig.S.FillBytes(signature[size:])
+	return signature, true
+}
+
+// curl -v -H "X-Vault-Token: s.xxxx" -d '{"input": "SGVsbG8gV29ybGQ=", "signature_algorithm": "pkcs1v15"}' 127.0.0.1:8300/v1/transit/sign/MyKey
+// curl -v -H "X-Vault-Token: s.xxxx" -d '{"input": "SGVsbG8gV29ybGQ=", "hash_algorithm": "sha2-384"}' 127.0.0.1:8300/v1/transit/sign/MyEcKey
+func ApiVaultSign(c *gin.Context) {
+	var param paramVaultSign
+	if !vaultBind(c, &param) {
+		return
+	}
+	input, ok := checkVaultSignParam(c, &param)
+	if !ok {
+		return
+	}
+
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_SIGN)
+	if !ok {
+		return
+	}
+	defer release()
+
+	a, ok := vaultSignAlg(c, appName, client, &param)
+	if !ok {
+		return
+	}
+	keyName, signature, code := signMessage(appName, client, c.Param("name"), input)
+	if code != CODE_SUCCESS {
+		vaultCodeError(c, code)
+		return
+	}
+	if a.ecc && param.MarshalingAlgorithm != "jws" {
+		var err error
+		if signature, err = vaultMarshalEcdsa(signature); err != nil {
+			zap.L().Error(err.Error())
+			vaultCodeError(c, CODE_PARSEC_ERROR)
+			return
+		}
+	}
+
+	_, version := splitKeyName(keyName)
+	c.JSON(http.StatusOK, &rtnVault{Data: gin.H{
+		"signature":   vaultVersionPrefix(keyName) + vaultSignEncoding(&param).EncodeToString(signature),
+		"key_version": version + 1,
+	}})
+}
+
+// curl -v -H "X-Vault-Token: s.xxxx" -d '{"input": "SGVsbG8gV29ybGQ=", "signature": "vault:v1:xxx", "signature_algorithm": "pkcs1v15"}' 127.0.0.1:8300/v1/transit/verify/MyKey
+func ApiVaultVerify(c *gin.Context) {
+	var param paramVaultSign
+	if !vaultBind(c, &param) {
+		return
+	}
+	input, ok := checkVaultSignParam(c, &param)
+	if !ok {
+		return
+	}
+	hint, value, ok := parseVaultValue(param.Signature)
+	if !ok {
+		vaultError(c, http.StatusBadRequest, "invalid signature: no prefix")
+		return
+	}
+	signature, err := vaultSignEncoding(&param).DecodeString(value)
+	if err != nil {
+		vaultError(c, http.StatusBadRequest, "invalid signature: could not decode base64")
+		return
+	}
+
+	appName, client, ok := vaultClient(c)
+	if !ok {
+		return
+	}
+
+	release, ok := vaultLimit(c, appName, LIMIT_OP_VERIFY)
+	if !ok {
+		return
+	}
+	defer release()
+
+	a, ok := vaultSignAlg(c, appName, client, &param)
+	if !ok {
+		return
+	}
+	if a.ecc && param.MarshalingAlgorithm != "jws" {
+		if signature, ok = vaultUnmarshalEcdsa(a, signature); !ok {
+			c.JSON(http.StatusOK, &rtnVault{Data: gin.H{"valid": false}})
+			return
+		}
+	}
+	_, code := verifyMessage(appName, client, c.Param("name"), input, signature, hint)
+	if code != CODE_SUCCESS && code != CODE_VERIFY_FAIL {
+		vaultCodeError(c, code)
+		return
+	}
+
+	c.JSON(http.StatusOK, &rtnVault{Data: gin.H{
+		"valid": code == CODE_SUCCESS,
+	}})
+}
+
+// register vault transit routes under /v1/<mount>
+func registerVaultApis(r *gin.Engine) {
+	conf := Conf.Vault
+	g := r.Group("/v1/" + strings.Trim(conf.Mount, "/"))
+	g.POST("/keys/:name", ApiVaultCreateKey)
+	g.GET("/keys/:name", ApiVaultReadKey)
+	g.DELETE("/keys/:name", ApiVaultDeleteKey)
+	g.POST("/keys/:name/rotate", ApiVaultRotateKey)
+	g.Handle("LIST", "/keys", ApiVaultListKeys)
+	g.GET("/keys", ApiVaultListKeys)
+	g.POST("/encrypt/:name", ApiVaultEncrypt)
+	g.POST("/decrypt/:name", ApiVaultDecrypt)
+	g.POST("/sign/:name", ApiVaultSign)
+	g.POST("/sign/:name/:hash", ApiVaultSign)
+	g.POST("/verify/:name", ApiVaultVerify)
+	g.POST("/verify/:name/:hash", ApiVaultVerify)
+	zap.L().Info("Vault transit api enabled", zap.String("mount", conf.Mount))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testVaultToken = "s.test"
+
+func testVault(t *testing.T, token string, method string, path string, param interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, "/v1/transit"+path, bytes.NewReader(data))
+	req.Header.Set("X-Vault-Token", token)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	if w.Body.Len() == 0 {
+		return w.Code, nil
+	}
+	var rtn struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rtn); err != nil {
+		t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+	}
+	if len(rtn.Errors) != 0 {
+		return w.Code, map[string]interface{}{"errors": strings.Join(rtn.Errors, ", ")}
+	}
+	return w.Code, rtn.Data
+}
+
+func testVaultEncrypt(t *testing.T, keyName string, plaintext string) string {
+	t.Helper()
+	status, data := testVault(t, testVaultToken, "POST", "/encrypt/"+keyName, vaultBody{"plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext))})
+	if status != http.StatusOK {
+		t.Fatalf("encrypt: status %d, %v", status, data)
+	}
+	return data["ciphertext"].(string)
+}
+
+func testVaultDecrypt(t *testing.T, keyName string, ciphertext string) string {
+	t.Helper()
+	status, data := testVault(t, testVaultToken, "POST", "/decrypt/"+keyName, vaultBody{"ciphertext": ciphertext})
+	if status != http.StatusOK {
+		t.Fatalf("decrypt: status %d, %v", status, data)
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(data["plaintext"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plaintext)
+}
+
+type vaultBody map[string]interface{}
+
+func (b vaultBody) with(k string, v interface{}) vaultBody {
+	rtn := vaultBody{k: v}
+	for key, value := range b {
+		if key != k {
+			rtn[key] = value
+		}
+	}
+	return rtn
+}
+
+func TestVaultAes256Gcm96(t *testing.T) {
+	t.Cleanup(func() {
+		testVault(t, testVaultToken, "DELETE", "/keys/AesKey", nil)
+		testApi(t, "DELETE", "/client", &paramAll{Name: "VaultClient"})
+	})
+
+	// vault default type
+	if status, data := testVault(t, testVaultToken, "POST", "/keys/AesKey", vaultBody{}); status != http.StatusNoContent {
+		t.Fatalf("create: status %d, %v", status, data)
+	}
+	status, data := testVault(t, testVaultToken, "GET", "/keys/AesKey", nil)
+	if status != http.StatusOK || data["type"] != VAULT_KEY_AES256 {
+		t.Fatalf("read: status %d, %v", status, data)
+	}
+
+	ciphertext := testVaultEncrypt(t, "AesKey", "Hello World")
+	if !strings.HasPrefix(ciphertext, "vault:v1:") {
+		t.Fatalf("ciphertext %q", ciphertext)
+	}
+	// nonce 12 || ciphertext 11 || tag 16, not a 256 bytes rsa block
+	sealed, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, "vault:v1:"))
+	if len(sealed) != vaultNonceSize+len("Hello World")+16 {
+		t.Fatalf("ciphertext of %d bytes is not AES-GCM", len(sealed))
+	}
+	if testVaultEncrypt(t, "AesKey", "Hello World") == ciphertext {
+		t.Fatalf("nonce was reused")
+	}
+	if plaintext := testVaultDecrypt(t, "AesKey", ciphertext); plaintext != "Hello World" {
+		t.Fatalf("decrypt got %q", plaintext)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	tampered := "vault:v1:" + base64.StdEncoding.EncodeToString(sealed)
+	if status, _ := testVault(t, testVaultToken, "POST", "/decrypt/AesKey", vaultBody{"ciphertext": tampered}); status == http.StatusOK {
+		t.Fatalf("tampered ciphertext decrypted")
+	}
+
+	// rotation keep the aes type, old ciphertext still decrypted in grace period
+	if status, data := testVault(t, testVaultToken, "POST", "/keys/AesKey/rotate", vaultBody{}); status != http.StatusNoContent {
+		t.Fatalf("rotate: status %d, %v", status, data)
+	}
+	rotated := testVaultEncrypt(t, "AesKey", "Hello World")
+	if !strings.HasPrefix(rotated, "vault:v2:") {
+		t.Fatalf("ciphertext after rotate %q", rotated)
+	}
+	if status, data := testVault(t, testVaultToken, "GET", "/keys/AesKey", nil); data["type"] != VAULT_KEY_AES256 {
+		t.Fatalf("read after rotate: status %d, %v", status, data)
+	}
+
+	// attributes forgotten like after restart, the type come from listed key bits
+	resetKeyRings("VaultClient")
+	if plaintext := testVaultDecrypt(t, "AesKey", ciphertext); plaintext != "Hello World" {
+		t.Fatalf("decrypt after reset got %q", plaintext)
+	}
+	if plaintext := testVaultDecrypt(t, "AesKey", rotated); plaintext != "Hello World" {
+		t.Fatalf("decrypt rotated after reset got %q", plaintext)
+	}
+
+	if status, _ := testVault(t, testVaultToken, "POST", "/decrypt/NoKey", vaultBody{"ciphertext": ciphertext}); status != http.StatusBadRequest {
+		t.Fatalf("decrypt by missing key: status %d", status)
+	}
+}
+
+func TestVaultSignAlgorithm(t *testing.T) {
+	testNewClient(t, "VaultClient")
+	for _, keyType := range []string{VAULT_KEY_RSA, VAULT_KEY_ECDSA_P256, VAULT_KEY_ECDSA_P384} {
+		if status, data := testVault(t, testVaultToken, "POST", "/keys/"+keyType, vaultBody{"type": keyType}); status != http.StatusNoContent {
+			t.Fatalf("create %s: status %d, %v", keyType, status, data)
+		}
+		if status, data := testVault(t, testVaultToken, "GET", "/keys/"+keyType, nil); data["type"] != keyType {
+			t.Fatalf("read %s: status %d, %v", keyType, status, data)
+		}
+	}
+	// PS256 key of /keysign is a rsa-2048 of pss
+	testExpect(t, testApi(t, "POST", "/keysign", &paramAll{Name: "VaultClient", KeyName: "PssKey", Alg: JWS_PS256}), CODE_SUCCESS)
+	input := base64.StdEncoding.EncodeToString([]byte("Hello World"))
+
+	tests := []struct {
+		name    string
+		keyName string
+		param   vaultBody
+		status  int
+	}{
+		{"Pkcs1v15", VAULT_KEY_RSA, vaultBody{"signature_algorithm": "pkcs1v15"}, http.StatusOK},
+		{"Pkcs1v15Omitted", VAULT_KEY_RSA, vaultBody{}, http.StatusBadRequest},
+		{"Pkcs1v15ByPss", VAULT_KEY_RSA, vaultBody{"signature_algorithm": "pss"}, http.StatusBadRequest},
+		{"Pss", "PssKey", vaultBody{"signature_algorithm": "pss"}, http.StatusOK},
+		{"PssOmitted", "PssKey", vaultBody{}, http.StatusOK},
+		{"PssByPkcs1v15", "PssKey", vaultBody{"signature_algorithm": "pkcs1v15"}, http.StatusBadRequest},
+		{"P256Asn1", VAULT_KEY_ECDSA_P256, vaultBody{}, http.StatusOK},
+		{"P256Jws", VAULT_KEY_ECDSA_P256, vaultBody{"marshaling_algorithm": "jws"}, http.StatusOK},
+		{"P256Sha384", VAULT_KEY_ECDSA_P256, vaultBody{"hash_algorithm": "sha2-384"}, http.StatusBadRequest},
+		{"P384", VAULT_KEY_ECDSA_P384, vaultBody{"hash_algorithm": "sha2-384"}, http.StatusOK},
+		{"P384HashOmitted", VAULT_KEY_ECDSA_P384, vaultBody{}, http.StatusBadRequest},
+		{"NoKey", "NoKey", vaultBody{"signature_algorithm": "pkcs1v15"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			param := vaultBody{"input": input}
+			for k, v := range tt.param {
+				param[k] = v
+			}
+			status, data := testVault(t, testVaultToken, "POST", "/sign/"+tt.keyName, param)
+			if status != tt.status {
+				t.Fatalf("sign: status %d, want %d, %v", status, tt.status, data)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			signature := data["signature"].(string)
+			status, data = testVault(t, testVaultToken, "POST", "/verify/"+tt.keyName, param.with("signature", signature))
+			if status != http.StatusOK || data["valid"] != true {
+				t.Fatalf("verify: status %d, %v", status, data)
+			}
+			param["input"] = base64.StdEncoding.EncodeToString([]byte("Hello World!"))
+			status, data = testVault(t, testVaultToken, "POST", "/verify/"+tt.keyName, param.with("signature", signature))
+			if status != http.StatusOK || data["valid"] != false {
+				t.Fatalf("verify other input: status %d, %v", status, data)
+			}
+		})
+	}
+}
+
+func TestVaultToken(t *testing.T) {
+	for _, token := range []string{"", "VaultClient", "s.other"} {
+		if status, _ := testVault(t, token, "GET", "/keys?list=true", nil); status != http.StatusForbidden {
+			t.Fatalf("token %q: status %d", token, status)
+		}
+	}
+
+	conf := GetConf()
+	conf.Vault.Tokens = nil
+	if err := conf.Validate(); err == nil {
+		t.Fatalf("vault enabled without tokens: no error")
+	}
+}